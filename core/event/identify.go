@@ -8,6 +8,15 @@ import (
 	"github.com/multiformats/go-multiaddr"
 )
 
+// EvtPeerIdentificationStarted is emitted when we start identifying a peer on a connection.
+// It is followed by either an EvtPeerIdentificationCompleted or an EvtPeerIdentificationFailed.
+type EvtPeerIdentificationStarted struct {
+	// Peer is the ID of the peer we're identifying.
+	Peer peer.ID
+	// Conn is the connection we're identifying.
+	Conn network.Conn
+}
+
 // EvtPeerIdentificationCompleted is emitted when the initial identification round for a peer is completed.
 type EvtPeerIdentificationCompleted struct {
 	// Peer is the ID of the peer whose identification succeeded.
@@ -44,3 +53,53 @@ type EvtPeerIdentificationFailed struct {
 	// Reason is the reason why identification failed.
 	Reason error
 }
+
+// EvtPeerGoodbye is emitted when a peer announces that it is shutting down.
+// Its connections to us are expected to be closed soon.
+type EvtPeerGoodbye struct {
+	// Peer is the ID of the peer that is shutting down.
+	Peer peer.ID
+}
+
+// EvtPeerAddrsUpdated is emitted when a peer advertises a different set of
+// addresses than it advertised before, e.g. in an Identify Push.
+type EvtPeerAddrsUpdated struct {
+	// Peer is the ID of the peer whose addresses changed.
+	Peer peer.ID
+	// Added are the addresses the peer started advertising.
+	Added []multiaddr.Multiaddr
+	// Removed are the addresses the peer stopped advertising.
+	Removed []multiaddr.Multiaddr
+}
+
+// EvtIdentifyPushSent is emitted when we sent an Identify Push to a peer.
+type EvtIdentifyPushSent struct {
+	// Peer is the ID of the peer we sent the push to.
+	Peer peer.ID
+	// Conn is the connection the push was sent on.
+	Conn network.Conn
+}
+
+// EvtIdentifyPushFailed is emitted when sending an Identify Push to a peer failed.
+type EvtIdentifyPushFailed struct {
+	// Peer is the ID of the peer we failed to send the push to.
+	Peer peer.ID
+	// Conn is the connection the push was attempted on.
+	Conn network.Conn
+	// Reason is the reason why the push failed.
+	Reason error
+}
+
+// EvtPeerIdentifyPushFailed is emitted when sending Identify Pushes to a peer
+// failed repeatedly, i.e. when we can't keep the peer in sync with our state.
+// Unlike EvtIdentifyPushFailed, which is emitted for every failed push, it is
+// only emitted once the number of consecutive failures reaches a threshold,
+// and for every further failure. The count is reset by a successful push.
+type EvtPeerIdentifyPushFailed struct {
+	// Peer is the ID of the peer we failed to send the pushes to.
+	Peer peer.ID
+	// Attempts is the number of consecutive failed pushes.
+	Attempts int
+	// LastErr is the reason why the last push failed.
+	LastErr error
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
@@ -31,6 +32,20 @@ type SecureTransport interface {
 	ID() protocol.ID
 }
 
+// SecuritySummary summarizes a secured connection, independent of the security
+// protocol used. It is intended to log connections uniformly across security
+// transports, which provide it via a SecuritySummary method on the connection.
+type SecuritySummary struct {
+	// Protocol is the protocol ID of the security protocol.
+	Protocol string
+	// PeerID is the authenticated ID of the remote peer.
+	PeerID peer.ID
+	// KeyType is the type of the remote peer's key, e.g. "Ed25519".
+	KeyType string
+	// HandshakeDuration is the time it took to secure the connection.
+	HandshakeDuration time.Duration
+}
+
 type ErrPeerIDMismatch struct {
 	Expected peer.ID
 	Actual   peer.ID
@@ -721,21 +721,31 @@ func (h *BasicHost) NewStream(ctx context.Context, p peer.ID, pids ...protocol.I
 		}
 	}()
 
-	// Wait for any in-progress identifies on the connection to finish. This
-	// is faster than negotiating.
-	//
-	// If the other side doesn't support identify, that's fine. This will
-	// just be a no-op.
-	select {
-	case <-h.ids.IdentifyWait(s.Conn()):
-	case <-ctx.Done():
-		return nil, fmt.Errorf("identify failed to complete: %w", ctx.Err())
-	}
-
+	// If we already know that the peer supports the protocol we prefer most,
+	// e.g. from a previous connection, there's no need to wait for identify.
+	// Otherwise, we might just not have identified the peer yet, and identify
+	// might tell us that it supports a protocol we prefer.
 	pref, err := h.preferredProtocol(p, pids)
 	if err != nil {
 		return nil, err
 	}
+	if pref == "" || pref != pids[0] {
+		// Wait for any in-progress identifies on the connection to finish. This
+		// is faster than negotiating.
+		//
+		// If the other side doesn't support identify, that's fine. This will
+		// just be a no-op.
+		select {
+		case <-h.ids.IdentifyWait(s.Conn()):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("identify failed to complete: %w", ctx.Err())
+		}
+
+		pref, err = h.preferredProtocol(p, pids)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	if pref != "" {
 		if err := s.SetProtocol(pref); err != nil {
@@ -758,6 +768,9 @@ func (h *BasicHost) NewStream(ctx context.Context, p peer.ID, pids ...protocol.I
 	select {
 	case err = <-errCh:
 		if err != nil {
+			if errors.Is(err, msmux.ErrNotSupported[protocol.ID]{}) {
+				h.reportNegotiation(p, pids, "")
+			}
 			return nil, fmt.Errorf("failed to negotiate protocol: %w", err)
 		}
 	case <-ctx.Done():
@@ -772,9 +785,23 @@ func (h *BasicHost) NewStream(ctx context.Context, p peer.ID, pids ...protocol.I
 		return nil, err
 	}
 	_ = h.Peerstore().AddProtocols(p, selected) // adding the protocol to the peerstore isn't critical
+	h.reportNegotiation(p, pids, selected)
 	return s, nil
 }
 
+// reportNegotiation reports the outcome of negotiating pids with peer p to the
+// identify service: p rejected the protocols before selected, and accepted
+// selected. If selected is empty, p rejected all of them.
+func (h *BasicHost) reportNegotiation(p peer.ID, pids []protocol.ID, selected protocol.ID) {
+	for _, pid := range pids {
+		if pid == selected {
+			h.ids.ReportNegotiation(p, pid, true)
+			return
+		}
+		h.ids.ReportNegotiation(p, pid, false)
+	}
+}
+
 func (h *BasicHost) preferredProtocol(p peer.ID, pids []protocol.ID) (protocol.ID, error) {
 	supported, err := h.Peerstore().SupportsProtocols(p, pids...)
 	if err != nil {
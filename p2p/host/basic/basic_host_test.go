@@ -995,3 +995,51 @@ func TestHostTimeoutNewStream(t *testing.T) {
 	require.Error(t, err)
 	require.ErrorContains(t, err, "context deadline exceeded")
 }
+
+func TestNewStreamSkipsIdentifyForKnownProtocols(t *testing.T) {
+	h1, err := NewHost(swarmt.GenSwarm(t), nil)
+	require.NoError(t, err)
+	h1.Start()
+	defer h1.Close()
+	h2, err := NewHost(swarmt.GenSwarm(t), nil)
+	require.NoError(t, err)
+	h2.Start()
+	defer h2.Close()
+
+	// h2 never answers identify requests
+	unblock := make(chan struct{})
+	defer close(unblock)
+	h2.SetStreamHandler(identify.ID, func(s network.Stream) {
+		<-unblock
+		s.Reset()
+	})
+	h2.SetStreamHandler("/known", func(s network.Stream) { s.Close() })
+	// don't learn about h2's protocols from its pushes either
+	h1.RemoveStreamHandler(identify.IDPush)
+	// Connect would wait for identify, so dial directly
+	h1.Peerstore().AddAddrs(h2.ID(), h2.Addrs(), peerstore.PermanentAddrTTL)
+	_, err = h1.Network().DialPeer(context.Background(), h2.ID())
+	require.NoError(t, err)
+
+	// we know that h2 supports the protocol, so we don't wait for identify
+	require.NoError(t, h1.Peerstore().AddProtocols(h2.ID(), "/known"))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	s, err := h1.NewStream(ctx, h2.ID(), "/known")
+	require.NoError(t, err)
+	require.Equal(t, protocol.ID("/known"), s.Protocol())
+	s.Close()
+
+	// without any information in the peerstore, we wait for identify
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err = h1.NewStream(ctx, h2.ID(), "/unknown")
+	require.ErrorContains(t, err, "identify failed to complete")
+
+	// if we only know that h2 supports a protocol we prefer less, we wait for
+	// identify, which might tell us that h2 supports the preferred protocol
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err = h1.NewStream(ctx, h2.ID(), "/preferred", "/known")
+	require.ErrorContains(t, err, "identify failed to complete")
+}
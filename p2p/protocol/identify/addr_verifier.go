@@ -0,0 +1,84 @@
+package identify
+
+import (
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// addrVerificationTTL is the time we cache the result of verifying an address for.
+var addrVerificationTTL = 10 * time.Minute
+
+type addrVerification struct {
+	ok      bool
+	expires time.Time
+}
+
+// addrVerifier verifies addresses, caching the results.
+type addrVerifier struct {
+	verify func(ma.Multiaddr) bool
+	clock  clock.Clock
+
+	mu      sync.Mutex
+	results map[string]addrVerification
+}
+
+func newAddrVerifier(verify func(ma.Multiaddr) bool, clk clock.Clock) *addrVerifier {
+	return &addrVerifier{
+		verify:  verify,
+		clock:   clk,
+		results: make(map[string]addrVerification),
+	}
+}
+
+// Verified returns the (cached) result of verifying addr.
+func (v *addrVerifier) Verified(addr ma.Multiaddr) bool {
+	key := string(addr.Bytes())
+	now := v.clock.Now()
+	v.mu.Lock()
+	r, ok := v.results[key]
+	v.mu.Unlock()
+	if ok && now.Before(r.expires) {
+		return r.ok
+	}
+
+	verified := v.verify(addr)
+	if !verified {
+		log.Debugw("address failed verification", "addr", addr)
+	}
+	v.mu.Lock()
+	v.results[key] = addrVerification{ok: verified, expires: now.Add(addrVerificationTTL)}
+	v.mu.Unlock()
+	return verified
+}
+
+// Filter returns the addresses that pass verification.
+// Cached results for addresses not in addrs are dropped.
+func (v *addrVerifier) Filter(addrs []ma.Multiaddr) []ma.Multiaddr {
+	v.mu.Lock()
+	for key := range v.results {
+		if !containsAddrBytes(addrs, key) {
+			delete(v.results, key)
+		}
+	}
+	v.mu.Unlock()
+
+	verified := make([]ma.Multiaddr, 0, len(addrs))
+	for _, a := range addrs {
+		if v.Verified(a) {
+			verified = append(verified, a)
+		}
+	}
+	return verified
+}
+
+func containsAddrBytes(addrs []ma.Multiaddr, b string) bool {
+	for _, a := range addrs {
+		if string(a.Bytes()) == b {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+// Package bloom implements a bloom filter, a space-efficient probabilistic set.
+// Membership tests never return false negatives, but might return false positives.
+package bloom
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// Filter is a bloom filter. It is not safe for concurrent use.
+type Filter struct {
+	bits []uint64
+	// m is the number of bits, k the number of hash functions
+	m, k uint64
+}
+
+// New creates a bloom filter sized for n elements,
+// with a false positive rate of (at most) fpRate once n elements were added.
+func New(n int, fpRate float64) *Filter {
+	if n < 1 {
+		n = 1
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	k := uint64(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &Filter{bits: make([]uint64, (m+63)/64), m: m, k: k}
+}
+
+// Add adds key to the filter.
+func (f *Filter) Add(key []byte) {
+	h1, h2 := hashes(key)
+	for i := uint64(0); i < f.k; i++ {
+		idx := (h1 + i*h2) % f.m
+		f.bits[idx/64] |= 1 << (idx % 64)
+	}
+}
+
+// AddString adds key to the filter.
+func (f *Filter) AddString(key string) { f.Add([]byte(key)) }
+
+// Test returns true if key was probably added to the filter,
+// and false if it definitely wasn't.
+func (f *Filter) Test(key []byte) bool {
+	h1, h2 := hashes(key)
+	for i := uint64(0); i < f.k; i++ {
+		idx := (h1 + i*h2) % f.m
+		if f.bits[idx/64]&(1<<(idx%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// TestString returns true if key was probably added to the filter,
+// and false if it definitely wasn't.
+func (f *Filter) TestString(key string) bool { return f.Test([]byte(key)) }
+
+// hashes returns the two hashes that the k hash functions are derived from,
+// see Kirsch and Mitzenmacher, "Less Hashing, Same Performance".
+func hashes(key []byte) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write(key)
+	h1 := h.Sum64()
+	h = fnv.New64()
+	h.Write(key)
+	// make sure h2 is odd, such that the k indexes differ
+	return h1, h.Sum64() | 1
+}
@@ -0,0 +1,26 @@
+package bloom
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilter(t *testing.T) {
+	const n = 1000
+	f := New(n, 0.01)
+	for i := 0; i < n; i++ {
+		f.AddString(fmt.Sprintf("added-%d", i))
+	}
+	for i := 0; i < n; i++ {
+		require.True(t, f.TestString(fmt.Sprintf("added-%d", i)))
+	}
+	var falsePositives int
+	for i := 0; i < 10*n; i++ {
+		if f.TestString(fmt.Sprintf("not-added-%d", i)) {
+			falsePositives++
+		}
+	}
+	require.Less(t, falsePositives, 10*n*2/100)
+}
@@ -0,0 +1,89 @@
+package identify
+
+import (
+	"compress/gzip"
+	"io"
+
+	"github.com/libp2p/go-libp2p/core/protocol"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdMaxWindowSize limits the memory used for decompressing Identify
+// messages. Identify messages are small, so this doesn't affect legit peers.
+const zstdMaxWindowSize = 64 << 10
+
+// Codec compresses Identify messages, see WithCompression.
+// The codec is negotiated by appending its name to the Identify protocol ID,
+// e.g. /ipfs/id/1.0.0/zstd.
+type Codec interface {
+	// Name is the name of the codec. It is used as the protocol ID suffix.
+	Name() string
+	// NewWriter returns a writer compressing into w. Closing the writer
+	// flushes all data, but doesn't close w.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	// NewReader returns a reader decompressing from r.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	// Gzip compresses Identify messages using gzip.
+	Gzip Codec = gzipCodec{}
+	// Zstd compresses Identify messages using zstd.
+	Zstd Codec = zstdCodec{}
+)
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string { return "gzip" }
+
+func (gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+type zstdCodec struct{}
+
+func (zstdCodec) Name() string { return "zstd" }
+
+func (zstdCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(zstdMaxWindowSize))
+}
+
+func (zstdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(zstdMaxWindowSize), zstd.WithDecoderLowmem(true))
+	if err != nil {
+		return nil, err
+	}
+	return d.IOReadCloser(), nil
+}
+
+// compressedID returns the protocol ID of Identify requests compressed using codec.
+func compressedID(codec Codec) protocol.ID {
+	return ID + "/" + protocol.ID(codec.Name())
+}
+
+// codecFor returns the codec negotiated for the Identify stream using protocol
+// proto, or nil if the stream isn't compressed.
+func (ids *idService) codecFor(proto protocol.ID) Codec {
+	for _, codec := range ids.codecs {
+		if compressedID(codec) == proto {
+			return codec
+		}
+	}
+	return nil
+}
+
+// identifyProtocols returns the protocols we offer when sending an Identify
+// request, in order of preference: the compressed variants, followed by the
+// uncompressed protocol that all peers support.
+func (ids *idService) identifyProtocols() []protocol.ID {
+	protos := make([]protocol.ID, 0, len(ids.codecs)+1)
+	for _, codec := range ids.codecs {
+		protos = append(protos, compressedID(codec))
+	}
+	return append(protos, ID)
+}
@@ -0,0 +1,145 @@
+package identify
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// IdentifyDebugState is a dump of the state of the identify service, see DebugState.
+// It is meant for debugging only, its format might change at any time.
+type IdentifyDebugState struct {
+	// Seq is the sequence number of our current snapshot.
+	Seq       uint64
+	Protocols []protocol.ID
+	Addrs     []string
+	// ObservedAddrs are our addresses, as observed by our peers.
+	ObservedAddrs []string
+	Peers         []PeerDebugState
+}
+
+// PeerDebugState is the state the identify service keeps for a peer.
+type PeerDebugState struct {
+	ID              peer.ID
+	ProtocolVersion string
+	AgentVersion    string
+	// Protocols, Addrs and ReachableAddrs are taken from the peer's latest snapshot.
+	Protocols      []protocol.ID
+	Addrs          []string
+	ReachableAddrs []string
+	// ObservedAddr is the address the peer reported observing us on.
+	ObservedAddr string
+	// LastIdentified is the time we received the peer's latest snapshot.
+	// It is zero if we haven't received a snapshot yet.
+	LastIdentified time.Time
+	Conns          []ConnDebugState
+}
+
+// ConnDebugState is the state the identify service keeps for a connection.
+type ConnDebugState struct {
+	ID string
+	// PushSupport is "supported", "unsupported" or "unknown".
+	PushSupport string
+	// SentSeq is the sequence number of the last snapshot we sent on this connection.
+	SentSeq uint64
+	// AckedSeq is the sequence number of the last snapshot the peer acknowledged.
+	AckedSeq uint64
+	// PendingPush is set if the peer doesn't have our current snapshot yet.
+	PendingPush bool
+}
+
+// DebugState returns a dump of the state of the identify service, for debugging.
+// It can be serialized to JSON, e.g. to expose it on an admin HTTP endpoint.
+// Peers are sorted by peer ID.
+func (ids *idService) DebugState() IdentifyDebugState {
+	ids.currentSnapshot.Lock()
+	snapshot := ids.currentSnapshot.snapshot
+	ids.currentSnapshot.Unlock()
+
+	state := IdentifyDebugState{
+		Seq:       snapshot.seq,
+		Protocols: slices.Clone(snapshot.protocols),
+		Addrs:     addrStrings(snapshot.addrs),
+	}
+	if !ids.disableObservedAddrManager {
+		state.ObservedAddrs = addrStrings(ids.observedAddrMgr.Addrs())
+	}
+
+	peers := make(map[peer.ID]*PeerDebugState)
+	getPeer := func(p peer.ID) *PeerDebugState {
+		ps, ok := peers[p]
+		if !ok {
+			ps = &PeerDebugState{ID: p}
+			peers[p] = ps
+		}
+		return ps
+	}
+
+	ids.connsMu.RLock()
+	for c, e := range ids.conns {
+		sent := e.Sequence
+		if e.PushAckSupport {
+			sent = e.AckedSequence
+		}
+		ps := getPeer(c.RemotePeer())
+		ps.Conns = append(ps.Conns, ConnDebugState{
+			ID:          c.ID(),
+			PushSupport: e.PushSupport.String(),
+			SentSeq:     e.Sequence,
+			AckedSeq:    e.AckedSequence,
+			PendingPush: e.PushSupport != identifyPushUnsupported && sent < snapshot.seq,
+		})
+	}
+	ids.connsMu.RUnlock()
+
+	ids.peersMu.Lock()
+	for p, s := range ids.peers {
+		ps := getPeer(p)
+		ps.Protocols = slices.Clone(s.snapshot.protocols)
+		ps.Addrs = addrStrings(s.snapshot.addrs)
+		ps.ReachableAddrs = addrStrings(s.snapshot.reachable)
+		if s.observed != nil {
+			ps.ObservedAddr = s.observed.String()
+		}
+		ps.LastIdentified = s.received
+	}
+	ids.peersMu.Unlock()
+
+	state.Peers = make([]PeerDebugState, 0, len(peers))
+	for p, ps := range peers {
+		if v, err := ids.Host.Peerstore().Get(p, "ProtocolVersion"); err == nil {
+			ps.ProtocolVersion, _ = v.(string)
+		}
+		if v, err := ids.Host.Peerstore().Get(p, "AgentVersion"); err == nil {
+			ps.AgentVersion, _ = v.(string)
+		}
+		slices.SortFunc(ps.Conns, func(a, b ConnDebugState) int { return strings.Compare(a.ID, b.ID) })
+		state.Peers = append(state.Peers, *ps)
+	}
+	slices.SortFunc(state.Peers, func(a, b PeerDebugState) int { return strings.Compare(string(a.ID), string(b.ID)) })
+	return state
+}
+
+func (s identifyPushSupport) String() string {
+	switch s {
+	case identifyPushSupported:
+		return "supported"
+	case identifyPushUnsupported:
+		return "unsupported"
+	default:
+		return "unknown"
+	}
+}
+
+func addrStrings(addrs []ma.Multiaddr) []string {
+	strs := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		strs = append(strs, a.String())
+	}
+	return strs
+}
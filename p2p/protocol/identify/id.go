@@ -3,10 +3,16 @@ package identify
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"math"
+	"net"
+	"os"
 	"slices"
+	"strings"
 	"sync"
 	"time"
 
@@ -19,27 +25,60 @@ import (
 	"github.com/libp2p/go-libp2p/core/protocol"
 	"github.com/libp2p/go-libp2p/core/record"
 	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
+	"github.com/libp2p/go-libp2p/p2p/protocol/identify/bloom"
 	useragent "github.com/libp2p/go-libp2p/p2p/protocol/identify/internal/user-agent"
 	"github.com/libp2p/go-libp2p/p2p/protocol/identify/pb"
 
+	"github.com/benbjohnson/clock"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/libp2p/go-msgio/pbio"
 	ma "github.com/multiformats/go-multiaddr"
 	manet "github.com/multiformats/go-multiaddr/net"
 	msmux "github.com/multiformats/go-multistream"
+	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
 var log = logging.Logger("net/identify")
 
 var Timeout = 30 * time.Second // timeout on all incoming Identify interactions
 
+// DefaultProtocolBloomFalsePositiveRate is the default false positive rate of
+// the bloom filters returned by PeerProtocolBloom.
+const DefaultProtocolBloomFalsePositiveRate = 0.01
+
+// DefaultPushDebounce is the default time we wait for further changes to our
+// snapshot before pushing it, see WithPushDebounce.
+const DefaultPushDebounce = 100 * time.Millisecond
+
+// DefaultPushTimeout is the default time we allow for opening an Identify
+// Push stream, see WithPushTimeout.
+const DefaultPushTimeout = 5 * time.Second
+
+// DefaultPushFailureThreshold is the default number of consecutive failed
+// pushes to a peer after which EvtPeerIdentifyPushFailed is emitted, see
+// WithPushFailureThreshold.
+const DefaultPushFailureThreshold = 3
+
+// DefaultMaxPushConcurrency is the default number of Identify Push streams
+// that are opened concurrently, see WithMaxPushConcurrency.
+const DefaultMaxPushConcurrency = 32
+
 const (
 	// ID is the protocol.ID of version 1.0.0 of the identify service.
 	ID = "/ipfs/id/1.0.0"
 	// IDPush is the protocol.ID of the Identify push protocol.
 	// It sends full identify messages containing the current state of the peer.
 	IDPush = "/ipfs/id/push/1.0.0"
+	// IDPushAck is the protocol.ID of the Identify push protocol with acknowledgements.
+	// It works like IDPush, but the receiver acknowledges the message after processing it.
+	// See WithPushAck.
+	IDPushAck = "/ipfs/id/push-ack/1.0.0"
+	// IDDelta is the protocol.ID of the Identify delta protocol.
+	// It sends the changes of the peer's protocols since the last snapshot it sent.
+	// See WithDeltaPush.
+	IDDelta = "/p2p/id/delta/1.0.0"
 
 	ServiceName = "libp2p.identify"
 
@@ -47,24 +86,54 @@ const (
 	signedIDSize          = 8 * 1024
 	maxOwnIdentifyMsgSize = 4 * 1024 // smaller than what we accept. This is 4k to be compatible with rust-libp2p
 	maxMessages           = 10
-	maxPushConcurrency    = 32
+	// pushAck is sent to acknowledge an Identify Push received via IDPushAck
+	pushAck byte = 1
+	// goodbyeTimeout is the time we spend sending goodbye messages when shutting down
+	goodbyeTimeout = time.Second
+	// identifyRequestGracePeriod is the time we give newly connected peers to request our snapshot
+	// via Identify, before we push it to them.
+	identifyRequestGracePeriod = 2 * time.Second
 	// number of addresses to keep for peers we have disconnected from for peerstore.RecentlyConnectedTTL time
 	// This number can be small as we already filter peer addresses based on whether the peer is connected to us over
 	// localhost, private IP or public IP address
 	recentlyConnectedPeerMaxAddrs = 20
-	connectedPeerMaxAddrs         = 500
 )
 
+// DefaultMaxPeerAddrs is the default number of addresses we accept from a
+// connected peer, see WithMaxPeerAddrs.
+const DefaultMaxPeerAddrs = 500
+
 type identifySnapshot struct {
 	seq       uint64
 	protocols []protocol.ID
 	addrs     []ma.Multiaddr
+	// reachable is the subset of addrs that was confirmed to be reachable
+	reachable []ma.Multiaddr
 	record    *record.Envelope
+	// publicRecord is the record sent to public peers, only containing public addresses.
+	// It is only set if private addresses are only advertised to local peers.
+	publicRecord *record.Envelope
+	// uptime is the uptime hint (in seconds) contained in a peer's snapshot, if any.
+	uptime *uint64
+	// dialback is the address to target when hole punching, if any. See SetDialbackHint.
+	dialback ma.Multiaddr
+	// protocolsHash is the hash of the protocol list received from a peer, see protocolsHash.
+	protocolsHash []byte
+	// deprecations are the deprecation notices received from a peer, see WithProtocolDeprecations.
+	deprecations map[protocol.ID]ProtocolDeprecation
+	// version describes the message a peer's snapshot was received in.
+	version IdentifyVersion
 }
 
 // Equal says if two snapshots are identical.
 // It does NOT compare the sequence number.
 func (s identifySnapshot) Equal(other *identifySnapshot) bool {
+	return slices.Equal(s.protocols, other.protocols) && s.equalExceptProtocols(other)
+}
+
+// equalExceptProtocols says if two snapshots are identical, apart from their protocols.
+// It does NOT compare the sequence number.
+func (s identifySnapshot) equalExceptProtocols(other *identifySnapshot) bool {
 	hasRecord := s.record != nil
 	otherHasRecord := other.record != nil
 	if hasRecord != otherHasRecord {
@@ -73,20 +142,107 @@ func (s identifySnapshot) Equal(other *identifySnapshot) bool {
 	if hasRecord && !s.record.Equal(other.record) {
 		return false
 	}
-	if !slices.Equal(s.protocols, other.protocols) {
+	if (s.dialback == nil) != (other.dialback == nil) || (s.dialback != nil && !s.dialback.Equal(other.dialback)) {
 		return false
 	}
-	if len(s.addrs) != len(other.addrs) {
+	return sameAddrs(s.addrs, other.addrs) && sameAddrs(s.reachable, other.reachable)
+}
+
+func sameAddrs(a, b []ma.Multiaddr) bool {
+	if len(a) != len(b) {
 		return false
 	}
-	for i, a := range s.addrs {
-		if !a.Equal(other.addrs[i]) {
+	for i, addr := range a {
+		if !addr.Equal(b[i]) {
 			return false
 		}
 	}
 	return true
 }
 
+// PeerSnapshot is the information a peer sends in an Identify message.
+type PeerSnapshot struct {
+	Protocols        []protocol.ID
+	Addrs            []ma.Multiaddr
+	ReachableAddrs   []ma.Multiaddr
+	SignedPeerRecord *record.Envelope
+	ProtocolVersion  string
+	AgentVersion     string
+}
+
+// PushStats are the statistics of the Identify Pushes sent to a peer.
+type PushStats struct {
+	// Sent is the number of pushes sent successfully.
+	Sent int
+	// Failed is the number of pushes that failed.
+	Failed int
+	// LastPush is the time of the last push, successful or not.
+	LastPush time.Time
+}
+
+// pushState tracks the pushes sent to a peer.
+type pushState struct {
+	stats               PushStats
+	consecutiveFailures int
+}
+
+// IdentifyVersion describes the Identify message a peer sent, for debugging
+// interoperability with different implementations and versions.
+type IdentifyVersion struct {
+	// ProtocolVersion is the protocol version the peer sent.
+	ProtocolVersion string
+	// Fields are the numbers of the fields set in the message, in ascending
+	// order, including fields we don't know.
+	Fields []int
+	// UnknownFields are the numbers of the fields set in the message that we
+	// don't know, in ascending order. They were probably added in a later
+	// version of the protocol.
+	UnknownFields []int
+}
+
+// identifyVersion captures the IdentifyVersion of a received message.
+func identifyVersion(mes *pb.Identify) IdentifyVersion {
+	v := IdentifyVersion{ProtocolVersion: mes.GetProtocolVersion()}
+	mes.ProtoReflect().Range(func(fd protoreflect.FieldDescriptor, _ protoreflect.Value) bool {
+		v.Fields = append(v.Fields, int(fd.Number()))
+		return true
+	})
+	for b := mes.ProtoReflect().GetUnknown(); len(b) > 0; {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			break
+		}
+		b = b[n:]
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			break
+		}
+		b = b[n:]
+		if !slices.Contains(v.UnknownFields, int(num)) {
+			v.UnknownFields = append(v.UnknownFields, int(num))
+		}
+	}
+	slices.Sort(v.UnknownFields)
+	v.Fields = append(v.Fields, v.UnknownFields...)
+	slices.Sort(v.Fields)
+	return v
+}
+
+// PostIdentifyHook is called after consuming a peer's Identify message.
+// If it returns false, the connection the message was received on is closed.
+type PostIdentifyHook func(p peer.ID, snapshot PeerSnapshot) (keep bool)
+
+// ErrIdentifyTimeout is returned by IdentifyWaitTimeout if the Identify
+// request didn't complete in time.
+var ErrIdentifyTimeout = errors.New("timed out waiting for identify")
+
+// errConnRejected is returned when the PostIdentifyHook rejected a connection.
+var errConnRejected = errors.New("connection rejected after identify")
+
+// ErrIdentifyNotSupported is returned by RefreshPeer if the peer doesn't
+// support the Identify protocol.
+var ErrIdentifyNotSupported = errors.New("peer doesn't support identify")
+
 type IDService interface {
 	// IdentifyConn synchronously triggers an identify request on the connection and
 	// waits for it to complete. If the connection is being identified by another
@@ -102,6 +258,9 @@ type IDService interface {
 	// ObservedAddrsFor returns the addresses peers have reported we've dialed from,
 	// for a specific local address.
 	ObservedAddrsFor(local ma.Multiaddr) []ma.Multiaddr
+	// ReportNegotiation reports the outcome of negotiating a protocol with a
+	// peer using multistream-select, e.g. when opening a stream.
+	ReportNegotiation(p peer.ID, proto protocol.ID, accepted bool)
 	Start()
 	io.Closer
 }
@@ -124,6 +283,18 @@ type entry struct {
 	PushSupport identifyPushSupport
 	// Sequence is the sequence number of the last snapshot we sent to this peer.
 	Sequence uint64
+	// PushAckSupport is set if the peer supports Identify Push with acknowledgements.
+	PushAckSupport bool
+	// AckedSequence is the sequence number of the last snapshot the peer acknowledged.
+	AckedSequence uint64
+	// PushVersion is the version of the Identify Push protocol negotiated in
+	// the latest push to the peer, see pushVersions. It is empty before the first push.
+	PushVersion protocol.ID
+	// DeltaSupport is set if the peer supports the Identify delta protocol.
+	DeltaSupport bool
+	// Sent is the last snapshot we sent to this peer.
+	// It is only tracked if delta pushes are enabled, see WithDeltaPush.
+	Sent *identifySnapshot
 }
 
 // idService is a structure that implements ProtocolIdentify.
@@ -148,33 +319,159 @@ type idService struct {
 	refCount sync.WaitGroup
 
 	disableSignedPeerRecord bool
+	dnsAddr                 ma.Multiaddr
+	postIdentifyHook        PostIdentifyHook
+	isReservedProtocol      func(protocol.ID) bool
+	sendGoodbye             bool
+	identifyRetries         int
+	identifyRetryBackoff    time.Duration
+	pushAck                 bool
+	privateAddrsLocalOnly   bool // private addresses are only advertised to local peers
+	protocolNamespaces      func(peer.ID) []protocol.ID
+	protocolBloomFPRate     float64
+	peerUnreachableHook     func(peer.ID)
+	addrsMismatchHook       func(peer.ID, []ma.Multiaddr, []ma.Multiaddr)
+	uptimeHint              bool
+	earlyPushBehavior       EarlyPushBehavior
+	maxPushConcurrency      int
+	pushDebounce            time.Duration
+	pushTimeout             time.Duration
+	pushFailureThreshold    int
+	deltaPush               bool
+	pushProtocols           map[protocol.ID]struct{}
+	codecs                  []Codec
+	maxPeerAddrs            int
+	peerAddrsPriority       func(a, b ma.Multiaddr) int
+	peerAddrsTruncatedHook  func(peer.ID, []ma.Multiaddr)
+	protocolConflictHook    func(peer.ID, protocol.ID, bool)
+	deprecations            map[protocol.ID]ProtocolDeprecation
+	clock                   clock.Clock
+	// started is the time Start was called
+	started time.Time
+	// workers limits the number of Identify messages processed concurrently. May be nil.
+	workers chan struct{}
+
+	// triggerPush queues sending our current snapshot to all peers
+	triggerPush chan struct{}
+	// catchUpTimer queues the catch-up push to peers that connected recently, see sendPushes.
+	// It is only accessed by the Go routine sending pushes, and by Close after that Go routine returned.
+	catchUpTimer *clock.Timer
+	// stopPushes is closed by CloseGraceful, no further pushes are sent afterwards
+	stopPushes     chan struct{}
+	stopPushesOnce sync.Once
+	// pushRefCount tracks the Go routine sending pushes
+	pushRefCount sync.WaitGroup
+	// ready is closed by MarkReady. Pushes are held until then.
+	// It is nil if pushes are not gated, see WithBootstrapGate.
+	ready     chan struct{}
+	readyOnce sync.Once
+
+	wal   WAL
+	walCh chan walEntry
+
+	// addrVerifier is used to verify our addresses before advertising them. May be nil.
+	addrVerifier *addrVerifier
+	// addrFilter selects the host addresses we advertise. May be nil.
+	addrFilter func(ma.Multiaddr) bool
 
 	connsMu sync.RWMutex
 	// The conns map contains all connections we're currently handling.
 	// Connections are inserted as soon as they're available in the swarm
 	// Connections are removed from the map when the connection disconnects.
 	conns map[network.Conn]entry
+	// ackCh is closed (and replaced) when a peer acknowledges a snapshot or disconnects.
+	// It is protected by connsMu.
+	ackCh chan struct{}
 
 	addrMu sync.Mutex
 
+	dialbackMu sync.Mutex
+	// dialbackHint is the address we ask peers to target when hole punching. May be nil.
+	dialbackHint ma.Multiaddr
+
 	// our own observed addresses.
 	observedAddrMgr            *ObservedAddrManager
 	disableObservedAddrManager bool
+	// observedAddrStore persists the observed address consensus. May be nil.
+	observedAddrStore ObservedAddrStore
 
 	emitters struct {
 		evtPeerProtocolsUpdated        event.Emitter
+		evtPeerAddrsUpdated            event.Emitter
+		evtPeerIdentificationStarted   event.Emitter
 		evtPeerIdentificationCompleted event.Emitter
 		evtPeerIdentificationFailed    event.Emitter
+		evtPeerGoodbye                 event.Emitter
+		evtPushSent                    event.Emitter
+		evtPushFailed                  event.Emitter
+		evtPeerPushFailed              event.Emitter
 	}
 
 	currentSnapshot struct {
 		sync.Mutex
 		snapshot identifySnapshot
+		// hostRecord is the peer record the snapshot's record was derived from.
+		// If we advertise a different set of addresses than the host, this is a
+		// different record than snapshot.record.
+		hostRecord *record.Envelope
 	}
 
+	peersMu sync.Mutex
+	// The peers map contains the state we keep for every peer we're connected to.
+	// Entries are created when we first consume an Identify message from the peer,
+	// and removed when we disconnect from it.
+	peers map[peer.ID]*peerState
+	// pushes tracks the pushes sent to every peer. It is protected by peersMu.
+	pushes map[peer.ID]*pushState
+
 	natEmitter *natEmitter
 }
 
+// peerState is the state we keep for a peer we're connected to.
+type peerState struct {
+	// snapshot is the last snapshot we received from this peer.
+	snapshot identifySnapshot
+	// source is the ID of the connection we received the snapshot on,
+	// opened is the time that connection was opened.
+	source string
+	opened time.Time
+	// received is the time we received the snapshot.
+	received time.Time
+	// observed is the address the peer last reported observing us on.
+	observed ma.Multiaddr
+}
+
+// snapshotRecencyResolution is the resolution at which we compare the recency
+// of snapshots containing peer records with the same sequence number.
+// If a snapshot is received within this interval of the current one, the one
+// received on the more stable connection wins. This prevents the snapshot from
+// flapping when the peer sends different snapshots on different connections.
+const snapshotRecencyResolution = time.Second
+
+// supersedes returns true if the snapshot in ps takes precedence over a
+// snapshot containing a peer record with sequence number seq, received at
+// received on a connection opened at opened.
+// Snapshots are ordered by the sequence number of their peer record, then by
+// the time they were received. Ties are broken by the stability of the
+// connection they were received on: the longer it has been open, the more
+// stable it is.
+func (ps *peerState) supersedes(seq uint64, received, opened time.Time) bool {
+	if ps.snapshot.record == nil {
+		return false
+	}
+	currentSeq, ok := peerRecordSeq(ps.snapshot.record)
+	if !ok {
+		return false
+	}
+	if currentSeq != seq {
+		return currentSeq > seq
+	}
+	if received.Sub(ps.received) >= snapshotRecencyResolution {
+		return false
+	}
+	return ps.opened.Before(opened)
+}
+
 type normalizer interface {
 	NormalizeMultiaddr(ma.Multiaddr) ma.Multiaddr
 }
@@ -182,10 +479,58 @@ type normalizer interface {
 // NewIDService constructs a new *idService and activates it by
 // attaching its stream handler to the given host.Host.
 func NewIDService(h host.Host, opts ...Option) (*idService, error) {
-	var cfg config
+	cfg := config{
+		maxPushConcurrency:   DefaultMaxPushConcurrency,
+		pushDebounce:         DefaultPushDebounce,
+		pushTimeout:          DefaultPushTimeout,
+		pushFailureThreshold: DefaultPushFailureThreshold,
+		maxPeerAddrs:         DefaultMaxPeerAddrs,
+	}
 	for _, opt := range opts {
 		opt(&cfg)
 	}
+	if cfg.maxPushConcurrency <= 0 {
+		return nil, errors.New("identify push concurrency must be positive")
+	}
+	if cfg.pushDebounce < 0 {
+		return nil, errors.New("identify push debounce must not be negative")
+	}
+	if cfg.pushTimeout < 0 {
+		return nil, errors.New("identify push timeout must not be negative")
+	}
+	if cfg.pushFailureThreshold <= 0 {
+		return nil, errors.New("identify push failure threshold must be positive")
+	}
+	codecNames := make(map[string]struct{}, len(cfg.codecs))
+	for _, codec := range cfg.codecs {
+		if _, ok := codecNames[codec.Name()]; ok || codec.Name() == "" || strings.Contains(codec.Name(), "/") {
+			return nil, fmt.Errorf("invalid identify compression codec name: %q", codec.Name())
+		}
+		codecNames[codec.Name()] = struct{}{}
+	}
+	if cfg.maxPeerAddrs <= 0 {
+		return nil, errors.New("maximum number of peer addresses must be positive")
+	}
+	if cfg.identifyRetries < 0 || cfg.identifyRetryBackoff < 0 {
+		return nil, errors.New("identify retries and backoff must not be negative")
+	}
+	if cfg.workers < 0 {
+		return nil, errors.New("number of identify workers must not be negative")
+	}
+	if cfg.protocolBloomFPRate == 0 {
+		cfg.protocolBloomFPRate = DefaultProtocolBloomFalsePositiveRate
+	}
+	if cfg.protocolBloomFPRate <= 0 || cfg.protocolBloomFPRate >= 1 {
+		return nil, errors.New("protocol bloom filter false positive rate must be between 0 and 1")
+	}
+	if cfg.clock == nil {
+		cfg.clock = clock.New()
+	}
+	if cfg.dnsAddr != nil {
+		if first, _ := ma.SplitFirst(cfg.dnsAddr); first == nil || first.Protocol().Code != ma.P_DNSADDR {
+			return nil, fmt.Errorf("not a /dnsaddr multiaddr: %s", cfg.dnsAddr)
+		}
+	}
 
 	userAgent := useragent.DefaultUserAgent()
 	if cfg.userAgent != "" {
@@ -200,11 +545,58 @@ func NewIDService(h host.Host, opts ...Option) (*idService, error) {
 		ctx:                     ctx,
 		ctxCancel:               cancel,
 		conns:                   make(map[network.Conn]entry),
+		peers:                   make(map[peer.ID]*peerState),
 		disableSignedPeerRecord: cfg.disableSignedPeerRecord,
+		dnsAddr:                 cfg.dnsAddr,
+		addrFilter:              cfg.addrFilter,
+		postIdentifyHook:        cfg.postIdentifyHook,
+		isReservedProtocol:      cfg.isReservedProtocol,
+		sendGoodbye:             cfg.sendGoodbye,
+		wal:                     cfg.wal,
+		identifyRetries:         cfg.identifyRetries,
+		identifyRetryBackoff:    cfg.identifyRetryBackoff,
+		pushAck:                 cfg.pushAck,
+		privateAddrsLocalOnly:   cfg.privateAddrsLocalOnly,
+		protocolNamespaces:      cfg.protocolNamespaces,
+		protocolBloomFPRate:     cfg.protocolBloomFPRate,
+		peerUnreachableHook:     cfg.peerUnreachableHook,
+		addrsMismatchHook:       cfg.addrsMismatchHook,
+		uptimeHint:              cfg.uptimeHint,
+		earlyPushBehavior:       cfg.earlyPushBehavior,
+		maxPushConcurrency:      cfg.maxPushConcurrency,
+		pushDebounce:            cfg.pushDebounce,
+		pushTimeout:             cfg.pushTimeout,
+		pushFailureThreshold:    cfg.pushFailureThreshold,
+		deltaPush:               cfg.deltaPush,
+		pushProtocols:           cfg.pushProtocols,
+		codecs:                  cfg.codecs,
+		maxPeerAddrs:            cfg.maxPeerAddrs,
+		peerAddrsPriority:       cfg.peerAddrsPriority,
+		peerAddrsTruncatedHook:  cfg.peerAddrsTruncatedHook,
+		protocolConflictHook:    cfg.protocolConflictHook,
+		deprecations:            cfg.deprecations,
+		pushes:                  make(map[peer.ID]*pushState),
+		clock:                   cfg.clock,
+		triggerPush:             make(chan struct{}, 1),
+		stopPushes:              make(chan struct{}),
+		ackCh:                   make(chan struct{}),
 		setupCompleted:          make(chan struct{}),
 		metricsTracer:           cfg.metricsTracer,
 	}
 
+	if s.wal != nil {
+		s.walCh = make(chan walEntry, walQueueSize)
+	}
+	if cfg.bootstrapGate {
+		s.ready = make(chan struct{})
+	}
+	if cfg.workers > 0 {
+		s.workers = make(chan struct{}, cfg.workers)
+	}
+	if cfg.verifyAddr != nil {
+		s.addrVerifier = newAddrVerifier(cfg.verifyAddr, cfg.clock)
+	}
+
 	var normalize func(ma.Multiaddr) ma.Multiaddr
 	if hn, ok := h.(normalizer); ok {
 		normalize = hn.NormalizeMultiaddr
@@ -219,6 +611,15 @@ func NewIDService(h host.Host, opts ...Option) (*idService, error) {
 		if err != nil {
 			return nil, fmt.Errorf("failed to create observed address manager: %s", err)
 		}
+		if cfg.observedAddrStore != nil {
+			consensus, err := cfg.observedAddrStore.Load()
+			if err != nil {
+				log.Warnw("failed to load observed address consensus", "error", err)
+			} else {
+				observedAddrs.LoadConsensus(consensus)
+			}
+			s.observedAddrStore = cfg.observedAddrStore
+		}
 		natEmitter, err := newNATEmitter(h, observedAddrs, time.Minute)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create nat emitter: %s", err)
@@ -231,6 +632,14 @@ func NewIDService(h host.Host, opts ...Option) (*idService, error) {
 	if err != nil {
 		log.Warnf("identify service not emitting peer protocol updates; err: %s", err)
 	}
+	s.emitters.evtPeerAddrsUpdated, err = h.EventBus().Emitter(&event.EvtPeerAddrsUpdated{})
+	if err != nil {
+		log.Warnf("identify service not emitting peer address updates; err: %s", err)
+	}
+	s.emitters.evtPeerIdentificationStarted, err = h.EventBus().Emitter(&event.EvtPeerIdentificationStarted{})
+	if err != nil {
+		log.Warnf("identify service not emitting identification started events; err: %s", err)
+	}
 	s.emitters.evtPeerIdentificationCompleted, err = h.EventBus().Emitter(&event.EvtPeerIdentificationCompleted{})
 	if err != nil {
 		log.Warnf("identify service not emitting identification completed events; err: %s", err)
@@ -239,18 +648,78 @@ func NewIDService(h host.Host, opts ...Option) (*idService, error) {
 	if err != nil {
 		log.Warnf("identify service not emitting identification failed events; err: %s", err)
 	}
+	s.emitters.evtPeerGoodbye, err = h.EventBus().Emitter(&event.EvtPeerGoodbye{})
+	if err != nil {
+		log.Warnf("identify service not emitting goodbye events; err: %s", err)
+	}
+	s.emitters.evtPushSent, err = h.EventBus().Emitter(&event.EvtIdentifyPushSent{})
+	if err != nil {
+		log.Warnf("identify service not emitting push sent events; err: %s", err)
+	}
+	s.emitters.evtPushFailed, err = h.EventBus().Emitter(&event.EvtIdentifyPushFailed{})
+	if err != nil {
+		log.Warnf("identify service not emitting push failed events; err: %s", err)
+	}
+	s.emitters.evtPeerPushFailed, err = h.EventBus().Emitter(&event.EvtPeerIdentifyPushFailed{})
+	if err != nil {
+		log.Warnf("identify service not emitting peer push failed events; err: %s", err)
+	}
 	return s, nil
 }
 
 func (ids *idService) Start() {
+	ids.started = ids.clock.Now()
 	ids.Host.Network().Notify((*netNotifiee)(ids))
 	ids.Host.SetStreamHandler(ID, ids.handleIdentifyRequest)
+	for _, codec := range ids.codecs {
+		ids.Host.SetStreamHandler(compressedID(codec), ids.handleIdentifyRequest)
+	}
 	ids.Host.SetStreamHandler(IDPush, ids.handlePush)
+	if ids.pushAck {
+		ids.Host.SetStreamHandler(IDPushAck, ids.handlePush)
+	}
+	if ids.deltaPush {
+		ids.Host.SetStreamHandler(IDDelta, ids.handleDelta)
+	}
 	ids.updateSnapshot()
 	close(ids.setupCompleted)
 
 	ids.refCount.Add(1)
 	go ids.loop(ids.ctx)
+	if ids.wal != nil {
+		ids.refCount.Add(1)
+		go ids.walLoop()
+	}
+	if !ids.disableObservedAddrManager {
+		ids.refCount.Add(1)
+		go ids.observedAddrsLoop()
+	}
+}
+
+// addrChangeSignaler is implemented by hosts that can be told to re-check their
+// addresses, like the basic host.
+type addrChangeSignaler interface {
+	SignalAddressChange()
+}
+
+// observedAddrsLoop makes the host update its addresses when our observed
+// addresses change. Many peers confirming an address results in a single
+// update, once the address gets activated.
+func (ids *idService) observedAddrsLoop() {
+	defer ids.refCount.Done()
+
+	h, ok := ids.Host.(addrChangeSignaler)
+	if !ok {
+		return
+	}
+	for {
+		select {
+		case <-ids.observedAddrMgr.AddrsUpdated():
+			h.SignalAddressChange()
+		case <-ids.ctx.Done():
+			return
+		}
+	}
 }
 
 func (ids *idService) loop(ctx context.Context) {
@@ -271,43 +740,146 @@ func (ids *idService) loop(ctx context.Context) {
 	// That way, we can end up with
 	// * this Go routine busy looping over all peers in sendPushes
 	// * another push being queued in the triggerPush channel
-	triggerPush := make(chan struct{}, 1)
 	ids.refCount.Add(1)
+	ids.pushRefCount.Add(1)
 	go func() {
 		defer ids.refCount.Done()
+		defer ids.pushRefCount.Done()
 
+		if ids.ready != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ids.stopPushes:
+				return
+			case <-ids.ready:
+				// Send a single push for all changes made while bootstrapping.
+				ids.queuePush()
+			}
+		}
 		for {
 			select {
 			case <-ctx.Done():
 				return
-			case <-triggerPush:
+			case <-ids.stopPushes:
+				return
+			case <-ids.triggerPush:
+				// Wait for further changes, e.g. while our addresses are flapping,
+				// and send a single push for all of them.
+				if !ids.debouncePush(ctx) {
+					return
+				}
 				ids.sendPushes(ctx)
 			}
 		}
 	}()
 
+	// Periodically re-verify our addresses, as the verification results expire.
+	var reverify <-chan time.Time
+	if ids.addrVerifier != nil {
+		t := ids.clock.Ticker(addrVerificationTTL)
+		defer t.Stop()
+		reverify = t.C
+	}
+
 	for {
 		select {
 		case e, ok := <-sub.Out():
 			if !ok {
 				return
 			}
+			ids.currentSnapshot.Lock()
+			old := ids.currentSnapshot.snapshot
+			ids.currentSnapshot.Unlock()
 			if updated := ids.updateSnapshot(); !updated {
 				continue
 			}
+			if !ids.triggersPush(&old) {
+				log.Debugw("not pushing snapshot, only protocols changed that don't trigger a push")
+				continue
+			}
 			if ids.metricsTracer != nil {
 				ids.metricsTracer.TriggeredPushes(e)
 			}
-			select {
-			case triggerPush <- struct{}{}:
-			default: // we already have one more push queued, no need to queue another one
+			ids.queuePush()
+		case <-reverify:
+			if updated := ids.updateSnapshot(); !updated {
+				continue
 			}
+			ids.queuePush()
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
+// triggersPush says if the change from the old snapshot to our current one is
+// pushed to our peers right away, see WithPushProtocols.
+func (ids *idService) triggersPush(old *identifySnapshot) bool {
+	if ids.pushProtocols == nil {
+		return true
+	}
+	ids.currentSnapshot.Lock()
+	current := ids.currentSnapshot.snapshot
+	ids.currentSnapshot.Unlock()
+	if !current.equalExceptProtocols(old) {
+		return true
+	}
+	added, removed := diff(old.protocols, current.protocols)
+	for _, p := range append(added, removed...) {
+		if _, ok := ids.pushProtocols[p]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// debouncePush waits for the push debounce, consuming all pushes queued in
+// the meantime. It returns false if ctx is canceled, or if pushes were stopped
+// by CloseGraceful.
+func (ids *idService) debouncePush(ctx context.Context) bool {
+	select {
+	case <-ids.stopPushes:
+		return false
+	default:
+	}
+	if ids.pushDebounce == 0 {
+		return true
+	}
+	t := ids.clock.Timer(ids.pushDebounce)
+	defer t.Stop()
+	for {
+		select {
+		case <-ids.triggerPush:
+		case <-t.C:
+			return true
+		case <-ctx.Done():
+			return false
+		case <-ids.stopPushes:
+			return false
+		}
+	}
+}
+
+// MarkReady signals that the host has finished bootstrapping, and that our
+// snapshot is settled. If the service was created using WithBootstrapGate,
+// Identify Pushes are held until MarkReady is called, and a single push of
+// the current snapshot is sent afterwards. Otherwise, it is a no-op.
+func (ids *idService) MarkReady() {
+	if ids.ready == nil {
+		return
+	}
+	ids.readyOnce.Do(func() { close(ids.ready) })
+}
+
+// queuePush queues sending our current snapshot to all peers that don't have it yet.
+func (ids *idService) queuePush() {
+	select {
+	case ids.triggerPush <- struct{}{}:
+	default: // we already have one more push queued, no need to queue another one
+	}
+}
+
 func (ids *idService) sendPushes(ctx context.Context) {
 	ids.connsMu.RLock()
 	conns := make([]network.Conn, 0, len(ids.conns))
@@ -320,8 +892,18 @@ func (ids *idService) sendPushes(ctx context.Context) {
 	}
 	ids.connsMu.RUnlock()
 
-	sem := make(chan struct{}, maxPushConcurrency)
+	sem := make(chan struct{}, ids.maxPushConcurrency)
 	var wg sync.WaitGroup
+	// catchUp is the time until we need to push to the peers we skipped because they connected recently
+	var catchUp time.Duration
+	defer func() {
+		if catchUp > 0 {
+			if ids.catchUpTimer != nil {
+				ids.catchUpTimer.Stop()
+			}
+			ids.catchUpTimer = ids.clock.AfterFunc(catchUp, ids.queuePush)
+		}
+	}()
 	for _, c := range conns {
 		// check if the connection is still alive
 		ids.connsMu.RLock()
@@ -334,41 +916,208 @@ func (ids *idService) sendPushes(ctx context.Context) {
 		ids.currentSnapshot.Lock()
 		snapshot := ids.currentSnapshot.snapshot
 		ids.currentSnapshot.Unlock()
-		if e.Sequence >= snapshot.seq {
+		// For peers that acknowledge pushes, resend the snapshot until they do.
+		sent := e.Sequence
+		if e.PushAckSupport {
+			sent = e.AckedSequence
+		}
+		if sent >= snapshot.seq {
 			log.Debugw("already sent this snapshot to peer", "peer", c.RemotePeer(), "seq", snapshot.seq)
 			continue
 		}
+		// Peers that connected recently are about to request the current snapshot via Identify.
+		// Don't push it to them as well, so they don't receive it twice.
+		// If they don't request it within the grace period, they get a catch-up push.
+		if e.Sequence == 0 {
+			if wait := identifyRequestGracePeriod - ids.clock.Since(c.Stat().Opened); wait > 0 {
+				if catchUp == 0 || wait < catchUp {
+					catchUp = wait
+				}
+				continue
+			}
+		}
+		// Peers that have a snapshot that only differs from the current one in its protocols
+		// are only sent the change of our protocols.
+		pushProtos := ids.pushVersions(c.RemotePeer())
+		var prev *identifySnapshot
+		if e.DeltaSupport && !e.PushAckSupport && e.Sent != nil && e.Sent.equalExceptProtocols(&snapshot) {
+			prev = e.Sent
+			pushProtos = []protocol.ID{IDDelta}
+		}
 		// we haven't, send it now
 		sem <- struct{}{}
 		wg.Add(1)
 		go func(c network.Conn) {
 			defer wg.Done()
 			defer func() { <-sem }()
-			ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
-			defer cancel()
+			ctx := ctx
+			if ids.pushTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, ids.pushTimeout)
+				defer cancel()
+			}
 
-			str, err := newStreamAndNegotiate(ctx, c, IDPush)
+			str, err := newStreamAndNegotiateOneOf(ctx, c, pushProtos)
 			if err != nil { // connection might have been closed recently
+				ids.emitters.evtPushFailed.Emit(event.EvtIdentifyPushFailed{Peer: c.RemotePeer(), Conn: c, Reason: err})
+				ids.recordPushResult(c.RemotePeer(), err)
 				return
 			}
+			if prev == nil {
+				ids.setPushVersion(c, str.Protocol())
+			}
 			// TODO: find out if the peer supports push if we didn't have any information about push support
-			if err := ids.sendIdentifyResp(str, true); err != nil {
+			if prev != nil {
+				err = ids.sendDelta(str, prev, &snapshot)
+			} else {
+				err = ids.sendIdentifyResp(str, true, false)
+			}
+			if err != nil {
 				log.Debugw("failed to send identify push", "peer", c.RemotePeer(), "error", err)
+				ids.emitters.evtPushFailed.Emit(event.EvtIdentifyPushFailed{Peer: c.RemotePeer(), Conn: c, Reason: err})
+				ids.recordPushResult(c.RemotePeer(), err)
+				return
+			}
+			ids.emitters.evtPushSent.Emit(event.EvtIdentifyPushSent{Peer: c.RemotePeer(), Conn: c})
+			ids.recordPushResult(c.RemotePeer(), nil)
+		}(c)
+	}
+	wg.Wait()
+}
+
+// pushVersions returns the versions of the Identify Push protocol we offer to
+// peer p when pushing our snapshot, newest first. The peer picks the newest
+// version it supports. Versions the peer is known not to support aren't
+// offered, as each rejected version costs a roundtrip.
+func (ids *idService) pushVersions(p peer.ID) []protocol.ID {
+	versions := []protocol.ID{IDPush}
+	if ids.pushAck {
+		versions = []protocol.ID{IDPushAck, IDPush}
+	}
+	if sup, err := ids.Host.Peerstore().SupportsProtocols(p, versions...); err == nil && len(sup) > 0 {
+		versions = slices.DeleteFunc(versions, func(v protocol.ID) bool { return !slices.Contains(sup, v) })
+	}
+	return versions
+}
+
+// setPushVersion records the version of the Identify Push protocol negotiated
+// with the peer of c.
+func (ids *idService) setPushVersion(c network.Conn, version protocol.ID) {
+	ids.connsMu.Lock()
+	defer ids.connsMu.Unlock()
+	e, ok := ids.conns[c]
+	if !ok {
+		return
+	}
+	e.PushVersion = version
+	e.PushAckSupport = version == IDPushAck
+	ids.conns[c] = e
+}
+
+// recordPushResult updates the PushStats of peer p, and counts the consecutive
+// failed pushes to p. It emits EvtPeerIdentifyPushFailed once the count
+// reaches the push failure threshold. A successful push (err == nil) resets
+// the count.
+func (ids *idService) recordPushResult(p peer.ID, err error) {
+	ids.peersMu.Lock()
+	ps, ok := ids.pushes[p]
+	if !ok {
+		ps = &pushState{}
+		ids.pushes[p] = ps
+	}
+	ps.stats.LastPush = ids.clock.Now()
+	if err == nil {
+		ps.stats.Sent++
+		ps.consecutiveFailures = 0
+		ids.peersMu.Unlock()
+		return
+	}
+	ps.stats.Failed++
+	ps.consecutiveFailures++
+	attempts := ps.consecutiveFailures
+	ids.peersMu.Unlock()
+
+	if attempts >= ids.pushFailureThreshold {
+		log.Debugw("identify push failed repeatedly", "peer", p, "attempts", attempts, "error", err)
+		ids.emitters.evtPeerPushFailed.Emit(event.EvtPeerIdentifyPushFailed{Peer: p, Attempts: attempts, LastErr: err})
+	}
+}
+
+// sendGoodbyes sends an Identify Push with the goodbye flag set to all peers that support push.
+func (ids *idService) sendGoodbyes() {
+	ids.connsMu.RLock()
+	conns := make([]network.Conn, 0, len(ids.conns))
+	for c, e := range ids.conns {
+		if e.PushSupport != identifyPushUnsupported {
+			conns = append(conns, c)
+		}
+	}
+	ids.connsMu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(ids.ctx, goodbyeTimeout)
+	defer cancel()
+	sem := make(chan struct{}, ids.maxPushConcurrency)
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(c network.Conn) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			str, err := newStreamAndNegotiate(ctx, c, IDPush)
+			if err != nil {
 				return
 			}
+			str.SetDeadline(time.Now().Add(goodbyeTimeout))
+			if err := ids.sendIdentifyResp(str, true, true); err != nil {
+				log.Debugw("failed to send goodbye", "peer", c.RemotePeer(), "error", err)
+			}
 		}(c)
 	}
 	wg.Wait()
 }
 
+// CloseGraceful is like Close, but lets a push that is currently being sent to
+// our peers complete first, such that peers don't see it canceled half-way.
+// No further pushes are started. If the push doesn't complete within timeout,
+// it is canceled like by Close.
+func (ids *idService) CloseGraceful(timeout time.Duration) error {
+	ids.stopPushesOnce.Do(func() { close(ids.stopPushes) })
+	done := make(chan struct{})
+	go func() {
+		ids.pushRefCount.Wait()
+		close(done)
+	}()
+	t := ids.clock.Timer(timeout)
+	defer t.Stop()
+	select {
+	case <-done:
+	case <-t.C:
+		log.Debugw("timed out waiting for identify push to complete", "timeout", timeout)
+	}
+	return ids.Close()
+}
+
 // Close shuts down the idService
 func (ids *idService) Close() error {
+	if ids.sendGoodbye {
+		ids.sendGoodbyes()
+	}
 	ids.ctxCancel()
 	if !ids.disableObservedAddrManager {
+		if ids.observedAddrStore != nil {
+			if err := ids.observedAddrStore.Save(ids.observedAddrMgr.Consensus()); err != nil {
+				log.Warnw("failed to save observed address consensus", "error", err)
+			}
+		}
 		ids.observedAddrMgr.Close()
 		ids.natEmitter.Close()
 	}
 	ids.refCount.Wait()
+	if ids.catchUpTimer != nil {
+		ids.catchUpTimer.Stop()
+	}
 	return nil
 }
 
@@ -386,6 +1135,241 @@ func (ids *idService) ObservedAddrsFor(local ma.Multiaddr) []ma.Multiaddr {
 	return ids.observedAddrMgr.AddrsFor(local)
 }
 
+// IdentifySource returns the ID of the connection on which we received the
+// latest Identify (or Identify Push) message from peer p.
+// It returns false if we're not connected to p, or haven't identified it yet.
+func (ids *idService) IdentifySource(p peer.ID) (connID string, ok bool) {
+	ids.peersMu.Lock()
+	defer ids.peersMu.Unlock()
+	ps, ok := ids.peers[p]
+	if !ok {
+		return "", false
+	}
+	return ps.source, true
+}
+
+// PeerHasAddrs returns true if peer p advertised at least one address in its
+// latest Identify message. Peers that didn't are only reachable via their
+// existing connections, and shouldn't be dialed once disconnected.
+// It returns false if we're not connected to p, or haven't identified it yet.
+func (ids *idService) PeerHasAddrs(p peer.ID) bool {
+	ids.peersMu.Lock()
+	defer ids.peersMu.Unlock()
+	ps, ok := ids.peers[p]
+	return ok && len(ps.snapshot.addrs) > 0
+}
+
+// ReachableAddrs returns the addresses that peer p flagged as confirmed to be
+// reachable in its latest Identify message. These should be dialed first.
+// It returns nil if we're not connected to p, or haven't identified it yet.
+func (ids *idService) ReachableAddrs(p peer.ID) []ma.Multiaddr {
+	ids.peersMu.Lock()
+	defer ids.peersMu.Unlock()
+	ps, ok := ids.peers[p]
+	if !ok {
+		return nil
+	}
+	return slices.Clone(ps.snapshot.reachable)
+}
+
+// PeerProtocolBloom returns a bloom filter of the protocols peer p advertised
+// in its latest Identify message. The filter allows for space-efficient
+// membership tests: it never misses a protocol the peer advertised, but it
+// might claim support for protocols the peer didn't advertise, at the rate set
+// by WithProtocolBloomFalsePositiveRate. Use Filter.TestString to test for a protocol.
+// It returns false if we're not connected to p, or haven't identified it yet.
+func (ids *idService) PeerProtocolBloom(p peer.ID) (*bloom.Filter, bool) {
+	ids.peersMu.Lock()
+	ps, ok := ids.peers[p]
+	var protos []protocol.ID
+	if ok {
+		protos = ps.snapshot.protocols
+	}
+	ids.peersMu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	f := bloom.New(len(protos), ids.protocolBloomFPRate)
+	for _, proto := range protos {
+		f.AddString(string(proto))
+	}
+	return f, true
+}
+
+// ObservedByPeer returns the address peer p reported observing us on in its
+// latest Identify message. Comparing the addresses reported by different peers
+// shows via which paths we're reachable.
+// It returns false if we're not connected to p, or p didn't report an address.
+func (ids *idService) ObservedByPeer(p peer.ID) (ma.Multiaddr, bool) {
+	ids.peersMu.Lock()
+	defer ids.peersMu.Unlock()
+	ps, ok := ids.peers[p]
+	if !ok || ps.observed == nil {
+		return nil, false
+	}
+	return ps.observed, true
+}
+
+// PeerUptimeHint returns the uptime peer p reported in its latest Identify
+// message, see WithUptimeHint. The hint is advisory and can't be verified.
+// It returns false if we're not connected to p, or p didn't send a hint.
+func (ids *idService) PeerUptimeHint(p peer.ID) (time.Duration, bool) {
+	ids.peersMu.Lock()
+	defer ids.peersMu.Unlock()
+	ps, ok := ids.peers[p]
+	if !ok || ps.snapshot.uptime == nil {
+		return 0, false
+	}
+	uptime := *ps.snapshot.uptime
+	if maxUptime := uint64(math.MaxInt64 / int64(time.Second)); uptime > maxUptime {
+		uptime = maxUptime
+	}
+	return time.Duration(uptime) * time.Second, true
+}
+
+// PeerProtocolDeprecations returns the deprecation notices peer p sent in its
+// latest Identify message, see WithProtocolDeprecations. The map is empty if p
+// didn't announce any deprecations. It returns false if we're not connected to p.
+func (ids *idService) PeerProtocolDeprecations(p peer.ID) (map[protocol.ID]ProtocolDeprecation, bool) {
+	ids.peersMu.Lock()
+	defer ids.peersMu.Unlock()
+	ps, ok := ids.peers[p]
+	if !ok {
+		return nil, false
+	}
+	return maps.Clone(ps.snapshot.deprecations), true
+}
+
+// ReportNegotiation reports the outcome of negotiating protocol proto with peer
+// p using multistream-select, e.g. when opening a stream. accepted is true if
+// the peer accepted the protocol. If the outcome contradicts the protocols p
+// advertised in its latest Identify message, the hook set by
+// WithProtocolConflictHook is called. Outcomes for peers we haven't
+// identified yet are ignored.
+func (ids *idService) ReportNegotiation(p peer.ID, proto protocol.ID, accepted bool) {
+	if ids.protocolConflictHook == nil {
+		return
+	}
+	ids.peersMu.Lock()
+	ps, ok := ids.peers[p]
+	var advertised bool
+	if ok {
+		advertised = slices.Contains(ps.snapshot.protocols, proto)
+	}
+	ids.peersMu.Unlock()
+	if !ok || advertised == accepted {
+		return
+	}
+	log.Debugw("negotiated protocol conflicts with identify", "peer", p, "protocol", proto, "advertised", advertised)
+	ids.protocolConflictHook(p, proto, advertised)
+}
+
+// Snapshot returns our current snapshot, i.e. the protocols, addresses and
+// signed peer record we advertise to our peers. The returned slices are copies
+// that the caller may modify. The signed peer record is shared and must be
+// treated as immutable.
+// Peers might be sent a subset of the snapshot, depending on the options used.
+func (ids *idService) Snapshot() PeerSnapshot {
+	ids.currentSnapshot.Lock()
+	snapshot := ids.currentSnapshot.snapshot
+	ids.currentSnapshot.Unlock()
+
+	return PeerSnapshot{
+		Protocols:        slices.Clone(snapshot.protocols),
+		Addrs:            slices.Clone(snapshot.addrs),
+		ReachableAddrs:   slices.Clone(snapshot.reachable),
+		SignedPeerRecord: snapshot.record,
+		ProtocolVersion:  ids.ProtocolVersion,
+		AgentVersion:     ids.UserAgent,
+	}
+}
+
+// PushStats returns the statistics of the Identify Pushes we sent to peer p.
+// The statistics are reset when we disconnect from p.
+// It returns false if we haven't pushed to p since connecting.
+func (ids *idService) PushStats(p peer.ID) (PushStats, bool) {
+	ids.peersMu.Lock()
+	defer ids.peersMu.Unlock()
+	ps, ok := ids.pushes[p]
+	if !ok {
+		return PushStats{}, false
+	}
+	return ps.stats, true
+}
+
+// LastSnapshot returns the latest snapshot we received from peer p, i.e. the
+// protocols, addresses and signed peer record we believe p has. This helps to
+// debug pushes that didn't arrive.
+// It returns false if we're not connected to p, or haven't identified it yet.
+func (ids *idService) LastSnapshot(p peer.ID) (PeerSnapshot, bool) {
+	ids.peersMu.Lock()
+	ps, ok := ids.peers[p]
+	var snapshot identifySnapshot
+	if ok {
+		snapshot = ps.snapshot
+	}
+	ids.peersMu.Unlock()
+	if !ok {
+		return PeerSnapshot{}, false
+	}
+
+	s := PeerSnapshot{
+		Protocols:        slices.Clone(snapshot.protocols),
+		Addrs:            slices.Clone(snapshot.addrs),
+		ReachableAddrs:   slices.Clone(snapshot.reachable),
+		SignedPeerRecord: snapshot.record,
+	}
+	if v, err := ids.Host.Peerstore().Get(p, "ProtocolVersion"); err == nil {
+		s.ProtocolVersion, _ = v.(string)
+	}
+	if v, err := ids.Host.Peerstore().Get(p, "AgentVersion"); err == nil {
+		s.AgentVersion, _ = v.(string)
+	}
+	return s, true
+}
+
+// PeerIdentifyVersion returns the protocol version and the fields that peer p
+// sent in its latest Identify message, see IdentifyVersion.
+// It returns false if we're not connected to p, or haven't identified it yet.
+func (ids *idService) PeerIdentifyVersion(p peer.ID) (IdentifyVersion, bool) {
+	ids.peersMu.Lock()
+	defer ids.peersMu.Unlock()
+	ps, ok := ids.peers[p]
+	if !ok {
+		return IdentifyVersion{}, false
+	}
+	v := ps.snapshot.version
+	v.Fields = slices.Clone(v.Fields)
+	v.UnknownFields = slices.Clone(v.UnknownFields)
+	return v, true
+}
+
+// SetDialbackHint sets the address that peers should target when coordinating
+// a hole punch with us, e.g. the address selected by the hole punching service.
+// The hint is sent in Identify messages, and pushed to connected peers.
+// It is advisory, peers may ignore it. Passing nil removes the hint.
+func (ids *idService) SetDialbackHint(addr ma.Multiaddr) {
+	ids.dialbackMu.Lock()
+	ids.dialbackHint = addr
+	ids.dialbackMu.Unlock()
+	if ids.updateSnapshot() {
+		ids.queuePush()
+	}
+}
+
+// DialbackHint returns the address peer p asked to be targeted when hole
+// punching, see SetDialbackHint. The hint is advisory.
+// It returns false if we're not connected to p, or p didn't send a hint.
+func (ids *idService) DialbackHint(p peer.ID) (ma.Multiaddr, bool) {
+	ids.peersMu.Lock()
+	defer ids.peersMu.Unlock()
+	ps, ok := ids.peers[p]
+	if !ok || ps.snapshot.dialback == nil {
+		return nil, false
+	}
+	return ps.snapshot.dialback, true
+}
+
 // IdentifyConn runs the Identify protocol on a connection.
 // It returns when we've received the peer's Identify message (or the request fails).
 // If successful, the peer store will contain the peer's addresses and supported protocols.
@@ -427,7 +1411,8 @@ func (ids *idService) IdentifyWait(c network.Conn) <-chan struct{} {
 	// stream then forget the connection.
 	go func() {
 		defer close(e.IdentifyWaitChan)
-		if err := ids.identifyConn(c); err != nil {
+		ids.emitters.evtPeerIdentificationStarted.Emit(event.EvtPeerIdentificationStarted{Peer: c.RemotePeer(), Conn: c})
+		if err := ids.identifyConnWithRetries(c); err != nil {
 			log.Warnf("failed to identify %s: %s", c.RemotePeer(), err)
 			ids.emitters.evtPeerIdentificationFailed.Emit(event.EvtPeerIdentificationFailed{Peer: c.RemotePeer(), Reason: err})
 			return
@@ -437,6 +1422,22 @@ func (ids *idService) IdentifyWait(c network.Conn) <-chan struct{} {
 	return e.IdentifyWaitChan
 }
 
+// IdentifyWaitTimeout is like IdentifyWait, but blocks until the Identify
+// request completes (or fails). If that takes longer than d, it returns
+// ErrIdentifyTimeout. This allows telling apart peers that didn't respond to
+// our request in time from callers giving up on waiting.
+// Like IdentifyWait, it returns nil if the Identify request failed.
+func (ids *idService) IdentifyWaitTimeout(c network.Conn, d time.Duration) error {
+	t := ids.clock.Timer(d)
+	defer t.Stop()
+	select {
+	case <-ids.IdentifyWait(c):
+		return nil
+	case <-t.C:
+		return ErrIdentifyTimeout
+	}
+}
+
 // newStreamAndNegotiate opens a new stream on the given connection and negotiates the given protocol.
 func newStreamAndNegotiate(ctx context.Context, c network.Conn, proto protocol.ID) (network.Stream, error) {
 	s, err := c.NewStream(network.WithAllowLimitedConn(ctx, "identify"))
@@ -462,10 +1463,38 @@ func newStreamAndNegotiate(ctx context.Context, c network.Conn, proto protocol.I
 	return s, nil
 }
 
+// newStreamAndNegotiateOneOf is like newStreamAndNegotiate, but negotiates
+// the first of protos that the peer supports.
+func newStreamAndNegotiateOneOf(ctx context.Context, c network.Conn, protos []protocol.ID) (network.Stream, error) {
+	if len(protos) == 1 {
+		return newStreamAndNegotiate(ctx, c, protos[0])
+	}
+	s, err := c.NewStream(network.WithAllowLimitedConn(ctx, "identify"))
+	if err != nil {
+		log.Debugw("error opening identify stream", "peer", c.RemotePeer(), "error", err)
+		return nil, err
+	}
+
+	_ = s.SetDeadline(time.Now().Add(Timeout))
+
+	proto, err := msmux.SelectOneOf(protos, s)
+	if err != nil {
+		log.Infow("failed negotiate identify protocol with peer", "peer", c.RemotePeer(), "error", err)
+		_ = s.Reset()
+		return nil, err
+	}
+	if err := s.SetProtocol(proto); err != nil {
+		log.Warnf("error setting identify protocol for stream: %s", err)
+		_ = s.Reset()
+		return nil, err
+	}
+	return s, nil
+}
+
 func (ids *idService) identifyConn(c network.Conn) error {
 	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
 	defer cancel()
-	s, err := newStreamAndNegotiate(network.WithAllowLimitedConn(ctx, "identify"), c, ID)
+	s, err := newStreamAndNegotiateOneOf(network.WithAllowLimitedConn(ctx, "identify"), c, ids.identifyProtocols())
 	if err != nil {
 		log.Debugw("error opening identify stream", "peer", c.RemotePeer(), "error", err)
 		return err
@@ -474,17 +1503,232 @@ func (ids *idService) identifyConn(c network.Conn) error {
 	return ids.handleIdentifyResponse(s, false)
 }
 
+// RefreshPeer runs the Identify protocol with peer p, independently of any
+// pushes the peer sends us, and updates the peer store and the peer's snapshot
+// with the response. It can be used when the peer's information is suspected
+// to be stale. The connections to p are tried in turn, until the request
+// succeeds on one of them. It returns ErrIdentifyNotSupported if the peer
+// doesn't support Identify anymore.
+func (ids *idService) RefreshPeer(ctx context.Context, p peer.ID) error {
+	conns := ids.Host.Network().ConnsToPeer(p)
+	if len(conns) == 0 {
+		return network.ErrNoConn
+	}
+	var err error
+	for _, c := range conns {
+		if err = ids.refreshConn(ctx, c); err == nil || errors.Is(err, ErrIdentifyNotSupported) || ctx.Err() != nil {
+			return err
+		}
+		log.Debugw("refreshing peer failed, trying next connection", "peer", p, "error", err)
+	}
+	return err
+}
+
+// refreshConn runs the Identify protocol on connection c for RefreshPeer.
+func (ids *idService) refreshConn(ctx context.Context, c network.Conn) error {
+	s, err := newStreamAndNegotiateOneOf(network.WithAllowLimitedConn(ctx, "identify"), c, ids.identifyProtocols())
+	if err != nil {
+		if errors.Is(err, msmux.ErrNotSupported[protocol.ID]{}) {
+			return ErrIdentifyNotSupported
+		}
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = s.SetDeadline(deadline)
+	}
+	return ids.handleIdentifyResponse(s, false)
+}
+
+// ProbeIdentify runs the Identify protocol on connection c, and returns the
+// information the peer sent us, after validating it. Unlike IdentifyConn, it
+// doesn't store the result in the peer store, doesn't emit any events and
+// doesn't keep any state for the peer. It can be used without calling Start,
+// e.g. for one-off queries.
+func (ids *idService) ProbeIdentify(ctx context.Context, c network.Conn) (PeerSnapshot, error) {
+	s, err := newStreamAndNegotiate(network.WithAllowLimitedConn(ctx, "identify"), c, ID)
+	if err != nil {
+		return PeerSnapshot{}, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = s.SetDeadline(deadline)
+	}
+	if err := s.Scope().SetService(ServiceName); err != nil {
+		s.Reset()
+		return PeerSnapshot{}, err
+	}
+	if err := s.Scope().ReserveMemory(signedIDSize, network.ReservationPriorityAlways); err != nil {
+		s.Reset()
+		return PeerSnapshot{}, err
+	}
+	defer s.Scope().ReleaseMemory(signedIDSize)
+
+	mes := &pb.Identify{}
+	if err := readAllIDMessages(pbio.NewDelimitedReader(s, signedIDSize), mes); err != nil {
+		s.Reset()
+		return PeerSnapshot{}, err
+	}
+	s.Close()
+
+	p := c.RemotePeer()
+	snapshot := PeerSnapshot{
+		Protocols:       protocol.ConvertFromStrings(mes.Protocols),
+		ProtocolVersion: mes.GetProtocolVersion(),
+		AgentVersion:    mes.GetAgentVersion(),
+	}
+	if ids.isReservedProtocol != nil {
+		snapshot.Protocols = slices.DeleteFunc(snapshot.Protocols, ids.isReservedProtocol)
+	}
+	signedPeerRecord, err := signedPeerRecordFromMessage(mes)
+	if err != nil {
+		return PeerSnapshot{}, fmt.Errorf("invalid signed peer record: %w", err)
+	}
+	if signedPeerRecord != nil {
+		addrs, err := ids.consumeSignedPeerRecord(p, signedPeerRecord)
+		if err != nil {
+			return PeerSnapshot{}, fmt.Errorf("invalid signed peer record: %w", err)
+		}
+		snapshot.SignedPeerRecord = signedPeerRecord
+		snapshot.Addrs = addrs
+	} else {
+		for _, b := range mes.ListenAddrs {
+			addr, err := ma.NewMultiaddrBytes(b)
+			if err != nil {
+				log.Debugw("failed to parse listen addr", "peer", p, "error", err)
+				continue
+			}
+			snapshot.Addrs = append(snapshot.Addrs, addr)
+		}
+	}
+	for _, b := range mes.ReachableAddrs {
+		addr, err := ma.NewMultiaddrBytes(b)
+		if err == nil && ma.Contains(snapshot.Addrs, addr) {
+			snapshot.ReachableAddrs = append(snapshot.ReachableAddrs, addr)
+		}
+	}
+	return snapshot, nil
+}
+
+// identifyConnWithRetries identifies the connection, retrying (with backoff)
+// if the Identify request times out, as configured by WithIdentifyRetries.
+func (ids *idService) identifyConnWithRetries(c network.Conn) error {
+	backoff := ids.identifyRetryBackoff
+	for i := 0; ; i++ {
+		err := ids.identifyConn(c)
+		if err == nil || i >= ids.identifyRetries || !isTimeout(err) {
+			return err
+		}
+		log.Debugw("identify timed out, retrying", "peer", c.RemotePeer(), "attempt", i+1, "backoff", backoff)
+		select {
+		case <-ids.clock.After(backoff):
+		case <-ids.ctx.Done():
+			return err
+		}
+		if c.IsClosed() {
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// isTimeout returns true if the error was caused by a deadline being exceeded.
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return true
+	}
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Timeout()
+}
+
 // handlePush handles incoming identify push streams
 func (ids *idService) handlePush(s network.Stream) {
 	s.SetDeadline(time.Now().Add(Timeout))
 	ids.handleIdentifyResponse(s, true)
 }
 
+// handleDelta handles a change of the peer's protocols received via the
+// Identify delta protocol. It is applied to the last snapshot we received from
+// the peer.
+func (ids *idService) handleDelta(s network.Stream) {
+	s.SetDeadline(time.Now().Add(Timeout))
+	if err := s.Scope().SetService(ServiceName); err != nil {
+		log.Warnf("error attaching stream to identify service: %s", err)
+		s.Reset()
+		return
+	}
+	if err := s.Scope().ReserveMemory(signedIDSize, network.ReservationPriorityAlways); err != nil {
+		log.Warnf("error reserving memory for identify stream: %s", err)
+		s.Reset()
+		return
+	}
+	defer s.Scope().ReleaseMemory(signedIDSize)
+
+	mes := &pb.Identify{}
+	if err := pbio.NewDelimitedReader(s, signedIDSize).ReadMsg(mes); err != nil {
+		log.Warn("error reading identify delta: ", err)
+		s.Reset()
+		return
+	}
+	defer s.Close()
+	if mes.Delta == nil {
+		log.Debugw("identify delta message without a delta", "peer", s.Conn().RemotePeer())
+		return
+	}
+	ids.consumeDelta(s.Conn(), mes.Delta)
+}
+
+// consumeDelta applies a change of the protocols of the remote peer of c.
+func (ids *idService) consumeDelta(c network.Conn, delta *pb.Delta) {
+	p := c.RemotePeer()
+	ids.peersMu.Lock()
+	ps, ok := ids.peers[p]
+	var snapshot identifySnapshot
+	if ok {
+		snapshot = ps.snapshot
+	}
+	ids.peersMu.Unlock()
+	if !ok {
+		// We don't have a snapshot to apply the delta to.
+		// The peer will send us a full snapshot when we identify it.
+		log.Debugw("ignoring identify delta from peer that hasn't been identified", "peer", p)
+		return
+	}
+
+	added := protocol.ConvertFromStrings(delta.GetAddedProtocols())
+	if ids.isReservedProtocol != nil {
+		added = slices.DeleteFunc(added, func(proto protocol.ID) bool {
+			if ids.isReservedProtocol(proto) {
+				log.Debugw("ignoring reserved protocol advertised by peer", "peer", p, "protocol", proto)
+				return true
+			}
+			return false
+		})
+	}
+	removed := protocol.ConvertFromStrings(delta.GetRmProtocols())
+	protos := slices.DeleteFunc(slices.Clone(snapshot.protocols), func(proto protocol.ID) bool {
+		return slices.Contains(removed, proto) || slices.Contains(added, proto)
+	})
+	protos = append(protos, added...)
+	slices.Sort(protos)
+	added, removed = diff(snapshot.protocols, protos)
+
+	ids.Host.Peerstore().RemoveProtocols(p, removed...)
+	ids.Host.Peerstore().AddProtocols(p, added...)
+	snapshot.protocols = protos
+	// We can't tell if the protocols match the hash sent by the peer anymore.
+	snapshot.protocolsHash = nil
+	ids.applySnapshot(p, c.ID(), c.Stat().Opened, snapshot, nil)
+	ids.emitters.evtPeerProtocolsUpdated.Emit(event.EvtPeerProtocolsUpdated{
+		Peer:    p,
+		Added:   added,
+		Removed: removed,
+	})
+}
+
 func (ids *idService) handleIdentifyRequest(s network.Stream) {
-	_ = ids.sendIdentifyResp(s, false)
+	_ = ids.sendIdentifyResp(s, false, false)
 }
 
-func (ids *idService) sendIdentifyResp(s network.Stream, isPush bool) error {
+func (ids *idService) sendIdentifyResp(s network.Stream, isPush, goodbye bool) error {
 	if err := s.Scope().SetService(ServiceName); err != nil {
 		s.Reset()
 		return fmt.Errorf("failed to attaching stream to identify service: %w", err)
@@ -498,30 +1742,157 @@ func (ids *idService) sendIdentifyResp(s network.Stream, isPush bool) error {
 	log.Debugw("sending snapshot", "seq", snapshot.seq, "protocols", snapshot.protocols, "addrs", snapshot.addrs)
 
 	mes := ids.createBaseIdentifyResponse(s.Conn(), &snapshot)
-	mes.SignedPeerRecord = ids.getSignedRecord(&snapshot)
+	mes.SignedPeerRecord = ids.getSignedRecord(&snapshot, ids.isPublicPeer(s.Conn()))
+	if goodbye {
+		mes.Goodbye = proto.Bool(true)
+	}
 
 	log.Debugf("%s sending message to %s %s", ID, s.Conn().RemotePeer(), s.Conn().RemoteMultiaddr())
-	if err := ids.writeChunkedIdentifyMsg(s, mes); err != nil {
+	if codec := ids.codecFor(s.Protocol()); codec != nil {
+		w, err := codec.NewWriter(s)
+		if err != nil {
+			s.Reset()
+			return err
+		}
+		if err := ids.writeChunkedIdentifyMsg(w, mes); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+	} else if err := ids.writeChunkedIdentifyMsg(s, mes); err != nil {
 		return err
 	}
+	acked := s.Protocol() == IDPushAck
+	if acked {
+		if err := readPushAck(s); err != nil {
+			s.Reset()
+			return err
+		}
+	}
 
 	if ids.metricsTracer != nil {
 		ids.metricsTracer.IdentifySent(isPush, len(mes.Protocols), len(mes.ListenAddrs))
 	}
 
-	ids.connsMu.Lock()
-	defer ids.connsMu.Unlock()
-	e, ok := ids.conns[s.Conn()]
-	// The connection might already have been closed.
-	// We *should* receive the Connected notification from the swarm before we're able to accept the peer's
-	// Identify stream, but if that for some reason doesn't work, we also wouldn't have a map entry here.
-	// The only consequence would be that we send a spurious Push to that peer later.
-	if !ok {
-		return nil
+	ids.setSentSnapshot(s.Conn(), &snapshot, acked)
+
+	if !isPush {
+		// We might have skipped this peer when pushing a newer snapshot,
+		// since we expected it to receive that snapshot in this response.
+		ids.currentSnapshot.Lock()
+		outdated := ids.currentSnapshot.snapshot.seq > snapshot.seq
+		ids.currentSnapshot.Unlock()
+		if outdated {
+			ids.queuePush()
+		}
+	}
+	return nil
+}
+
+// sendDelta sends the change of the protocols advertised to the peer from the
+// prev to the cur snapshot via the Identify delta protocol.
+func (ids *idService) sendDelta(s network.Stream, prev, cur *identifySnapshot) error {
+	if err := s.Scope().SetService(ServiceName); err != nil {
+		s.Reset()
+		return fmt.Errorf("failed to attaching stream to identify service: %w", err)
+	}
+	defer s.Close()
+
+	added, removed := diff(ids.advertisedProtocols(s.Conn(), prev.protocols), ids.advertisedProtocols(s.Conn(), cur.protocols))
+	log.Debugw("sending protocols delta", "seq", cur.seq, "added", added, "removed", removed)
+	mes := &pb.Identify{Delta: &pb.Delta{
+		AddedProtocols: protocol.ConvertToStrings(added),
+		RmProtocols:    protocol.ConvertToStrings(removed),
+	}}
+	writer := newIdentifyMsgWriter(s)
+	if err := writer.WriteMsg(mes); err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	ids.setSentSnapshot(s.Conn(), cur, false)
+	return nil
+}
+
+// setSentSnapshot records that we sent the snapshot on conn c.
+func (ids *idService) setSentSnapshot(c network.Conn, snapshot *identifySnapshot, acked bool) {
+	ids.connsMu.Lock()
+	defer ids.connsMu.Unlock()
+	e, ok := ids.conns[c]
+	// The connection might already have been closed.
+	// We *should* receive the Connected notification from the swarm before we're able to accept the peer's
+	// Identify stream, but if that for some reason doesn't work, we also wouldn't have a map entry here.
+	// The only consequence would be that we send a spurious Push to that peer later.
+	if !ok {
+		return
+	}
+	e.Sequence = snapshot.seq
+	if acked {
+		e.AckedSequence = snapshot.seq
+		ids.notifyAckWithLock()
+	}
+	if ids.deltaPush {
+		e.Sent = snapshot
+	}
+	ids.conns[c] = e
+}
+
+// readPushAck waits for the peer to acknowledge the Identify Push we sent on s.
+func readPushAck(s network.Stream) error {
+	if err := s.CloseWrite(); err != nil {
+		return err
+	}
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(s, b); err != nil {
+		return fmt.Errorf("failed to read push acknowledgement: %w", err)
+	}
+	if b[0] != pushAck {
+		return fmt.Errorf("invalid push acknowledgement: %d", b[0])
+	}
+	return nil
+}
+
+// notifyAckWithLock wakes up WaitForConvergence.
+// The caller must hold connsMu.
+func (ids *idService) notifyAckWithLock() {
+	close(ids.ackCh)
+	ids.ackCh = make(chan struct{})
+}
+
+// WaitForConvergence blocks until all connected peers that support Identify Push
+// with acknowledgements (see WithPushAck) acknowledged our current snapshot.
+// Peers that don't support it are not waited for. Pushes are resent to peers
+// that haven't acknowledged the current snapshot yet.
+// It returns an error if the context is canceled first.
+func (ids *idService) WaitForConvergence(ctx context.Context) error {
+	ids.queuePush()
+	for {
+		ids.currentSnapshot.Lock()
+		seq := ids.currentSnapshot.snapshot.seq
+		ids.currentSnapshot.Unlock()
+
+		ids.connsMu.RLock()
+		converged := true
+		for _, e := range ids.conns {
+			if e.PushAckSupport && e.AckedSequence < seq {
+				converged = false
+				break
+			}
+		}
+		ackCh := ids.ackCh
+		ids.connsMu.RUnlock()
+		if converged {
+			return nil
+		}
+
+		select {
+		case <-ackCh:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
-	e.Sequence = snapshot.seq
-	ids.conns[s.Conn()] = e
-	return nil
 }
 
 func (ids *idService) handleIdentifyResponse(s network.Stream, isPush bool) error {
@@ -540,7 +1911,18 @@ func (ids *idService) handleIdentifyResponse(s network.Stream, isPush bool) erro
 
 	c := s.Conn()
 
-	r := pbio.NewDelimitedReader(s, signedIDSize)
+	var in io.Reader = s
+	if codec := ids.codecFor(s.Protocol()); codec != nil {
+		dr, err := codec.NewReader(s)
+		if err != nil {
+			log.Debugw("error decompressing identify message", "peer", c.RemotePeer(), "codec", codec.Name(), "error", err)
+			s.Reset()
+			return err
+		}
+		defer dr.Close()
+		in = dr
+	}
+	r := pbio.NewDelimitedReader(in, signedIDSize)
 	mes := &pb.Identify{}
 
 	if err := readAllIDMessages(r, mes); err != nil {
@@ -553,7 +1935,31 @@ func (ids *idService) handleIdentifyResponse(s network.Stream, isPush bool) erro
 
 	log.Debugf("%s received message from %s %s", s.Protocol(), c.RemotePeer(), c.RemoteMultiaddr())
 
-	ids.consumeMessage(mes, c, isPush)
+	if isPush && ids.earlyPushBehavior == EarlyPushBuffer {
+		ids.waitForInitialIdentify(c)
+	}
+
+	// Reading the message doesn't count towards the limit,
+	// so that slow peers can't block processing of other peers' messages.
+	if ids.workers != nil {
+		select {
+		case ids.workers <- struct{}{}:
+		case <-ids.ctx.Done():
+			return ids.ctx.Err()
+		}
+	}
+	err := ids.consumeMessage(mes, c, isPush)
+	if ids.workers != nil {
+		<-ids.workers
+	}
+	if err != nil {
+		return err
+	}
+	if s.Protocol() == IDPushAck {
+		if _, err := s.Write([]byte{pushAck}); err != nil {
+			log.Debugw("failed to acknowledge identify push", "peer", c.RemotePeer(), "error", err)
+		}
+	}
 
 	if ids.metricsTracer != nil {
 		ids.metricsTracer.IdentifyReceived(isPush, len(mes.Protocols), len(mes.ListenAddrs))
@@ -571,6 +1977,14 @@ func (ids *idService) handleIdentifyResponse(s network.Stream, isPush bool) erro
 	} else {
 		e.PushSupport = identifyPushUnsupported
 	}
+	if ids.pushAck {
+		sup, err := ids.Host.Peerstore().SupportsProtocols(c.RemotePeer(), IDPushAck)
+		e.PushAckSupport = err == nil && len(sup) > 0
+	}
+	if ids.deltaPush {
+		sup, err := ids.Host.Peerstore().SupportsProtocols(c.RemotePeer(), IDDelta)
+		e.DeltaSupport = err == nil && len(sup) > 0
+	}
 
 	if ids.metricsTracer != nil {
 		ids.metricsTracer.ConnPushSupport(e.PushSupport)
@@ -580,6 +1994,26 @@ func (ids *idService) handleIdentifyResponse(s network.Stream, isPush bool) erro
 	return nil
 }
 
+// waitForInitialIdentify waits until the Identify request on connection c has
+// completed, if one is in progress.
+func (ids *idService) waitForInitialIdentify(c network.Conn) {
+	ids.connsMu.RLock()
+	ch := ids.conns[c].IdentifyWaitChan
+	ids.connsMu.RUnlock()
+	if ch == nil {
+		return
+	}
+	select {
+	case <-ch:
+	default:
+		log.Debugw("holding back identify push until the initial identify completes", "peer", c.RemotePeer())
+		select {
+		case <-ch:
+		case <-ids.ctx.Done():
+		}
+	}
+}
+
 func readAllIDMessages(r pbio.Reader, finalMsg proto.Message) error {
 	mes := &pb.Identify{}
 	for i := 0; i < maxMessages; i++ {
@@ -607,11 +2041,39 @@ func (ids *idService) updateSnapshot() (updated bool) {
 	for i := 0; i < len(protos); i++ {
 		usedSpace += len(protos[i])
 	}
+	if ids.dnsAddr != nil {
+		usedSpace += len(ids.dnsAddr.Bytes())
+		addrs = ma.FilterAddrs(addrs, func(a ma.Multiaddr) bool { return !a.Equal(ids.dnsAddr) })
+	}
+	if ids.addrFilter != nil {
+		addrs = ma.FilterAddrs(addrs, ids.addrFilter)
+	}
+	if ids.addrVerifier != nil {
+		addrs = ids.addrVerifier.Filter(addrs)
+	}
 	addrs = trimHostAddrList(addrs, maxOwnIdentifyMsgSize-usedSpace-256) // 256 bytes of buffer
+	reachable := ids.reachableAddrs(addrs)
+	if len(reachable) > 0 {
+		// The reachable addresses are sent in addition to the listen addresses.
+		for _, a := range addrs {
+			usedSpace += len(a.Bytes())
+		}
+		reachable = trimHostAddrList(reachable, maxOwnIdentifyMsgSize-usedSpace-256)
+		slices.SortFunc(reachable, func(a, b ma.Multiaddr) int { return bytes.Compare(a.Bytes(), b.Bytes()) })
+	}
+	if ids.dnsAddr != nil {
+		addrs = append([]ma.Multiaddr{ids.dnsAddr}, addrs...)
+	}
+
+	ids.dialbackMu.Lock()
+	dialback := ids.dialbackHint
+	ids.dialbackMu.Unlock()
 
 	snapshot := identifySnapshot{
 		addrs:     addrs,
+		reachable: reachable,
 		protocols: protos,
+		dialback:  dialback,
 	}
 
 	if !ids.disableSignedPeerRecord {
@@ -623,10 +2085,35 @@ func (ids *idService) updateSnapshot() (updated bool) {
 	ids.currentSnapshot.Lock()
 	defer ids.currentSnapshot.Unlock()
 
-	if ids.currentSnapshot.snapshot.Equal(&snapshot) {
+	current := ids.currentSnapshot.snapshot
+	current.record = ids.currentSnapshot.hostRecord
+	if current.Equal(&snapshot) {
 		return false
 	}
 
+	ids.currentSnapshot.hostRecord = snapshot.record
+	var added []ma.Multiaddr
+	if ids.dnsAddr != nil {
+		added = []ma.Multiaddr{ids.dnsAddr}
+	}
+	var keep func(ma.Multiaddr) bool
+	if ids.addrFilter != nil || ids.addrVerifier != nil {
+		keep = func(a ma.Multiaddr) bool {
+			return (ids.addrFilter == nil || ids.addrFilter(a)) && (ids.addrVerifier == nil || ids.addrVerifier.Verified(a))
+		}
+	}
+	if ids.privateAddrsLocalOnly {
+		var publicAdded []ma.Multiaddr
+		for _, a := range added {
+			if manet.IsPublicAddr(a) {
+				publicAdded = append(publicAdded, a)
+			}
+		}
+		snapshot.publicRecord = ids.advertisedRecord(snapshot.record, publicAdded, func(a ma.Multiaddr) bool {
+			return manet.IsPublicAddr(a) && (keep == nil || keep(a))
+		})
+	}
+	snapshot.record = ids.advertisedRecord(snapshot.record, added, keep)
 	snapshot.seq = ids.currentSnapshot.snapshot.seq + 1
 	ids.currentSnapshot.snapshot = snapshot
 
@@ -634,11 +2121,80 @@ func (ids *idService) updateSnapshot() (updated bool) {
 	return true
 }
 
-func (ids *idService) writeChunkedIdentifyMsg(s network.Stream, mes *pb.Identify) error {
-	writer := pbio.NewDelimitedWriter(s)
+// reachableAddrs returns the addresses that we confirmed to be reachable:
+// Addresses that passed verification (see WithAddrVerifier), and addresses
+// that enough peers observed us on.
+func (ids *idService) reachableAddrs(addrs []ma.Multiaddr) []ma.Multiaddr {
+	var observed []ma.Multiaddr
+	if !ids.disableObservedAddrManager {
+		observed = ids.observedAddrMgr.Addrs()
+	}
+	reachable := make([]ma.Multiaddr, 0, len(addrs))
+	for _, a := range addrs {
+		if ma.Contains(observed, a) || (ids.addrVerifier != nil && ids.addrVerifier.Verified(a)) {
+			reachable = append(reachable, a)
+		}
+	}
+	return reachable
+}
+
+// advertisedRecord returns the signed peer record we advertise. If we advertise addresses
+// that are not part of the host's record, or don't advertise some of the host's addresses
+// (keep returns false for them), a new record containing the added addresses followed by
+// the kept host addresses is signed using the host's private key.
+// A nil keep function keeps all of the host's addresses.
+func (ids *idService) advertisedRecord(hostRecord *record.Envelope, added []ma.Multiaddr, keep func(ma.Multiaddr) bool) *record.Envelope {
+	if hostRecord == nil || (len(added) == 0 && keep == nil) {
+		return hostRecord
+	}
+	r, err := hostRecord.Record()
+	if err != nil {
+		log.Errorw("failed to obtain host peer record", "err", err)
+		return nil
+	}
+	hostRec, ok := r.(*peer.PeerRecord)
+	if !ok {
+		log.Errorw("host record is not a peer record")
+		return nil
+	}
+	// added addresses go first, as they're the ones we want peers to prefer
+	addrs := make([]ma.Multiaddr, 0, len(added)+len(hostRec.Addrs))
+	for _, a := range added {
+		if !ma.Contains(hostRec.Addrs, a) {
+			addrs = append(addrs, a)
+		}
+	}
+	numAdded := len(addrs)
+	for _, a := range hostRec.Addrs {
+		if keep == nil || keep(a) {
+			addrs = append(addrs, a)
+		}
+	}
+	if numAdded == 0 && len(addrs) == len(hostRec.Addrs) {
+		return hostRecord
+	}
+	key := ids.Host.Peerstore().PrivKey(ids.Host.ID())
+	if key == nil {
+		log.Errorw("no private key to sign peer record")
+		return nil
+	}
+	rec := peer.PeerRecordFromAddrInfo(peer.AddrInfo{ID: ids.Host.ID(), Addrs: addrs})
+	env, err := record.Seal(rec, key)
+	if err != nil {
+		log.Errorw("failed to sign peer record", "err", err)
+		return nil
+	}
+	return env
+}
+
+func (ids *idService) writeChunkedIdentifyMsg(w io.Writer, mes *pb.Identify) error {
+	writer := newIdentifyMsgWriter(w)
 
 	if mes.SignedPeerRecord == nil || proto.Size(mes) <= legacyIDSize {
-		return writer.WriteMsg(mes)
+		if err := writer.WriteMsg(mes); err != nil {
+			return err
+		}
+		return writer.Flush()
 	}
 
 	sr := mes.SignedPeerRecord
@@ -647,7 +2203,10 @@ func (ids *idService) writeChunkedIdentifyMsg(s network.Stream, mes *pb.Identify
 		return err
 	}
 	// then write just the signed record
-	return writer.WriteMsg(&pb.Identify{SignedPeerRecord: sr})
+	if err := writer.WriteMsg(&pb.Identify{SignedPeerRecord: sr}); err != nil {
+		return err
+	}
+	return writer.Flush()
 }
 
 func (ids *idService) createBaseIdentifyResponse(conn network.Conn, snapshot *identifySnapshot) *pb.Identify {
@@ -657,7 +2216,23 @@ func (ids *idService) createBaseIdentifyResponse(conn network.Conn, snapshot *id
 	localAddr := conn.LocalMultiaddr()
 
 	// set protocols this node is currently handling
-	mes.Protocols = protocol.ConvertToStrings(snapshot.protocols)
+	advertised := ids.advertisedProtocols(conn, snapshot.protocols)
+	mes.Protocols = protocol.ConvertToStrings(advertised)
+	mes.ProtocolsHash = protocolsHash(advertised)
+	for _, pid := range advertised {
+		d, ok := ids.deprecations[pid]
+		if !ok {
+			continue
+		}
+		pd := &pb.Deprecation{Protocol: proto.String(string(pid))}
+		if d.Notice != "" {
+			pd.Notice = &d.Notice
+		}
+		if !d.RemovalAfter.IsZero() {
+			pd.RemovalAfter = proto.Int64(d.RemovalAfter.Unix())
+		}
+		mes.Deprecations = append(mes.Deprecations, pd)
+	}
 
 	// observed address so other side is informed of their
 	// "public" address, at least in relation to us.
@@ -667,13 +2242,23 @@ func (ids *idService) createBaseIdentifyResponse(conn network.Conn, snapshot *id
 	// peers that do not yet support signed addresses will need this.
 	// Note: LocalMultiaddr is sometimes 0.0.0.0
 	viaLoopback := manet.IsIPLoopback(localAddr) || manet.IsIPLoopback(remoteAddr)
+	publicPeer := ids.isPublicPeer(conn)
+	withhold := func(addr ma.Multiaddr) bool {
+		return (!viaLoopback && manet.IsIPLoopback(addr)) || (publicPeer && !manet.IsPublicAddr(addr))
+	}
 	mes.ListenAddrs = make([][]byte, 0, len(snapshot.addrs))
 	for _, addr := range snapshot.addrs {
-		if !viaLoopback && manet.IsIPLoopback(addr) {
+		if withhold(addr) {
 			continue
 		}
 		mes.ListenAddrs = append(mes.ListenAddrs, addr.Bytes())
 	}
+	for _, addr := range snapshot.reachable {
+		if withhold(addr) {
+			continue
+		}
+		mes.ReachableAddrs = append(mes.ReachableAddrs, addr.Bytes())
+	}
 	// set our public key
 	ownKey := ids.Host.Peerstore().PubKey(ids.Host.ID())
 
@@ -699,15 +2284,56 @@ func (ids *idService) createBaseIdentifyResponse(conn network.Conn, snapshot *id
 	mes.ProtocolVersion = &ids.ProtocolVersion
 	mes.AgentVersion = &ids.UserAgent
 
+	if ids.uptimeHint {
+		mes.Uptime = proto.Uint64(uint64(ids.clock.Since(ids.started) / time.Second))
+	}
+	if snapshot.dialback != nil && !withhold(snapshot.dialback) {
+		mes.DialbackAddr = snapshot.dialback.Bytes()
+	}
+
 	return mes
 }
 
-func (ids *idService) getSignedRecord(snapshot *identifySnapshot) []byte {
-	if ids.disableSignedPeerRecord || snapshot.record == nil {
+// advertisedProtocols returns the protocols advertised to the remote peer of conn,
+// see WithProtocolNamespaces.
+func (ids *idService) advertisedProtocols(conn network.Conn, protos []protocol.ID) []protocol.ID {
+	if ids.protocolNamespaces == nil {
+		return protos
+	}
+	namespaces := ids.protocolNamespaces(conn.RemotePeer())
+	if namespaces == nil {
+		return protos
+	}
+	advertised := make([]protocol.ID, 0, len(protos))
+	for _, proto := range protos {
+		for _, ns := range namespaces {
+			if strings.HasPrefix(string(proto), string(ns)) {
+				advertised = append(advertised, proto)
+				break
+			}
+		}
+	}
+	return advertised
+}
+
+// isPublicPeer returns true if private addresses are only advertised to local peers,
+// and the peer is connected to us via a public address.
+func (ids *idService) isPublicPeer(conn network.Conn) bool {
+	return ids.privateAddrsLocalOnly && manet.IsPublicAddr(conn.RemoteMultiaddr())
+}
+
+// getSignedRecord returns the signed peer record to send to a peer.
+// Public peers are sent a record that only contains our public addresses.
+func (ids *idService) getSignedRecord(snapshot *identifySnapshot, publicPeer bool) []byte {
+	rec := snapshot.record
+	if publicPeer {
+		rec = snapshot.publicRecord
+	}
+	if ids.disableSignedPeerRecord || rec == nil {
 		return nil
 	}
 
-	recBytes, err := snapshot.record.Marshal()
+	recBytes, err := rec.Marshal()
 	if err != nil {
 		log.Errorw("failed to marshal signed record", "err", err)
 		return nil
@@ -746,19 +2372,146 @@ func diff(a, b []protocol.ID) (added, removed []protocol.ID) {
 	return
 }
 
-func (ids *idService) consumeMessage(mes *pb.Identify, c network.Conn, isPush bool) {
+// diffAddrs takes two slices of multiaddrs (a and b) and computes which elements were added and removed in b
+func diffAddrs(a, b []ma.Multiaddr) (added, removed []ma.Multiaddr) {
+	for _, x := range b {
+		if !ma.Contains(a, x) {
+			added = append(added, x)
+		}
+	}
+	for _, x := range a {
+		if !ma.Contains(b, x) {
+			removed = append(removed, x)
+		}
+	}
+	return
+}
+
+// applySnapshot stores the snapshot we received from peer p on the connection
+// with ID source, and logs how it differs from the one we previously had.
+// observed is the address p observed us on, if it reported one.
+func (ids *idService) applySnapshot(p peer.ID, source string, opened time.Time, snapshot identifySnapshot, observed ma.Multiaddr) {
+	ids.peersMu.Lock()
+	ps, ok := ids.peers[p]
+	if !ok {
+		ps = &peerState{}
+		ids.peers[p] = ps
+	}
+	old := ps.snapshot
+	ps.snapshot = snapshot
+	ps.source = source
+	ps.opened = opened
+	ps.received = ids.clock.Now()
+	if observed != nil {
+		ps.observed = observed
+	}
+	ids.peersMu.Unlock()
+
+	if ok && len(old.addrs) > 0 && len(snapshot.addrs) == 0 && ids.peerUnreachableHook != nil {
+		ids.peerUnreachableHook(p)
+	}
+
+	protosAdded, protosRemoved := diff(old.protocols, snapshot.protocols)
+	addrsAdded, addrsRemoved := diffAddrs(old.addrs, snapshot.addrs)
+	if ok && (len(addrsAdded) > 0 || len(addrsRemoved) > 0) {
+		ids.emitters.evtPeerAddrsUpdated.Emit(event.EvtPeerAddrsUpdated{Peer: p, Added: addrsAdded, Removed: addrsRemoved})
+	}
+	if len(protosAdded) == 0 && len(protosRemoved) == 0 && len(addrsAdded) == 0 && len(addrsRemoved) == 0 {
+		return
+	}
+	log.Debugw("peer snapshot changed",
+		"peer", p,
+		"protocols_added", protosAdded,
+		"protocols_removed", protosRemoved,
+		"addrs_added", addrsAdded,
+		"addrs_removed", addrsRemoved,
+	)
+}
+
+// protocolsHash returns the SHA-256 hash of the sorted list of protocols.
+// Every protocol is prefixed with its length, so that the hash is unambiguous.
+func protocolsHash(protos []protocol.ID) []byte {
+	sorted := slices.Clone(protos)
+	slices.Sort(sorted)
+	h := sha256.New()
+	var b []byte
+	for _, p := range sorted {
+		b = protowire.AppendBytes(b[:0], []byte(p))
+		h.Write(b)
+	}
+	return h.Sum(nil)
+}
+
+// unchangedProtocols checks if hash, sent by peer p, matches the hash of the
+// protocols we last received from p. If so, it returns the protocols we
+// stored for p, and the message's protocol list doesn't need to be processed.
+func (ids *idService) unchangedProtocols(p peer.ID, hash []byte) ([]protocol.ID, []byte, bool) {
+	if len(hash) == 0 {
+		return nil, nil, false
+	}
+	ids.peersMu.Lock()
+	defer ids.peersMu.Unlock()
+	ps, ok := ids.peers[p]
+	if !ok || !bytes.Equal(ps.snapshot.protocolsHash, hash) {
+		return nil, nil, false
+	}
+	return ps.snapshot.protocols, ps.snapshot.protocolsHash, true
+}
+
+// PeerProtocolsHash returns the hash of the protocols that peer p advertised
+// in its latest Identify message: the SHA-256 hash of the sorted list of
+// protocols. Comparing hashes is a cheap way to detect changes.
+// It returns false if we're not connected to p, or haven't identified it yet.
+func (ids *idService) PeerProtocolsHash(p peer.ID) ([]byte, bool) {
+	ids.peersMu.Lock()
+	defer ids.peersMu.Unlock()
+	ps, ok := ids.peers[p]
+	if !ok {
+		return nil, false
+	}
+	return slices.Clone(ps.snapshot.protocolsHash), true
+}
+
+func (ids *idService) consumeMessage(mes *pb.Identify, c network.Conn, isPush bool) error {
 	p := c.RemotePeer()
 
-	supported, _ := ids.Host.Peerstore().GetProtocols(p)
-	mesProtocols := protocol.ConvertFromStrings(mes.Protocols)
-	added, removed := diff(supported, mesProtocols)
-	ids.Host.Peerstore().SetProtocols(p, mesProtocols...)
-	if isPush {
-		ids.emitters.evtPeerProtocolsUpdated.Emit(event.EvtPeerProtocolsUpdated{
-			Peer:    p,
-			Added:   added,
-			Removed: removed,
-		})
+	// add certified addresses for the peer, if they sent us a signed peer record
+	// otherwise use the unsigned addresses.
+	signedPeerRecord, err := signedPeerRecordFromMessage(mes)
+	if err != nil {
+		log.Errorf("error getting peer record from Identify message: %v", err)
+	}
+	// If the peer sends different snapshots on different connections,
+	// make sure the one with the newest record wins, independent of the order
+	// in which we receive them.
+	if current, ok := ids.newerSnapshot(p, signedPeerRecord, c.Stat().Opened); ok {
+		log.Debugw("ignoring addresses and protocols of outdated identify message", "peer", p, "conn", c.ID())
+		return ids.consumeOutdatedMessage(mes, c, isPush, current)
+	}
+
+	mesProtocols, protosHash, unchanged := ids.unchangedProtocols(p, mes.GetProtocolsHash())
+	if !unchanged {
+		supported, _ := ids.Host.Peerstore().GetProtocols(p)
+		mesProtocols = protocol.ConvertFromStrings(mes.Protocols)
+		protosHash = protocolsHash(mesProtocols)
+		if ids.isReservedProtocol != nil {
+			mesProtocols = slices.DeleteFunc(mesProtocols, func(proto protocol.ID) bool {
+				if ids.isReservedProtocol(proto) {
+					log.Debugw("ignoring reserved protocol advertised by peer", "peer", p, "protocol", proto)
+					return true
+				}
+				return false
+			})
+		}
+		added, removed := diff(supported, mesProtocols)
+		ids.Host.Peerstore().SetProtocols(p, mesProtocols...)
+		if isPush {
+			ids.emitters.evtPeerProtocolsUpdated.Emit(event.EvtPeerProtocolsUpdated{
+				Peer:    p,
+				Added:   added,
+				Removed: removed,
+			})
+		}
 	}
 
 	obsAddr, err := ma.NewMultiaddrBytes(mes.GetObservedAddr())
@@ -793,13 +2546,6 @@ func (ids *idService) consumeMessage(mes *pb.Identify, c network.Conn, isPush bo
 	// that picks random source ports, this can cause DHT nodes to collect
 	// many undialable addresses for other peers.
 
-	// add certified addresses for the peer, if they sent us a signed peer record
-	// otherwise use the unsigned addresses.
-	signedPeerRecord, err := signedPeerRecordFromMessage(mes)
-	if err != nil {
-		log.Errorf("error getting peer record from Identify message: %v", err)
-	}
-
 	// Extend the TTLs on the known (probably) good addresses.
 	// Taking the lock ensures that we don't concurrently process a disconnect.
 	ids.addrMu.Lock()
@@ -808,6 +2554,12 @@ func (ids *idService) consumeMessage(mes *pb.Identify, c network.Conn, isPush bo
 	case network.Limited, network.Connected:
 		ttl = peerstore.ConnectedAddrTTL
 	}
+	goodbye := isPush && mes.GetGoodbye()
+	if goodbye {
+		// The peer is shutting down. Don't keep its addresses around for
+		// longer than if we had already disconnected.
+		ttl = peerstore.RecentlyConnectedAddrTTL
+	}
 
 	// Downgrade connected and recently connected addrs to a temporary TTL.
 	for _, ttl := range []time.Duration{
@@ -825,13 +2577,16 @@ func (ids *idService) consumeMessage(mes *pb.Identify, c network.Conn, isPush bo
 			signedPeerRecord = nil
 		} else {
 			addrs = signedAddrs
+			if isPush {
+				ids.checkUnsignedAddrs(p, lmaddrs, signedAddrs)
+			}
 		}
 	} else {
 		addrs = lmaddrs
 	}
 	addrs = filterAddrs(addrs, c.RemoteMultiaddr())
-	if len(addrs) > connectedPeerMaxAddrs {
-		addrs = addrs[:connectedPeerMaxAddrs]
+	if len(addrs) > ids.maxPeerAddrs {
+		addrs = ids.truncatePeerAddrs(p, addrs)
 	}
 
 	ids.Host.Peerstore().AddAddrs(p, addrs, ttl)
@@ -841,6 +2596,60 @@ func (ids *idService) consumeMessage(mes *pb.Identify, c network.Conn, isPush bo
 	ids.addrMu.Unlock()
 
 	log.Debugf("%s received listen addrs for %s: %s", c.LocalPeer(), c.RemotePeer(), addrs)
+	if len(addrs) == 0 {
+		log.Debugw("peer didn't advertise any addresses", "peer", p)
+	}
+
+	// Only accept the reachability flag for addresses we actually use.
+	var reachable []ma.Multiaddr
+	for _, b := range mes.GetReachableAddrs() {
+		addr, err := ma.NewMultiaddrBytes(b)
+		if err != nil {
+			log.Debugw("failed to parse reachable addr", "peer", p, "error", err)
+			continue
+		}
+		if ma.Contains(addrs, addr) && !ma.Contains(reachable, addr) {
+			reachable = append(reachable, addr)
+		}
+	}
+
+	var dialback ma.Multiaddr
+	if b := mes.GetDialbackAddr(); b != nil {
+		dialback, err = ma.NewMultiaddrBytes(b)
+		if err != nil {
+			log.Debugw("failed to parse dialback addr", "peer", p, "error", err)
+		}
+	}
+
+	// Only accept deprecation notices for protocols the peer actually supports.
+	var deprecations map[protocol.ID]ProtocolDeprecation
+	for _, d := range mes.GetDeprecations() {
+		pid := protocol.ID(d.GetProtocol())
+		if !slices.Contains(mesProtocols, pid) {
+			continue
+		}
+		if deprecations == nil {
+			deprecations = make(map[protocol.ID]ProtocolDeprecation)
+		}
+		pd := ProtocolDeprecation{Notice: d.GetNotice()}
+		if d.RemovalAfter != nil {
+			pd.RemovalAfter = time.Unix(d.GetRemovalAfter(), 0)
+		}
+		deprecations[pid] = pd
+	}
+
+	ids.applySnapshot(p, c.ID(), c.Stat().Opened, identifySnapshot{
+		protocols: mesProtocols,
+		addrs:     addrs,
+		reachable: reachable,
+		record:    signedPeerRecord,
+		uptime:    mes.Uptime,
+		dialback:  dialback,
+
+		protocolsHash: protosHash,
+		deprecations:  deprecations,
+		version:       identifyVersion(mes),
+	}, obsAddr)
 
 	// get protocol versions
 	pv := mes.GetProtocolVersion()
@@ -852,6 +2661,43 @@ func (ids *idService) consumeMessage(mes *pb.Identify, c network.Conn, isPush bo
 	// get the key from the other side. we may not have it (no-auth transport)
 	ids.consumeReceivedPubKey(c, mes.PublicKey)
 
+	if ids.postIdentifyHook != nil {
+		keep := ids.postIdentifyHook(p, PeerSnapshot{
+			Protocols:        mesProtocols,
+			Addrs:            addrs,
+			ReachableAddrs:   reachable,
+			SignedPeerRecord: signedPeerRecord,
+			ProtocolVersion:  pv,
+			AgentVersion:     av,
+		})
+		if !keep {
+			log.Debugw("closing connection rejected by post-identify hook", "peer", p)
+			c.Close()
+			return errConnRejected
+		}
+	}
+
+	if ids.wal != nil {
+		walSnapshot := &pb.Identify{
+			Protocols:       protocol.ConvertToStrings(mesProtocols),
+			ListenAddrs:     make([][]byte, 0, len(addrs)),
+			ProtocolVersion: &pv,
+			AgentVersion:    &av,
+		}
+		for _, a := range addrs {
+			walSnapshot.ListenAddrs = append(walSnapshot.ListenAddrs, a.Bytes())
+		}
+		if signedPeerRecord != nil {
+			walSnapshot.SignedPeerRecord = mes.SignedPeerRecord
+		}
+		ids.appendToWAL(p, walSnapshot)
+	}
+
+	if goodbye {
+		log.Debugw("peer is shutting down", "peer", p)
+		ids.emitters.evtPeerGoodbye.Emit(event.EvtPeerGoodbye{Peer: p})
+	}
+
 	ids.emitters.evtPeerIdentificationCompleted.Emit(event.EvtPeerIdentificationCompleted{
 		Peer:             c.RemotePeer(),
 		Conn:             c,
@@ -862,7 +2708,134 @@ func (ids *idService) consumeMessage(mes *pb.Identify, c network.Conn, isPush bo
 		ProtocolVersion:  pv,
 		AgentVersion:     av,
 	})
+	return nil
+}
+
+// truncatePeerAddrs drops the addresses of peer p that exceed the maximum
+// number of addresses we accept, see WithMaxPeerAddrs.
+func (ids *idService) truncatePeerAddrs(p peer.ID, addrs []ma.Multiaddr) []ma.Multiaddr {
+	if ids.peerAddrsPriority != nil {
+		addrs = slices.Clone(addrs)
+		slices.SortStableFunc(addrs, ids.peerAddrsPriority)
+	}
+	log.Debugw("peer advertised too many addresses", "peer", p, "addrs", len(addrs), "max", ids.maxPeerAddrs)
+	if ids.peerAddrsTruncatedHook != nil {
+		ids.peerAddrsTruncatedHook(p, slices.Clone(addrs[ids.maxPeerAddrs:]))
+	}
+	return addrs[:ids.maxPeerAddrs:ids.maxPeerAddrs]
+}
+
+// checkUnsignedAddrs reports if peer p pushed unsigned addresses that are
+// missing from its signed peer record. We only use the signed addresses.
+// Addresses only contained in the record are expected: peers don't send all of
+// their addresses unsigned, e.g. loopback addresses are withheld from remote peers.
+func (ids *idService) checkUnsignedAddrs(p peer.ID, unsigned, signed []ma.Multiaddr) {
+	unsignedOnly, signedOnly := diffAddrs(signed, unsigned)
+	if len(unsignedOnly) == 0 {
+		return
+	}
+	log.Debugw("unsigned addresses don't match signed peer record", "peer", p, "unsigned_only", unsignedOnly, "signed_only", signedOnly)
+	if ids.addrsMismatchHook != nil {
+		ids.addrsMismatchHook(p, unsignedOnly, signedOnly)
+	}
+}
+
+// newerSnapshot returns the snapshot we have for peer p, if it takes precedence
+// over a snapshot containing the peer record rec, received now on a connection
+// opened at opened.
+func (ids *idService) newerSnapshot(p peer.ID, rec *record.Envelope, opened time.Time) (identifySnapshot, bool) {
+	if rec == nil {
+		return identifySnapshot{}, false
+	}
+	seq, ok := peerRecordSeq(rec)
+	if !ok {
+		return identifySnapshot{}, false
+	}
+	ids.peersMu.Lock()
+	defer ids.peersMu.Unlock()
+	ps, ok := ids.peers[p]
+	if !ok || !ps.supersedes(seq, ids.clock.Now(), opened) {
+		return identifySnapshot{}, false
+	}
+	return ps.snapshot, true
+}
+
+// consumeOutdatedMessage processes an identify message received on connection
+// c, which was superseded by the current snapshot we have for the peer.
+// The addresses and protocols in the message are ignored, but everything
+// specific to the connection is processed as usual.
+func (ids *idService) consumeOutdatedMessage(mes *pb.Identify, c network.Conn, isPush bool, current identifySnapshot) error {
+	p := c.RemotePeer()
+
+	obsAddr, err := ma.NewMultiaddrBytes(mes.GetObservedAddr())
+	if err != nil {
+		log.Debugf("error parsing received observed addr for %s: %s", c, err)
+		obsAddr = nil
+	}
+	if obsAddr != nil && !ids.disableObservedAddrManager {
+		ids.observedAddrMgr.Record(c, obsAddr)
+	}
+	if obsAddr != nil {
+		ids.peersMu.Lock()
+		if ps, ok := ids.peers[p]; ok {
+			ps.observed = obsAddr
+		}
+		ids.peersMu.Unlock()
+	}
+
+	pv := mes.GetProtocolVersion()
+	av := mes.GetAgentVersion()
+	ids.Host.Peerstore().Put(p, "ProtocolVersion", pv)
+	ids.Host.Peerstore().Put(p, "AgentVersion", av)
+
+	// get the key from the other side. we may not have it (no-auth transport)
+	ids.consumeReceivedPubKey(c, mes.PublicKey)
+
+	if ids.postIdentifyHook != nil {
+		keep := ids.postIdentifyHook(p, PeerSnapshot{
+			Protocols:        current.protocols,
+			Addrs:            current.addrs,
+			ReachableAddrs:   current.reachable,
+			SignedPeerRecord: current.record,
+			ProtocolVersion:  pv,
+			AgentVersion:     av,
+		})
+		if !keep {
+			log.Debugw("closing connection rejected by post-identify hook", "peer", p)
+			c.Close()
+			return errConnRejected
+		}
+	}
+
+	if isPush && mes.GetGoodbye() {
+		log.Debugw("peer is shutting down", "peer", p)
+		ids.emitters.evtPeerGoodbye.Emit(event.EvtPeerGoodbye{Peer: p})
+	}
+
+	ids.emitters.evtPeerIdentificationCompleted.Emit(event.EvtPeerIdentificationCompleted{
+		Peer:             p,
+		Conn:             c,
+		ListenAddrs:      current.addrs,
+		Protocols:        current.protocols,
+		SignedPeerRecord: current.record,
+		ObservedAddr:     obsAddr,
+		ProtocolVersion:  pv,
+		AgentVersion:     av,
+	})
+	return nil
+}
 
+// peerRecordSeq returns the sequence number of the peer record contained in env.
+func peerRecordSeq(env *record.Envelope) (uint64, bool) {
+	r, err := env.Record()
+	if err != nil {
+		return 0, false
+	}
+	rec, ok := r.(*peer.PeerRecord)
+	if !ok {
+		return 0, false
+	}
+	return rec.Seq, true
 }
 
 func (ids *idService) consumeSignedPeerRecord(p peer.ID, signedPeerRecord *record.Envelope) ([]ma.Multiaddr, error) {
@@ -1036,6 +3009,7 @@ func (nn *netNotifiee) Disconnected(_ network.Network, c network.Conn) {
 	// Stop tracking the connection.
 	ids.connsMu.Lock()
 	delete(ids.conns, c)
+	ids.notifyAckWithLock()
 	ids.connsMu.Unlock()
 
 	if !ids.disableObservedAddrManager {
@@ -1053,6 +3027,12 @@ func (nn *netNotifiee) Disconnected(_ network.Network, c network.Conn) {
 	case network.Connected, network.Limited:
 		return
 	}
+
+	ids.peersMu.Lock()
+	delete(ids.peers, c.RemotePeer())
+	delete(ids.pushes, c.RemotePeer())
+	ids.peersMu.Unlock()
+
 	// peerstore returns the elements in a random order as it uses a map to store the addresses
 	addrs := ids.Host.Peerstore().Addrs(c.RemotePeer())
 	n := len(addrs)
@@ -1,18 +1,32 @@
 package identify
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/benbjohnson/clock"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/core/record"
 	recordPb "github.com/libp2p/go-libp2p/core/record/pb"
 	blhost "github.com/libp2p/go-libp2p/p2p/host/blank"
 	swarmt "github.com/libp2p/go-libp2p/p2p/net/swarm/testing"
+	"github.com/libp2p/go-libp2p/p2p/protocol/identify/pb"
 	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/proto"
 
 	"github.com/stretchr/testify/assert"
@@ -114,7 +128,7 @@ func TestWrongSignedPeerRecord(t *testing.T) {
 	s, err := h2.NewStream(context.Background(), h1.ID(), IDPush)
 	require.NoError(t, err)
 
-	err = ids3.sendIdentifyResp(s, true)
+	err = ids3.sendIdentifyResp(s, true, false)
 	// This should fail because the peer record is signed by h3, not h2
 	require.NoError(t, err)
 	time.Sleep(time.Second)
@@ -206,3 +220,1496 @@ func TestIncomingAddrFilter(t *testing.T) {
 		})
 	}
 }
+
+func TestAdvertiseDNSAddr(t *testing.T) {
+	dnsAddr := ma.StringCast("/dnsaddr/example.com")
+
+	_, err := NewIDService(blhost.NewBlankHost(swarmt.GenSwarm(t)), WithDNSAddr(ma.StringCast("/dns4/example.com/tcp/1234")))
+	require.Error(t, err)
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h1.Close()
+	// blank hosts don't create signed peer records, so we need to do it ourselves
+	rec := peer.PeerRecordFromAddrInfo(peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()})
+	env, err := record.Seal(rec, h1.Peerstore().PrivKey(h1.ID()))
+	require.NoError(t, err)
+	cab, ok := peerstore.GetCertifiedAddrBook(h1.Peerstore())
+	require.True(t, ok)
+	_, err = cab.ConsumePeerRecord(env, peerstore.PermanentAddrTTL)
+	require.NoError(t, err)
+
+	ids1, err := NewIDService(h1, WithDNSAddr(dnsAddr))
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+
+	ids1.currentSnapshot.Lock()
+	snapshot := ids1.currentSnapshot.snapshot
+	ids1.currentSnapshot.Unlock()
+	require.Len(t, snapshot.addrs, len(h1.Addrs())+1)
+	require.True(t, snapshot.addrs[0].Equal(dnsAddr), "expected the dnsaddr to be advertised first")
+	require.NotNil(t, snapshot.record)
+	r, err := snapshot.record.Record()
+	require.NoError(t, err)
+	require.True(t, r.(*peer.PeerRecord).Addrs[0].Equal(dnsAddr), "expected the dnsaddr to be part of the signed record")
+
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h2.Close()
+	ids2, err := NewIDService(h2)
+	require.NoError(t, err)
+	defer ids2.Close()
+	ids2.Start()
+
+	require.NoError(t, h2.Connect(context.Background(), peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}))
+	ids2.IdentifyConn(h2.Network().ConnsToPeer(h1.ID())[0])
+	require.True(t, ma.Contains(h2.Peerstore().Addrs(h1.ID()), dnsAddr))
+}
+
+// connWithID is a network.Conn with an overridden ID, used to simulate an
+// additional connection to the same peer.
+// If opened is set, it overrides the time the connection was opened.
+type connWithID struct {
+	network.Conn
+	id     string
+	opened time.Time
+}
+
+func (c *connWithID) ID() string { return c.id }
+
+func (c *connWithID) Stat() network.ConnStats {
+	stat := c.Conn.Stat()
+	if !c.opened.IsZero() {
+		stat.Opened = c.opened
+	}
+	return stat
+}
+
+func TestIdentifySource(t *testing.T) {
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h1.Close()
+	defer h2.Close()
+
+	ids1, err := NewIDService(h1)
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+	ids2, err := NewIDService(h2)
+	require.NoError(t, err)
+	defer ids2.Close()
+	ids2.Start()
+
+	_, ok := ids1.IdentifySource(h2.ID())
+	require.False(t, ok)
+
+	require.NoError(t, h1.Connect(context.Background(), peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	conn := h1.Network().ConnsToPeer(h2.ID())[0]
+	ids1.IdentifyConn(conn)
+	source, ok := ids1.IdentifySource(h2.ID())
+	require.True(t, ok)
+	require.Equal(t, conn.ID(), source)
+
+	// a push received on a second connection
+	other := &connWithID{Conn: conn, id: conn.ID() + "-other"}
+	ids2.currentSnapshot.Lock()
+	snapshot := ids2.currentSnapshot.snapshot
+	ids2.currentSnapshot.Unlock()
+	mes := ids2.createBaseIdentifyResponse(conn, &snapshot)
+	require.NoError(t, ids1.consumeMessage(mes, other, true))
+	source, ok = ids1.IdentifySource(h2.ID())
+	require.True(t, ok)
+	require.Equal(t, other.ID(), source)
+
+	require.NoError(t, conn.Close())
+	require.Eventually(t, func() bool {
+		_, ok := ids1.IdentifySource(h2.ID())
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestAddrVerifier(t *testing.T) {
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h1.Close()
+	require.Greater(t, len(h1.Addrs()), 1)
+	rec := peer.PeerRecordFromAddrInfo(peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()})
+	env, err := record.Seal(rec, h1.Peerstore().PrivKey(h1.ID()))
+	require.NoError(t, err)
+	cab, ok := peerstore.GetCertifiedAddrBook(h1.Peerstore())
+	require.True(t, ok)
+	_, err = cab.ConsumePeerRecord(env, peerstore.PermanentAddrTTL)
+	require.NoError(t, err)
+
+	dead := h1.Addrs()[0]
+	var mx sync.Mutex
+	verified := make(map[string]int)
+	ids1, err := NewIDService(h1, WithAddrVerifier(func(a ma.Multiaddr) bool {
+		mx.Lock()
+		defer mx.Unlock()
+		verified[string(a.Bytes())]++
+		return !a.Equal(dead)
+	}))
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+
+	ids1.currentSnapshot.Lock()
+	snapshot := ids1.currentSnapshot.snapshot
+	ids1.currentSnapshot.Unlock()
+	require.Len(t, snapshot.addrs, len(h1.Addrs())-1)
+	require.False(t, ma.Contains(snapshot.addrs, dead))
+	require.NotNil(t, snapshot.record)
+	r, err := snapshot.record.Record()
+	require.NoError(t, err)
+	require.False(t, ma.Contains(r.(*peer.PeerRecord).Addrs, dead), "expected the address to be removed from the signed record")
+	require.Len(t, r.(*peer.PeerRecord).Addrs, len(h1.Addrs())-1)
+
+	// results are cached
+	ids1.updateSnapshot()
+	mx.Lock()
+	for _, a := range h1.Addrs() {
+		require.Equal(t, 1, verified[string(a.Bytes())])
+	}
+	mx.Unlock()
+
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h2.Close()
+	ids2, err := NewIDService(h2)
+	require.NoError(t, err)
+	defer ids2.Close()
+	ids2.Start()
+
+	require.NoError(t, h2.Connect(context.Background(), peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}))
+	ids2.IdentifyConn(h2.Network().ConnsToPeer(h1.ID())[0])
+	require.Eventually(t, func() bool {
+		addrs := h2.Peerstore().Addrs(h1.ID())
+		return len(addrs) > 0 && !ma.Contains(addrs, dead)
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestAddrFilter(t *testing.T) {
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h1.Close()
+	require.Greater(t, len(h1.Addrs()), 1)
+	rec := peer.PeerRecordFromAddrInfo(peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()})
+	env, err := record.Seal(rec, h1.Peerstore().PrivKey(h1.ID()))
+	require.NoError(t, err)
+	cab, ok := peerstore.GetCertifiedAddrBook(h1.Peerstore())
+	require.True(t, ok)
+	_, err = cab.ConsumePeerRecord(env, peerstore.PermanentAddrTTL)
+	require.NoError(t, err)
+
+	hidden := h1.Addrs()[0]
+	ids1, err := NewIDService(h1, WithAddrFilter(func(a ma.Multiaddr) bool { return !a.Equal(hidden) }))
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+
+	ids1.currentSnapshot.Lock()
+	snapshot := ids1.currentSnapshot.snapshot
+	ids1.currentSnapshot.Unlock()
+	require.Len(t, snapshot.addrs, len(h1.Addrs())-1)
+	require.False(t, ma.Contains(snapshot.addrs, hidden))
+	require.NotNil(t, snapshot.record)
+	r, err := snapshot.record.Record()
+	require.NoError(t, err)
+	require.False(t, ma.Contains(r.(*peer.PeerRecord).Addrs, hidden), "expected the address to be removed from the signed record")
+	require.Len(t, r.(*peer.PeerRecord).Addrs, len(h1.Addrs())-1)
+
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h2.Close()
+	ids2, err := NewIDService(h2)
+	require.NoError(t, err)
+	defer ids2.Close()
+	ids2.Start()
+
+	require.NoError(t, h2.Connect(context.Background(), peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}))
+	ids2.IdentifyConn(h2.Network().ConnsToPeer(h1.ID())[0])
+	require.Eventually(t, func() bool {
+		addrs := h2.Peerstore().Addrs(h1.ID())
+		return len(addrs) > 0 && !ma.Contains(addrs, hidden)
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestIdentifyRetries(t *testing.T) {
+	timeout := Timeout
+	Timeout = 200 * time.Millisecond
+	defer func() { Timeout = timeout }()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h1.Close()
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h2.Close()
+
+	ids1, err := NewIDService(h1, WithIdentifyRetries(2, 10*time.Millisecond))
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+	ids2, err := NewIDService(h2)
+	require.NoError(t, err)
+	defer ids2.Close()
+	ids2.Start()
+
+	// Don't respond to the first Identify request, but respond to the retry.
+	var requests atomic.Int32
+	h2.SetStreamHandler(ID, func(s network.Stream) {
+		if requests.Add(1) == 1 {
+			<-ids2.ctx.Done()
+			s.Reset()
+			return
+		}
+		ids2.handleIdentifyRequest(s)
+	})
+
+	require.NoError(t, h1.Connect(context.Background(), peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	conn := h1.Network().ConnsToPeer(h2.ID())[0]
+	select {
+	case <-ids1.IdentifyWait(conn):
+	case <-time.After(5 * time.Second):
+		t.Fatal("identify didn't complete")
+	}
+	require.Equal(t, int32(2), requests.Load())
+	protos, err := h1.Peerstore().GetProtocols(h2.ID())
+	require.NoError(t, err)
+	require.Contains(t, protos, protocol.ID(ID))
+}
+
+func TestIdentifyWaitTimeout(t *testing.T) {
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h1.Close()
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h2.Close()
+
+	ids1, err := NewIDService(h1)
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+	ids2, err := NewIDService(h2)
+	require.NoError(t, err)
+	defer ids2.Close()
+	ids2.Start()
+
+	// Only respond to the Identify request once we're told to.
+	respond := make(chan struct{})
+	h2.SetStreamHandler(ID, func(s network.Stream) {
+		<-respond
+		ids2.handleIdentifyRequest(s)
+	})
+
+	require.NoError(t, h1.Connect(context.Background(), peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	conn := h1.Network().ConnsToPeer(h2.ID())[0]
+	require.ErrorIs(t, ids1.IdentifyWaitTimeout(conn, 100*time.Millisecond), ErrIdentifyTimeout)
+	close(respond)
+	require.NoError(t, ids1.IdentifyWaitTimeout(conn, 5*time.Second))
+	protos, err := h1.Peerstore().GetProtocols(h2.ID())
+	require.NoError(t, err)
+	require.Contains(t, protos, protocol.ID(ID))
+}
+
+// addrsHost is a host that advertises additional addresses.
+type addrsHost struct {
+	host.Host
+	extra []ma.Multiaddr
+}
+
+func (h *addrsHost) Addrs() []ma.Multiaddr {
+	return append(h.Host.Addrs(), h.extra...)
+}
+
+func TestReachableAddrs(t *testing.T) {
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h1.Close()
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h2.Close()
+
+	var tcpAddr ma.Multiaddr
+	for _, a := range h1.Network().ListenAddresses() {
+		if _, err := a.ValueForProtocol(ma.P_TCP); err == nil {
+			tcpAddr = a
+		}
+	}
+	require.NotNil(t, tcpAddr)
+	observed := ma.StringCast("/ip4/2.2.2.2/tcp/2")
+	unconfirmed := ma.StringCast("/ip4/3.3.3.3/tcp/3")
+
+	// the extra addresses are not contained in the host's signed peer record
+	ids1, err := NewIDService(&addrsHost{Host: h1, extra: []ma.Multiaddr{observed, unconfirmed}}, DisableSignedPeerRecord())
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+	ids2, err := NewIDService(h2)
+	require.NoError(t, err)
+	defer ids2.Close()
+	ids2.Start()
+
+	// enough peers observe us on the observed address
+	for i := 1; i <= 4; i++ {
+		ids1.observedAddrMgr.Record(newConn(tcpAddr, ma.StringCast(fmt.Sprintf("/ip4/1.2.3.%d/tcp/1", i))), observed)
+	}
+	require.Eventually(t, func() bool { return ma.Contains(ids1.observedAddrMgr.Addrs(), observed) }, time.Second, 10*time.Millisecond)
+	ids1.updateSnapshot()
+
+	ids1.currentSnapshot.Lock()
+	snapshot := ids1.currentSnapshot.snapshot
+	ids1.currentSnapshot.Unlock()
+	require.True(t, ma.Contains(snapshot.addrs, unconfirmed))
+	require.Equal(t, []ma.Multiaddr{observed}, snapshot.reachable)
+
+	require.NoError(t, h2.Connect(context.Background(), peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}))
+	<-ids2.IdentifyWait(h2.Network().ConnsToPeer(h1.ID())[0])
+	require.True(t, ma.Contains(h2.Peerstore().Addrs(h1.ID()), unconfirmed))
+	require.Equal(t, []ma.Multiaddr{observed}, ids2.ReachableAddrs(h1.ID()))
+}
+
+// addrConn is a network.Conn with overridden local and remote addresses.
+type addrConn struct {
+	network.Conn
+	local, remote ma.Multiaddr
+}
+
+func (c *addrConn) LocalMultiaddr() ma.Multiaddr  { return c.local }
+func (c *addrConn) RemoteMultiaddr() ma.Multiaddr { return c.remote }
+
+func TestMaxPeerAddrs(t *testing.T) {
+	_, err := NewIDService(blhost.NewBlankHost(swarmt.GenSwarm(t)), WithMaxPeerAddrs(0, nil))
+	require.Error(t, err)
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h1.Close()
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h2.Close()
+
+	extra := make([]ma.Multiaddr, 10)
+	for i := range extra {
+		extra[i] = ma.StringCast(fmt.Sprintf("/ip4/1.2.3.4/tcp/%d", i+1))
+	}
+	// prefer the last 3 addresses
+	preferred := extra[7:]
+	rank := func(a ma.Multiaddr) int {
+		if ma.Contains(preferred, a) {
+			return 0
+		}
+		return 1
+	}
+	var mx sync.Mutex
+	var dropped []ma.Multiaddr
+	ids1, err := NewIDService(h1,
+		WithMaxPeerAddrs(len(preferred), func(a, b ma.Multiaddr) int { return rank(a) - rank(b) }),
+		WithPeerAddrsTruncatedHook(func(p peer.ID, addrs []ma.Multiaddr) {
+			require.Equal(t, h2.ID(), p)
+			mx.Lock()
+			dropped = addrs
+			mx.Unlock()
+		}),
+	)
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+	ids2, err := NewIDService(&addrsHost{Host: h2, extra: extra}, DisableSignedPeerRecord())
+	require.NoError(t, err)
+	defer ids2.Close()
+	ids2.Start()
+
+	require.NoError(t, h2.Connect(context.Background(), peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}))
+	require.Eventually(t, func() bool { return len(h1.Network().ConnsToPeer(h2.ID())) > 0 }, time.Second, 10*time.Millisecond)
+	ids1.IdentifyConn(h1.Network().ConnsToPeer(h2.ID())[0])
+	require.ElementsMatch(t, preferred, h1.Peerstore().Addrs(h2.ID()))
+	mx.Lock()
+	defer mx.Unlock()
+	require.Len(t, dropped, len(h2.Addrs())+len(extra)-len(preferred))
+	for _, a := range extra[:7] {
+		require.True(t, ma.Contains(dropped, a))
+	}
+}
+
+func TestLocalAddrsForLocalPeersOnly(t *testing.T) {
+	h := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h.Close()
+
+	privateAddr := ma.StringCast("/ip4/192.168.1.1/tcp/1234")
+	publicAddr := ma.StringCast("/ip4/1.2.3.4/tcp/1234")
+	ids, err := NewIDService(&addrsHost{Host: h, extra: []ma.Multiaddr{privateAddr, publicAddr}}, WithLocalAddrsForLocalPeersOnly())
+	require.NoError(t, err)
+	defer ids.Close()
+	ids.Start()
+	ids.updateSnapshot()
+
+	ids.currentSnapshot.Lock()
+	snapshot := ids.currentSnapshot.snapshot
+	ids.currentSnapshot.Unlock()
+
+	localAddr := ma.StringCast("/ip4/192.168.1.1/tcp/1234")
+	listenAddrs := func(remote ma.Multiaddr) []ma.Multiaddr {
+		mes := ids.createBaseIdentifyResponse(&addrConn{local: localAddr, remote: remote}, &snapshot)
+		addrs := make([]ma.Multiaddr, 0, len(mes.ListenAddrs))
+		for _, b := range mes.ListenAddrs {
+			a, err := ma.NewMultiaddrBytes(b)
+			require.NoError(t, err)
+			addrs = append(addrs, a)
+		}
+		return addrs
+	}
+	recordAddrs := func(publicPeer bool) []ma.Multiaddr {
+		_, rec, err := record.ConsumeEnvelope(ids.getSignedRecord(&snapshot, publicPeer), peer.PeerRecordEnvelopeDomain)
+		require.NoError(t, err)
+		return rec.(*peer.PeerRecord).Addrs
+	}
+
+	lanAddrs := listenAddrs(ma.StringCast("/ip4/192.168.1.2/tcp/1"))
+	require.True(t, ma.Contains(lanAddrs, privateAddr))
+	require.True(t, ma.Contains(lanAddrs, publicAddr))
+
+	wanAddrs := listenAddrs(ma.StringCast("/ip4/5.6.7.8/tcp/1"))
+	require.Equal(t, []ma.Multiaddr{publicAddr}, wanAddrs)
+
+	// the host's signed peer record contains its loopback listen addresses
+	require.NotEmpty(t, recordAddrs(false))
+	for _, a := range recordAddrs(true) {
+		require.True(t, manet.IsPublicAddr(a), "record contains private address %s", a)
+	}
+}
+
+func TestNewestRecordWins(t *testing.T) {
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h1.Close()
+	defer h2.Close()
+
+	ids1, err := NewIDService(h1)
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+	ids2, err := NewIDService(h2, DisableSignedPeerRecord())
+	require.NoError(t, err)
+	defer ids2.Close()
+	ids2.Start()
+
+	require.NoError(t, h1.Connect(context.Background(), peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	conn := h1.Network().ConnsToPeer(h2.ID())[0]
+	ids1.IdentifyConn(conn)
+
+	sub, err := h1.EventBus().Subscribe(new(event.EvtPeerIdentificationCompleted))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	newMessage := func(seq uint64, proto protocol.ID, addr, observed ma.Multiaddr, agentVersion string) *pb.Identify {
+		rec := peer.PeerRecordFromAddrInfo(peer.AddrInfo{ID: h2.ID(), Addrs: []ma.Multiaddr{addr}})
+		rec.Seq = seq
+		env, err := record.Seal(rec, h2.Peerstore().PrivKey(h2.ID()))
+		require.NoError(t, err)
+		b, err := env.Marshal()
+		require.NoError(t, err)
+		return &pb.Identify{
+			Protocols:        []string{string(proto)},
+			ListenAddrs:      [][]byte{addr.Bytes()},
+			SignedPeerRecord: b,
+			ObservedAddr:     observed.Bytes(),
+			AgentVersion:     &agentVersion,
+		}
+	}
+	newerAddr := ma.StringCast("/ip4/1.2.3.4/tcp/1")
+	newer := newMessage(20, "/newer", newerAddr, ma.StringCast("/ip4/5.6.7.8/tcp/1"), "newer")
+	older := newMessage(10, "/older", ma.StringCast("/ip4/1.2.3.4/tcp/2"), ma.StringCast("/ip4/5.6.7.8/tcp/2"), "older")
+
+	for i, order := range [][]*pb.Identify{{older, newer}, {newer, older}} {
+		conn1 := &connWithID{Conn: conn, id: fmt.Sprintf("%s-%d-1", conn.ID(), i)}
+		conn2 := &connWithID{Conn: conn, id: fmt.Sprintf("%s-%d-2", conn.ID(), i)}
+		require.NoError(t, ids1.consumeMessage(order[0], conn1, true))
+		require.NoError(t, ids1.consumeMessage(order[1], conn2, true))
+
+		// The outdated message is still processed for its connection.
+		var evts []event.EvtPeerIdentificationCompleted
+		for len(evts) < 2 {
+			select {
+			case e := <-sub.Out():
+				if evt := e.(event.EvtPeerIdentificationCompleted); evt.Conn == conn1 || evt.Conn == conn2 {
+					evts = append(evts, evt)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("expected an event for every message")
+			}
+		}
+		require.Equal(t, conn2, evts[1].Conn)
+		require.Equal(t, []protocol.ID{"/newer"}, evts[1].Protocols)
+		require.Equal(t, []ma.Multiaddr{newerAddr}, evts[1].ListenAddrs)
+		av, err := h1.Peerstore().Get(h2.ID(), "AgentVersion")
+		require.NoError(t, err)
+		require.Equal(t, order[1].GetAgentVersion(), av)
+		observed, ok := ids1.ObservedByPeer(h2.ID())
+		require.True(t, ok)
+		require.Equal(t, order[1].ObservedAddr, observed.Bytes())
+
+		ids1.peersMu.Lock()
+		snapshot := ids1.peers[h2.ID()].snapshot
+		ids1.peersMu.Unlock()
+		seq, ok := peerRecordSeq(snapshot.record)
+		require.True(t, ok)
+		require.Equal(t, uint64(20), seq)
+		require.Equal(t, []protocol.ID{"/newer"}, snapshot.protocols)
+		protos, err := h1.Peerstore().GetProtocols(h2.ID())
+		require.NoError(t, err)
+		require.Equal(t, []protocol.ID{"/newer"}, protos)
+	}
+}
+
+func TestSnapshotStableConnectionWins(t *testing.T) {
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h1.Close()
+	defer h2.Close()
+
+	ids1, err := NewIDService(h1)
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+
+	require.NoError(t, h1.Connect(context.Background(), peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	conn := h1.Network().ConnsToPeer(h2.ID())[0]
+
+	rec := peer.PeerRecordFromAddrInfo(peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()})
+	rec.Seq = 10
+	env, err := record.Seal(rec, h2.Peerstore().PrivKey(h2.ID()))
+	require.NoError(t, err)
+	b, err := env.Marshal()
+	require.NoError(t, err)
+	newMessage := func(proto protocol.ID) *pb.Identify {
+		return &pb.Identify{Protocols: []string{string(proto)}, SignedPeerRecord: b}
+	}
+	protocols := func() []protocol.ID {
+		ids1.peersMu.Lock()
+		defer ids1.peersMu.Unlock()
+		return ids1.peers[h2.ID()].snapshot.protocols
+	}
+
+	stable := &connWithID{Conn: conn, id: "stable", opened: time.Now().Add(-time.Hour)}
+	unstable := &connWithID{Conn: conn, id: "unstable", opened: time.Now()}
+
+	// Snapshots with the same sequence number received at about the same time:
+	// the one received on the connection that has been open for longer wins.
+	require.NoError(t, ids1.consumeMessage(newMessage("/stable"), stable, true))
+	require.NoError(t, ids1.consumeMessage(newMessage("/unstable"), unstable, true))
+	require.Equal(t, []protocol.ID{"/stable"}, protocols())
+	require.NoError(t, ids1.consumeMessage(newMessage("/stable2"), stable, true))
+	require.Equal(t, []protocol.ID{"/stable2"}, protocols())
+
+	// Otherwise, the most recent one wins.
+	ids1.peersMu.Lock()
+	ids1.peers[h2.ID()].received = time.Now().Add(-snapshotRecencyResolution)
+	ids1.peersMu.Unlock()
+	require.NoError(t, ids1.consumeMessage(newMessage("/unstable"), unstable, true))
+	require.Equal(t, []protocol.ID{"/unstable"}, protocols())
+}
+
+func TestWorkers(t *testing.T) {
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h1.Close()
+	defer h2.Close()
+
+	const workers = 2
+	var processed, running, maxRunning atomic.Int32
+	ids1, err := NewIDService(h1, WithWorkers(workers), WithPostIdentifyHook(func(peer.ID, PeerSnapshot) bool {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			m := maxRunning.Load()
+			if n <= m || maxRunning.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		processed.Add(1)
+		return true
+	}))
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+	ids2, err := NewIDService(h2)
+	require.NoError(t, err)
+	defer ids2.Close()
+	ids2.Start()
+
+	require.NoError(t, h2.Connect(context.Background(), peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}))
+	conn := h2.Network().ConnsToPeer(h1.ID())[0]
+	require.Eventually(t, func() bool { return processed.Load() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	// flood h1 with Identify Push messages
+	const pushes = 20
+	var wg sync.WaitGroup
+	for i := 0; i < pushes; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			str, err := newStreamAndNegotiate(context.Background(), conn, IDPush)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.NoError(t, ids2.sendIdentifyResp(str, true, false))
+		}()
+	}
+	wg.Wait()
+	require.Eventually(t, func() bool { return processed.Load() == pushes+1 }, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, int32(workers), maxRunning.Load())
+}
+
+func TestProbeIdentify(t *testing.T) {
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h1.Close()
+	defer h2.Close()
+
+	// ids1 is not started, so it doesn't track connections
+	ids1, err := NewIDService(h1)
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids2, err := NewIDService(h2, UserAgent("probed"))
+	require.NoError(t, err)
+	defer ids2.Close()
+	ids2.Start()
+
+	require.NoError(t, h1.Connect(context.Background(), peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	conn := h1.Network().ConnsToPeer(h2.ID())[0]
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	snapshot, err := ids1.ProbeIdentify(ctx, conn)
+	require.NoError(t, err)
+	require.Contains(t, snapshot.Protocols, protocol.ID(ID))
+	require.Equal(t, "probed", snapshot.AgentVersion)
+	require.NotNil(t, snapshot.SignedPeerRecord)
+	require.ElementsMatch(t, h2.Addrs(), snapshot.Addrs)
+
+	// no state was kept
+	ids1.connsMu.RLock()
+	require.Empty(t, ids1.conns)
+	ids1.connsMu.RUnlock()
+	ids1.peersMu.Lock()
+	require.Empty(t, ids1.peers)
+	ids1.peersMu.Unlock()
+	protos, err := h1.Peerstore().GetProtocols(h2.ID())
+	require.NoError(t, err)
+	require.Empty(t, protos)
+}
+
+func TestCatchUpPushStoppedOnClose(t *testing.T) {
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h1.Close()
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h2.Close()
+
+	ids1, err := NewIDService(h1)
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+	ids2, err := NewIDService(h2)
+	require.NoError(t, err)
+	defer ids2.Close()
+	ids2.Start()
+
+	// h2's Identify request never completes, so it needs a catch-up push
+	block := make(chan struct{})
+	defer close(block)
+	h1.SetStreamHandler(ID, func(s network.Stream) {
+		<-block
+		s.Reset()
+	})
+	require.NoError(t, h2.Connect(context.Background(), peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}))
+	require.Eventually(t, func() bool {
+		ids1.connsMu.RLock()
+		defer ids1.connsMu.RUnlock()
+		return len(ids1.conns) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	h1.SetStreamHandler("/new", func(network.Stream) {})
+	time.Sleep(200 * time.Millisecond)
+	require.NoError(t, ids1.Close())
+	require.NotNil(t, ids1.catchUpTimer)
+	// the timer was already stopped by Close
+	require.False(t, ids1.catchUpTimer.Stop())
+}
+
+func TestPushToPeerConnectingDuringFanOut(t *testing.T) {
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h1.Close()
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h2.Close()
+
+	ids1, err := NewIDService(h1)
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+
+	type received struct{ protos []protocol.ID }
+	receivedCh := make(chan received, 10)
+	ids2, err := NewIDService(h2, WithPostIdentifyHook(func(p peer.ID, snapshot PeerSnapshot) bool {
+		if p == h1.ID() {
+			receivedCh <- received{protos: snapshot.Protocols}
+		}
+		return true
+	}))
+	require.NoError(t, err)
+	defer ids2.Close()
+	ids2.Start()
+
+	// delay h2's Identify request, until the push to h2 would have happened
+	block := make(chan struct{})
+	h1.SetStreamHandler(ID, func(s network.Stream) {
+		<-block
+		ids1.handleIdentifyRequest(s)
+	})
+	require.NoError(t, h2.Connect(context.Background(), peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}))
+	require.Eventually(t, func() bool {
+		ids1.connsMu.RLock()
+		defer ids1.connsMu.RUnlock()
+		return len(ids1.conns) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// update the snapshot, triggering a push to all peers
+	h1.SetStreamHandler("/new", func(network.Stream) {})
+	require.Eventually(t, func() bool {
+		ids1.currentSnapshot.Lock()
+		defer ids1.currentSnapshot.Unlock()
+		return slices.Contains(ids1.currentSnapshot.snapshot.protocols, "/new")
+	}, time.Second, 10*time.Millisecond)
+	select {
+	case <-receivedCh:
+		t.Fatal("didn't expect a push")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// h2 receives the latest snapshot in the Identify response...
+	close(block)
+	select {
+	case r := <-receivedCh:
+		require.Contains(t, r.protos, protocol.ID("/new"))
+	case <-time.After(5 * time.Second):
+		t.Fatal("didn't receive the Identify response")
+	}
+	// ... and doesn't receive it again in a catch-up push
+	select {
+	case <-receivedCh:
+		t.Fatal("received the snapshot twice")
+	case <-time.After(identifyRequestGracePeriod + 500*time.Millisecond):
+	}
+}
+
+func TestPushAddrsMismatchHook(t *testing.T) {
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h1.Close()
+	defer h2.Close()
+
+	type mismatch struct {
+		p                        peer.ID
+		unsignedOnly, signedOnly []ma.Multiaddr
+	}
+	mismatches := make(chan mismatch, 1)
+	ids1, err := NewIDService(h1, WithPushAddrsMismatchHook(func(p peer.ID, unsignedOnly, signedOnly []ma.Multiaddr) {
+		mismatches <- mismatch{p: p, unsignedOnly: unsignedOnly, signedOnly: signedOnly}
+	}))
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+	ids2, err := NewIDService(h2, DisableSignedPeerRecord())
+	require.NoError(t, err)
+	defer ids2.Close()
+	ids2.Start()
+
+	require.NoError(t, h1.Connect(context.Background(), peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	conn := h1.Network().ConnsToPeer(h2.ID())[0]
+	ids1.IdentifyConn(conn)
+
+	signedAddr := ma.StringCast("/ip4/1.2.3.4/tcp/1")
+	smuggledAddr := ma.StringCast("/ip4/5.6.7.8/tcp/1")
+	newMessage := func(listenAddrs ...ma.Multiaddr) *pb.Identify {
+		rec := peer.PeerRecordFromAddrInfo(peer.AddrInfo{ID: h2.ID(), Addrs: []ma.Multiaddr{signedAddr}})
+		env, err := record.Seal(rec, h2.Peerstore().PrivKey(h2.ID()))
+		require.NoError(t, err)
+		b, err := env.Marshal()
+		require.NoError(t, err)
+		mes := &pb.Identify{SignedPeerRecord: b}
+		for _, addr := range listenAddrs {
+			mes.ListenAddrs = append(mes.ListenAddrs, addr.Bytes())
+		}
+		return mes
+	}
+
+	// matching addresses
+	require.NoError(t, ids1.consumeMessage(newMessage(signedAddr), conn, true))
+	select {
+	case m := <-mismatches:
+		t.Fatalf("unexpected mismatch: %v", m)
+	default:
+	}
+
+	require.NoError(t, ids1.consumeMessage(newMessage(smuggledAddr), conn, true))
+	select {
+	case m := <-mismatches:
+		require.Equal(t, h2.ID(), m.p)
+		require.Equal(t, []ma.Multiaddr{smuggledAddr}, m.unsignedOnly)
+		require.Equal(t, []ma.Multiaddr{signedAddr}, m.signedOnly)
+	default:
+		t.Fatal("expected the mismatch to be reported")
+	}
+	// the signed addresses win
+	require.Equal(t, []ma.Multiaddr{signedAddr}, h1.Peerstore().Addrs(h2.ID()))
+}
+
+type memObservedAddrStore struct {
+	mu        sync.Mutex
+	consensus []ObservedAddrConsensus
+}
+
+func (s *memObservedAddrStore) Load() ([]ObservedAddrConsensus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.consensus, nil
+}
+
+func (s *memObservedAddrStore) Save(c []ObservedAddrConsensus) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.consensus = c
+	return nil
+}
+
+func TestObservedAddrStore(t *testing.T) {
+	h := blhost.NewBlankHost(swarmt.GenSwarm(t, swarmt.OptDisableQUIC))
+	defer h.Close()
+	store := &memObservedAddrStore{}
+
+	ids, err := NewIDService(h, WithObservedAddrStore(store))
+	require.NoError(t, err)
+	ids.Start()
+
+	var local ma.Multiaddr
+	for _, a := range h.Network().ListenAddresses() {
+		if _, err := a.ValueForProtocol(ma.P_TCP); err == nil {
+			local = a
+		}
+	}
+	require.NotNil(t, local)
+	observed := ma.StringCast("/ip4/2.2.2.2/tcp/2")
+	for i := 1; i <= ActivationThresh; i++ {
+		c := newConn(local, ma.StringCast(fmt.Sprintf("/ip4/1.2.3.%d/tcp/1", i)))
+		ids.observedAddrMgr.Record(c, observed)
+	}
+	require.Eventually(t, func() bool {
+		return slices.ContainsFunc(ids.OwnObservedAddrs(), observed.Equal)
+	}, time.Second, 10*time.Millisecond)
+	require.False(t, ids.observedAddrMgr.IsProvisional(observed))
+	require.NoError(t, ids.Close())
+	require.Equal(t, []ObservedAddrConsensus{{Local: local, Observed: observed}}, store.consensus)
+
+	// restart the service
+	ids, err = NewIDService(h, WithObservedAddrStore(store))
+	require.NoError(t, err)
+	defer ids.Close()
+	ids.Start()
+	require.Equal(t, []ma.Multiaddr{observed}, ids.OwnObservedAddrs())
+	require.Equal(t, []ma.Multiaddr{observed}, ids.ObservedAddrsFor(local))
+	require.True(t, ids.observedAddrMgr.IsProvisional(observed))
+
+	// a fresh consensus replaces the provisional address
+	reobserved := ma.StringCast("/ip4/3.3.3.3/tcp/3")
+	for i := 1; i <= ActivationThresh; i++ {
+		c := newConn(local, ma.StringCast(fmt.Sprintf("/ip4/1.2.4.%d/tcp/1", i)))
+		ids.observedAddrMgr.Record(c, reobserved)
+	}
+	require.Eventually(t, func() bool {
+		addrs := ids.OwnObservedAddrs()
+		return len(addrs) == 1 && addrs[0].Equal(reobserved)
+	}, time.Second, 10*time.Millisecond)
+	require.False(t, ids.observedAddrMgr.IsProvisional(observed))
+}
+
+func TestPeerProtocolsHash(t *testing.T) {
+	require.Equal(t, protocolsHash([]protocol.ID{"/a", "/b"}), protocolsHash([]protocol.ID{"/b", "/a"}))
+	require.NotEqual(t, protocolsHash([]protocol.ID{"/a", "/b"}), protocolsHash([]protocol.ID{"/a", "/b", "/c"}))
+	// protocols are length-prefixed
+	require.NotEqual(t, protocolsHash([]protocol.ID{"/a", "/b"}), protocolsHash([]protocol.ID{"/a/b"}))
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h1.Close()
+	defer h2.Close()
+
+	ids1, err := NewIDService(h1)
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+	ids2, err := NewIDService(h2)
+	require.NoError(t, err)
+	defer ids2.Close()
+	ids2.Start()
+
+	_, ok := ids2.PeerProtocolsHash(h1.ID())
+	require.False(t, ok)
+
+	require.NoError(t, h2.Connect(context.Background(), peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}))
+	conn := h2.Network().ConnsToPeer(h1.ID())[0]
+	<-ids2.IdentifyWait(conn)
+	hash, ok := ids2.PeerProtocolsHash(h1.ID())
+	require.True(t, ok)
+	require.Equal(t, protocolsHash(h1.Mux().Protocols()), hash)
+
+	// a push with the same hash doesn't need to be processed again
+	ids1.currentSnapshot.Lock()
+	snapshot := ids1.currentSnapshot.snapshot
+	ids1.currentSnapshot.Unlock()
+	mes := ids1.createBaseIdentifyResponse(h1.Network().ConnsToPeer(h2.ID())[0], &snapshot)
+	require.Equal(t, hash, mes.ProtocolsHash)
+	mes.Protocols = []string{"/ignored"}
+	require.NoError(t, ids2.consumeMessage(mes, conn, true))
+	protos, err := h2.Peerstore().GetProtocols(h1.ID())
+	require.NoError(t, err)
+	require.NotContains(t, protos, protocol.ID("/ignored"))
+
+	// adding a protocol changes the hash
+	h1.SetStreamHandler("/foo", func(network.Stream) {})
+	require.Eventually(t, func() bool {
+		newHash, _ := ids2.PeerProtocolsHash(h1.ID())
+		return !bytes.Equal(hash, newHash)
+	}, 5*time.Second, 10*time.Millisecond)
+	newHash, _ := ids2.PeerProtocolsHash(h1.ID())
+	require.Equal(t, protocolsHash(h1.Mux().Protocols()), newHash)
+}
+
+func TestMaxPushConcurrency(t *testing.T) {
+	_, err := NewIDService(blhost.NewBlankHost(swarmt.GenSwarm(t)), WithMaxPushConcurrency(0))
+	require.Error(t, err)
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h1.Close()
+	const concurrency = 2
+	ids1, err := NewIDService(h1, WithMaxPushConcurrency(concurrency), WithPushAck())
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+
+	var received, running, maxRunning atomic.Int32
+	const peers = 6
+	for i := 0; i < peers; i++ {
+		h := blhost.NewBlankHost(swarmt.GenSwarm(t))
+		defer h.Close()
+		ids, err := NewIDService(h, WithPushAck())
+		require.NoError(t, err)
+		defer ids.Close()
+		ids.Start()
+		// delay the acknowledgement of every push, so that the pushes saturate the semaphore
+		h.SetStreamHandler(IDPushAck, func(s network.Stream) {
+			defer s.Close()
+			if _, err := io.ReadAll(s); err != nil {
+				s.Reset()
+				return
+			}
+			n := running.Add(1)
+			defer running.Add(-1)
+			for {
+				m := maxRunning.Load()
+				if n <= m || maxRunning.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+			received.Add(1)
+			s.Write([]byte{pushAck})
+		})
+		require.NoError(t, h.Connect(context.Background(), peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}))
+	}
+	// wait for the identify requests of all peers to be answered
+	require.Eventually(t, func() bool {
+		ids1.connsMu.RLock()
+		defer ids1.connsMu.RUnlock()
+		if len(ids1.conns) != peers {
+			return false
+		}
+		for _, e := range ids1.conns {
+			if e.Sequence == 0 {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	h1.SetStreamHandler("/foo", func(network.Stream) {})
+	require.Eventually(t, func() bool { return received.Load() == peers }, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, int32(concurrency), maxRunning.Load())
+}
+
+func TestPushDebounce(t *testing.T) {
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h1.Close()
+	defer h2.Close()
+
+	_, err := NewIDService(h1, WithPushDebounce(-time.Second))
+	require.Error(t, err)
+
+	const debounce = time.Second
+	clk := clock.NewMock()
+	clk.Set(time.Now())
+	ids1, err := NewIDService(h1, WithPushDebounce(debounce), WithClock(clk))
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+	var received atomic.Int32
+	ids2, err := NewIDService(h2, WithPostIdentifyHook(func(peer.ID, PeerSnapshot) bool {
+		received.Add(1)
+		return true
+	}))
+	require.NoError(t, err)
+	defer ids2.Close()
+	ids2.Start()
+
+	require.NoError(t, h2.Connect(context.Background(), peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}))
+	ids2.IdentifyConn(h2.Network().ConnsToPeer(h1.ID())[0])
+	require.Equal(t, int32(1), received.Load())
+
+	// a burst of changes results in a single push, carrying the latest snapshot
+	for i := 0; i < 5; i++ {
+		h1.SetStreamHandler(protocol.ID(fmt.Sprintf("/proto%d", i)), func(network.Stream) {})
+	}
+	require.Eventually(t, func() bool { return hasProtocol(ids1, "/proto4") }, 5*time.Second, 10*time.Millisecond)
+	// nothing is pushed until the debounce expires
+	clk.Add(debounce - time.Millisecond)
+	require.Equal(t, int32(1), received.Load())
+	require.Eventually(t, func() bool {
+		clk.Add(debounce)
+		return received.Load() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	s, ok := ids2.LastSnapshot(h1.ID())
+	require.True(t, ok)
+	require.Contains(t, s.Protocols, protocol.ID("/proto4"))
+	clk.Add(10 * debounce)
+	require.Equal(t, int32(2), received.Load())
+}
+
+// hasProtocol says if the current snapshot of ids contains proto.
+func hasProtocol(ids *idService, proto protocol.ID) bool {
+	ids.currentSnapshot.Lock()
+	defer ids.currentSnapshot.Unlock()
+	return slices.Contains(ids.currentSnapshot.snapshot.protocols, proto)
+}
+
+func TestPeerIdentifyVersion(t *testing.T) {
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h1.Close()
+	defer h2.Close()
+
+	ids1, err := NewIDService(h1)
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+
+	_, ok := ids1.PeerIdentifyVersion(h2.ID())
+	require.False(t, ok)
+
+	require.NoError(t, h1.Connect(context.Background(), peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	conn := h1.Network().ConnsToPeer(h2.ID())[0]
+
+	// a message sent by a peer running a newer version of the protocol
+	mes := &pb.Identify{
+		ProtocolVersion: proto.String("fake/2.0.0"),
+		AgentVersion:    proto.String("fake-agent"),
+		ListenAddrs:     [][]byte{ma.StringCast("/ip4/1.2.3.4/tcp/1").Bytes()},
+	}
+	var unknown []byte
+	unknown = protowire.AppendTag(unknown, 100, protowire.VarintType)
+	unknown = protowire.AppendVarint(unknown, 1)
+	unknown = protowire.AppendTag(unknown, 99, protowire.BytesType)
+	unknown = protowire.AppendBytes(unknown, []byte("flags"))
+	unknown = protowire.AppendTag(unknown, 100, protowire.VarintType)
+	unknown = protowire.AppendVarint(unknown, 2)
+	b, err := proto.Marshal(mes)
+	require.NoError(t, err)
+	received := &pb.Identify{}
+	require.NoError(t, proto.Unmarshal(append(b, unknown...), received))
+	require.NoError(t, ids1.consumeMessage(received, conn, false))
+
+	v, ok := ids1.PeerIdentifyVersion(h2.ID())
+	require.True(t, ok)
+	require.Equal(t, "fake/2.0.0", v.ProtocolVersion)
+	require.Equal(t, []int{2, 5, 6, 99, 100}, v.Fields)
+	require.Equal(t, []int{99, 100}, v.UnknownFields)
+}
+
+func TestPushFailureThreshold(t *testing.T) {
+	_, err := NewIDService(blhost.NewBlankHost(swarmt.GenSwarm(t)), WithPushFailureThreshold(0))
+	require.Error(t, err)
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h1.Close()
+	defer h2.Close()
+
+	ids1, err := NewIDService(h1, WithPushFailureThreshold(2), WithPushDebounce(0), WithPushAck())
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+	ids2, err := NewIDService(h2, WithPushAck())
+	require.NoError(t, err)
+	defer ids2.Close()
+	ids2.Start()
+
+	sub, err := h1.EventBus().Subscribe([]interface{}{
+		new(event.EvtIdentifyPushFailed),
+		new(event.EvtIdentifyPushSent),
+		new(event.EvtPeerIdentifyPushFailed),
+	})
+	require.NoError(t, err)
+	defer sub.Close()
+
+	require.NoError(t, h2.Connect(context.Background(), peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}))
+	ids2.IdentifyConn(h2.Network().ConnsToPeer(h1.ID())[0])
+	require.Eventually(t, func() bool {
+		ids1.connsMu.RLock()
+		defer ids1.connsMu.RUnlock()
+		for _, e := range ids1.conns {
+			return e.Sequence != 0
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// push triggers a push and returns the events emitted for it
+	var i int
+	push := func() []interface{} {
+		i++
+		h1.SetStreamHandler(protocol.ID(fmt.Sprintf("/proto%d", i)), func(network.Stream) {})
+		var evts []interface{}
+		for {
+			select {
+			case e := <-sub.Out():
+				evts = append(evts, e)
+				if _, ok := e.(event.EvtPeerIdentifyPushFailed); ok {
+					return evts
+				}
+				if _, ok := e.(event.EvtIdentifyPushSent); ok {
+					return evts
+				}
+				if _, ok := e.(event.EvtIdentifyPushFailed); ok {
+					// the aggregated event is emitted right after the per-push event, if at all
+					select {
+					case e := <-sub.Out():
+						return append(evts, e)
+					case <-time.After(200 * time.Millisecond):
+						return evts
+					}
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timeout waiting for events of push %d, got %v", i, evts)
+			}
+		}
+	}
+
+	// make pushes fail by resetting the stream instead of acknowledging them
+	reject := func(s network.Stream) {
+		io.ReadAll(s)
+		s.Reset()
+	}
+	h2.SetStreamHandler(IDPushAck, reject)
+	require.Len(t, push(), 1)
+	evts := push()
+	require.Len(t, evts, 2)
+	evt := evts[1].(event.EvtPeerIdentifyPushFailed)
+	require.Equal(t, h2.ID(), evt.Peer)
+	require.Equal(t, 2, evt.Attempts)
+	require.Error(t, evt.LastErr)
+	evts = push()
+	require.Len(t, evts, 2)
+	require.Equal(t, 3, evts[1].(event.EvtPeerIdentifyPushFailed).Attempts)
+
+	// a successful push resets the count
+	h2.SetStreamHandler(IDPushAck, ids2.handlePush)
+	evts = push()
+	require.Len(t, evts, 1)
+	require.IsType(t, event.EvtIdentifyPushSent{}, evts[0])
+	h2.SetStreamHandler(IDPushAck, reject)
+	require.Len(t, push(), 1)
+}
+
+func TestBootstrapGate(t *testing.T) {
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h1.Close()
+	// With a push debounce, pushes are only sent when we advance the clock.
+	const debounce = time.Second
+	clk := clock.NewMock()
+	clk.Set(time.Now())
+	ids1, err := NewIDService(h1, WithBootstrapGate(), WithPushDebounce(debounce), WithClock(clk))
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+
+	const peers = 2
+	var received [peers]atomic.Int32
+	services := make([]*idService, 0, peers)
+	for i := 0; i < peers; i++ {
+		h := blhost.NewBlankHost(swarmt.GenSwarm(t))
+		defer h.Close()
+		ids, err := NewIDService(h, WithPostIdentifyHook(func(peer.ID, PeerSnapshot) bool {
+			received[i].Add(1)
+			return true
+		}))
+		require.NoError(t, err)
+		defer ids.Close()
+		ids.Start()
+		services = append(services, ids)
+
+		require.NoError(t, h.Connect(context.Background(), peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}))
+		ids.IdentifyConn(h.Network().ConnsToPeer(h1.ID())[0])
+		require.Equal(t, int32(1), received[i].Load())
+	}
+	// wait for the identify requests of all peers to be answered
+	require.Eventually(t, func() bool {
+		ids1.connsMu.RLock()
+		defer ids1.connsMu.RUnlock()
+		if len(ids1.conns) != peers {
+			return false
+		}
+		for _, e := range ids1.conns {
+			if e.Sequence == 0 {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// changes made while bootstrapping are not pushed
+	for i := 0; i < 3; i++ {
+		h1.SetStreamHandler(protocol.ID(fmt.Sprintf("/proto%d", i)), func(network.Stream) {})
+		require.Eventually(t, func() bool { return hasProtocol(ids1, protocol.ID(fmt.Sprintf("/proto%d", i))) }, 5*time.Second, 10*time.Millisecond)
+		clk.Add(debounce)
+	}
+	for i := range received {
+		require.Equal(t, int32(1), received[i].Load())
+	}
+
+	ids1.MarkReady()
+	ids1.MarkReady() // calling it multiple times is fine
+	for i, ids := range services {
+		require.Eventually(t, func() bool {
+			clk.Add(debounce)
+			return received[i].Load() == 2
+		}, 5*time.Second, 10*time.Millisecond)
+		s, ok := ids.LastSnapshot(h1.ID())
+		require.True(t, ok)
+		require.Contains(t, s.Protocols, protocol.ID("/proto2"))
+	}
+	clk.Add(10 * debounce)
+	for i := range received {
+		require.Equal(t, int32(2), received[i].Load())
+	}
+}
+
+func TestDeltaPush(t *testing.T) {
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h1.Close()
+	ids1, err := NewIDService(h1, WithDeltaPush())
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+
+	// h2 supports deltas, h3 doesn't
+	var fullMessages [2]atomic.Int32
+	hosts := make([]host.Host, 0, 2)
+	for i, opts := range [][]Option{{WithDeltaPush()}, nil} {
+		h := blhost.NewBlankHost(swarmt.GenSwarm(t))
+		defer h.Close()
+		ids, err := NewIDService(h, append(opts, WithPostIdentifyHook(func(peer.ID, PeerSnapshot) bool {
+			fullMessages[i].Add(1)
+			return true
+		}))...)
+		require.NoError(t, err)
+		defer ids.Close()
+		ids.Start()
+		hosts = append(hosts, h)
+
+		require.NoError(t, h.Connect(context.Background(), peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}))
+		ids.IdentifyConn(h.Network().ConnsToPeer(h1.ID())[0])
+		ids1.IdentifyConn(h1.Network().ConnsToPeer(h.ID())[0])
+	}
+	h2, h3 := hosts[0], hosts[1]
+	// wait for the identify requests of all peers to be answered
+	require.Eventually(t, func() bool {
+		ids1.connsMu.RLock()
+		defer ids1.connsMu.RUnlock()
+		for _, e := range ids1.conns {
+			if e.Sent == nil {
+				return false
+			}
+		}
+		return len(ids1.conns) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	ids1.connsMu.RLock()
+	require.True(t, ids1.conns[h1.Network().ConnsToPeer(h2.ID())[0]].DeltaSupport)
+	require.False(t, ids1.conns[h1.Network().ConnsToPeer(h3.ID())[0]].DeltaSupport)
+	ids1.connsMu.RUnlock()
+
+	sub, err := h2.EventBus().Subscribe(new(event.EvtPeerProtocolsUpdated))
+	require.NoError(t, err)
+	defer sub.Close()
+	nextEvent := func() event.EvtPeerProtocolsUpdated {
+		select {
+		case e := <-sub.Out():
+			return e.(event.EvtPeerProtocolsUpdated)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for protocols updated event")
+			return event.EvtPeerProtocolsUpdated{}
+		}
+	}
+
+	// protocol changes are sent as deltas to h2, and as full pushes to h3
+	h1.SetStreamHandler("/foo", func(network.Stream) {})
+	evt := nextEvent()
+	require.Equal(t, h1.ID(), evt.Peer)
+	require.Equal(t, []protocol.ID{"/foo"}, evt.Added)
+	require.Empty(t, evt.Removed)
+	protos, err := h2.Peerstore().GetProtocols(h1.ID())
+	require.NoError(t, err)
+	require.Contains(t, protos, protocol.ID("/foo"))
+	require.Contains(t, protos, protocol.ID(IDDelta))
+	require.Eventually(t, func() bool { return fullMessages[1].Load() == 2 }, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, int32(1), fullMessages[0].Load())
+
+	h1.RemoveStreamHandler("/foo")
+	evt = nextEvent()
+	require.Empty(t, evt.Added)
+	require.Equal(t, []protocol.ID{"/foo"}, evt.Removed)
+	protos, err = h2.Peerstore().GetProtocols(h1.ID())
+	require.NoError(t, err)
+	require.NotContains(t, protos, protocol.ID("/foo"))
+	require.Equal(t, int32(1), fullMessages[0].Load())
+
+	// other changes are sent as full pushes
+	ids1.SetDialbackHint(h1.Addrs()[0])
+	require.Eventually(t, func() bool { return fullMessages[0].Load() == 2 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestPushVersionNegotiation(t *testing.T) {
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h1.Close()
+	ids1, err := NewIDService(h1, WithPushAck())
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+
+	// h2 supports push acknowledgements, h3 doesn't
+	hosts := make([]host.Host, 0, 2)
+	for _, opts := range [][]Option{{WithPushAck()}, nil} {
+		h := blhost.NewBlankHost(swarmt.GenSwarm(t))
+		defer h.Close()
+		ids, err := NewIDService(h, opts...)
+		require.NoError(t, err)
+		defer ids.Close()
+		ids.Start()
+		hosts = append(hosts, h)
+
+		require.NoError(t, h.Connect(context.Background(), peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}))
+		ids.IdentifyConn(h.Network().ConnsToPeer(h1.ID())[0])
+		ids1.IdentifyConn(h1.Network().ConnsToPeer(h.ID())[0])
+		// Forget which push versions the peer supports, so that they are negotiated.
+		require.NoError(t, h1.Peerstore().RemoveProtocols(h.ID(), IDPush, IDPushAck))
+	}
+	h2, h3 := hosts[0], hosts[1]
+
+	h1.SetStreamHandler("/foo", func(network.Stream) {})
+	for _, h := range hosts {
+		require.Eventually(t, func() bool {
+			protos, err := h.Peerstore().SupportsProtocols(h1.ID(), "/foo")
+			return err == nil && len(protos) > 0
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+	require.Eventually(t, func() bool {
+		ids1.connsMu.RLock()
+		defer ids1.connsMu.RUnlock()
+		return ids1.conns[h1.Network().ConnsToPeer(h2.ID())[0]].PushVersion != "" &&
+			ids1.conns[h1.Network().ConnsToPeer(h3.ID())[0]].PushVersion != ""
+	}, 5*time.Second, 10*time.Millisecond)
+	ids1.connsMu.RLock()
+	defer ids1.connsMu.RUnlock()
+	e2 := ids1.conns[h1.Network().ConnsToPeer(h2.ID())[0]]
+	require.Equal(t, protocol.ID(IDPushAck), e2.PushVersion)
+	require.True(t, e2.PushAckSupport)
+	e3 := ids1.conns[h1.Network().ConnsToPeer(h3.ID())[0]]
+	require.Equal(t, protocol.ID(IDPush), e3.PushVersion)
+	require.False(t, e3.PushAckSupport)
+}
+
+func TestRefreshPeer(t *testing.T) {
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h1.Close()
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h2.Close()
+	ids1, err := NewIDService(h1)
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+	ids2, err := NewIDService(h2)
+	require.NoError(t, err)
+	defer ids2.Close()
+	ids2.Start()
+
+	require.ErrorIs(t, ids1.RefreshPeer(context.Background(), h2.ID()), network.ErrNoConn)
+
+	require.NoError(t, h1.Connect(context.Background(), peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	ids1.IdentifyConn(h1.Network().ConnsToPeer(h2.ID())[0])
+
+	// Don't accept pushes, so that h1 only learns about /foo by refreshing.
+	h1.RemoveStreamHandler(IDPush)
+	h2.SetStreamHandler("/foo", func(network.Stream) {})
+	time.Sleep(100 * time.Millisecond)
+	protos, err := h1.Peerstore().SupportsProtocols(h2.ID(), "/foo")
+	require.NoError(t, err)
+	require.Empty(t, protos)
+
+	require.NoError(t, ids1.RefreshPeer(context.Background(), h2.ID()))
+	protos, err = h1.Peerstore().SupportsProtocols(h2.ID(), "/foo")
+	require.NoError(t, err)
+	require.Equal(t, []protocol.ID{"/foo"}, protos)
+	ids1.peersMu.Lock()
+	require.Contains(t, ids1.peers[h2.ID()].snapshot.protocols, protocol.ID("/foo"))
+	ids1.peersMu.Unlock()
+
+	// connections that fail are skipped
+	h2.SetStreamHandler("/bar", func(network.Stream) {})
+	ids3, err := NewIDService(&brokenConnHost{Host: h1})
+	require.NoError(t, err)
+	defer ids3.Close()
+	require.NoError(t, ids3.RefreshPeer(context.Background(), h2.ID()))
+	protos, err = h1.Peerstore().SupportsProtocols(h2.ID(), "/bar")
+	require.NoError(t, err)
+	require.Equal(t, []protocol.ID{"/bar"}, protos)
+
+	h2.RemoveStreamHandler(ID)
+	require.ErrorIs(t, ids1.RefreshPeer(context.Background(), h2.ID()), ErrIdentifyNotSupported)
+}
+
+// brokenConnHost is a host that reports a broken connection ahead of the
+// actual connections to a peer.
+type brokenConnHost struct {
+	host.Host
+}
+
+func (h *brokenConnHost) Network() network.Network {
+	return &brokenConnNetwork{Network: h.Host.Network()}
+}
+
+type brokenConnNetwork struct {
+	network.Network
+}
+
+func (n *brokenConnNetwork) ConnsToPeer(p peer.ID) []network.Conn {
+	conns := n.Network.ConnsToPeer(p)
+	if len(conns) == 0 {
+		return nil
+	}
+	return append([]network.Conn{&brokenConn{Conn: conns[0]}}, conns...)
+}
+
+// brokenConn is a network.Conn that fails to open streams.
+type brokenConn struct {
+	network.Conn
+}
+
+func (c *brokenConn) NewStream(context.Context) (network.Stream, error) {
+	return nil, errors.New("broken connection")
+}
@@ -2,11 +2,15 @@ package identify_test
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -34,6 +38,8 @@ import (
 	"github.com/libp2p/go-libp2p-testing/race"
 	"github.com/libp2p/go-msgio/pbio"
 	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	msmux "github.com/multiformats/go-multistream"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -983,3 +989,1289 @@ func waitForDisconnectNotification(swarm *swarm.Swarm) <-chan struct{} {
 
 	return done
 }
+
+func TestPostIdentifyHook(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h2.Close()
+	defer h1.Close()
+
+	hookCalled := make(chan identify.PeerSnapshot, 1)
+	ids1, err := identify.NewIDService(h1, identify.WithPostIdentifyHook(func(p peer.ID, snapshot identify.PeerSnapshot) bool {
+		assert.Equal(t, h2.ID(), p)
+		hookCalled <- snapshot
+		return !strings.HasPrefix(snapshot.AgentVersion, "incompatible/")
+	}))
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+
+	ids2, err := identify.NewIDService(h2, identify.UserAgent("incompatible/1.0"))
+	require.NoError(t, err)
+	defer ids2.Close()
+	ids2.Start()
+
+	sub, err := h1.EventBus().Subscribe(new(event.EvtPeerIdentificationFailed))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	ids1.IdentifyConn(h1.Network().ConnsToPeer(h2.ID())[0])
+
+	select {
+	case snapshot := <-hookCalled:
+		require.Equal(t, "incompatible/1.0", snapshot.AgentVersion)
+		require.Contains(t, snapshot.Protocols, protocol.ID(identify.ID))
+	case <-time.After(time.Second):
+		t.Fatal("expected the post-identify hook to be called")
+	}
+	require.Eventually(t, func() bool {
+		return h1.Network().Connectedness(h2.ID()) != network.Connected
+	}, 5*time.Second, 10*time.Millisecond)
+
+	select {
+	case e := <-sub.Out():
+		require.Equal(t, h2.ID(), e.(event.EvtPeerIdentificationFailed).Peer)
+	case <-time.After(time.Second):
+		t.Fatal("expected an EvtPeerIdentificationFailed event")
+	}
+}
+
+func TestReservedProtocolFilter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h2.Close()
+	defer h1.Close()
+
+	ids1, err := identify.NewIDService(h1, identify.WithReservedProtocolFilter(func(p protocol.ID) bool {
+		return strings.HasPrefix(string(p), "/internal/")
+	}))
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+
+	h2.SetStreamHandler("/internal/admin", func(network.Stream) {})
+	h2.SetStreamHandler("/public", func(network.Stream) {})
+	ids2, err := identify.NewIDService(h2)
+	require.NoError(t, err)
+	defer ids2.Close()
+	ids2.Start()
+
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	ids1.IdentifyConn(h1.Network().ConnsToPeer(h2.ID())[0])
+
+	protos, err := h1.Peerstore().GetProtocols(h2.ID())
+	require.NoError(t, err)
+	require.Contains(t, protos, protocol.ID("/public"))
+	require.NotContains(t, protos, protocol.ID("/internal/admin"))
+}
+
+func TestGoodbyeOnClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h2.Close()
+	defer h1.Close()
+
+	ids1, err := identify.NewIDService(h1, identify.WithGoodbyeOnClose())
+	require.NoError(t, err)
+	ids1.Start()
+
+	ids2, err := identify.NewIDService(h2)
+	require.NoError(t, err)
+	defer ids2.Close()
+	ids2.Start()
+
+	sub, err := h2.EventBus().Subscribe(new(event.EvtPeerGoodbye))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	conn := h1.Network().ConnsToPeer(h2.ID())[0]
+	ids1.IdentifyConn(conn)
+	// wait until h2 has identified h1, so it knows h1's addresses
+	ids2.IdentifyConn(h2.Network().ConnsToPeer(h1.ID())[0])
+	require.NotEmpty(t, h2.Peerstore().Addrs(h1.ID()))
+
+	require.NoError(t, ids1.Close())
+	select {
+	case e := <-sub.Out():
+		require.Equal(t, h1.ID(), e.(event.EvtPeerGoodbye).Peer)
+	case <-time.After(time.Second):
+		t.Fatal("expected an EvtPeerGoodbye event")
+	}
+	require.Equal(t, network.Connected, h2.Network().Connectedness(h1.ID()))
+}
+
+type walEntry struct {
+	peer     peer.ID
+	snapshot []byte
+}
+
+type memWAL struct {
+	mx      sync.Mutex
+	entries []walEntry
+}
+
+func (w *memWAL) Append(p peer.ID, snapshot []byte) error {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	w.entries = append(w.entries, walEntry{peer: p, snapshot: snapshot})
+	return nil
+}
+
+func (w *memWAL) Entries() []walEntry {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	return slices.Clone(w.entries)
+}
+
+func TestWAL(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h2.Close()
+	defer h1.Close()
+	h2.SetStreamHandler("/foo", func(s network.Stream) { s.Reset() })
+
+	wal := &memWAL{}
+	ids1, err := identify.NewIDService(h1, identify.WithWAL(wal))
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+	ids2, err := identify.NewIDService(h2, identify.UserAgent("test/1.0"))
+	require.NoError(t, err)
+	defer ids2.Close()
+	ids2.Start()
+
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	ids1.IdentifyConn(h1.Network().ConnsToPeer(h2.ID())[0])
+	require.Eventually(t, func() bool { return len(wal.Entries()) > 0 }, time.Second, 10*time.Millisecond)
+	entry := wal.Entries()[0]
+	require.Equal(t, h2.ID(), entry.peer)
+
+	// replay the WAL into a fresh identify service
+	h3 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h3.Close()
+	ids3, err := identify.NewIDService(h3)
+	require.NoError(t, err)
+	defer ids3.Close()
+	for _, e := range wal.Entries() {
+		require.NoError(t, ids3.ImportSnapshot(e.peer, e.snapshot))
+	}
+	require.ElementsMatch(t, h2.Addrs(), h3.Peerstore().Addrs(h2.ID()))
+	protos, err := h3.Peerstore().GetProtocols(h2.ID())
+	require.NoError(t, err)
+	require.Contains(t, protos, protocol.ID("/foo"))
+	av, err := h3.Peerstore().Get(h2.ID(), "AgentVersion")
+	require.NoError(t, err)
+	require.Equal(t, "test/1.0", av)
+
+	// snapshots for another peer are rejected, as the signed peer record doesn't match
+	require.Error(t, ids3.ImportSnapshot(h1.ID(), entry.snapshot))
+}
+
+func TestPeerHasAddrs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	// h3 doesn't listen, so it has no addresses
+	h3 := blhost.NewBlankHost(swarmt.GenSwarm(t, swarmt.OptDialOnly))
+	defer h3.Close()
+	defer h2.Close()
+	defer h1.Close()
+	require.Empty(t, h3.Addrs())
+
+	ids1, err := identify.NewIDService(h1)
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+	for _, h := range []host.Host{h2, h3} {
+		ids, err := identify.NewIDService(h)
+		require.NoError(t, err)
+		defer ids.Close()
+		ids.Start()
+	}
+
+	require.False(t, ids1.PeerHasAddrs(h2.ID()))
+
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	ids1.IdentifyConn(h1.Network().ConnsToPeer(h2.ID())[0])
+	require.True(t, ids1.PeerHasAddrs(h2.ID()))
+
+	require.NoError(t, h3.Connect(ctx, peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}))
+	require.Eventually(t, func() bool { return len(h1.Network().ConnsToPeer(h3.ID())) > 0 }, time.Second, 10*time.Millisecond)
+	ids1.IdentifyConn(h1.Network().ConnsToPeer(h3.ID())[0])
+	_, identified := ids1.IdentifySource(h3.ID())
+	require.True(t, identified)
+	require.False(t, ids1.PeerHasAddrs(h3.ID()))
+}
+
+func TestWaitForConvergence(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	h3 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	h4 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h4.Close()
+	defer h3.Close()
+	defer h2.Close()
+	defer h1.Close()
+
+	ids1, err := identify.NewIDService(h1, identify.WithPushAck())
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+	for _, h := range []host.Host{h2, h3} {
+		ids, err := identify.NewIDService(h, identify.WithPushAck())
+		require.NoError(t, err)
+		defer ids.Close()
+		ids.Start()
+	}
+	// h4 doesn't support push acknowledgements, and is not waited for
+	ids4, err := identify.NewIDService(h4)
+	require.NoError(t, err)
+	defer ids4.Close()
+	ids4.Start()
+
+	for _, h := range []host.Host{h2, h4} {
+		require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()}))
+		ids1.IdentifyConn(h1.Network().ConnsToPeer(h.ID())[0])
+	}
+	waitCtx, waitCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer waitCancel()
+	require.NoError(t, ids1.WaitForConvergence(waitCtx))
+
+	// h3 receives pushes, but never acknowledges them
+	var pushes atomic.Int32
+	h3.SetStreamHandler(identify.IDPushAck, func(s network.Stream) {
+		pushes.Add(1)
+		io.Copy(io.Discard, s)
+		s.Close()
+	})
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h3.ID(), Addrs: h3.Addrs()}))
+	ids1.IdentifyConn(h1.Network().ConnsToPeer(h3.ID())[0])
+	// h3 never requests our snapshot, so it's only pushed once the grace period for new peers is over
+	waitCtx, waitCancel = context.WithTimeout(ctx, 3*time.Second)
+	defer waitCancel()
+	require.ErrorIs(t, ids1.WaitForConvergence(waitCtx), context.DeadlineExceeded)
+	require.NotZero(t, pushes.Load())
+}
+
+func TestProtocolNamespaces(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	tenantA := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	tenantB := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer tenantB.Close()
+	defer tenantA.Close()
+	defer h1.Close()
+
+	h1.SetStreamHandler("/tenantA/foo", func(network.Stream) {})
+	h1.SetStreamHandler("/tenantB/bar", func(network.Stream) {})
+	ids1, err := identify.NewIDService(h1, identify.WithProtocolNamespaces(func(p peer.ID) []protocol.ID {
+		switch p {
+		case tenantA.ID():
+			return []protocol.ID{"/tenantA/"}
+		case tenantB.ID():
+			return []protocol.ID{"/tenantB/"}
+		default:
+			return nil
+		}
+	}))
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+
+	for _, h := range []host.Host{tenantA, tenantB} {
+		ids, err := identify.NewIDService(h)
+		require.NoError(t, err)
+		defer ids.Close()
+		ids.Start()
+
+		require.NoError(t, h.Connect(ctx, peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}))
+		<-ids.IdentifyWait(h.Network().ConnsToPeer(h1.ID())[0])
+	}
+
+	protosA, err := tenantA.Peerstore().GetProtocols(h1.ID())
+	require.NoError(t, err)
+	require.Equal(t, []protocol.ID{"/tenantA/foo"}, protosA)
+	protosB, err := tenantB.Peerstore().GetProtocols(h1.ID())
+	require.NoError(t, err)
+	require.Equal(t, []protocol.ID{"/tenantB/bar"}, protosB)
+
+	// the protocols are still available to all peers
+	s, err := tenantA.NewStream(ctx, h1.ID(), "/tenantB/bar")
+	require.NoError(t, err)
+	s.Close()
+}
+
+func TestPeerProtocolBloom(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h2.Close()
+	defer h1.Close()
+
+	ids1, err := identify.NewIDService(h1, identify.WithProtocolBloomFalsePositiveRate(0.001))
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+
+	var protos []protocol.ID
+	for i := 0; i < 100; i++ {
+		proto := protocol.ID(fmt.Sprintf("/known/%d", i))
+		protos = append(protos, proto)
+		h2.SetStreamHandler(proto, func(network.Stream) {})
+	}
+	ids2, err := identify.NewIDService(h2)
+	require.NoError(t, err)
+	defer ids2.Close()
+	ids2.Start()
+
+	_, ok := ids1.PeerProtocolBloom(h2.ID())
+	require.False(t, ok)
+
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	ids1.IdentifyConn(h1.Network().ConnsToPeer(h2.ID())[0])
+
+	f, ok := ids1.PeerProtocolBloom(h2.ID())
+	require.True(t, ok)
+	for _, proto := range protos {
+		require.True(t, f.TestString(string(proto)))
+	}
+	var falsePositives int
+	for i := 0; i < 1000; i++ {
+		if f.TestString(fmt.Sprintf("/unknown/%d", i)) {
+			falsePositives++
+		}
+	}
+	require.Less(t, falsePositives, 10)
+
+	_, err = identify.NewIDService(h1, identify.WithProtocolBloomFalsePositiveRate(1))
+	require.Error(t, err)
+}
+
+func TestObservedByPeer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	h3 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h3.Close()
+	defer h2.Close()
+	defer h1.Close()
+
+	ids1, err := identify.NewIDService(h1)
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+	for _, h := range []host.Host{h2, h3} {
+		ids, err := identify.NewIDService(h)
+		require.NoError(t, err)
+		defer ids.Close()
+		ids.Start()
+	}
+
+	_, ok := ids1.ObservedByPeer(h2.ID())
+	require.False(t, ok)
+
+	// connect to h2 via TCP and to h3 via QUIC, such that they observe us on different addresses
+	onlyProtocol := func(addrs []ma.Multiaddr, code int) []ma.Multiaddr {
+		var res []ma.Multiaddr
+		for _, a := range addrs {
+			if _, err := a.ValueForProtocol(code); err == nil {
+				res = append(res, a)
+			}
+		}
+		require.NotEmpty(t, res)
+		return res
+	}
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: onlyProtocol(h2.Addrs(), ma.P_TCP)}))
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h3.ID(), Addrs: onlyProtocol(h3.Addrs(), ma.P_QUIC_V1)}))
+
+	for _, h := range []host.Host{h2, h3} {
+		c := h1.Network().ConnsToPeer(h.ID())[0]
+		ids1.IdentifyConn(c)
+		observed, ok := ids1.ObservedByPeer(h.ID())
+		require.True(t, ok)
+		require.True(t, c.LocalMultiaddr().Equal(observed), "expected %s, got %s", c.LocalMultiaddr(), observed)
+	}
+	observed2, _ := ids1.ObservedByPeer(h2.ID())
+	observed3, _ := ids1.ObservedByPeer(h3.ID())
+	require.False(t, observed2.Equal(observed3))
+}
+
+// noAddrsHost is a host that stops advertising its addresses once noAddrs is set.
+type noAddrsHost struct {
+	host.Host
+	noAddrs atomic.Bool
+}
+
+func (h *noAddrsHost) Addrs() []ma.Multiaddr {
+	if h.noAddrs.Load() {
+		return nil
+	}
+	return h.Host.Addrs()
+}
+
+func TestPeerUnreachableViaAddrsHook(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	h2 := &noAddrsHost{Host: blhost.NewBlankHost(swarmt.GenSwarm(t))}
+	defer h2.Close()
+	defer h1.Close()
+
+	unreachable := make(chan peer.ID, 1)
+	ids1, err := identify.NewIDService(h1, identify.WithPeerUnreachableViaAddrsHook(func(p peer.ID) { unreachable <- p }))
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+	ids2, err := identify.NewIDService(h2)
+	require.NoError(t, err)
+	defer ids2.Close()
+	ids2.Start()
+
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	ids1.IdentifyConn(h1.Network().ConnsToPeer(h2.ID())[0])
+	require.True(t, ids1.PeerHasAddrs(h2.ID()))
+
+	// h2 pushes an update without any addresses
+	h2.noAddrs.Store(true)
+	emitAddrChangeEvt(t, h2)
+	select {
+	case p := <-unreachable:
+		require.Equal(t, h2.ID(), p)
+	case <-time.After(5 * time.Second):
+		t.Fatal("hook wasn't called")
+	}
+	require.False(t, ids1.PeerHasAddrs(h2.ID()))
+	require.Equal(t, network.Connected, h1.Network().Connectedness(h2.ID()))
+}
+
+func TestDebugState(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h2.Close()
+	defer h1.Close()
+
+	clk := mockClock.NewMock()
+	clk.Set(time.Now())
+	ids1, err := identify.NewIDService(h1, identify.WithClock(clk))
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+	h2.SetStreamHandler("/foo", func(network.Stream) {})
+	ids2, err := identify.NewIDService(h2, identify.UserAgent("debug-test"))
+	require.NoError(t, err)
+	defer ids2.Close()
+	ids2.Start()
+
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	c := h1.Network().ConnsToPeer(h2.ID())[0]
+	ids1.IdentifyConn(c)
+
+	state := ids1.DebugState()
+	require.NotZero(t, state.Seq)
+	require.Contains(t, state.Protocols, protocol.ID(identify.ID))
+	require.Len(t, state.Peers, 1)
+	ps := state.Peers[0]
+	require.Equal(t, h2.ID(), ps.ID)
+	require.Equal(t, "debug-test", ps.AgentVersion)
+	require.Contains(t, ps.Protocols, protocol.ID("/foo"))
+	require.NotEmpty(t, ps.Addrs)
+	require.NotEmpty(t, ps.ObservedAddr)
+	require.Equal(t, clk.Now(), ps.LastIdentified)
+	require.Len(t, ps.Conns, 1)
+	require.Equal(t, c.ID(), ps.Conns[0].ID)
+	require.Equal(t, "supported", ps.Conns[0].PushSupport)
+
+	b, err := json.Marshal(state)
+	require.NoError(t, err)
+	var decoded identify.IdentifyDebugState
+	require.NoError(t, json.Unmarshal(b, &decoded))
+	require.Equal(t, h2.ID(), decoded.Peers[0].ID)
+	require.Equal(t, ps.Protocols, decoded.Peers[0].Protocols)
+}
+
+func TestPushAddrsMismatchHookLoopback(t *testing.T) {
+	// find a non-loopback address to connect on
+	ifaceAddrs, err := manet.InterfaceMultiaddrs()
+	require.NoError(t, err)
+	var ip ma.Multiaddr
+	for _, a := range ifaceAddrs {
+		if _, err := a.ValueForProtocol(ma.P_IP4); err == nil && !manet.IsIPLoopback(a) {
+			ip = a
+			break
+		}
+	}
+	if ip == nil {
+		t.Skip("no non-loopback IPv4 address")
+	}
+
+	// h2 is a regular host, signing all of its addresses, but withholding the
+	// loopback address from the unsigned addresses it sends to h1
+	h2, err := libp2p.New(
+		libp2p.ListenAddrs(ma.StringCast("/ip4/127.0.0.1/tcp/0"), ip.Encapsulate(ma.StringCast("/tcp/0"))),
+		// the test swarm doesn't use encryption
+		libp2p.NoSecurity,
+	)
+	require.NoError(t, err)
+	defer h2.Close()
+	var remoteAddr ma.Multiaddr
+	for _, a := range h2.Addrs() {
+		if !manet.IsIPLoopback(a) {
+			remoteAddr = a
+		}
+	}
+	require.NotNil(t, remoteAddr)
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, swarmt.OptDialOnly))
+	defer h1.Close()
+	mismatches := make(chan []ma.Multiaddr, 10)
+	ids1, err := identify.NewIDService(h1, identify.WithPushAddrsMismatchHook(func(_ peer.ID, unsignedOnly, _ []ma.Multiaddr) {
+		mismatches <- unsignedOnly
+	}))
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+
+	require.NoError(t, h1.Connect(context.Background(), peer.AddrInfo{ID: h2.ID(), Addrs: []ma.Multiaddr{remoteAddr}}))
+	ids1.IdentifyConn(h1.Network().ConnsToPeer(h2.ID())[0])
+
+	h2.SetStreamHandler("/foo", func(network.Stream) {})
+	require.Eventually(t, func() bool {
+		protos, err := h1.Peerstore().SupportsProtocols(h2.ID(), "/foo")
+		return err == nil && len(protos) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	select {
+	case m := <-mismatches:
+		t.Fatalf("unexpected mismatch: %v", m)
+	default:
+	}
+}
+
+func TestUptimeHint(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h2.Close()
+	defer h1.Close()
+
+	clk := mockClock.NewMock()
+	clk.Set(time.Now())
+	ids1, err := identify.NewIDService(h1, identify.WithClock(clk), identify.WithPushDebounce(0), identify.WithUptimeHint())
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+	ids2, err := identify.NewIDService(h2)
+	require.NoError(t, err)
+	defer ids2.Close()
+	ids2.Start()
+
+	clk.Add(10 * time.Second)
+	require.NoError(t, h2.Connect(ctx, peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}))
+	ids2.IdentifyConn(h2.Network().ConnsToPeer(h1.ID())[0])
+	uptime, ok := ids2.PeerUptimeHint(h1.ID())
+	require.True(t, ok)
+	require.Equal(t, 10*time.Second, uptime)
+	// h2 doesn't send a hint
+	ids1.IdentifyConn(h1.Network().ConnsToPeer(h2.ID())[0])
+	_, ok = ids1.PeerUptimeHint(h2.ID())
+	require.False(t, ok)
+
+	// the next Identify Push contains the updated uptime
+	clk.Add(time.Minute)
+	h1.SetStreamHandler("/foo", func(network.Stream) {})
+	require.Eventually(t, func() bool {
+		uptime, _ := ids2.PeerUptimeHint(h1.ID())
+		return uptime == 70*time.Second
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestProtocolDeprecations(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h2.Close()
+	defer h1.Close()
+
+	removal := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	h1.SetStreamHandler("/old", func(network.Stream) {})
+	ids1, err := identify.NewIDService(h1, identify.WithProtocolDeprecations(map[protocol.ID]identify.ProtocolDeprecation{
+		"/old":         {Notice: "use /new instead", RemovalAfter: removal},
+		"/unsupported": {Notice: "not advertised"},
+	}))
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+	ids2, err := identify.NewIDService(h2)
+	require.NoError(t, err)
+	defer ids2.Close()
+	ids2.Start()
+
+	require.NoError(t, h2.Connect(ctx, peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}))
+	ids2.IdentifyConn(h2.Network().ConnsToPeer(h1.ID())[0])
+	deprecations, ok := ids2.PeerProtocolDeprecations(h1.ID())
+	require.True(t, ok)
+	// notices are only sent for protocols we advertise
+	require.Len(t, deprecations, 1)
+	require.Equal(t, "use /new instead", deprecations["/old"].Notice)
+	require.True(t, removal.Equal(deprecations["/old"].RemovalAfter))
+
+	// h2 doesn't deprecate any protocols
+	ids1.IdentifyConn(h1.Network().ConnsToPeer(h2.ID())[0])
+	deprecations, ok = ids1.PeerProtocolDeprecations(h2.ID())
+	require.True(t, ok)
+	require.Empty(t, deprecations)
+
+	// once the protocol is removed, the notice isn't sent anymore
+	h1.RemoveStreamHandler("/old")
+	require.Eventually(t, func() bool {
+		deprecations, _ := ids2.PeerProtocolDeprecations(h1.ID())
+		return len(deprecations) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestEarlyPushBehavior(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		behavior identify.EarlyPushBehavior
+	}{
+		{name: "apply", behavior: identify.EarlyPushApply},
+		{name: "buffer", behavior: identify.EarlyPushBuffer},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+			h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+			defer h1.Close()
+			defer h2.Close()
+
+			ids1, err := identify.NewIDService(h1, identify.WithEarlyPushBehavior(tc.behavior))
+			require.NoError(t, err)
+			defer ids1.Close()
+			ids1.Start()
+
+			// h2 doesn't run identify. It answers the identify request once released.
+			release := make(chan struct{})
+			h2.SetStreamHandler(identify.ID, func(s network.Stream) {
+				<-release
+				pbio.NewDelimitedWriter(s).WriteMsg(&pb.Identify{Protocols: []string{"/initial"}})
+				s.Close()
+			})
+			sendPush := func() {
+				s, err := h2.NewStream(context.Background(), h1.ID(), identify.IDPush)
+				require.NoError(t, err)
+				require.NoError(t, pbio.NewDelimitedWriter(s).WriteMsg(&pb.Identify{Protocols: []string{"/pushed"}}))
+				require.NoError(t, s.Close())
+			}
+			protocols := func() []protocol.ID {
+				protos, err := h1.Peerstore().GetProtocols(h2.ID())
+				require.NoError(t, err)
+				return protos
+			}
+
+			require.NoError(t, h1.Connect(context.Background(), peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+			require.Eventually(t, func() bool { return len(h2.Network().ConnsToPeer(h1.ID())) > 0 }, 5*time.Second, 10*time.Millisecond)
+			conn := h1.Network().ConnsToPeer(h2.ID())[0]
+			done := ids1.IdentifyWait(conn)
+			sendPush()
+
+			switch tc.behavior {
+			case identify.EarlyPushApply:
+				// the push is applied as a full snapshot, and replaced by the response
+				require.Eventually(t, func() bool { return slices.Equal(protocols(), []protocol.ID{"/pushed"}) }, 5*time.Second, 10*time.Millisecond)
+				close(release)
+				<-done
+				require.Equal(t, []protocol.ID{"/initial"}, protocols())
+			case identify.EarlyPushBuffer:
+				// the push is held back until the response has been processed
+				time.Sleep(200 * time.Millisecond)
+				require.Empty(t, protocols())
+				close(release)
+				<-done
+				require.Eventually(t, func() bool { return slices.Equal(protocols(), []protocol.ID{"/pushed"}) }, 5*time.Second, 10*time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestLifecycleEvents(t *testing.T) {
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h1.Close()
+	defer h2.Close()
+
+	eventTypes := []any{
+		new(event.EvtPeerIdentificationStarted),
+		new(event.EvtPeerIdentificationCompleted),
+		new(event.EvtPeerIdentificationFailed),
+		new(event.EvtIdentifyPushSent),
+		new(event.EvtIdentifyPushFailed),
+		new(event.EvtPeerProtocolsUpdated),
+		new(event.EvtPeerAddrsUpdated),
+	}
+	sub1, err := h1.EventBus().Subscribe(eventTypes)
+	require.NoError(t, err)
+	defer sub1.Close()
+	sub2, err := h2.EventBus().Subscribe(eventTypes)
+	require.NoError(t, err)
+	defer sub2.Close()
+
+	ids1, err := identify.NewIDService(h1)
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+	ids2, err := identify.NewIDService(h2)
+	require.NoError(t, err)
+	defer ids2.Close()
+	ids2.Start()
+
+	// nextEvents reads events until (and including) the first event of type last
+	nextEvents := func(t *testing.T, sub event.Subscription, last any) []any {
+		t.Helper()
+		var evts []any
+		for {
+			select {
+			case e := <-sub.Out():
+				evts = append(evts, e)
+				if fmt.Sprintf("%T", e) == fmt.Sprintf("%T", last) {
+					return evts
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timeout waiting for %T, got %#v", last, evts)
+			}
+		}
+	}
+	types := func(evts []any) []string {
+		var types []string
+		for _, e := range evts {
+			types = append(types, fmt.Sprintf("%T", e))
+		}
+		return types
+	}
+
+	// connect and identify
+	require.NoError(t, h1.Connect(context.Background(), peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	c1 := h1.Network().ConnsToPeer(h2.ID())[0]
+	ids1.IdentifyConn(c1)
+	require.Eventually(t, func() bool { return len(h2.Network().ConnsToPeer(h1.ID())) > 0 }, 5*time.Second, 10*time.Millisecond)
+	c2 := h2.Network().ConnsToPeer(h1.ID())[0]
+	ids2.IdentifyConn(c2)
+
+	evts := nextEvents(t, sub1, event.EvtPeerIdentificationCompleted{})
+	require.Equal(t, []string{"event.EvtPeerIdentificationStarted", "event.EvtPeerIdentificationCompleted"}, types(evts))
+	require.Equal(t, event.EvtPeerIdentificationStarted{Peer: h2.ID(), Conn: c1}, evts[0])
+	require.Equal(t, h2.ID(), evts[1].(event.EvtPeerIdentificationCompleted).Peer)
+	evts = nextEvents(t, sub2, event.EvtPeerIdentificationCompleted{})
+	require.Equal(t, []string{"event.EvtPeerIdentificationStarted", "event.EvtPeerIdentificationCompleted"}, types(evts))
+
+	// h1 starts listening on a new address, and pushes it to h2
+	newAddr := ma.StringCast("/ip4/127.0.0.1/tcp/1234")
+	require.NoError(t, h1.Network().Listen(newAddr))
+	emitAddrChangeEvt(t, h1)
+
+	evts = nextEvents(t, sub1, event.EvtIdentifyPushSent{})
+	require.Equal(t, []string{"event.EvtIdentifyPushSent"}, types(evts))
+	require.Equal(t, event.EvtIdentifyPushSent{Peer: h2.ID(), Conn: c1}, evts[0])
+
+	// the protocols didn't change, so the push only updates the addresses
+	evts = nextEvents(t, sub2, event.EvtPeerAddrsUpdated{})
+	require.Equal(t, []string{"event.EvtPeerAddrsUpdated"}, types(evts))
+	addrsUpdated := evts[0].(event.EvtPeerAddrsUpdated)
+	require.Equal(t, h1.ID(), addrsUpdated.Peer)
+	require.Equal(t, []ma.Multiaddr{newAddr}, addrsUpdated.Added)
+	require.Empty(t, addrsUpdated.Removed)
+}
+
+func TestDialbackHint(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h2.Close()
+	defer h1.Close()
+
+	ids1, err := identify.NewIDService(h1)
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+	ids2, err := identify.NewIDService(h2)
+	require.NoError(t, err)
+	defer ids2.Close()
+	ids2.Start()
+
+	hint := ma.StringCast("/ip4/1.2.3.4/udp/1234/quic-v1")
+	ids1.SetDialbackHint(hint)
+
+	require.NoError(t, h2.Connect(ctx, peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}))
+	ids2.IdentifyConn(h2.Network().ConnsToPeer(h1.ID())[0])
+	addr, ok := ids2.DialbackHint(h1.ID())
+	require.True(t, ok)
+	require.True(t, hint.Equal(addr))
+	// h2 doesn't send a hint
+	ids1.IdentifyConn(h1.Network().ConnsToPeer(h2.ID())[0])
+	_, ok = ids1.DialbackHint(h2.ID())
+	require.False(t, ok)
+
+	// updating the hint pushes it to connected peers
+	newHint := ma.StringCast("/ip4/1.2.3.4/tcp/1234")
+	ids1.SetDialbackHint(newHint)
+	require.Eventually(t, func() bool {
+		addr, ok := ids2.DialbackHint(h1.ID())
+		return ok && newHint.Equal(addr)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	ids1.SetDialbackHint(nil)
+	require.Eventually(t, func() bool {
+		_, ok := ids2.DialbackHint(h1.ID())
+		return !ok
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestLastSnapshot(t *testing.T) {
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h2.Close()
+	defer h1.Close()
+
+	ids1, err := identify.NewIDService(h1, identify.UserAgent("agent1"))
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+	ids2, err := identify.NewIDService(h2)
+	require.NoError(t, err)
+	defer ids2.Close()
+	ids2.Start()
+
+	_, ok := ids2.LastSnapshot(h1.ID())
+	require.False(t, ok)
+
+	require.NoError(t, h2.Connect(context.Background(), peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}))
+	ids2.IdentifyConn(h2.Network().ConnsToPeer(h1.ID())[0])
+	s, ok := ids2.LastSnapshot(h1.ID())
+	require.True(t, ok)
+	require.ElementsMatch(t, h1.Mux().Protocols(), s.Protocols)
+	require.ElementsMatch(t, h1.Addrs(), s.Addrs)
+	require.NotNil(t, s.SignedPeerRecord)
+	require.Equal(t, "agent1", s.AgentVersion)
+
+	// the snapshot is updated by pushes
+	h1.SetStreamHandler("/foo", func(network.Stream) {})
+	require.Eventually(t, func() bool {
+		s, _ := ids2.LastSnapshot(h1.ID())
+		return slices.Contains(s.Protocols, "/foo")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the returned snapshot is a copy
+	s.Protocols[0] = "/modified"
+	s, _ = ids2.LastSnapshot(h1.ID())
+	require.NotContains(t, s.Protocols, protocol.ID("/modified"))
+}
+
+func TestPushStats(t *testing.T) {
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h2.Close()
+	defer h1.Close()
+
+	clk := mockClock.NewMock()
+	clk.Set(time.Now())
+	ids1, err := identify.NewIDService(h1, identify.WithPushAck(), identify.WithClock(clk), identify.WithPushDebounce(0))
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+	ids2, err := identify.NewIDService(h2, identify.WithPushAck())
+	require.NoError(t, err)
+	defer ids2.Close()
+	ids2.Start()
+
+	require.NoError(t, h2.Connect(context.Background(), peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}))
+	ids2.IdentifyConn(h2.Network().ConnsToPeer(h1.ID())[0])
+	ids1.IdentifyConn(h1.Network().ConnsToPeer(h2.ID())[0])
+	_, ok := ids1.PushStats(h2.ID())
+	require.False(t, ok)
+
+	clk.Add(time.Minute)
+	h1.SetStreamHandler("/foo", func(network.Stream) {})
+	require.Eventually(t, func() bool {
+		stats, ok := ids1.PushStats(h2.ID())
+		return ok && stats.Sent == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	stats, _ := ids1.PushStats(h2.ID())
+	require.Zero(t, stats.Failed)
+	require.Equal(t, clk.Now(), stats.LastPush)
+
+	// make the next push fail
+	h2.SetStreamHandler(identify.IDPushAck, func(s network.Stream) {
+		io.ReadAll(s)
+		s.Reset()
+	})
+	h1.SetStreamHandler("/bar", func(network.Stream) {})
+	require.Eventually(t, func() bool {
+		stats, _ := ids1.PushStats(h2.ID())
+		return stats.Failed == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	stats, _ = ids1.PushStats(h2.ID())
+	require.Equal(t, 1, stats.Sent)
+
+	// the stats are reset when disconnecting
+	require.NoError(t, h1.Network().ClosePeer(h2.ID()))
+	require.Eventually(t, func() bool {
+		_, ok := ids1.PushStats(h2.ID())
+		return !ok
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestSnapshot(t *testing.T) {
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h2.Close()
+	defer h1.Close()
+
+	ids1, err := identify.NewIDService(h1, identify.UserAgent("agent1"))
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+	ids2, err := identify.NewIDService(h2)
+	require.NoError(t, err)
+	defer ids2.Close()
+	ids2.Start()
+
+	s := ids1.Snapshot()
+	require.ElementsMatch(t, h1.Mux().Protocols(), s.Protocols)
+	require.ElementsMatch(t, h1.Addrs(), s.Addrs)
+	require.NotNil(t, s.SignedPeerRecord)
+	require.Equal(t, "agent1", s.AgentVersion)
+
+	require.NoError(t, h2.Connect(context.Background(), peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}))
+	ids2.IdentifyConn(h2.Network().ConnsToPeer(h1.ID())[0])
+
+	// Modify snapshots while pushes of updated snapshots are sent.
+	// Run with the race detector to check that the snapshots don't share memory.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			h1.SetStreamHandler(protocol.ID(fmt.Sprintf("/proto%d", i)), func(network.Stream) {})
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		s := ids1.Snapshot()
+		for i := range s.Protocols {
+			s.Protocols[i] = "/modified"
+		}
+		for i := range s.Addrs {
+			s.Addrs[i] = nil
+		}
+	}
+
+	require.NotContains(t, ids1.Snapshot().Protocols, protocol.ID("/modified"))
+	require.Eventually(t, func() bool {
+		s, _ := ids2.LastSnapshot(h1.ID())
+		return slices.Contains(s.Protocols, "/proto9")
+	}, 5*time.Second, 10*time.Millisecond)
+	s, _ = ids2.LastSnapshot(h1.ID())
+	require.NotContains(t, s.Protocols, protocol.ID("/modified"))
+	require.ElementsMatch(t, h1.Addrs(), s.Addrs)
+}
+
+func TestPushTimeout(t *testing.T) {
+	_, err := identify.NewIDService(blhost.NewBlankHost(swarmt.GenSwarm(t)), identify.WithPushTimeout(-time.Second))
+	require.Error(t, err)
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h2.Close()
+	defer h1.Close()
+
+	// No peer answers that quickly, so every push times out.
+	ids1, err := identify.NewIDService(h1, identify.WithPushTimeout(time.Nanosecond))
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+	ids2, err := identify.NewIDService(h2)
+	require.NoError(t, err)
+	defer ids2.Close()
+	ids2.Start()
+
+	require.NoError(t, h1.Connect(context.Background(), peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	ids1.IdentifyConn(h1.Network().ConnsToPeer(h2.ID())[0])
+	require.Eventually(t, func() bool { return len(h2.Network().ConnsToPeer(h1.ID())) > 0 }, 5*time.Second, 10*time.Millisecond)
+	ids2.IdentifyConn(h2.Network().ConnsToPeer(h1.ID())[0])
+
+	h1.SetStreamHandler("/foo", func(network.Stream) {})
+	require.Eventually(t, func() bool {
+		stats, _ := ids1.PushStats(h2.ID())
+		return stats.Failed > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	stats, _ := ids1.PushStats(h2.ID())
+	require.Zero(t, stats.Sent)
+	protos, err := h2.Peerstore().GetProtocols(h1.ID())
+	require.NoError(t, err)
+	require.NotContains(t, protos, protocol.ID("/foo"))
+}
+
+func TestPushProtocols(t *testing.T) {
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h2.Close()
+	defer h1.Close()
+
+	ids1, err := identify.NewIDService(h1, identify.WithPushProtocols([]protocol.ID{"/important"}))
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+	ids2, err := identify.NewIDService(h2)
+	require.NoError(t, err)
+	defer ids2.Close()
+	ids2.Start()
+
+	require.NoError(t, h1.Connect(context.Background(), peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	ids1.IdentifyConn(h1.Network().ConnsToPeer(h2.ID())[0])
+	require.Eventually(t, func() bool { return len(h2.Network().ConnsToPeer(h1.ID())) > 0 }, 5*time.Second, 10*time.Millisecond)
+	ids2.IdentifyConn(h2.Network().ConnsToPeer(h1.ID())[0])
+
+	supports := func(proto protocol.ID) bool {
+		protos, err := h2.Peerstore().SupportsProtocols(h1.ID(), proto)
+		require.NoError(t, err)
+		return len(protos) > 0
+	}
+	// adding this protocol doesn't trigger a push
+	h1.SetStreamHandler("/ephemeral", func(network.Stream) {})
+	require.Eventually(t, func() bool { return slices.Contains(ids1.Snapshot().Protocols, "/ephemeral") }, 5*time.Second, 10*time.Millisecond)
+	require.Never(t, func() bool { return supports("/ephemeral") }, 500*time.Millisecond, 10*time.Millisecond)
+
+	// this one does, and the push includes all changes
+	h1.SetStreamHandler("/important", func(network.Stream) {})
+	require.Eventually(t, func() bool { return supports("/important") && supports("/ephemeral") }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestCloseGraceful(t *testing.T) {
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h1.Close()
+	// Push to one peer at a time, so that the push to the second peer only
+	// starts once the first one completed.
+	ids1, err := identify.NewIDService(h1, identify.WithPushAck(), identify.WithMaxPushConcurrency(1))
+	require.NoError(t, err)
+	ids1.Start()
+
+	received := make(chan struct{}, 2)
+	var peers []peer.ID
+	for i := 0; i < 2; i++ {
+		h := blhost.NewBlankHost(swarmt.GenSwarm(t))
+		defer h.Close()
+		ids, err := identify.NewIDService(h, identify.WithPushAck())
+		require.NoError(t, err)
+		defer ids.Close()
+		ids.Start()
+		// acknowledge pushes slowly
+		h.SetStreamHandler(identify.IDPushAck, func(s network.Stream) {
+			io.ReadAll(s)
+			received <- struct{}{}
+			time.Sleep(100 * time.Millisecond)
+			s.Write([]byte{1})
+			s.Close()
+		})
+
+		require.NoError(t, h1.Connect(context.Background(), peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()}))
+		ids1.IdentifyConn(h1.Network().ConnsToPeer(h.ID())[0])
+		require.Eventually(t, func() bool { return len(h.Network().ConnsToPeer(h1.ID())) > 0 }, 5*time.Second, 10*time.Millisecond)
+		ids.IdentifyConn(h.Network().ConnsToPeer(h1.ID())[0])
+		peers = append(peers, h.ID())
+	}
+
+	h1.SetStreamHandler("/foo", func(network.Stream) {})
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for push")
+	}
+	require.NoError(t, ids1.CloseGraceful(5*time.Second))
+	// the push completed for both peers
+	for _, p := range peers {
+		stats, ok := ids1.PushStats(p)
+		require.True(t, ok)
+		require.Equal(t, 1, stats.Sent)
+		require.Zero(t, stats.Failed)
+	}
+}
+
+func TestCloseGracefulDebouncedPush(t *testing.T) {
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h1.Close()
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h2.Close()
+	ids1, err := identify.NewIDService(h1, identify.WithPushDebounce(time.Second))
+	require.NoError(t, err)
+	ids1.Start()
+	ids2, err := identify.NewIDService(h2)
+	require.NoError(t, err)
+	defer ids2.Close()
+	ids2.Start()
+
+	require.NoError(t, h1.Connect(context.Background(), peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	ids1.IdentifyConn(h1.Network().ConnsToPeer(h2.ID())[0])
+
+	h1.SetStreamHandler("/foo", func(network.Stream) {})
+	// give the push time to be queued, it is now held back by the debounce
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	require.NoError(t, ids1.CloseGraceful(5*time.Second))
+	require.Less(t, time.Since(start), 500*time.Millisecond)
+	stats, _ := ids1.PushStats(h2.ID())
+	require.Zero(t, stats.Sent)
+}
+
+// countingCodec counts the messages compressed and decompressed by a codec.
+type countingCodec struct {
+	identify.Codec
+	compressed, decompressed atomic.Int32
+}
+
+func (c *countingCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	c.compressed.Add(1)
+	return c.Codec.NewWriter(w)
+}
+
+func (c *countingCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	c.decompressed.Add(1)
+	return c.Codec.NewReader(r)
+}
+
+func TestCompression(t *testing.T) {
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	legacy := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h1.Close()
+	defer h2.Close()
+	defer legacy.Close()
+
+	zstd1 := &countingCodec{Codec: identify.Zstd}
+	ids1, err := identify.NewIDService(h1, identify.WithCompression(zstd1, identify.Gzip))
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+	// h2 prefers gzip, but h1's preference is used when h1 identifies h2
+	zstd2 := &countingCodec{Codec: identify.Zstd}
+	ids2, err := identify.NewIDService(h2, identify.WithCompression(identify.Gzip, zstd2))
+	require.NoError(t, err)
+	defer ids2.Close()
+	ids2.Start()
+	idsLegacy, err := identify.NewIDService(legacy)
+	require.NoError(t, err)
+	defer idsLegacy.Close()
+	idsLegacy.Start()
+
+	for _, h := range []host.Host{h2, legacy} {
+		require.NoError(t, h1.Connect(context.Background(), peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()}))
+	}
+
+	// zstd is negotiated between the two capable peers
+	ids1.IdentifyConn(h1.Network().ConnsToPeer(h2.ID())[0])
+	require.Equal(t, int32(1), zstd1.decompressed.Load())
+	require.Equal(t, int32(1), zstd2.compressed.Load())
+	protos, err := h1.Peerstore().GetProtocols(h2.ID())
+	require.NoError(t, err)
+	require.Contains(t, protos, protocol.ID(identify.ID))
+
+	// the legacy peer sends an uncompressed response
+	ids1.IdentifyConn(h1.Network().ConnsToPeer(legacy.ID())[0])
+	require.Equal(t, int32(1), zstd1.decompressed.Load())
+	protos, err = h1.Peerstore().GetProtocols(legacy.ID())
+	require.NoError(t, err)
+	require.Contains(t, protos, protocol.ID(identify.ID))
+
+	// and requests an uncompressed response
+	require.Eventually(t, func() bool { return len(legacy.Network().ConnsToPeer(h1.ID())) > 0 }, 5*time.Second, 10*time.Millisecond)
+	idsLegacy.IdentifyConn(legacy.Network().ConnsToPeer(h1.ID())[0])
+	require.Zero(t, zstd1.compressed.Load())
+	protos, err = legacy.Peerstore().GetProtocols(h1.ID())
+	require.NoError(t, err)
+	require.Contains(t, protos, protocol.ID(identify.ID))
+
+	_, err = identify.NewIDService(h1, identify.WithCompression(identify.Zstd, identify.Zstd))
+	require.Error(t, err)
+}
+
+func TestProtocolConflictHook(t *testing.T) {
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t))
+	defer h2.Close()
+	defer h1.Close()
+
+	type conflict struct {
+		proto      protocol.ID
+		advertised bool
+	}
+	conflicts := make(chan conflict, 10)
+	ids1, err := identify.NewIDService(h1, identify.WithProtocolConflictHook(func(p peer.ID, proto protocol.ID, advertised bool) {
+		require.Equal(t, h2.ID(), p)
+		conflicts <- conflict{proto: proto, advertised: advertised}
+	}))
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids1.Start()
+	h2.SetStreamHandler("/advertised", func(s network.Stream) { s.Close() })
+	ids2, err := identify.NewIDService(h2)
+	require.NoError(t, err)
+	ids2.Start()
+
+	require.NoError(t, h1.Connect(context.Background(), peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	// outcomes for peers that we haven't identified yet are ignored
+	ids1.ReportNegotiation(h2.ID(), "/advertised", false)
+	ids1.IdentifyConn(h1.Network().ConnsToPeer(h2.ID())[0])
+
+	// Stop h2's identify service, so that h2 doesn't push the following changes.
+	require.NoError(t, ids2.Close())
+	h2.RemoveStreamHandler("/advertised")
+	h2.SetStreamHandler("/unadvertised", func(s network.Stream) { s.Close() })
+
+	negotiate := func(proto protocol.ID) {
+		s, err := h1.Network().NewStream(context.Background(), h2.ID())
+		require.NoError(t, err)
+		defer s.Close()
+		err = msmux.SelectProtoOrFail(proto, s)
+		ids1.ReportNegotiation(h2.ID(), proto, err == nil)
+	}
+	negotiate("/advertised")
+	require.Equal(t, conflict{proto: "/advertised", advertised: true}, <-conflicts)
+	negotiate("/unadvertised")
+	require.Equal(t, conflict{proto: "/unadvertised", advertised: false}, <-conflicts)
+	require.Empty(t, conflicts)
+}
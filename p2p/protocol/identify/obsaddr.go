@@ -7,6 +7,7 @@ import (
 	"slices"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/libp2p/go-libp2p/core/network"
 
@@ -27,6 +28,19 @@ var observedAddrManagerWorkerChannelSize = 16
 
 const maxExternalThinWaistAddrsPerLocalAddr = 3
 
+// maxObserverObservationBurst is the number of observations recorded from a single
+// observer in a burst. After that, observations are recorded at a rate of one per
+// observerObservationInterval. This prevents a single observer from manipulating
+// our address inference by rapidly changing the observed addresses it reports.
+var (
+	maxObserverObservationBurst = 32
+	observerObservationInterval = 10 * time.Second
+)
+
+// maxObservedAddrsPerObserver is the number of distinct observed thin waist addresses
+// tracked for a single observer.
+var maxObservedAddrsPerObserver = 8
+
 // thinWaist is a struct that stores the address along with it's thin waist prefix and rest of the multiaddr
 type thinWaist struct {
 	Addr, TW, Rest ma.Multiaddr
@@ -133,6 +147,56 @@ func (s *observerSet) cacheMultiaddr(addr ma.Multiaddr) ma.Multiaddr {
 	return s.cachedMultiaddrs[addrStr]
 }
 
+// observerState is the state we track for a single observer
+type observerState struct {
+	// tokens is the number of observations we'll record before rate limiting the observer
+	tokens     int
+	lastRefill time.Time
+	// observedTWAddrs counts the connections per observed thin waist address
+	observedTWAddrs map[string]int
+}
+
+// allowObservation reports whether an observation of observedTWStr is recorded,
+// given that it replaces the previous observation prevTWStr (if any) on the same connection.
+func (s *observerState) allowObservation(now time.Time, observedTWStr, prevTWStr string) bool {
+	if refill := int(now.Sub(s.lastRefill) / observerObservationInterval); refill > 0 {
+		s.tokens = min(s.tokens+refill, maxObserverObservationBurst)
+		s.lastRefill = s.lastRefill.Add(time.Duration(refill) * observerObservationInterval)
+	}
+	if s.tokens <= 0 {
+		return false
+	}
+	if _, ok := s.observedTWAddrs[observedTWStr]; !ok {
+		n := len(s.observedTWAddrs)
+		if prevTWStr != "" && s.observedTWAddrs[prevTWStr] == 1 {
+			// the previous observation will be removed
+			n--
+		}
+		if n >= maxObservedAddrsPerObserver {
+			return false
+		}
+	}
+	s.tokens--
+	return true
+}
+
+// ObservedAddrConsensus is an external thin waist address that our peers agree
+// on for one of our local thin waist addresses.
+type ObservedAddrConsensus struct {
+	// Local is the thin waist form of our local (listen) address.
+	Local ma.Multiaddr
+	// Observed is the thin waist form of the address peers observe us on.
+	Observed ma.Multiaddr
+}
+
+// ObservedAddrStore persists the observed address consensus across restarts.
+type ObservedAddrStore interface {
+	// Load returns the consensus saved by the last call to Save.
+	Load() ([]ObservedAddrConsensus, error)
+	// Save replaces the saved consensus.
+	Save([]ObservedAddrConsensus) error
+}
+
 type observation struct {
 	conn     connMultiaddrs
 	observed ma.Multiaddr
@@ -152,6 +216,8 @@ type ObservedAddrManager struct {
 	wch chan observation
 	// notified on recording an observation
 	addrRecordedNotif chan struct{}
+	// notified when an observed address gets activated or deactivated
+	addrsUpdatedNotif chan struct{}
 
 	// for closing
 	wg        sync.WaitGroup
@@ -166,6 +232,12 @@ type ObservedAddrManager struct {
 	// localMultiaddr => thin waist form with the count of the connections the multiaddr
 	// was seen on for tracking our local listen addresses
 	localAddrs map[string]*thinWaistWithCount
+	// observers maps the observer to the state used for limiting its observations
+	observers map[string]*observerState
+	// provisional maps the local thin waist to the external thin waist addresses
+	// loaded from a previous run. They are used until observations for the local
+	// thin waist get activated again.
+	provisional map[string][]*observerSet
 }
 
 // NewObservedAddrManager returns a new address manager using peerstore.OwnObservedAddressTTL as the TTL.
@@ -178,8 +250,11 @@ func NewObservedAddrManager(listenAddrs, hostAddrs func() []ma.Multiaddr,
 		externalAddrs:        make(map[string]map[string]*observerSet),
 		connObservedTWAddrs:  make(map[connMultiaddrs]ma.Multiaddr),
 		localAddrs:           make(map[string]*thinWaistWithCount),
+		observers:            make(map[string]*observerState),
+		provisional:          make(map[string][]*observerSet),
 		wch:                  make(chan observation, observedAddrManagerWorkerChannelSize),
 		addrRecordedNotif:    make(chan struct{}, 1),
+		addrsUpdatedNotif:    make(chan struct{}, 1),
 		listenAddrs:          listenAddrs,
 		interfaceListenAddrs: interfaceListenAddrs,
 		hostAddrs:            hostAddrs,
@@ -205,7 +280,7 @@ func (o *ObservedAddrManager) AddrsFor(addr ma.Multiaddr) (addrs []ma.Multiaddr)
 		return nil
 	}
 
-	observerSets := o.getTopExternalAddrs(string(tw.TW.Bytes()))
+	observerSets := o.topExternalAddrs(string(tw.TW.Bytes()))
 	res := make([]ma.Multiaddr, 0, len(observerSets))
 	for _, s := range observerSets {
 		res = append(res, s.cacheMultiaddr(tw.Rest))
@@ -221,10 +296,7 @@ func (o *ObservedAddrManager) AddrsFor(addr ma.Multiaddr) (addrs []ma.Multiaddr)
 // the external WebTransport address.
 func (o *ObservedAddrManager) appendInferredAddrs(twToObserverSets map[string][]*observerSet, addrs []ma.Multiaddr) []ma.Multiaddr {
 	if twToObserverSets == nil {
-		twToObserverSets = make(map[string][]*observerSet)
-		for localTWStr := range o.externalAddrs {
-			twToObserverSets[localTWStr] = append(twToObserverSets[localTWStr], o.getTopExternalAddrs(localTWStr)...)
-		}
+		twToObserverSets = o.allTopExternalAddrs()
 	}
 	lAddrs, err := o.interfaceListenAddrs()
 	if err != nil {
@@ -260,10 +332,7 @@ func (o *ObservedAddrManager) Addrs() []ma.Multiaddr {
 	o.mu.RLock()
 	defer o.mu.RUnlock()
 
-	m := make(map[string][]*observerSet)
-	for localTWStr := range o.externalAddrs {
-		m[localTWStr] = append(m[localTWStr], o.getTopExternalAddrs(localTWStr)...)
-	}
+	m := o.allTopExternalAddrs()
 	addrs := make([]ma.Multiaddr, 0, maxExternalThinWaistAddrsPerLocalAddr*5) // assume 5 transports
 	for _, t := range o.localAddrs {
 		for _, s := range m[string(t.TW.Bytes())] {
@@ -275,6 +344,29 @@ func (o *ObservedAddrManager) Addrs() []ma.Multiaddr {
 	return addrs
 }
 
+// allTopExternalAddrs returns the top external addresses for all local thin waist addresses.
+func (o *ObservedAddrManager) allTopExternalAddrs() map[string][]*observerSet {
+	m := make(map[string][]*observerSet, len(o.externalAddrs)+len(o.provisional))
+	for localTWStr := range o.externalAddrs {
+		m[localTWStr] = o.topExternalAddrs(localTWStr)
+	}
+	for localTWStr := range o.provisional {
+		if _, ok := m[localTWStr]; !ok {
+			m[localTWStr] = o.topExternalAddrs(localTWStr)
+		}
+	}
+	return m
+}
+
+// topExternalAddrs returns the activated external addresses for the local thin
+// waist, falling back to the provisional ones if none are activated.
+func (o *ObservedAddrManager) topExternalAddrs(localTWStr string) []*observerSet {
+	if observerSets := o.getTopExternalAddrs(localTWStr); len(observerSets) > 0 {
+		return observerSets
+	}
+	return o.provisional[localTWStr]
+}
+
 func (o *ObservedAddrManager) getTopExternalAddrs(localTWStr string) []*observerSet {
 	observerSets := make([]*observerSet, 0, len(o.externalAddrs[localTWStr]))
 	for _, v := range o.externalAddrs[localTWStr] {
@@ -446,6 +538,29 @@ func (o *ObservedAddrManager) recordObservationUnlocked(conn connMultiaddrs, loc
 	}
 
 	prevObservedTWAddr, ok := o.connObservedTWAddrs[conn]
+	if ok && prevObservedTWAddr.Equal(observedTW.TW) {
+		// we have received the same observation again, nothing to do
+		return
+	}
+
+	s, sok := o.observers[observer]
+	if !sok {
+		s = &observerState{
+			tokens:          maxObserverObservationBurst,
+			lastRefill:      time.Now(),
+			observedTWAddrs: make(map[string]int),
+		}
+	}
+	var prevObservedTWStr string
+	if ok {
+		prevObservedTWStr = string(prevObservedTWAddr.Bytes())
+	}
+	if !s.allowObservation(time.Now(), observedTWStr, prevObservedTWStr) {
+		log.Debugw("ignoring observation: observer is rate limited", "observer", observer, "observed", observedTW.Addr)
+		return
+	}
+	o.observers[observer] = s
+
 	if !ok {
 		t, ok := o.localAddrs[string(localTW.Addr.Bytes())]
 		if !ok {
@@ -456,12 +571,8 @@ func (o *ObservedAddrManager) recordObservationUnlocked(conn connMultiaddrs, loc
 		}
 		t.Count++
 	} else {
-		if prevObservedTWAddr.Equal(observedTW.TW) {
-			// we have received the same observation again, nothing to do
-			return
-		}
 		// if we have a previous entry remove it from externalAddrs
-		o.removeExternalAddrsUnlocked(observer, localTWStr, string(prevObservedTWAddr.Bytes()))
+		o.removeExternalAddrsUnlocked(observer, localTWStr, prevObservedTWStr)
 		// no need to change the localAddrs map here
 	}
 	o.connObservedTWAddrs[conn] = observedTW.TW
@@ -476,6 +587,16 @@ func (o *ObservedAddrManager) removeExternalAddrsUnlocked(observer, localTWStr,
 	s.ObservedBy[observer]--
 	if s.ObservedBy[observer] <= 0 {
 		delete(s.ObservedBy, observer)
+		if len(s.ObservedBy) == ActivationThresh-1 {
+			// the address isn't activated anymore
+			o.notifyAddrsUpdatedUnlocked()
+		}
+	}
+	if st, ok := o.observers[observer]; ok {
+		st.observedTWAddrs[observedTWStr]--
+		if st.observedTWAddrs[observedTWStr] <= 0 {
+			delete(st.observedTWAddrs, observedTWStr)
+		}
 	}
 	if len(s.ObservedBy) == 0 {
 		delete(o.externalAddrs[localTWStr], observedTWStr)
@@ -498,6 +619,33 @@ func (o *ObservedAddrManager) addExternalAddrsUnlocked(observedTWAddr ma.Multiad
 		o.externalAddrs[localTWStr][observedTWStr] = s
 	}
 	s.ObservedBy[observer]++
+	o.observers[observer].observedTWAddrs[observedTWStr]++
+	if s.ObservedBy[observer] == 1 && len(s.ObservedBy) == ActivationThresh {
+		// the address just got activated
+		o.notifyAddrsUpdatedUnlocked()
+	}
+	if len(s.ObservedBy) >= ActivationThresh {
+		// we have a fresh consensus for this local address
+		delete(o.provisional, localTWStr)
+	}
+}
+
+// notifyAddrsUpdatedUnlocked signals AddrsUpdated. Notifications that haven't
+// been consumed yet are coalesced.
+func (o *ObservedAddrManager) notifyAddrsUpdatedUnlocked() {
+	select {
+	case o.addrsUpdatedNotif <- struct{}{}:
+	default:
+	}
+}
+
+// AddrsUpdated returns a channel that receives a value when an observed address
+// is activated, i.e. when the number of peers that observed it reaches
+// ActivationThresh, or deactivated again. Observations that don't change the
+// set of activated addresses don't trigger a notification, and changes that
+// happen before the previous notification is consumed are coalesced.
+func (o *ObservedAddrManager) AddrsUpdated() <-chan struct{} {
+	return o.addrsUpdatedNotif
 }
 
 func (o *ObservedAddrManager) removeConn(conn connMultiaddrs) {
@@ -534,6 +682,9 @@ func (o *ObservedAddrManager) removeConn(conn connMultiaddrs) {
 	}
 
 	o.removeExternalAddrsUnlocked(observer, string(localTW.TW.Bytes()), string(observedTWAddr.Bytes()))
+	if s, ok := o.observers[observer]; ok && len(s.observedTWAddrs) == 0 {
+		delete(o.observers, observer)
+	}
 	select {
 	case o.addrRecordedNotif <- struct{}{}:
 	default:
@@ -595,6 +746,66 @@ func (o *ObservedAddrManager) getNATType() (tcpNATType, udpNATType network.NATDe
 	return
 }
 
+// Consensus returns the current observed address consensus, suitable for
+// persisting with an ObservedAddrStore. Provisional addresses that haven't been
+// replaced by activated ones are included.
+func (o *ObservedAddrManager) Consensus() []ObservedAddrConsensus {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	var res []ObservedAddrConsensus
+	for localTWStr, observerSets := range o.allTopExternalAddrs() {
+		local, err := ma.NewMultiaddrBytes([]byte(localTWStr))
+		if err != nil {
+			continue
+		}
+		for _, s := range observerSets {
+			res = append(res, ObservedAddrConsensus{Local: local, Observed: s.ObservedTWAddr})
+		}
+	}
+	return res
+}
+
+// LoadConsensus loads a previously saved consensus. The loaded addresses are
+// provisional: they are returned by Addrs and AddrsFor until observations for
+// the same local address are activated.
+func (o *ObservedAddrManager) LoadConsensus(consensus []ObservedAddrConsensus) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	clear(o.provisional)
+	for _, c := range consensus {
+		if c.Local == nil || c.Observed == nil {
+			continue
+		}
+		localTWStr := string(c.Local.Bytes())
+		if len(o.getTopExternalAddrs(localTWStr)) > 0 ||
+			len(o.provisional[localTWStr]) >= maxExternalThinWaistAddrsPerLocalAddr {
+			continue
+		}
+		o.provisional[localTWStr] = append(o.provisional[localTWStr], &observerSet{ObservedTWAddr: c.Observed})
+	}
+}
+
+// IsProvisional reports whether addr is only known from a loaded consensus and
+// hasn't been reconfirmed by our peers yet.
+func (o *ObservedAddrManager) IsProvisional(addr ma.Multiaddr) bool {
+	tw, err := thinWaistForm(o.normalize(addr))
+	if err != nil {
+		return false
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	for _, observerSets := range o.provisional {
+		for _, s := range observerSets {
+			if s.ObservedTWAddr.Equal(tw.TW) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (o *ObservedAddrManager) Close() error {
 	o.ctxCancel()
 	o.wg.Wait()
@@ -91,7 +91,7 @@ func TestObservedAddrManager(t *testing.T) {
 	}
 
 	checkAllEntriesRemoved := func(o *ObservedAddrManager) bool {
-		return len(o.Addrs()) == 0 && len(o.externalAddrs) == 0 && len(o.connObservedTWAddrs) == 0 && len(o.localAddrs) == 0
+		return len(o.Addrs()) == 0 && len(o.externalAddrs) == 0 && len(o.connObservedTWAddrs) == 0 && len(o.localAddrs) == 0 && len(o.observers) == 0
 	}
 	t.Run("Single Observation", func(t *testing.T) {
 		o := newObservedAddrMgr()
@@ -169,6 +169,55 @@ func TestObservedAddrManager(t *testing.T) {
 		}, 1*time.Second, 100*time.Millisecond)
 	})
 
+	t.Run("AddrsUpdated", func(t *testing.T) {
+		o := newObservedAddrMgr()
+		defer o.Close()
+		observed := ma.StringCast("/ip4/2.2.2.2/tcp/2")
+		recorded := func() int {
+			o.mu.RLock()
+			defer o.mu.RUnlock()
+			return len(o.connObservedTWAddrs)
+		}
+		updates := func() int {
+			var n int
+			for {
+				select {
+				case <-o.AddrsUpdated():
+					n++
+				case <-time.After(100 * time.Millisecond):
+					return n
+				}
+			}
+		}
+
+		const N = 4 // ActivationThresh
+		var conns [N + 2]connMultiaddrs
+		for i := range conns {
+			conns[i] = newConn(tcp4ListenAddr, ma.StringCast(fmt.Sprintf("/ip4/1.2.3.%d/tcp/1", i)))
+		}
+		for i := 0; i < N-1; i++ {
+			o.Record(conns[i], observed)
+		}
+		require.Eventually(t, func() bool { return recorded() == N-1 }, time.Second, 10*time.Millisecond)
+		require.Zero(t, updates())
+
+		// crossing the threshold results in a single update, further confirmations don't cause any
+		for i := N - 1; i < len(conns); i++ {
+			o.Record(conns[i], observed)
+		}
+		require.Eventually(t, func() bool { return recorded() == len(conns) }, time.Second, 10*time.Millisecond)
+		require.Equal(t, 1, updates())
+		require.True(t, addrsEqual(t, o.Addrs(), []ma.Multiaddr{observed}))
+
+		// the address is deactivated once the number of observers drops below the threshold
+		o.removeConn(conns[0])
+		o.removeConn(conns[1])
+		require.Zero(t, updates())
+		o.removeConn(conns[2])
+		require.Equal(t, 1, updates())
+		require.Empty(t, o.Addrs())
+	})
+
 	t.Run("SameObservers", func(t *testing.T) {
 		o := newObservedAddrMgr()
 		defer o.Close()
@@ -513,6 +562,53 @@ func TestObservedAddrManager(t *testing.T) {
 		require.Equal(t, evt.TransportProtocol, network.NATTransportUDP)
 		require.Equal(t, evt.NatDeviceType, network.NATDeviceTypeCone)
 	})
+	t.Run("Rate limited observer", func(t *testing.T) {
+		o := newObservedAddrMgr()
+		defer o.Close()
+		observer := "1.2.3.1"
+
+		// a single connection rapidly changing the observed address
+		c := newConn(tcp4ListenAddr, ma.StringCast("/ip4/1.2.3.1/tcp/1"))
+		// most of the observations are ignored
+		N := 10 * maxObserverObservationBurst
+		var lastAccepted ma.Multiaddr
+		for i := 0; i < N; i++ {
+			observed := ma.StringCast(fmt.Sprintf("/ip4/2.2.%d.%d/tcp/2", i/256, i%256))
+			if i < maxObserverObservationBurst {
+				lastAccepted = observed
+			}
+			o.maybeRecordObservation(c, observed)
+		}
+		o.mu.RLock()
+		require.True(t, o.connObservedTWAddrs[c].Equal(lastAccepted))
+		require.Len(t, o.observers[observer].observedTWAddrs, 1)
+		o.mu.RUnlock()
+		o.removeConn(c)
+		require.True(t, checkAllEntriesRemoved(o))
+
+		// many connections from the same observer reporting different addresses
+		conns := make([]*mockConn, 2*maxObservedAddrsPerObserver)
+		for i := range conns {
+			conns[i] = newConn(tcp4ListenAddr, ma.StringCast(fmt.Sprintf("/ip4/1.2.3.1/tcp/%d", i+1)))
+			o.maybeRecordObservation(conns[i], ma.StringCast(fmt.Sprintf("/ip4/2.2.2.%d/tcp/2", i)))
+		}
+		o.mu.RLock()
+		require.Len(t, o.observers[observer].observedTWAddrs, maxObservedAddrsPerObserver)
+		require.Len(t, o.connObservedTWAddrs, maxObservedAddrsPerObserver)
+		o.mu.RUnlock()
+
+		// an already tracked address is still accepted
+		o.maybeRecordObservation(conns[len(conns)-1], ma.StringCast("/ip4/2.2.2.0/tcp/2"))
+		o.mu.RLock()
+		require.Len(t, o.connObservedTWAddrs, maxObservedAddrsPerObserver+1)
+		o.mu.RUnlock()
+
+		for _, c := range conns {
+			o.removeConn(c)
+		}
+		require.True(t, checkAllEntriesRemoved(o))
+	})
+
 	t.Run("Many connection many observations IP4 And IP6", func(t *testing.T) {
 		o := newObservedAddrMgr()
 		defer o.Close()
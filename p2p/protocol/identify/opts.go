@@ -1,11 +1,56 @@
 package identify
 
+import (
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+
+	"github.com/benbjohnson/clock"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
 type config struct {
 	protocolVersion            string
 	userAgent                  string
 	disableSignedPeerRecord    bool
 	metricsTracer              MetricsTracer
 	disableObservedAddrManager bool
+	dnsAddr                    ma.Multiaddr
+	postIdentifyHook           PostIdentifyHook
+	isReservedProtocol         func(protocol.ID) bool
+	sendGoodbye                bool
+	wal                        WAL
+	verifyAddr                 func(ma.Multiaddr) bool
+	identifyRetries            int
+	identifyRetryBackoff       time.Duration
+	pushAck                    bool
+	workers                    int
+	privateAddrsLocalOnly      bool
+	protocolNamespaces         func(peer.ID) []protocol.ID
+	protocolBloomFPRate        float64
+	peerUnreachableHook        func(peer.ID)
+	addrsMismatchHook          func(peer.ID, []ma.Multiaddr, []ma.Multiaddr)
+	clock                      clock.Clock
+	uptimeHint                 bool
+	earlyPushBehavior          EarlyPushBehavior
+	observedAddrStore          ObservedAddrStore
+	maxPushConcurrency         int
+	pushDebounce               time.Duration
+	pushTimeout                time.Duration
+	pushFailureThreshold       int
+	addrFilter                 func(ma.Multiaddr) bool
+	bootstrapGate              bool
+	pushProtocols              map[protocol.ID]struct{}
+	codecs                     []Codec
+	deltaPush                  bool
+	maxPeerAddrs               int
+	peerAddrsPriority          func(a, b ma.Multiaddr) int
+	peerAddrsTruncatedHook     func(peer.ID, []ma.Multiaddr)
+	protocolConflictHook       func(peer.ID, protocol.ID, bool)
+	deprecations               map[protocol.ID]ProtocolDeprecation
 }
 
 // Option is an option function for identify.
@@ -47,3 +92,357 @@ func DisableObservedAddrManager() Option {
 		cfg.disableObservedAddrManager = true
 	}
 }
+
+// WithObservedAddrStore persists the observed address consensus in the given
+// store. The consensus is loaded when the service is created, and saved when it
+// is closed. Loaded addresses are used provisionally, until they are
+// reconfirmed by our peers.
+func WithObservedAddrStore(s ObservedAddrStore) Option {
+	return func(cfg *config) {
+		cfg.observedAddrStore = s
+	}
+}
+
+// WithDNSAddr configures a /dnsaddr multiaddr that is advertised to peers in
+// addition to the host's addresses. It is placed ahead of all other addresses,
+// so peers prefer it over raw IP addresses, which might change over time.
+func WithDNSAddr(addr ma.Multiaddr) Option {
+	return func(cfg *config) {
+		cfg.dnsAddr = addr
+	}
+}
+
+// WithPostIdentifyHook sets a hook that is called after every Identify message
+// (including Identify Push messages) received from a peer. If the hook returns
+// false, the connection is closed. This can be used to drop connections to peers
+// that turn out to be of no use, e.g. because they run an incompatible version.
+func WithPostIdentifyHook(hook PostIdentifyHook) Option {
+	return func(cfg *config) {
+		cfg.postIdentifyHook = hook
+	}
+}
+
+// WithReservedProtocolFilter sets a predicate that identifies protocols that are
+// reserved for internal use. Reserved protocols advertised by a peer are dropped
+// before storing the peer's protocols, so peers can't claim to support them.
+func WithReservedProtocolFilter(isReserved func(protocol.ID) bool) Option {
+	return func(cfg *config) {
+		cfg.isReservedProtocol = isReserved
+	}
+}
+
+// WithGoodbyeOnClose makes the identify service send a final Identify Push to
+// all connected peers when it is closed, flagging that we're shutting down.
+// Peers that don't understand the flag process it as a regular push.
+func WithGoodbyeOnClose() Option {
+	return func(cfg *config) {
+		cfg.sendGoodbye = true
+	}
+}
+
+// WithWAL makes the identify service append every validated snapshot it
+// receives from a peer to the WAL. See WAL for details.
+func WithWAL(wal WAL) Option {
+	return func(cfg *config) {
+		cfg.wal = wal
+	}
+}
+
+// WithAddrVerifier sets a function that verifies our addresses before they are
+// advertised, e.g. by checking that they're reachable. Only addresses that pass
+// verification are advertised. Results are cached, and addresses are re-verified
+// periodically. The verifier may block, but this delays Identify Pushes.
+func WithAddrVerifier(verify func(ma.Multiaddr) bool) Option {
+	return func(cfg *config) {
+		cfg.verifyAddr = verify
+	}
+}
+
+// WithAddrFilter sets a filter for the host addresses we advertise, e.g. to
+// hide loopback addresses or the addresses of a management interface from our
+// peers. Only addresses for which filter returns true are advertised, both in
+// the unsigned address list and in the signed peer record.
+func WithAddrFilter(filter func(ma.Multiaddr) bool) Option {
+	return func(cfg *config) {
+		cfg.addrFilter = filter
+	}
+}
+
+// WithIdentifyRetries makes the identify service retry identifying a new
+// connection up to maxRetries times if the Identify request times out. Before
+// every retry, it waits for the backoff, which doubles after every attempt.
+// Retries stop when the connection is closed.
+func WithIdentifyRetries(maxRetries int, backoff time.Duration) Option {
+	return func(cfg *config) {
+		cfg.identifyRetries = maxRetries
+		cfg.identifyRetryBackoff = backoff
+	}
+}
+
+// WithPushAck enables Identify Push with acknowledgements (IDPushAck). We
+// acknowledge pushes received via this protocol, and use it to push to peers
+// that support it. This allows waiting until all peers received our latest
+// snapshot, see WaitForConvergence.
+func WithPushAck() Option {
+	return func(cfg *config) {
+		cfg.pushAck = true
+	}
+}
+
+// WithWorkers limits the number of Identify messages (including Identify Push
+// messages) that are processed concurrently to n. Processing a message involves
+// verifying the peer's signed record and updating the peer store. Messages that
+// arrive while all workers are busy wait until one becomes available.
+func WithWorkers(n int) Option {
+	return func(cfg *config) {
+		cfg.workers = n
+	}
+}
+
+// WithMaxPushConcurrency limits the number of Identify Push streams that are
+// opened concurrently when pushing our snapshot to our peers to n, which must be
+// positive. Pushes to further peers wait until a stream is done.
+// Defaults to DefaultMaxPushConcurrency. High-degree nodes might want to raise
+// the limit, so that pushes to all peers complete in time.
+func WithMaxPushConcurrency(n int) Option {
+	return func(cfg *config) {
+		cfg.maxPushConcurrency = n
+	}
+}
+
+// WithPushDebounce sets the time we wait after a change to our snapshot (e.g.
+// to our addresses) before pushing it to our peers. Further changes in that
+// time are sent in the same push, which reduces the number of pushes when our
+// addresses are flapping. Defaults to DefaultPushDebounce, 0 disables waiting.
+func WithPushDebounce(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.pushDebounce = d
+	}
+}
+
+// WithPushTimeout sets the time we allow for opening an Identify Push stream
+// to a peer. High-latency links might need a longer timeout, while a shorter
+// one makes pushes to unresponsive peers fail faster. d must not be negative,
+// 0 disables the timeout, such that pushes are only bounded by the lifetime of
+// the identify service. Defaults to DefaultPushTimeout.
+func WithPushTimeout(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.pushTimeout = d
+	}
+}
+
+// WithPushFailureThreshold sets the number of consecutive failed pushes to a
+// peer after which EvtPeerIdentifyPushFailed is emitted. n must be positive.
+// Defaults to DefaultPushFailureThreshold.
+func WithPushFailureThreshold(n int) Option {
+	return func(cfg *config) {
+		cfg.pushFailureThreshold = n
+	}
+}
+
+// WithBootstrapGate holds all Identify Pushes until MarkReady is called, to
+// avoid advertising the addresses and protocols that churn while the host is
+// bootstrapping. Peers still receive our current snapshot when identifying us.
+// After MarkReady, a single push of the settled snapshot is sent to the peers
+// that haven't received it yet.
+func WithBootstrapGate() Option {
+	return func(cfg *config) {
+		cfg.bootstrapGate = true
+	}
+}
+
+// WithPushProtocols limits the protocols that trigger an Identify Push when
+// they're added or removed to protos. Changes to other protocols, e.g. to
+// short-lived protocols that would otherwise cause a lot of pushes, still
+// update our snapshot, but are only sent to peers with the next push (or when
+// they identify us). Changes to our addresses always trigger a push.
+// By default, all protocol changes trigger a push.
+func WithPushProtocols(protos []protocol.ID) Option {
+	return func(cfg *config) {
+		cfg.pushProtocols = make(map[protocol.ID]struct{}, len(protos))
+		for _, p := range protos {
+			cfg.pushProtocols[p] = struct{}{}
+		}
+	}
+}
+
+// WithDeltaPush enables the Identify delta protocol (IDDelta). If only our
+// protocols changed since the last snapshot we sent to a peer, and the peer
+// supports the protocol, we only send it the added and removed protocols
+// instead of the full snapshot. Other peers, and peers that support Identify
+// Push with acknowledgements, are sent full pushes.
+// We also accept deltas from our peers, which are applied to the last snapshot
+// received from the peer.
+func WithDeltaPush() Option {
+	return func(cfg *config) {
+		cfg.deltaPush = true
+	}
+}
+
+// WithLocalAddrsForLocalPeersOnly makes the identify service advertise private
+// addresses (e.g. LAN addresses) only to peers that are connected to us via a
+// private or loopback address. Peers connected via a public address are only
+// sent our public addresses, both in the unsigned address list and in the
+// signed peer record.
+func WithLocalAddrsForLocalPeersOnly() Option {
+	return func(cfg *config) {
+		cfg.privateAddrsLocalOnly = true
+	}
+}
+
+// WithProtocolNamespaces restricts the protocols advertised to a peer, e.g. to
+// isolate the services of multiple tenants hosted on the same node. For every
+// Identify and Identify Push message, namespaces is called with the receiving
+// peer, and only protocols starting with one of the returned prefixes (e.g.
+// "/tenantA/") are advertised to it. If it returns nil, all protocols are advertised.
+// This only affects what is advertised, all protocols can still be used by all peers.
+func WithProtocolNamespaces(namespaces func(p peer.ID) []protocol.ID) Option {
+	return func(cfg *config) {
+		cfg.protocolNamespaces = namespaces
+	}
+}
+
+// WithProtocolBloomFalsePositiveRate sets the false positive rate of the bloom
+// filters returned by PeerProtocolBloom. Defaults to DefaultProtocolBloomFalsePositiveRate.
+func WithProtocolBloomFalsePositiveRate(rate float64) Option {
+	return func(cfg *config) {
+		cfg.protocolBloomFPRate = rate
+	}
+}
+
+// WithPeerUnreachableViaAddrsHook sets a hook that is called when a peer that
+// previously advertised addresses sends an update without any addresses, e.g.
+// because it moved behind a NAT or closed its listeners. The peer is still
+// connected, but can't be dialed directly anymore.
+// The hook is called synchronously while processing the Identify message.
+func WithPeerUnreachableViaAddrsHook(hook func(p peer.ID)) Option {
+	return func(cfg *config) {
+		cfg.peerUnreachableHook = hook
+	}
+}
+
+// WithPushAddrsMismatchHook sets a hook that is called when a peer pushes a
+// signed peer record together with unsigned addresses that are missing from
+// the record (unsignedOnly). signedOnly are the addresses only contained in
+// the record. On their own, they don't trigger the hook, since peers don't send
+// all of their addresses unsigned, e.g. loopback addresses to remote peers.
+// The addresses in the signed record are used either way, so a peer can't
+// smuggle unsigned addresses into our peerstore.
+// The hook is called synchronously while processing the Identify message.
+func WithPushAddrsMismatchHook(hook func(p peer.ID, unsignedOnly, signedOnly []ma.Multiaddr)) Option {
+	return func(cfg *config) {
+		cfg.addrsMismatchHook = hook
+	}
+}
+
+// WithMaxPeerAddrs limits the number of addresses we accept from a connected
+// peer to n, which must be positive. This bounds the memory a peer can make us
+// use by advertising a huge number of addresses. If the peer advertises more
+// addresses, the first n are kept. If priority is not nil, the addresses are
+// sorted by priority first (like slices.SortStableFunc), such that the n
+// addresses sorting first are kept. Defaults to DefaultMaxPeerAddrs.
+func WithMaxPeerAddrs(n int, priority func(a, b ma.Multiaddr) int) Option {
+	return func(cfg *config) {
+		cfg.maxPeerAddrs = n
+		cfg.peerAddrsPriority = priority
+	}
+}
+
+// WithPeerAddrsTruncatedHook sets a hook that is called with the addresses we
+// dropped when a peer advertised more addresses than we accept, see
+// WithMaxPeerAddrs.
+// The hook is called synchronously while processing the Identify message.
+func WithPeerAddrsTruncatedHook(hook func(p peer.ID, dropped []ma.Multiaddr)) Option {
+	return func(cfg *config) {
+		cfg.peerAddrsTruncatedHook = hook
+	}
+}
+
+// WithProtocolConflictHook sets a hook that is called when negotiating a
+// protocol with a peer contradicts the protocols the peer advertised in its
+// latest Identify message: advertised is true if the peer advertised proto
+// but rejected it, and false if it accepted proto without advertising it.
+// Consistent peers only cause conflicts when their protocols change while an
+// Identify Push is on its way, so repeated conflicts point to buggy peers.
+// Negotiation outcomes are reported using ReportNegotiation.
+func WithProtocolConflictHook(hook func(p peer.ID, proto protocol.ID, advertised bool)) Option {
+	return func(cfg *config) {
+		cfg.protocolConflictHook = hook
+	}
+}
+
+// WithClock sets the clock used by the identify service. Defaults to the system clock.
+// The clock is compared with the times connections were opened at, so it should
+// start at the current time.
+func WithClock(clk clock.Clock) Option {
+	return func(cfg *config) {
+		cfg.clock = clk
+	}
+}
+
+// WithUptimeHint makes the identify service send the time since it was started
+// in every Identify message. Peers can use this hint to prefer stable nodes,
+// e.g. when deciding which connections to keep. See PeerUptimeHint.
+func WithUptimeHint() Option {
+	return func(cfg *config) {
+		cfg.uptimeHint = true
+	}
+}
+
+// EarlyPushBehavior defines how Identify Pushes are handled that a peer sends
+// before we have processed its response to our initial Identify request.
+type EarlyPushBehavior int
+
+const (
+	// EarlyPushApply applies an early push immediately. Pushes carry the peer's
+	// full state, so the push is treated as a full snapshot. The response to
+	// the initial request is applied when it arrives, and replaces the pushed
+	// snapshot, unless it carries an older signed peer record.
+	// This is the default.
+	EarlyPushApply EarlyPushBehavior = iota
+	// EarlyPushBuffer holds back an early push until the initial Identify
+	// request has completed (or failed), and applies it afterwards. The peer
+	// sent the push after answering our request, so its state ends up
+	// reflecting the push.
+	EarlyPushBuffer
+)
+
+// WithEarlyPushBehavior sets how Identify Pushes received before the initial
+// Identify request completes are handled. Defaults to EarlyPushApply.
+func WithEarlyPushBehavior(b EarlyPushBehavior) Option {
+	return func(cfg *config) {
+		cfg.earlyPushBehavior = b
+	}
+}
+
+// ProtocolDeprecation announces that a peer plans to stop supporting a protocol.
+type ProtocolDeprecation struct {
+	// Notice is a human-readable explanation, e.g. which protocol to migrate to.
+	Notice string
+	// RemovalAfter is the time after which the protocol may no longer be
+	// supported. It is the zero time if no date was announced.
+	RemovalAfter time.Time
+}
+
+// WithProtocolDeprecations announces that we plan to stop supporting the given
+// protocols, so that peers can warn about it or migrate in advance. The notices
+// are sent along with the protocols in every Identify message, for the
+// protocols we currently advertise. Peers that don't know about deprecation
+// notices ignore them. See PeerProtocolDeprecations.
+func WithProtocolDeprecations(deprecations map[protocol.ID]ProtocolDeprecation) Option {
+	return func(cfg *config) {
+		cfg.deprecations = maps.Clone(deprecations)
+	}
+}
+
+// WithCompression enables compressing Identify responses using the given
+// codecs, in order of preference. When identifying a peer, we offer the codecs
+// by appending their names to the Identify protocol ID, and the peer picks the
+// first one it supports. Peers that don't support any of them (or compression
+// at all) send uncompressed responses. Gzip and Zstd are available as codecs.
+// Codec names must be unique.
+func WithCompression(codecs ...Codec) Option {
+	return func(cfg *config) {
+		cfg.codecs = slices.Clone(codecs)
+	}
+}
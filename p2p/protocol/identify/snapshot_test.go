@@ -1,13 +1,21 @@
 package identify
 
 import (
+	"bufio"
 	"crypto/rand"
+	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/protocol"
 	"github.com/libp2p/go-libp2p/core/record"
+	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
 
+	"github.com/benbjohnson/clock"
+	logging "github.com/ipfs/go-log/v2"
 	ma "github.com/multiformats/go-multiaddr"
 	"github.com/stretchr/testify/require"
 )
@@ -45,3 +53,44 @@ func TestSnapshotEquality(t *testing.T) {
 		}
 	}
 }
+
+func TestSnapshotChangeLogged(t *testing.T) {
+	require.NoError(t, logging.SetLogLevel("net/identify", "debug"))
+	t.Cleanup(func() { logging.SetLogLevel("net/identify", "error") })
+	pipe := logging.NewPipeReader(logging.PipeFormat(logging.JSONOutput), logging.PipeLevel(logging.LevelDebug))
+	defer pipe.Close()
+
+	entries := make(chan map[string]any, 10)
+	go func() {
+		scanner := bufio.NewScanner(pipe)
+		for scanner.Scan() {
+			var entry map[string]any
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				continue
+			}
+			if entry["msg"] == "peer snapshot changed" {
+				entries <- entry
+			}
+		}
+	}()
+
+	addr1 := ma.StringCast("/ip4/1.2.3.4/tcp/1234")
+	addr2 := ma.StringCast("/ip4/1.2.3.4/udp/1234/quic-v1")
+	p := peer.ID("peer")
+	ids := &idService{peers: make(map[peer.ID]*peerState), clock: clock.New()}
+	var err error
+	ids.emitters.evtPeerAddrsUpdated, err = eventbus.NewBus().Emitter(new(event.EvtPeerAddrsUpdated))
+	require.NoError(t, err)
+	ids.applySnapshot(p, "", time.Time{}, identifySnapshot{protocols: []protocol.ID{"/foo"}, addrs: []ma.Multiaddr{addr1}}, nil)
+	<-entries
+
+	// applying the same snapshot again doesn't log anything
+	ids.applySnapshot(p, "", time.Time{}, identifySnapshot{protocols: []protocol.ID{"/foo"}, addrs: []ma.Multiaddr{addr1}}, nil)
+	ids.applySnapshot(p, "", time.Time{}, identifySnapshot{protocols: []protocol.ID{"/bar"}, addrs: []ma.Multiaddr{addr2}}, nil)
+	entry := <-entries
+	require.Equal(t, p.String(), entry["peer"])
+	require.Equal(t, []any{"/bar"}, entry["protocols_added"])
+	require.Equal(t, []any{"/foo"}, entry["protocols_removed"])
+	require.Equal(t, []any{addr2.String()}, entry["addrs_added"])
+	require.Equal(t, []any{addr1.String()}, entry["addrs_removed"])
+}
@@ -0,0 +1,110 @@
+package identify
+
+import (
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/p2p/protocol/identify/pb"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"google.golang.org/protobuf/proto"
+)
+
+// walQueueSize is the number of snapshots queued for appending to the WAL.
+// If the WAL falls behind further, snapshots are dropped.
+const walQueueSize = 256
+
+// WAL is a write-ahead log the identify service appends peer snapshots to,
+// after they have been validated. A snapshot is an opaque byte slice that can
+// be passed to ImportSnapshot, e.g. to restore the peerstore after a crash.
+//
+// Appending is best-effort: it happens asynchronously, and snapshots are
+// dropped if the WAL can't keep up.
+type WAL interface {
+	Append(p peer.ID, snapshot []byte) error
+}
+
+type walEntry struct {
+	peer     peer.ID
+	snapshot *pb.Identify
+}
+
+// appendToWAL queues a snapshot for appending to the WAL. It never blocks.
+func (ids *idService) appendToWAL(p peer.ID, snapshot *pb.Identify) {
+	select {
+	case ids.walCh <- walEntry{peer: p, snapshot: snapshot}:
+	default:
+		log.Debugw("dropping snapshot, WAL queue is full", "peer", p)
+	}
+}
+
+func (ids *idService) walLoop() {
+	defer ids.refCount.Done()
+
+	for {
+		select {
+		case e := <-ids.walCh:
+			b, err := proto.Marshal(e.snapshot)
+			if err != nil {
+				log.Errorw("failed to marshal snapshot", "peer", e.peer, "error", err)
+				continue
+			}
+			if err := ids.wal.Append(e.peer, b); err != nil {
+				log.Debugw("failed to append snapshot to WAL", "peer", e.peer, "error", err)
+			}
+		case <-ids.ctx.Done():
+			return
+		}
+	}
+}
+
+// ImportSnapshot imports a snapshot of peer p that was previously appended to
+// the WAL. The peer's addresses are added to the peerstore with
+// peerstore.RecentlyConnectedAddrTTL.
+// Snapshots of peers we're currently connected to are ignored, as we already
+// have more recent information about them.
+func (ids *idService) ImportSnapshot(p peer.ID, snapshot []byte) error {
+	mes := &pb.Identify{}
+	if err := proto.Unmarshal(snapshot, mes); err != nil {
+		return fmt.Errorf("failed to unmarshal snapshot: %w", err)
+	}
+
+	var addrs []ma.Multiaddr
+	if len(mes.SignedPeerRecord) > 0 {
+		signedPeerRecord, err := signedPeerRecordFromMessage(mes)
+		if err != nil {
+			return fmt.Errorf("invalid signed peer record: %w", err)
+		}
+		addrs, err = ids.consumeSignedPeerRecord(p, signedPeerRecord)
+		if err != nil {
+			return err
+		}
+	} else {
+		addrs = make([]ma.Multiaddr, 0, len(mes.ListenAddrs))
+		for _, b := range mes.ListenAddrs {
+			addr, err := ma.NewMultiaddrBytes(b)
+			if err != nil {
+				return fmt.Errorf("invalid address: %w", err)
+			}
+			addrs = append(addrs, addr)
+		}
+	}
+
+	ids.addrMu.Lock()
+	defer ids.addrMu.Unlock()
+	switch ids.Host.Network().Connectedness(p) {
+	case network.Connected, network.Limited:
+		return nil
+	}
+	ps := ids.Host.Peerstore()
+	ps.AddAddrs(p, addrs, peerstore.RecentlyConnectedAddrTTL)
+	if err := ps.SetProtocols(p, protocol.ConvertFromStrings(mes.Protocols)...); err != nil {
+		return err
+	}
+	ps.Put(p, "ProtocolVersion", mes.GetProtocolVersion())
+	ps.Put(p, "AgentVersion", mes.GetAgentVersion())
+	return nil
+}
@@ -0,0 +1,264 @@
+package identify
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/libp2p/go-libp2p/p2p/protocol/identify/pb"
+
+	"github.com/libp2p/go-msgio/pbio"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// identifyWriteBufferSize is the size of the buffer used when writing Identify messages.
+const identifyWriteBufferSize = 4 << 10
+
+// identifyMsgWriter writes length-delimited Identify messages.
+// Instead of marshaling the entire message into a buffer, it encodes it
+// field by field, such that the memory used is bounded by the size of the
+// write buffer, not by the size of the message.
+type identifyMsgWriter struct {
+	w *bufio.Writer
+}
+
+func newIdentifyMsgWriter(w io.Writer) *identifyMsgWriter {
+	return &identifyMsgWriter{w: bufio.NewWriterSize(w, identifyWriteBufferSize)}
+}
+
+// WriteMsg writes a single length-delimited message.
+// The message might be buffered until Flush is called.
+func (w *identifyMsgWriter) WriteMsg(mes *pb.Identify) error {
+	size := proto.Size(mes)
+	if size != identifyMsgSize(mes) {
+		// The message contains fields we don't know how to encode incrementally.
+		return pbio.NewDelimitedWriter(w.w).WriteMsg(mes)
+	}
+
+	if _, err := w.w.Write(protowire.AppendVarint(w.w.AvailableBuffer(), uint64(size))); err != nil {
+		return err
+	}
+	if mes.PublicKey != nil {
+		if err := w.writeBytes(1, mes.PublicKey); err != nil {
+			return err
+		}
+	}
+	for _, a := range mes.ListenAddrs {
+		if err := w.writeBytes(2, a); err != nil {
+			return err
+		}
+	}
+	for _, p := range mes.Protocols {
+		if err := w.writeString(3, p); err != nil {
+			return err
+		}
+	}
+	if mes.ObservedAddr != nil {
+		if err := w.writeBytes(4, mes.ObservedAddr); err != nil {
+			return err
+		}
+	}
+	if mes.ProtocolVersion != nil {
+		if err := w.writeString(5, *mes.ProtocolVersion); err != nil {
+			return err
+		}
+	}
+	if mes.AgentVersion != nil {
+		if err := w.writeString(6, *mes.AgentVersion); err != nil {
+			return err
+		}
+	}
+	if mes.Delta != nil {
+		if err := w.writeDelta(7, mes.Delta); err != nil {
+			return err
+		}
+	}
+	if mes.SignedPeerRecord != nil {
+		if err := w.writeBytes(8, mes.SignedPeerRecord); err != nil {
+			return err
+		}
+	}
+	if mes.Goodbye != nil {
+		b := protowire.AppendTag(w.w.AvailableBuffer(), 9, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(*mes.Goodbye))
+		if _, err := w.w.Write(b); err != nil {
+			return err
+		}
+	}
+	for _, a := range mes.ReachableAddrs {
+		if err := w.writeBytes(10, a); err != nil {
+			return err
+		}
+	}
+	if mes.Uptime != nil {
+		b := protowire.AppendTag(w.w.AvailableBuffer(), 11, protowire.VarintType)
+		b = protowire.AppendVarint(b, *mes.Uptime)
+		if _, err := w.w.Write(b); err != nil {
+			return err
+		}
+	}
+	if mes.DialbackAddr != nil {
+		if err := w.writeBytes(12, mes.DialbackAddr); err != nil {
+			return err
+		}
+	}
+	if mes.ProtocolsHash != nil {
+		if err := w.writeBytes(13, mes.ProtocolsHash); err != nil {
+			return err
+		}
+	}
+	for _, d := range mes.Deprecations {
+		if err := w.writeDeprecation(14, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush writes any buffered data to the underlying writer.
+func (w *identifyMsgWriter) Flush() error {
+	return w.w.Flush()
+}
+
+func (w *identifyMsgWriter) writeBytes(num protowire.Number, v []byte) error {
+	if err := w.writeLengthPrefix(num, len(v)); err != nil {
+		return err
+	}
+	_, err := w.w.Write(v)
+	return err
+}
+
+func (w *identifyMsgWriter) writeString(num protowire.Number, v string) error {
+	if err := w.writeLengthPrefix(num, len(v)); err != nil {
+		return err
+	}
+	_, err := w.w.WriteString(v)
+	return err
+}
+
+func (w *identifyMsgWriter) writeDelta(num protowire.Number, d *pb.Delta) error {
+	if err := w.writeLengthPrefix(num, deltaSize(d)); err != nil {
+		return err
+	}
+	for _, p := range d.AddedProtocols {
+		if err := w.writeString(1, p); err != nil {
+			return err
+		}
+	}
+	for _, p := range d.RmProtocols {
+		if err := w.writeString(2, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *identifyMsgWriter) writeDeprecation(num protowire.Number, d *pb.Deprecation) error {
+	if err := w.writeLengthPrefix(num, deprecationSize(d)); err != nil {
+		return err
+	}
+	if d.Protocol != nil {
+		if err := w.writeString(1, *d.Protocol); err != nil {
+			return err
+		}
+	}
+	if d.Notice != nil {
+		if err := w.writeString(2, *d.Notice); err != nil {
+			return err
+		}
+	}
+	if d.RemovalAfter != nil {
+		b := protowire.AppendTag(w.w.AvailableBuffer(), 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(*d.RemovalAfter))
+		if _, err := w.w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *identifyMsgWriter) writeLengthPrefix(num protowire.Number, l int) error {
+	b := protowire.AppendTag(w.w.AvailableBuffer(), num, protowire.BytesType)
+	b = protowire.AppendVarint(b, uint64(l))
+	_, err := w.w.Write(b)
+	return err
+}
+
+// identifyMsgSize calculates the encoded size of the fields of mes that
+// identifyMsgWriter knows how to encode.
+func identifyMsgSize(mes *pb.Identify) int {
+	var size int
+	if mes.PublicKey != nil {
+		size += bytesField(len(mes.PublicKey))
+	}
+	for _, a := range mes.ListenAddrs {
+		size += bytesField(len(a))
+	}
+	for _, p := range mes.Protocols {
+		size += bytesField(len(p))
+	}
+	if mes.ObservedAddr != nil {
+		size += bytesField(len(mes.ObservedAddr))
+	}
+	if mes.ProtocolVersion != nil {
+		size += bytesField(len(*mes.ProtocolVersion))
+	}
+	if mes.AgentVersion != nil {
+		size += bytesField(len(*mes.AgentVersion))
+	}
+	if mes.Delta != nil {
+		size += bytesField(deltaSize(mes.Delta))
+	}
+	if mes.SignedPeerRecord != nil {
+		size += bytesField(len(mes.SignedPeerRecord))
+	}
+	if mes.Goodbye != nil {
+		size += 2
+	}
+	for _, a := range mes.ReachableAddrs {
+		size += bytesField(len(a))
+	}
+	if mes.Uptime != nil {
+		size += 1 + protowire.SizeVarint(*mes.Uptime)
+	}
+	if mes.DialbackAddr != nil {
+		size += bytesField(len(mes.DialbackAddr))
+	}
+	if mes.ProtocolsHash != nil {
+		size += bytesField(len(mes.ProtocolsHash))
+	}
+	for _, d := range mes.Deprecations {
+		size += bytesField(deprecationSize(d))
+	}
+	return size
+}
+
+func deltaSize(d *pb.Delta) int {
+	var size int
+	for _, p := range d.AddedProtocols {
+		size += bytesField(len(p))
+	}
+	for _, p := range d.RmProtocols {
+		size += bytesField(len(p))
+	}
+	return size
+}
+
+func deprecationSize(d *pb.Deprecation) int {
+	var size int
+	if d.Protocol != nil {
+		size += bytesField(len(*d.Protocol))
+	}
+	if d.Notice != nil {
+		size += bytesField(len(*d.Notice))
+	}
+	if d.RemovalAfter != nil {
+		size += 1 + protowire.SizeVarint(uint64(*d.RemovalAfter))
+	}
+	return size
+}
+
+// bytesField returns the encoded size of a length-delimited field of n bytes.
+func bytesField(n int) int {
+	return 1 + protowire.SizeBytes(n) // all field numbers fit into a single byte tag
+}
@@ -0,0 +1,77 @@
+package identify
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"runtime"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/p2p/protocol/identify/pb"
+
+	"github.com/libp2p/go-msgio/pbio"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestIdentifyMsgWriter(t *testing.T) {
+	mes := &pb.Identify{
+		ProtocolVersion:  proto.String("ipfs/0.1.0"),
+		AgentVersion:     proto.String("go-libp2p/test"),
+		PublicKey:        []byte("public key"),
+		ListenAddrs:      [][]byte{ma.StringCast("/ip4/1.2.3.4/tcp/1").Bytes(), ma.StringCast("/ip4/1.2.3.4/udp/1/quic-v1").Bytes()},
+		ObservedAddr:     ma.StringCast("/ip4/5.6.7.8/tcp/1").Bytes(),
+		Protocols:        []string{"/foo/1.0.0", "/bar/1.0.0"},
+		SignedPeerRecord: bytes.Repeat([]byte{42}, 1000),
+		Goodbye:          proto.Bool(true),
+		ReachableAddrs:   [][]byte{ma.StringCast("/ip4/1.2.3.4/tcp/1").Bytes()},
+		Uptime:           proto.Uint64(12345),
+		DialbackAddr:     ma.StringCast("/ip4/1.2.3.4/udp/1234/quic-v1").Bytes(),
+		ProtocolsHash:    bytes.Repeat([]byte{1}, 32),
+		Delta:            &pb.Delta{AddedProtocols: []string{"/baz/1.0.0"}, RmProtocols: []string{"/qux/1.0.0"}},
+		Deprecations: []*pb.Deprecation{
+			{Protocol: proto.String("/foo/1.0.0"), Notice: proto.String("use /foo/2.0.0"), RemovalAfter: proto.Int64(1700000000)},
+			{Protocol: proto.String("/bar/1.0.0")},
+		},
+	}
+
+	var expected bytes.Buffer
+	require.NoError(t, pbio.NewDelimitedWriter(&expected).WriteMsg(mes))
+
+	var buf bytes.Buffer
+	w := newIdentifyMsgWriter(&buf)
+	require.NoError(t, w.WriteMsg(mes))
+	require.NoError(t, w.WriteMsg(&pb.Identify{}))
+	require.NoError(t, w.Flush())
+	require.True(t, bytes.HasPrefix(buf.Bytes(), expected.Bytes()), "encoding differs from proto.Marshal")
+
+	r := pbio.NewDelimitedReader(&buf, signedIDSize)
+	var decoded pb.Identify
+	require.NoError(t, r.ReadMsg(&decoded))
+	require.True(t, proto.Equal(mes, &decoded))
+	require.NoError(t, r.ReadMsg(&decoded))
+	require.True(t, proto.Equal(&pb.Identify{}, &decoded))
+	require.ErrorIs(t, r.ReadMsg(&decoded), io.EOF)
+}
+
+func TestIdentifyMsgWriterMemory(t *testing.T) {
+	mes := &pb.Identify{Delta: &pb.Delta{}}
+	for i := 0; i < 20000; i++ {
+		p := fmt.Sprintf("/a/very/long/protocol/name/that/takes/up/space/%d", i)
+		mes.Protocols = append(mes.Protocols, p)
+		mes.Delta.AddedProtocols = append(mes.Delta.AddedProtocols, p)
+		mes.Deprecations = append(mes.Deprecations, &pb.Deprecation{Protocol: proto.String(p), RemovalAfter: proto.Int64(int64(i))})
+	}
+	size := proto.Size(mes)
+	require.Greater(t, size, 1<<20)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	w := newIdentifyMsgWriter(io.Discard)
+	require.NoError(t, w.WriteMsg(mes))
+	require.NoError(t, w.Flush())
+	runtime.ReadMemStats(&after)
+	require.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(4*identifyWriteBufferSize))
+}
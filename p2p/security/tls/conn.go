@@ -2,11 +2,15 @@ package libp2ptls
 
 import (
 	"crypto/tls"
+	"time"
 
 	ci "github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
 	"github.com/libp2p/go-libp2p/core/sec"
+
+	mh "github.com/multiformats/go-multihash"
 )
 
 type conn struct {
@@ -16,6 +20,16 @@ type conn struct {
 	remotePeer      peer.ID
 	remotePubKey    ci.PubKey
 	connectionState network.ConnectionState
+	nonce           []byte
+	// identityFingerprint is the fingerprint of the identity we presented
+	identityFingerprint []byte
+	// remoteProtos are the ALPN values offered by the peer, for inbound connections
+	remoteProtos []string
+	// remoteCertExtension is the value of the libp2p extension of the peer's certificate
+	remoteCertExtension []byte
+	protocolID          protocol.ID
+	handshakeDuration   time.Duration
+	estimatedRTT        time.Duration
 }
 
 var _ sec.SecureConn = &conn{}
@@ -35,3 +49,76 @@ func (c *conn) RemotePublicKey() ci.PubKey {
 func (c *conn) ConnState() network.ConnectionState {
 	return c.connectionState
 }
+
+// ConnectionNonce returns a nonce that is unique to this connection.
+// It is derived from the TLS handshake, so both ends of the connection
+// agree on its value, and it can't be influenced by either side.
+func (c *conn) ConnectionNonce() []byte {
+	return c.nonce
+}
+
+// LocalIdentityFingerprint returns the fingerprint of the local identity that
+// was presented to the peer, see Identity.Fingerprint. This identifies the key
+// used if the transport is configured with multiple keys.
+func (c *conn) LocalIdentityFingerprint() []byte {
+	return c.identityFingerprint
+}
+
+// RemoteSupportedProtos returns the ALPN values the peer offered in its
+// ClientHello, in the peer's order of preference. This is only available on
+// inbound connections, for outbound connections it returns nil.
+func (c *conn) RemoteSupportedProtos() []string {
+	return c.remoteProtos
+}
+
+// SecuritySummary summarizes the connection for logging, see sec.SecuritySummary.
+func (c *conn) SecuritySummary() sec.SecuritySummary {
+	return sec.SecuritySummary{
+		Protocol:          string(c.protocolID),
+		PeerID:            c.remotePeer,
+		KeyType:           c.remotePubKey.Type().String(),
+		HandshakeDuration: c.handshakeDuration,
+	}
+}
+
+// NegotiatedNextProto returns the ALPN value selected during the handshake,
+// see WithNextProtos. It returns an empty string if no value was selected,
+// including if the peer selected the "libp2p" value used by peers that don't
+// support early muxer negotiation.
+func (c *conn) NegotiatedNextProto() string {
+	return string(c.connectionState.StreamMultiplexer)
+}
+
+// RemoteCertExtension returns the value of the libp2p public key extension of
+// the certificate presented by the peer: the DER encoding of the SignedKey
+// structure defined in the libp2p TLS spec, holding the peer's public key and
+// its signature over the certificate key. It returns nil if the peer's
+// certificate didn't carry the extension.
+func (c *conn) RemoteCertExtension() []byte {
+	return c.remoteCertExtension
+}
+
+// DidResume reports whether the connection resumed a previous TLS session
+// instead of running a full handshake. Sessions are only resumed if enabled on
+// both sides, see WithSessionResumption.
+func (c *conn) DidResume() bool {
+	return c.ConnectionState().DidResume
+}
+
+// RemoteIDIsInline reports whether the peer's public key is embedded in its
+// peer ID (as is the case for Ed25519 and other small keys), as opposed to
+// the peer ID being a hash of the key. Either way, the peer proved that it
+// owns the key during the handshake.
+func (c *conn) RemoteIDIsInline() bool {
+	decoded, err := mh.Decode([]byte(c.remotePeer))
+	return err == nil && decoded.Code == mh.IDENTITY
+}
+
+// EstimatedRTT returns an estimate of the round-trip time to the peer, derived
+// from the handshake: it's the time between sending our first handshake flight
+// and receiving the peer's response. This includes the time the peer spent
+// processing our flight, so it overestimates the RTT somewhat. It returns 0 if
+// no estimate is available.
+func (c *conn) EstimatedRTT() time.Duration {
+	return c.estimatedRTT
+}
@@ -3,8 +3,10 @@ package libp2ptls
 import (
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
@@ -15,9 +17,11 @@ import (
 	"math/big"
 	"os"
 	"runtime/debug"
+	"slices"
 	"time"
 
 	ic "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/crypto/pb"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/sec"
 )
@@ -26,8 +30,21 @@ const certValidityPeriod = 100 * 365 * 24 * time.Hour // ~100 years
 const certificatePrefix = "libp2p-tls-handshake:"
 const alpn string = "libp2p"
 
+// deterministicCertKeyPrefix is used to derive the certificate key from the
+// host key, see WithDeterministicCertificate.
+const deterministicCertKeyPrefix = "libp2p-tls-certificate-key:"
+
+// deterministicNotBefore is the start of the validity period of certificates
+// generated using WithDeterministicCertificate without a template.
+var deterministicNotBefore = time.Unix(0, 0).UTC()
+
+// DefaultMaxChainLength is the default limit on the number of certificates
+// in the chain presented by a peer, see WithMaxChainLength.
+const DefaultMaxChainLength = 1
+
 var extensionID = getPrefixedExtensionID([]int{1, 1})
-var extensionCritical bool // so we can mark the extension critical in tests
+var extensionCritical bool  // so we can mark the extension critical in tests
+var extensionKey ic.PrivKey // so we can bind certificates to a different key in tests
 
 type signedKey struct {
 	PubKey    []byte
@@ -36,13 +53,42 @@ type signedKey struct {
 
 // Identity is used to secure connections
 type Identity struct {
-	config tls.Config
+	config          tls.Config
+	maxCertLifetime time.Duration
+	maxChainLength  int
+	keyType         pb.KeyType
+	// certVerifyCallback is called with the peer's certificate, see WithCertVerifyCallback
+	certVerifyCallback func(*x509.Certificate) error
+	// timeSource returns the current time, for checking certificate validity. May be nil.
+	timeSource func() time.Time
+	// weakKeys are the keys that peers are not allowed to use. May be nil.
+	weakKeys *WeakKeySet
+	// fingerprint is the SHA-256 hash of our certificate
+	fingerprint []byte
 }
 
 // IdentityConfig is used to configure an Identity
 type IdentityConfig struct {
-	CertTemplate *x509.Certificate
-	KeyLogWriter io.Writer
+	CertTemplate    *x509.Certificate
+	KeyLogWriter    io.Writer
+	MaxCertLifetime time.Duration
+	MaxChainLength  int
+	// DeterministicCertificate makes the generated certificate depend only on
+	// the key (and the template), see WithDeterministicCertificate.
+	DeterministicCertificate bool
+	// CertVerifyCallback is called with the certificate presented by the peer,
+	// before it is verified. Returning an error aborts the handshake.
+	CertVerifyCallback func(*x509.Certificate) error
+	// Rand is the source of randomness used to generate the certificate.
+	// Defaults to crypto/rand.Reader.
+	Rand io.Reader
+	// TimeSource returns the current time. It is used to check the validity
+	// of certificates, and to set the validity period of the generated
+	// certificate. Defaults to the system clock.
+	TimeSource func() time.Time
+	// WeakKeys is a set of keys known to be compromised. Peers presenting one
+	// of them are rejected, and creating an identity for one of them fails.
+	WeakKeys *WeakKeySet
 }
 
 // IdentityOption transforms an IdentityConfig to apply optional settings.
@@ -67,26 +113,150 @@ func WithKeyLogWriter(w io.Writer) IdentityOption {
 	}
 }
 
+// WithMaxCertLifetime rejects peers presenting a certificate that is valid for
+// longer than d, as measured from its NotBefore to its NotAfter date.
+// This enforces the use of short-lived certificates. Note that the certificates
+// generated by default are valid for 100 years, peers need to use WithCertTemplate
+// to generate certificates that pass this check.
+func WithMaxCertLifetime(d time.Duration) IdentityOption {
+	return func(c *IdentityConfig) {
+		c.MaxCertLifetime = d
+	}
+}
+
+// WithMaxChainLength rejects peers presenting a certificate chain of more than
+// n certificates, before we parse the chain to verify it. Note that crypto/tls
+// has already parsed the chain at that point, so this only saves our own
+// parsing. libp2p peers present a single certificate, and our verification
+// rejects longer chains in any case.
+// Defaults to DefaultMaxChainLength.
+func WithMaxChainLength(n int) IdentityOption {
+	return func(c *IdentityConfig) {
+		c.MaxChainLength = n
+	}
+}
+
+// WithDeterministicCertificate makes every certificate generated for the same
+// key byte-for-byte identical, which allows pinning it. To this end:
+//   - the serial number of the certificate (and of its subject) is derived from
+//     the public key, instead of being chosen randomly,
+//   - the certificate key is an Ed25519 key derived from the private key's raw
+//     bytes, instead of a random ECDSA key,
+//   - unless a template is set using WithCertTemplate, the certificate is valid
+//     for ~100 years from the Unix epoch, instead of from the time it was
+//     generated. Peers limiting the lifetime of certificates using
+//     WithMaxCertLifetime reject it; use a template with a shorter validity
+//     period to connect to them.
+//
+// ECDSA keys are not supported, since their signatures are randomized. Neither
+// are keys held by a signer (see PrivKeyFromSigner), since the certificate key
+// is derived from the private key's raw bytes.
+func WithDeterministicCertificate() IdentityOption {
+	return func(c *IdentityConfig) {
+		c.DeterministicCertificate = true
+	}
+}
+
+// WeakKeySet is a set of public keys known to be compromised, e.g. because
+// they were leaked in a breach.
+type WeakKeySet struct {
+	keys map[string]struct{}
+}
+
+// NewWeakKeySet returns a WeakKeySet containing keys.
+func NewWeakKeySet(keys ...ic.PubKey) (*WeakKeySet, error) {
+	s := &WeakKeySet{keys: make(map[string]struct{}, len(keys))}
+	for _, k := range keys {
+		b, err := ic.MarshalPublicKey(k)
+		if err != nil {
+			return nil, err
+		}
+		s.keys[string(b)] = struct{}{}
+	}
+	return s, nil
+}
+
+// Contains reports whether key is in the set.
+func (s *WeakKeySet) Contains(key ic.PubKey) bool {
+	if s == nil || len(s.keys) == 0 {
+		return false
+	}
+	b, err := ic.MarshalPublicKey(key)
+	if err != nil {
+		return false
+	}
+	_, ok := s.keys[string(b)]
+	return ok
+}
+
 // NewIdentity creates a new identity
 func NewIdentity(privKey ic.PrivKey, opts ...IdentityOption) (*Identity, error) {
 	config := IdentityConfig{}
 	for _, opt := range opts {
 		opt(&config)
 	}
+	if config.WeakKeys.Contains(privKey.GetPublic()) {
+		return nil, ErrWeakKey
+	}
+
+	if config.MaxChainLength == 0 {
+		config.MaxChainLength = DefaultMaxChainLength
+	}
+	if config.MaxChainLength < 0 {
+		return nil, errors.New("tls: maximum chain length must be positive")
+	}
+
+	if config.Rand == nil {
+		config.Rand = rand.Reader
+	}
 
 	var err error
+	if config.CertTemplate == nil && config.DeterministicCertificate {
+		config.CertTemplate = &x509.Certificate{
+			NotBefore: deterministicNotBefore,
+			NotAfter:  deterministicNotBefore.Add(certValidityPeriod),
+		}
+	}
 	if config.CertTemplate == nil {
-		config.CertTemplate, err = certTemplate()
+		now := time.Now()
+		if config.TimeSource != nil {
+			now = config.TimeSource()
+		}
+		config.CertTemplate, err = newCertTemplate(config.Rand, now)
 		if err != nil {
 			return nil, err
 		}
 	}
+	if config.DeterministicCertificate {
+		sn, subjectSN, err := serialNumbersFromKey(privKey.GetPublic())
+		if err != nil {
+			return nil, err
+		}
+		tmpl := *config.CertTemplate
+		tmpl.SerialNumber = sn
+		tmpl.Subject.SerialNumber = subjectSN.String()
+		config.CertTemplate = &tmpl
+	}
 
-	cert, err := keyToCertificate(privKey, config.CertTemplate)
+	var cert *tls.Certificate
+	if config.DeterministicCertificate {
+		cert, err = deterministicCertificate(privKey, config.CertTemplate)
+	} else {
+		cert, err = keyToCertificate(privKey, config.CertTemplate, config.Rand)
+	}
 	if err != nil {
 		return nil, err
 	}
+	fingerprint := sha256.Sum256(cert.Certificate[0])
 	return &Identity{
+		maxCertLifetime: config.MaxCertLifetime,
+		maxChainLength:  config.MaxChainLength,
+		keyType:         privKey.Type(),
+		fingerprint:     fingerprint[:],
+
+		certVerifyCallback: config.CertVerifyCallback,
+		timeSource:         config.TimeSource,
+		weakKeys:           config.WeakKeys,
 		config: tls.Config{
 			MinVersion:         tls.VersionTLS13,
 			InsecureSkipVerify: true, // This is not insecure here. We will verify the cert chain ourselves.
@@ -102,6 +272,89 @@ func NewIdentity(privKey ic.PrivKey, opts ...IdentityOption) (*Identity, error)
 	}, nil
 }
 
+// now returns the current time, according to the identity's time source.
+func (i *Identity) now() time.Time {
+	if i.timeSource != nil {
+		return i.timeSource()
+	}
+	return time.Now()
+}
+
+// Fingerprint returns the SHA-256 hash of the certificate presented by this identity.
+func (i *Identity) Fingerprint() []byte {
+	return i.fingerprint
+}
+
+// validate checks that the identity's certificate is currently valid,
+// and that it is bound to the key of peer p.
+func (i *Identity) validate(p peer.ID) error {
+	if len(i.config.Certificates) != 1 || len(i.config.Certificates[0].Certificate) != 1 {
+		return errors.New("expected a single certificate")
+	}
+	tlsCert := i.config.Certificates[0]
+	cert, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("parsing certificate failed: %w", err)
+	}
+	now := i.now()
+	if now.Before(cert.NotBefore) {
+		return fmt.Errorf("certificate is not valid before %s", cert.NotBefore)
+	}
+	if now.After(cert.NotAfter) {
+		return fmt.Errorf("certificate expired at %s", cert.NotAfter)
+	}
+	signer, ok := tlsCert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return errors.New("certificate key is not a signer")
+	}
+	if certPub, ok := cert.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); !ok || !certPub.Equal(signer.Public()) {
+		return errors.New("certificate doesn't match its private key")
+	}
+	if i.maxCertLifetime > 0 {
+		if lifetime := cert.NotAfter.Sub(cert.NotBefore); lifetime > i.maxCertLifetime {
+			return fmt.Errorf("certificate lifetime %s exceeds the maximum of %s, peers using the same configuration will reject it", lifetime, i.maxCertLifetime)
+		}
+	}
+	pubKey, err := pubKeyFromCertChain([]*x509.Certificate{cert}, now)
+	if err != nil {
+		return err
+	}
+	if !p.MatchesPublicKey(pubKey) {
+		certPeer, err := peer.IDFromPublicKey(pubKey)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("certificate is bound to a different key (peer %s)", certPeer)
+	}
+	return nil
+}
+
+// certPeer returns the peer ID our certificate is bound to, extracted the same
+// way as from a peer's certificate. The validity period is not checked.
+func (i *Identity) certPeer() (peer.ID, error) {
+	cert, err := i.certificate()
+	if err != nil {
+		return "", err
+	}
+	pubKey, err := pubKeyFromCertChain([]*x509.Certificate{cert}, cert.NotBefore)
+	if err != nil {
+		return "", err
+	}
+	return peer.IDFromPublicKey(pubKey)
+}
+
+// certificate returns the parsed certificate presented by this identity.
+func (i *Identity) certificate() (*x509.Certificate, error) {
+	if len(i.config.Certificates) != 1 || len(i.config.Certificates[0].Certificate) != 1 {
+		return nil, errors.New("expected a single certificate")
+	}
+	cert, err := x509.ParseCertificate(i.config.Certificates[0].Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("parsing certificate failed: %w", err)
+	}
+	return cert, nil
+}
+
 // ConfigForPeer creates a new single-use tls.Config that verifies the peer's
 // certificate chain and returns the peer's public key via the channel. If the
 // peer ID is empty, the returned config will accept any peer.
@@ -110,6 +363,10 @@ func NewIdentity(privKey ic.PrivKey, opts ...IdentityOption) (*Identity, error)
 // incoming or outgoing connection.
 func (i *Identity) ConfigForPeer(remote peer.ID) (*tls.Config, <-chan ic.PubKey) {
 	keyCh := make(chan ic.PubKey, 1)
+	return i.configForPeer(remote, keyCh), keyCh
+}
+
+func (i *Identity) configForPeer(remote peer.ID, keyCh chan<- ic.PubKey) *tls.Config {
 	// We need to check the peer ID in the VerifyPeerCertificate callback.
 	// The tls.Config it is also used for listening, and we might also have concurrent dials.
 	// Clone it so we can check for the specific peer ID we're dialing here.
@@ -127,34 +384,96 @@ func (i *Identity) ConfigForPeer(remote peer.ID) (*tls.Config, <-chan ic.PubKey)
 
 		defer close(keyCh)
 
+		if len(rawCerts) > i.maxChainLength {
+			return chainTooLongError(len(rawCerts), i.maxChainLength)
+		}
 		chain := make([]*x509.Certificate, len(rawCerts))
 		for i := 0; i < len(rawCerts); i++ {
 			cert, err := x509.ParseCertificate(rawCerts[i])
 			if err != nil {
-				return err
+				return certificateError{err}
 			}
 			chain[i] = cert
 		}
-
-		pubKey, err := PubKeyFromCertChain(chain)
+		pubKey, err := i.verifyChain(remote, chain)
 		if err != nil {
 			return err
 		}
-		if remote != "" && !remote.MatchesPublicKey(pubKey) {
-			peerID, err := peer.IDFromPublicKey(pubKey)
-			if err != nil {
-				peerID = peer.ID(fmt.Sprintf("(not determined: %s)", err.Error()))
-			}
-			return sec.ErrPeerIDMismatch{Expected: remote, Actual: peerID}
+		keyCh <- pubKey
+		return nil
+	}
+	// VerifyPeerCertificate is not called when a session is resumed. The peer
+	// proved possession of the session's secret, which was established with the
+	// certificate chain we verified during the original handshake. Our
+	// configuration might have changed since then though, so verify the chain
+	// again.
+	conf.VerifyConnection = func(cs tls.ConnectionState) error {
+		if !cs.DidResume {
+			return nil
+		}
+		defer close(keyCh)
+
+		if len(cs.PeerCertificates) > i.maxChainLength {
+			return chainTooLongError(len(cs.PeerCertificates), i.maxChainLength)
+		}
+		pubKey, err := i.verifyChain(remote, cs.PeerCertificates)
+		if err != nil {
+			return err
 		}
 		keyCh <- pubKey
 		return nil
 	}
-	return conf, keyCh
+	return conf
+}
+
+// verifyChain verifies the certificate chain presented by the remote peer,
+// and returns the peer's public key.
+func (i *Identity) verifyChain(remote peer.ID, chain []*x509.Certificate) (ic.PubKey, error) {
+	if i.certVerifyCallback != nil && len(chain) > 0 {
+		if err := i.certVerifyCallback(chain[0]); err != nil {
+			return nil, certificateError{err}
+		}
+	}
+	if i.maxCertLifetime > 0 && len(chain) > 0 {
+		if lifetime := chain[0].NotAfter.Sub(chain[0].NotBefore); lifetime > i.maxCertLifetime {
+			return nil, certificateError{fmt.Errorf("certificate lifetime %s exceeds the maximum of %s", lifetime, i.maxCertLifetime)}
+		}
+	}
+
+	pubKey, err := pubKeyFromCertChain(chain, i.now())
+	if err != nil {
+		return nil, certificateError{err}
+	}
+	if i.weakKeys.Contains(pubKey) {
+		return nil, certificateError{ErrWeakKey}
+	}
+	if remote != "" && !remote.MatchesPublicKey(pubKey) {
+		return nil, peerIDMismatchError(remote, pubKey)
+	}
+	return pubKey, nil
+}
+
+func chainTooLongError(n, maxChainLength int) error {
+	return certificateError{fmt.Errorf("certificate chain too long: got %d certificates, expected at most %d", n, maxChainLength)}
+}
+
+// peerIDMismatchError returns the error for a peer that authenticated with
+// pubKey, when we expected to connect to the remote peer.
+func peerIDMismatchError(remote peer.ID, pubKey ic.PubKey) error {
+	peerID, err := peer.IDFromPublicKey(pubKey)
+	if err != nil {
+		peerID = peer.ID(fmt.Sprintf("(not determined: %s)", err.Error()))
+	}
+	return peerIDMismatch{sec.ErrPeerIDMismatch{Expected: remote, Actual: peerID}}
 }
 
 // PubKeyFromCertChain verifies the certificate chain and extract the remote's public key.
 func PubKeyFromCertChain(chain []*x509.Certificate) (ic.PubKey, error) {
+	return pubKeyFromCertChain(chain, time.Now())
+}
+
+// pubKeyFromCertChain is PubKeyFromCertChain, checking the validity of the certificate at time now.
+func pubKeyFromCertChain(chain []*x509.Certificate, now time.Time) (ic.PubKey, error) {
 	if len(chain) != 1 {
 		return nil, errors.New("expected one certificates in the chain")
 	}
@@ -181,7 +500,7 @@ func PubKeyFromCertChain(chain []*x509.Certificate) (ic.PubKey, error) {
 	if !found {
 		return nil, errors.New("expected certificate to contain the key extension")
 	}
-	if _, err := cert.Verify(x509.VerifyOptions{Roots: pool}); err != nil {
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: pool, CurrentTime: now}); err != nil {
 		// If we return an x509 error here, it will be sent on the wire.
 		// Wrap the error to avoid that.
 		return nil, fmt.Errorf("certificate verification failed: %s", err)
@@ -209,6 +528,35 @@ func PubKeyFromCertChain(chain []*x509.Certificate) (ic.PubKey, error) {
 	return pubKey, nil
 }
 
+// libp2pExtension returns the value of the libp2p key extension of the
+// certificate, or nil if it doesn't contain the extension.
+func libp2pExtension(cert *x509.Certificate) []byte {
+	for _, ext := range cert.Extensions {
+		if extensionIDEqual(ext.Id, extensionID) {
+			return ext.Value
+		}
+	}
+	return nil
+}
+
+// peerIDFromCert returns the peer ID of the key in the libp2p key extension of
+// the certificate. It doesn't verify the certificate.
+func peerIDFromCert(cert *x509.Certificate) (peer.ID, error) {
+	ext := libp2pExtension(cert)
+	if ext == nil {
+		return "", errors.New("expected certificate to contain the key extension")
+	}
+	var sk signedKey
+	if _, err := asn1.Unmarshal(ext, &sk); err != nil {
+		return "", fmt.Errorf("unmarshalling signed certificate failed: %s", err)
+	}
+	pubKey, err := ic.UnmarshalPublicKey(sk.PubKey)
+	if err != nil {
+		return "", fmt.Errorf("unmarshalling public key failed: %s", err)
+	}
+	return peer.IDFromPublicKey(pubKey)
+}
+
 // GenerateSignedExtension uses the provided private key to sign the public key, and returns the
 // signature within a pkix.Extension.
 // This extension is included in a certificate to cryptographically tie it to the libp2p private key.
@@ -239,20 +587,49 @@ func GenerateSignedExtension(sk ic.PrivKey, pubKey crypto.PublicKey) (pkix.Exten
 // keyToCertificate generates a new ECDSA private key and corresponding x509 certificate.
 // The certificate includes an extension that cryptographically ties it to the provided libp2p
 // private key to authenticate TLS connections.
-func keyToCertificate(sk ic.PrivKey, certTmpl *x509.Certificate) (*tls.Certificate, error) {
-	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+func keyToCertificate(sk ic.PrivKey, certTmpl *x509.Certificate, r io.Reader) (*tls.Certificate, error) {
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), r)
 	if err != nil {
 		return nil, err
 	}
+	return signCertificate(sk, certKey, certTmpl, r)
+}
+
+// deterministicCertificate generates a certificate that only depends on sk and
+// the template, see WithDeterministicCertificate. The certificate key is an
+// Ed25519 key derived from sk, since Ed25519 signatures are deterministic.
+func deterministicCertificate(sk ic.PrivKey, certTmpl *x509.Certificate) (*tls.Certificate, error) {
+	if sk.Type() == pb.KeyType_ECDSA {
+		return nil, errors.New("tls: deterministic certificates are not supported for ECDSA keys")
+	}
+	if _, ok := sk.(*signerKey); ok {
+		return nil, errors.New("tls: deterministic certificates are not supported for keys held by a signer")
+	}
+	raw, err := sk.Raw()
+	if err != nil {
+		return nil, err
+	}
+	seed := sha256.Sum256(append([]byte(deterministicCertKeyPrefix), raw...))
+	// Ed25519 signing doesn't use the source of randomness.
+	return signCertificate(sk, ed25519.NewKeyFromSeed(seed[:]), certTmpl, rand.Reader)
+}
 
+// signCertificate generates the x509 certificate for certKey, including the
+// extension signed by sk.
+func signCertificate(sk ic.PrivKey, certKey crypto.Signer, certTmpl *x509.Certificate, r io.Reader) (*tls.Certificate, error) {
+	if extensionKey != nil {
+		sk = extensionKey
+	}
 	// after calling CreateCertificate, these will end up in Certificate.Extensions
 	extension, err := GenerateSignedExtension(sk, certKey.Public())
 	if err != nil {
 		return nil, err
 	}
-	certTmpl.ExtraExtensions = append(certTmpl.ExtraExtensions, extension)
+	// The template may be shared between identities, so don't modify it.
+	tmpl := *certTmpl
+	tmpl.ExtraExtensions = append(slices.Clip(certTmpl.ExtraExtensions), extension)
 
-	certDER, err := x509.CreateCertificate(rand.Reader, certTmpl, certTmpl, certKey.Public(), certKey)
+	certDER, err := x509.CreateCertificate(r, &tmpl, &tmpl, certKey.Public(), certKey)
 	if err != nil {
 		return nil, err
 	}
@@ -262,23 +639,44 @@ func keyToCertificate(sk ic.PrivKey, certTmpl *x509.Certificate) (*tls.Certifica
 	}, nil
 }
 
+// serialNumbersFromKey derives the serial numbers of the certificate and its
+// subject from the public key, see WithDeterministicCertificate.
+// Like the random serial numbers, they are positive and smaller than 2^62.
+func serialNumbersFromKey(pubKey ic.PubKey) (sn, subjectSN *big.Int, err error) {
+	keyBytes, err := ic.MarshalPublicKey(pubKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	h := sha256.Sum256(append([]byte(certificatePrefix), keyBytes...))
+	bigNum := big.NewInt(1 << 62)
+	sn = new(big.Int).Mod(new(big.Int).SetBytes(h[:16]), bigNum)
+	subjectSN = new(big.Int).Mod(new(big.Int).SetBytes(h[16:]), bigNum)
+	return sn, subjectSN, nil
+}
+
 // certTemplate returns the template for generating an Identity's TLS certificates.
 func certTemplate() (*x509.Certificate, error) {
+	return newCertTemplate(rand.Reader, time.Now())
+}
+
+// newCertTemplate returns a certificate template valid from (shortly before) now,
+// using r to choose the serial numbers.
+func newCertTemplate(r io.Reader, now time.Time) (*x509.Certificate, error) {
 	bigNum := big.NewInt(1 << 62)
-	sn, err := rand.Int(rand.Reader, bigNum)
+	sn, err := rand.Int(r, bigNum)
 	if err != nil {
 		return nil, err
 	}
 
-	subjectSN, err := rand.Int(rand.Reader, bigNum)
+	subjectSN, err := rand.Int(r, bigNum)
 	if err != nil {
 		return nil, err
 	}
 
 	return &x509.Certificate{
 		SerialNumber: sn,
-		NotBefore:    time.Now().Add(-time.Hour),
-		NotAfter:     time.Now().Add(certValidityPeriod),
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(certValidityPeriod),
 		// According to RFC 3280, the issuer field must be set,
 		// see https://datatracker.ietf.org/doc/html/rfc3280#section-4.1.2.4.
 		Subject: pkix.Name{SerialNumber: subjectSN.String()},
@@ -1,10 +1,14 @@
 package libp2ptls
 
 import (
+	"bytes"
+	"crypto/rand"
 	"crypto/x509"
 	"encoding/hex"
 	"testing"
+	"time"
 
+	ic "github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/peer"
 
 	"github.com/stretchr/testify/assert"
@@ -49,6 +53,52 @@ func TestNewIdentityCertificates(t *testing.T) {
 		assert.Equal(t, cn, x509Cert.Subject.CommonName)
 		assert.Equal(t, email, x509Cert.EmailAddresses[0])
 	})
+
+	t.Run("NewIdentity with deterministic certificate", func(t *testing.T) {
+		certificate := func(key ic.PrivKey) []byte {
+			id, err := NewIdentity(key, WithDeterministicCertificate())
+			require.NoError(t, err)
+			p, err := peer.IDFromPrivateKey(key)
+			require.NoError(t, err)
+			require.NoError(t, id.validate(p))
+			return id.config.Certificates[0].Certificate[0]
+		}
+
+		ed25519Key, _, err := ic.GenerateEd25519Key(rand.Reader)
+		require.NoError(t, err)
+		rsaKey, _, err := ic.GenerateRSAKeyPair(2048, rand.Reader)
+		require.NoError(t, err)
+		secp256k1Key, _, err := ic.GenerateSecp256k1Key(rand.Reader)
+		require.NoError(t, err)
+		for _, key := range []ic.PrivKey{ed25519Key, rsaKey, secp256k1Key} {
+			cert1 := certificate(key)
+			cert2 := certificate(key)
+			require.True(t, bytes.Equal(cert1, cert2), "certificates for %s key differ", key.Type())
+
+			x509Cert, err := x509.ParseCertificate(cert1)
+			require.NoError(t, err)
+			require.Positive(t, x509Cert.SerialNumber.Sign())
+			require.Equal(t, deterministicNotBefore, x509Cert.NotBefore)
+		}
+		require.False(t, bytes.Equal(certificate(ed25519Key), certificate(secp256k1Key)))
+
+		// a configured template is used as is, apart from the serial numbers
+		tmpl, err := certTemplate()
+		require.NoError(t, err)
+		id, err := NewIdentity(ed25519Key, WithDeterministicCertificate(), WithCertTemplate(tmpl))
+		require.NoError(t, err)
+		x509Cert, err := x509.ParseCertificate(id.config.Certificates[0].Certificate[0])
+		require.NoError(t, err)
+		require.Equal(t, tmpl.NotBefore.Truncate(time.Second).UTC(), x509Cert.NotBefore)
+		require.NotEqual(t, tmpl.SerialNumber, x509Cert.SerialNumber)
+
+		ecdsaKey, _, err := ic.GenerateECDSAKeyPair(rand.Reader)
+		require.NoError(t, err)
+		_, err = NewIdentity(ecdsaKey, WithDeterministicCertificate())
+		require.ErrorContains(t, err, "not supported for ECDSA keys")
+		_, err = NewIdentity(PrivKeyFromSigner(&recordingSigner{key: ed25519Key}), WithDeterministicCertificate())
+		require.ErrorContains(t, err, "not supported for keys held by a signer")
+	})
 }
 
 func TestVectors(t *testing.T) {
@@ -0,0 +1,42 @@
+package libp2ptls
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// entropyPollInterval is the interval at which WaitForEntropy polls the EntropySource.
+const entropyPollInterval = 50 * time.Millisecond
+
+// ErrEntropyNotReady is returned when the EntropySource didn't report
+// sufficient entropy in time.
+var ErrEntropyNotReady = errors.New("tls: entropy source not ready")
+
+// EntropySource reports whether the random number generator used for key and
+// certificate generation has been seeded with sufficient entropy. On embedded
+// devices, this might not be the case right after boot, and generating keys
+// at that point results in weak key material.
+type EntropySource interface {
+	Ready() bool
+}
+
+// WaitForEntropy blocks until src reports sufficient entropy.
+// It returns ErrEntropyNotReady if ctx is done first.
+func WaitForEntropy(ctx context.Context, src EntropySource) error {
+	if src.Ready() {
+		return nil
+	}
+	ticker := time.NewTicker(entropyPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ErrEntropyNotReady
+		case <-ticker.C:
+			if src.Ready() {
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package libp2ptls
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/sec"
+)
+
+// HandshakeErrorClass is the category of a handshake error.
+// It allows callers to decide how to react to a failed handshake,
+// e.g. whether to retry, try a different address or give up on the peer.
+type HandshakeErrorClass int
+
+const (
+	// HandshakeErrorUnknown is used for errors that don't fit any other class.
+	HandshakeErrorUnknown HandshakeErrorClass = iota
+	// HandshakeErrorPeerIDMismatch means that the peer presented a valid certificate,
+	// but for a different peer ID than expected.
+	HandshakeErrorPeerIDMismatch
+	// HandshakeErrorCertInvalid means that a certificate failed verification,
+	// either ours (as reported by the peer) or the peer's.
+	HandshakeErrorCertInvalid
+	// HandshakeErrorTransport means that the underlying connection failed.
+	HandshakeErrorTransport
+	// HandshakeErrorTimeout means that the handshake didn't complete in time.
+	HandshakeErrorTimeout
+	// HandshakeErrorThrottled means that the handshake was rejected due to resource limits.
+	HandshakeErrorThrottled
+	// HandshakeErrorCanceled means that the handshake was canceled, either via
+	// its context or its HandshakeHandle.
+	HandshakeErrorCanceled
+)
+
+func (c HandshakeErrorClass) String() string {
+	switch c {
+	case HandshakeErrorPeerIDMismatch:
+		return "peer ID mismatch"
+	case HandshakeErrorCertInvalid:
+		return "cert invalid"
+	case HandshakeErrorTransport:
+		return "transport"
+	case HandshakeErrorTimeout:
+		return "timeout"
+	case HandshakeErrorThrottled:
+		return "throttled"
+	case HandshakeErrorCanceled:
+		return "canceled"
+	default:
+		return "unknown"
+	}
+}
+
+// ErrNoCommonMuxer is returned when the peers didn't offer any stream multiplexer
+// in common during the handshake, and the transport is configured to fail in
+// that case, see WithRequireCommonMuxer.
+// Local and Remote are the multiplexers offered by the respective side.
+type ErrNoCommonMuxer struct {
+	Local  []string
+	Remote []string
+}
+
+func (e ErrNoCommonMuxer) Error() string {
+	return fmt.Sprintf("tls: no common stream multiplexer (local: %s, remote: %s)", strings.Join(e.Local, ", "), strings.Join(e.Remote, ", "))
+}
+
+// ErrWeakKey is returned when a key is in the weak key set, see WithWeakKeySet.
+// This applies both to the keys presented by peers and to our own keys.
+var ErrWeakKey = errors.New("tls: key is known to be weak")
+
+// ErrPeerIDMismatch is matched by the errors returned when the peer presented a
+// valid certificate for a different peer ID than expected, allowing callers to
+// use errors.Is. The error also unwraps to a sec.ErrPeerIDMismatch carrying
+// the expected and the actual peer ID.
+var ErrPeerIDMismatch = errors.New("tls: peer ID mismatch")
+
+// peerIDMismatch is the error returned when the peer's ID doesn't match the expected one.
+// It doesn't change the error message of sec.ErrPeerIDMismatch.
+type peerIDMismatch struct {
+	sec.ErrPeerIDMismatch
+}
+
+func (e peerIDMismatch) Unwrap() error        { return e.ErrPeerIDMismatch }
+func (e peerIDMismatch) Is(target error) bool { return target == ErrPeerIDMismatch }
+
+// certificateError is returned when verification of the peer's certificate chain fails.
+// It doesn't change the error message.
+type certificateError struct {
+	err error
+}
+
+func (e certificateError) Error() string { return e.err.Error() }
+func (e certificateError) Unwrap() error { return e.err }
+
+// certificateAlerts are the TLS alerts sent by a peer that failed to verify our certificate.
+var certificateAlerts = []string{
+	"tls: bad certificate",
+	"tls: unsupported certificate",
+	"tls: revoked certificate",
+	"tls: expired certificate",
+	"tls: unknown certificate",
+	"tls: unknown certificate authority",
+	"tls: certificate required",
+	// sent if the signature in the CertificateVerify message doesn't match the certificate
+	"tls: error decrypting message",
+}
+
+// ClassifyHandshakeError returns the class of an error returned by
+// SecureInbound or SecureOutbound, or by the first Read on a connection
+// returned from SecureOutbound (see SecureOutbound).
+func ClassifyHandshakeError(err error) HandshakeErrorClass {
+	if err == nil {
+		return HandshakeErrorUnknown
+	}
+	if errors.As(err, new(sec.ErrPeerIDMismatch)) {
+		return HandshakeErrorPeerIDMismatch
+	}
+	if errors.As(err, new(certificateError)) || errors.Is(err, ErrPeerNotVerified) {
+		return HandshakeErrorCertInvalid
+	}
+	if errors.Is(err, network.ErrResourceLimitExceeded) {
+		return HandshakeErrorThrottled
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, ErrHandshakeCanceled) {
+		return HandshakeErrorCanceled
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return HandshakeErrorTimeout
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "remote error" {
+		for _, a := range certificateAlerts {
+			if opErr.Err.Error() == a {
+				return HandshakeErrorCertInvalid
+			}
+		}
+		return HandshakeErrorUnknown
+	}
+	// returned by crypto/tls if the peer's handshake signature doesn't match its certificate
+	if strings.HasPrefix(err.Error(), "tls: invalid signature by the ") {
+		return HandshakeErrorCertInvalid
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return HandshakeErrorTimeout
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) || opErr != nil {
+		return HandshakeErrorTransport
+	}
+	return HandshakeErrorUnknown
+}
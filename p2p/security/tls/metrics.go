@@ -0,0 +1,23 @@
+package libp2ptls
+
+// MetricsTracer is notified about the outcome of handshakes, see WithMetricsTracer.
+// Its methods are called synchronously at the end of SecureInbound and
+// SecureOutbound, and must not block.
+// A Prometheus implementation is provided by the tlsmetrics package.
+type MetricsTracer interface {
+	// IncHandshakeSuccess is called for every successful handshake.
+	IncHandshakeSuccess()
+	// IncHandshakeFailure is called for every failed handshake.
+	// reason is the result of ClassifyHandshakeError, and allows distinguishing
+	// failed verifications (the peer was rejected) from problems with the
+	// underlying connection.
+	IncHandshakeFailure(reason HandshakeErrorClass)
+}
+
+// NoopMetricsTracer is a MetricsTracer that discards all events.
+type NoopMetricsTracer struct{}
+
+var _ MetricsTracer = NoopMetricsTracer{}
+
+func (NoopMetricsTracer) IncHandshakeSuccess()                    {}
+func (NoopMetricsTracer) IncHandshakeFailure(HandshakeErrorClass) {}
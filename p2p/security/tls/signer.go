@@ -0,0 +1,48 @@
+package libp2ptls
+
+import (
+	"errors"
+
+	ci "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/crypto/pb"
+)
+
+// errKeyNotExportable is returned when trying to access the raw bytes of a
+// key backed by a Signer.
+var errKeyNotExportable = errors.New("tls: private key is held by a signer and can't be exported")
+
+// Signer signs data with a libp2p private key it doesn't expose, e.g. because
+// the key is stored in an HSM or a KMS.
+type Signer interface {
+	// Public returns the public key of the signing key.
+	Public() ci.PubKey
+	// Sign signs data, the same way the private key's Sign method would.
+	Sign(data []byte) ([]byte, error)
+}
+
+// PrivKeyFromSigner returns a private key that delegates signing to s.
+// It can be passed to New (and NewIdentity) in place of the private key.
+// The transport only uses the libp2p key to sign the certificate when an
+// identity is created. Handshakes are run using the certificate's key, so
+// the private key never needs to leave the signer.
+// The returned key can't be marshaled.
+func PrivKeyFromSigner(s Signer) ci.PrivKey {
+	return &signerKey{signer: s}
+}
+
+type signerKey struct {
+	signer Signer
+}
+
+var _ ci.PrivKey = &signerKey{}
+
+func (k *signerKey) Sign(data []byte) ([]byte, error) { return k.signer.Sign(data) }
+func (k *signerKey) GetPublic() ci.PubKey             { return k.signer.Public() }
+func (k *signerKey) Type() pb.KeyType                 { return k.signer.Public().Type() }
+func (k *signerKey) Raw() ([]byte, error)             { return nil, errKeyNotExportable }
+
+// Equals returns true if other is a key for the same key pair.
+func (k *signerKey) Equals(other ci.Key) bool {
+	otherKey, ok := other.(ci.PrivKey)
+	return ok && k.signer.Public().Equals(otherKey.GetPublic())
+}
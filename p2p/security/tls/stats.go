@@ -0,0 +1,103 @@
+package libp2ptls
+
+import (
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/crypto/pb"
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// DefaultHandshakeStatsWindow is the default number of handshakes the
+// HandshakeStats are computed over, see WithHandshakeStatsWindow.
+const DefaultHandshakeStatsWindow = 1000
+
+// UnknownKeyType is the key type failed handshakes are counted under in
+// HandshakeStats.ByKeyType, since we don't know the peer's key then.
+const UnknownKeyType pb.KeyType = -1
+
+// HandshakeCounts is the number of succeeded and failed handshakes.
+type HandshakeCounts struct {
+	Succeeded int
+	Failed    int
+}
+
+// SuccessRate returns the fraction of handshakes that succeeded.
+// It returns 0 if no handshakes were performed.
+func (c HandshakeCounts) SuccessRate() float64 {
+	if c.Succeeded+c.Failed == 0 {
+		return 0
+	}
+	return float64(c.Succeeded) / float64(c.Succeeded+c.Failed)
+}
+
+func (c *HandshakeCounts) add(success bool) {
+	if success {
+		c.Succeeded++
+	} else {
+		c.Failed++
+	}
+}
+
+// HandshakeStats are the outcomes of the most recent handshakes, see Transport.HandshakeStats.
+type HandshakeStats struct {
+	Total HandshakeCounts
+	// ByDirection splits the handshakes by direction.
+	ByDirection map[network.Direction]HandshakeCounts
+	// ByKeyType splits the handshakes by the type of the peer's key.
+	// Failed handshakes are counted under UnknownKeyType.
+	ByKeyType map[pb.KeyType]HandshakeCounts
+}
+
+type handshakeOutcome struct {
+	dir     network.Direction
+	keyType pb.KeyType
+	success bool
+}
+
+// handshakeStats is a ring buffer of the outcomes of the most recent handshakes.
+type handshakeStats struct {
+	mx       sync.Mutex
+	outcomes []handshakeOutcome
+	next     int
+	full     bool
+}
+
+func newHandshakeStats(window int) *handshakeStats {
+	return &handshakeStats{outcomes: make([]handshakeOutcome, window)}
+}
+
+func (s *handshakeStats) record(dir network.Direction, keyType pb.KeyType, success bool) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.outcomes[s.next] = handshakeOutcome{dir: dir, keyType: keyType, success: success}
+	s.next++
+	if s.next == len(s.outcomes) {
+		s.next = 0
+		s.full = true
+	}
+}
+
+func (s *handshakeStats) stats() HandshakeStats {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	stats := HandshakeStats{
+		ByDirection: make(map[network.Direction]HandshakeCounts, 2),
+		ByKeyType:   make(map[pb.KeyType]HandshakeCounts),
+	}
+	outcomes := s.outcomes[:s.next]
+	if s.full {
+		outcomes = s.outcomes
+	}
+	for _, o := range outcomes {
+		stats.Total.add(o.success)
+		dirCounts := stats.ByDirection[o.dir]
+		dirCounts.add(o.success)
+		stats.ByDirection[o.dir] = dirCounts
+		keyCounts := stats.ByKeyType[o.keyType]
+		keyCounts.add(o.success)
+		stats.ByKeyType[o.keyType] = keyCounts
+	}
+	return stats
+}
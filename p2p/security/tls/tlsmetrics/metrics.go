@@ -0,0 +1,73 @@
+// Package tlsmetrics provides a Prometheus implementation of the TLS
+// transport's MetricsTracer.
+package tlsmetrics
+
+import (
+	"github.com/libp2p/go-libp2p/p2p/metricshelper"
+	libp2ptls "github.com/libp2p/go-libp2p/p2p/security/tls"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricNamespace = "libp2p_tls"
+
+var (
+	handshakes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Name:      "handshakes_total",
+			Help:      "Handshakes by outcome",
+		},
+		[]string{"outcome"},
+	)
+	handshakeFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Name:      "handshake_failures_total",
+			Help:      "Failed handshakes by reason",
+		},
+		[]string{"reason"},
+	)
+	collectors = []prometheus.Collector{
+		handshakes,
+		handshakeFailures,
+	}
+)
+
+type metricsTracer struct{}
+
+var _ libp2ptls.MetricsTracer = &metricsTracer{}
+
+type metricsTracerSetting struct {
+	reg prometheus.Registerer
+}
+
+type MetricsTracerOption func(*metricsTracerSetting)
+
+func WithRegisterer(reg prometheus.Registerer) MetricsTracerOption {
+	return func(s *metricsTracerSetting) {
+		if reg != nil {
+			s.reg = reg
+		}
+	}
+}
+
+// NewMetricsTracer returns a MetricsTracer that records handshake outcomes as
+// Prometheus metrics. Pass it to the transport using libp2ptls.WithMetricsTracer.
+func NewMetricsTracer(opts ...MetricsTracerOption) libp2ptls.MetricsTracer {
+	setting := &metricsTracerSetting{reg: prometheus.DefaultRegisterer}
+	for _, opt := range opts {
+		opt(setting)
+	}
+	metricshelper.RegisterCollectors(setting.reg, collectors...)
+	return &metricsTracer{}
+}
+
+func (t *metricsTracer) IncHandshakeSuccess() {
+	handshakes.WithLabelValues("success").Inc()
+}
+
+func (t *metricsTracer) IncHandshakeFailure(reason libp2ptls.HandshakeErrorClass) {
+	handshakes.WithLabelValues("failure").Inc()
+	handshakeFailures.WithLabelValues(reason.String()).Inc()
+}
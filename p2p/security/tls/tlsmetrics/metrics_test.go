@@ -0,0 +1,36 @@
+package tlsmetrics
+
+import (
+	"testing"
+
+	libp2ptls "github.com/libp2p/go-libp2p/p2p/security/tls"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+func getCounterValue(t *testing.T, counter *prometheus.CounterVec, labels ...string) int {
+	t.Helper()
+	m := &dto.Metric{}
+	require.NoError(t, counter.WithLabelValues(labels...).Write(m))
+	return int(*m.Counter.Value)
+}
+
+func TestMetricsTracer(t *testing.T) {
+	handshakes.Reset()
+	handshakeFailures.Reset()
+
+	tr := NewMetricsTracer(WithRegisterer(prometheus.NewRegistry()))
+	tr.IncHandshakeSuccess()
+	tr.IncHandshakeSuccess()
+	tr.IncHandshakeFailure(libp2ptls.HandshakeErrorTimeout)
+	tr.IncHandshakeFailure(libp2ptls.HandshakeErrorCertInvalid)
+	tr.IncHandshakeFailure(libp2ptls.HandshakeErrorTimeout)
+
+	require.Equal(t, 2, getCounterValue(t, handshakes, "success"))
+	require.Equal(t, 3, getCounterValue(t, handshakes, "failure"))
+	require.Equal(t, 2, getCounterValue(t, handshakeFailures, "timeout"))
+	require.Equal(t, 1, getCounterValue(t, handshakeFailures, "cert invalid"))
+	require.Equal(t, 0, getCounterValue(t, handshakeFailures, "canceled"))
+}
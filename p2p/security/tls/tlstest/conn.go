@@ -0,0 +1,67 @@
+// Package tlstest provides helpers for testing how code built on top of the
+// libp2p TLS transport reacts to security failures.
+package tlstest
+
+import (
+	"crypto/rand"
+	"net"
+	"sync"
+)
+
+const (
+	recordTypeApplicationData = 23
+	// corruptRecordLen is the length of the payload of an injected record. It is
+	// longer than the AEAD tag, so the record fails authentication, not parsing.
+	corruptRecordLen = 32
+)
+
+// Conn wraps the insecure net.Conn that is secured by the TLS transport, and
+// allows injecting faults into the secured connection, see InjectCorruptRecord.
+//
+// It is only meant to be used in tests.
+type Conn struct {
+	net.Conn
+
+	mx       sync.Mutex
+	injected []byte
+}
+
+var _ net.Conn = &Conn{}
+
+// NewConn wraps c. Pass the returned Conn to SecureInbound or SecureOutbound
+// instead of c.
+func NewConn(c net.Conn) *Conn {
+	return &Conn{Conn: c}
+}
+
+// InjectCorruptRecord injects a TLS record with a random payload into the data
+// read from the connection. The record can't be decrypted, so the next Read on
+// the secured connection fails with a TLS decryption error ("bad record MAC"),
+// and the connection becomes unusable. Data that has already been read from the
+// wrapped connection is not affected.
+// It must only be called after the handshake completed.
+func (c *Conn) InjectCorruptRecord() {
+	record := make([]byte, 5+corruptRecordLen)
+	record[0] = recordTypeApplicationData
+	record[1], record[2] = 3, 3 // legacy record version TLS 1.2, as used by TLS 1.3
+	record[3], record[4] = 0, corruptRecordLen
+	rand.Read(record[5:])
+
+	c.mx.Lock()
+	c.injected = append(c.injected, record...)
+	c.mx.Unlock()
+}
+
+// Read returns the injected data (if any) before reading from the wrapped
+// connection.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mx.Lock()
+	if len(c.injected) > 0 {
+		n := copy(b, c.injected)
+		c.injected = c.injected[n:]
+		c.mx.Unlock()
+		return n, nil
+	}
+	c.mx.Unlock()
+	return c.Conn.Read(b)
+}
@@ -0,0 +1,70 @@
+package tlstest
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"testing"
+
+	ic "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/sec"
+	libp2ptls "github.com/libp2p/go-libp2p/p2p/security/tls"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTransport(t *testing.T) (*libp2ptls.Transport, peer.ID) {
+	t.Helper()
+	priv, _, err := ic.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	id, err := peer.IDFromPrivateKey(priv)
+	require.NoError(t, err)
+	tr, err := libp2ptls.New(libp2ptls.ID, priv, nil)
+	require.NoError(t, err)
+	return tr, id
+}
+
+func TestInjectCorruptRecord(t *testing.T) {
+	clientTransport, _ := newTransport(t)
+	serverTransport, serverID := newTransport(t)
+
+	// Don't use a net.Pipe: Writes block until the data is read, which deadlocks when sending the TLS alert.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	clientInsecure, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer clientInsecure.Close()
+	serverInsecure, err := ln.Accept()
+	require.NoError(t, err)
+	defer serverInsecure.Close()
+	clientFault := NewConn(clientInsecure)
+
+	serverConnChan := make(chan sec.SecureConn, 1)
+	go func() {
+		conn, err := serverTransport.SecureInbound(context.Background(), serverInsecure, "")
+		if err != nil {
+			serverConnChan <- nil
+			return
+		}
+		serverConnChan <- conn
+	}()
+	clientConn, err := clientTransport.SecureOutbound(context.Background(), clientFault, serverID)
+	require.NoError(t, err)
+	defer clientConn.Close()
+	serverConn := <-serverConnChan
+	require.NotNil(t, serverConn)
+	defer serverConn.Close()
+
+	// the connection works before the fault is injected
+	go serverConn.Write([]byte("foobar"))
+	b := make([]byte, 6)
+	_, err = clientConn.Read(b)
+	require.NoError(t, err)
+	require.Equal(t, "foobar", string(b))
+
+	clientFault.InjectCorruptRecord()
+	_, err = clientConn.Read(b)
+	require.ErrorContains(t, err, "bad record MAC")
+}
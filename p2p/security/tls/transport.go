@@ -1,95 +1,710 @@
 package libp2ptls
 
 import (
+	"bytes"
+	"cmp"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"runtime/debug"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/libp2p/go-libp2p/core/canonicallog"
 	ci "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/crypto/pb"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/protocol"
 	"github.com/libp2p/go-libp2p/core/sec"
 	tptu "github.com/libp2p/go-libp2p/p2p/net/upgrader"
 
+	lru "github.com/hashicorp/golang-lru/v2"
 	manet "github.com/multiformats/go-multiaddr/net"
 )
 
 // ID is the protocol ID (used when negotiating with multistream)
 const ID = "/tls/1.0.0"
 
+// DefaultMaxHandshakeBytes is the default limit on the number of bytes read
+// from a peer during the handshake, see WithMaxHandshakeBytes.
+const DefaultMaxHandshakeBytes = 64 << 10
+
+// knownCertsCacheSize is the number of peers we remember the certificate of,
+// to detect certificate rotations, see WithCertRotatedHook.
+const knownCertsCacheSize = 1024
+
+const (
+	connectionNonceLabel = "EXPORTER-libp2p-connection-nonce"
+	connectionNonceLen   = 32
+)
+
+// ErrPeerNotVerified is returned in strict verification mode when the handshake
+// completed without the peer's certificate chain having been verified by us.
+var ErrPeerNotVerified = errors.New("tls: peer certificate was not verified")
+
+// ErrAlreadySecured is returned when the connection passed to SecureInbound or
+// SecureOutbound is already secured by TLS (or another security protocol).
+var ErrAlreadySecured = errors.New("tls: connection is already secured")
+
+// ErrHandshakeCanceled is returned when a handshake is canceled using HandshakeHandle.Cancel.
+var ErrHandshakeCanceled = errors.New("tls: handshake canceled")
+
+// ErrHandshakeTimeout is returned when a handshake doesn't complete within the
+// handshake timeout, see WithHandshakeTimeout.
+var ErrHandshakeTimeout = errors.New("tls: handshake timed out")
+
+// ErrHandshakeTooLarge is returned when a peer sends more data during the
+// handshake than allowed, see WithMaxHandshakeBytes.
+var ErrHandshakeTooLarge = errors.New("tls: handshake exceeded the size limit")
+
+// ErrDuplicateConnection is returned when a handshake is rejected because we
+// already have a connection to the peer, see WithConnectionReuseCheck.
+var ErrDuplicateConnection = errors.New("tls: duplicate connection")
+
+// Option is an option for the TLS transport.
+type Option func(*Transport) error
+
+// WithStrictVerification makes the transport fail the handshake unless it can
+// assert that the peer's certificate chain was verified by our libp2p-specific
+// verification logic. Any handshake that completes without this verification
+// (e.g. due to a misconfigured tls.Config) fails with ErrPeerNotVerified.
+func WithStrictVerification() Option {
+	return func(t *Transport) error {
+		t.strictVerification = true
+		return nil
+	}
+}
+
+// WithMaxHandshakeBytes limits the number of bytes read from a peer during the
+// handshake. Handshakes exceeding the limit fail with ErrHandshakeTooLarge.
+// Defaults to DefaultMaxHandshakeBytes, which is several times the size of a
+// regular handshake.
+func WithMaxHandshakeBytes(n int) Option {
+	return func(t *Transport) error {
+		if n <= 0 {
+			return errors.New("tls: handshake size limit must be positive")
+		}
+		t.maxHandshakeBytes = n
+		return nil
+	}
+}
+
+// WithIdentityOptions sets the options used when creating the identities
+// presented by the transport.
+func WithIdentityOptions(opts ...IdentityOption) Option {
+	return func(t *Transport) error {
+		t.identityOpts = append(t.identityOpts, opts...)
+		return nil
+	}
+}
+
+// KeySelector selects which key to present to a peer during a handshake.
+// remote is the expected remote peer, and is empty for inbound connections
+// accepting any peer. hint is the value attached to the handshake context using
+// ContextWithKeyHint, or empty if none was set.
+// Returning nil selects the transport's primary key.
+type KeySelector func(remote peer.ID, hint string) ci.PrivKey
+
+// WithKeys configures additional keys the transport can present, besides the
+// primary key passed to New. For every handshake, the selector decides which
+// key is used. The connection's LocalPeer is the peer ID of the selected key.
+func WithKeys(keys []ci.PrivKey, selector KeySelector) Option {
+	return func(t *Transport) error {
+		if selector == nil {
+			return errors.New("tls: key selector must not be nil")
+		}
+		t.additionalKeys = append(t.additionalKeys, keys...)
+		t.keySelector = selector
+		return nil
+	}
+}
+
+// WithSessionResumption enables an abbreviated handshake for peers we've
+// connected to before. Both sides remember a session ticket issued during the
+// first handshake, and resuming the session proves possession of the keys
+// negotiated back then, so certificates don't need to be sent again.
+// If the peer doesn't have (or doesn't accept) a ticket, a full handshake is run.
+// This needs to be enabled on both sides of the connection.
+func WithSessionResumption() Option {
+	return func(t *Transport) error {
+		t.sessionResumption = true
+		return nil
+	}
+}
+
+// WithVerifyConnection sets a callback that runs at the end of every handshake,
+// after the peer's certificate chain has passed libp2p's verification. It can be
+// used to enforce arbitrary policy on the negotiated connection, e.g. on the TLS
+// version or cipher suite. If it returns an error, the handshake is aborted.
+// The callback is passed the context of the handshake, i.e. the context passed
+// to SecureInbound or SecureOutbound.
+func WithVerifyConnection(verify func(context.Context, tls.ConnectionState) error) Option {
+	return func(t *Transport) error {
+		t.verifyConnection = verify
+		return nil
+	}
+}
+
+// WithConnectionReuseCheck sets a callback that is consulted once the peer has
+// been authenticated, before the handshake completes. If it returns false, e.g.
+// because a connection manager already has a connection to the peer, the
+// handshake is aborted, and SecureInbound or SecureOutbound return an error
+// wrapping ErrDuplicateConnection.
+func WithConnectionReuseCheck(allow func(peer.ID) bool) Option {
+	return func(t *Transport) error {
+		t.allowConnection = allow
+		return nil
+	}
+}
+
+// WithCertVerifyCallback sets a callback that is called with the certificate
+// presented by the peer, before libp2p's verification of the certificate chain
+// runs. This allows logging the certificates of peers that fail verification,
+// and enforcing additional policy, e.g. certificate pinning. Note that the
+// certificate hasn't been verified when the callback runs.
+// If the callback returns an error, the handshake is aborted and SecureInbound
+// or SecureOutbound return an error wrapping it.
+// The callback is also called when a session is resumed, with the certificate
+// the peer presented in the original handshake.
+func WithCertVerifyCallback(cb func(*x509.Certificate) error) Option {
+	return func(t *Transport) error {
+		t.identityOpts = append(t.identityOpts, func(c *IdentityConfig) {
+			c.CertVerifyCallback = cb
+		})
+		return nil
+	}
+}
+
+// WithRand sets the source of randomness used to generate the certificates,
+// e.g. a hardware RNG. Defaults to crypto/rand.Reader.
+// Note that this doesn't make certificate generation deterministic, since
+// crypto/ecdsa deliberately doesn't produce deterministic output for a given reader.
+func WithRand(r io.Reader) Option {
+	return func(t *Transport) error {
+		if r == nil {
+			return errors.New("tls: source of randomness must not be nil")
+		}
+		t.identityOpts = append(t.identityOpts, func(c *IdentityConfig) {
+			c.Rand = r
+		})
+		return nil
+	}
+}
+
+// WithTimeSource sets the source of the current time, e.g. a trusted time
+// source on devices without a reliable clock. It is used to check the validity
+// period of certificates, both of our own and of our peers, and to set the
+// validity period of the generated certificates. Defaults to the system clock.
+func WithTimeSource(now func() time.Time) Option {
+	return func(t *Transport) error {
+		if now == nil {
+			return errors.New("tls: time source must not be nil")
+		}
+		t.identityOpts = append(t.identityOpts, func(c *IdentityConfig) {
+			c.TimeSource = now
+		})
+		return nil
+	}
+}
+
+// WithCertRotatedHook sets a hook that is called when a peer we connected to
+// before presents a different certificate than the last time, and the new
+// certificate verifies for the same peer ID. The fingerprints are the SHA-256
+// hashes of the old and the new certificate.
+// The transport remembers the certificates of the most recently seen peers.
+func WithCertRotatedHook(onCertRotated func(p peer.ID, oldFingerprint, newFingerprint []byte)) Option {
+	return func(t *Transport) error {
+		knownCerts, err := lru.New[peer.ID, []byte](knownCertsCacheSize)
+		if err != nil {
+			return err
+		}
+		t.onCertRotated = onCertRotated
+		t.knownCerts = knownCerts
+		return nil
+	}
+}
+
+// WithRequireCommonMuxer makes inbound handshakes fail with ErrNoCommonMuxer if
+// the peer offers stream multiplexers, but none of them is supported by us.
+// By default, the handshake succeeds without selecting a multiplexer, and the
+// multiplexer is negotiated after the handshake, which will fail as well.
+func WithRequireCommonMuxer() Option {
+	return func(t *Transport) error {
+		t.requireCommonMuxer = true
+		return nil
+	}
+}
+
+// WithHandshakeStatsWindow sets the number of most recent handshakes the
+// statistics returned by Transport.HandshakeStats are computed over.
+// Defaults to DefaultHandshakeStatsWindow.
+func WithHandshakeStatsWindow(n int) Option {
+	return func(t *Transport) error {
+		if n <= 0 {
+			return errors.New("tls: handshake stats window must be positive")
+		}
+		t.handshakeStatsWindow = n
+		return nil
+	}
+}
+
+// WithEntropyCheck makes New wait until src reports sufficient entropy before
+// generating the certificates, for at most timeout.
+// If src doesn't become ready in time, New fails with ErrEntropyNotReady.
+func WithEntropyCheck(src EntropySource, timeout time.Duration) Option {
+	return func(t *Transport) error {
+		if src == nil {
+			return errors.New("tls: entropy source must not be nil")
+		}
+		if timeout <= 0 {
+			return errors.New("tls: entropy check timeout must be positive")
+		}
+		t.entropySource = src
+		t.entropyTimeout = timeout
+		return nil
+	}
+}
+
+// WithCipherSuites restricts the cipher suites that may be negotiated, e.g. to
+// comply with FIPS requirements. Since the transport only speaks TLS 1.3, all
+// suites must be TLS 1.3 suites.
+// Note that crypto/tls doesn't allow configuring the TLS 1.3 suites offered or
+// their order. The suites are therefore enforced after negotiation instead:
+// handshakes that negotiate a different suite fail. Since both sides offer all
+// suites, the negotiated suite is the one crypto/tls prefers on the server,
+// independent of the suites allowed by either side. This option is therefore
+// only useful to guarantee that the suite crypto/tls chooses is acceptable.
+// Restrictions excluding that suite make all handshakes fail, e.g. restricting
+// both sides to TLS_AES_256_GCM_SHA384 on hardware with AES support.
+func WithCipherSuites(suites []uint16) Option {
+	return func(t *Transport) error {
+		if len(suites) == 0 {
+			return errors.New("tls: no cipher suites configured")
+		}
+		for _, s := range suites {
+			if !slices.Contains(tls13CipherSuites, s) {
+				return fmt.Errorf("tls: cipher suite %s is not a TLS 1.3 cipher suite", tls.CipherSuiteName(s))
+			}
+		}
+		t.cipherSuites = slices.Clone(suites)
+		return nil
+	}
+}
+
+// tls13CipherSuites are the cipher suites defined for TLS 1.3.
+var tls13CipherSuites = []uint16{
+	tls.TLS_AES_128_GCM_SHA256,
+	tls.TLS_AES_256_GCM_SHA384,
+	tls.TLS_CHACHA20_POLY1305_SHA256,
+}
+
+// WithHandshakeTimeout limits the duration of a handshake, independent of the
+// context passed to SecureInbound and SecureOutbound. The timeout is enforced
+// by setting a deadline on the underlying connection, which is cleared once
+// the handshake completes. Handshakes that time out fail with an error wrapping
+// ErrHandshakeTimeout, while handshakes aborted by canceling the context fail
+// with the context's error.
+// Zero (the default) means no timeout.
+func WithHandshakeTimeout(d time.Duration) Option {
+	return func(t *Transport) error {
+		if d < 0 {
+			return errors.New("tls: handshake timeout must not be negative")
+		}
+		t.handshakeTimeout = d
+		return nil
+	}
+}
+
+// WithNextProtos sets the ALPN values used to negotiate the stream multiplexer
+// during the handshake, in order of preference. By default, the protocol IDs of
+// the muxers passed to New are used. The value selected during the handshake is
+// available via the connection's NegotiatedNextProto method.
+func WithNextProtos(protos []string) Option {
+	return func(t *Transport) error {
+		for _, p := range protos {
+			if p == "" || len(p) > 255 {
+				return fmt.Errorf("tls: invalid ALPN value %q", p)
+			}
+			if p == alpn {
+				return fmt.Errorf("tls: ALPN value %q is reserved", alpn)
+			}
+		}
+		t.muxerProtos = slices.Clone(protos)
+		return nil
+	}
+}
+
+// WithWeakKeySet rejects peers presenting one of the keys in set, failing the
+// handshake with an error wrapping ErrWeakKey. This is a denylist of keys,
+// e.g. keys that were compromised, independent of the peer ID.
+// New (and SetPrivateKey) fail if one of our own keys is in the set.
+func WithWeakKeySet(set *WeakKeySet) Option {
+	return func(t *Transport) error {
+		t.identityOpts = append(t.identityOpts, func(c *IdentityConfig) {
+			c.WeakKeys = set
+		})
+		return nil
+	}
+}
+
+// WithMetricsTracer sets a tracer that is notified about the outcome of handshakes.
+// By default, no tracer is set and no metrics are collected.
+func WithMetricsTracer(tr MetricsTracer) Option {
+	return func(t *Transport) error {
+		t.metricsTracer = tr
+		return nil
+	}
+}
+
+type keyHintKey struct{}
+
+// ContextWithKeyHint returns a context carrying a hint that is passed to the
+// KeySelector of handshakes run with that context.
+func ContextWithKeyHint(ctx context.Context, hint string) context.Context {
+	return context.WithValue(ctx, keyHintKey{}, hint)
+}
+
+type identityOverrideKey struct{}
+
+// ContextWithIdentityOverride returns a context that makes handshakes run with
+// it present the identity of peer id, bypassing the KeySelector. id must be the
+// peer ID of the primary key or of one of the keys configured using WithKeys.
+// This allows choosing the identity for individual dials, e.g. for canary dials
+// during a key migration.
+func ContextWithIdentityOverride(ctx context.Context, id peer.ID) context.Context {
+	return context.WithValue(ctx, identityOverrideKey{}, id)
+}
+
 // Transport constructs secure communication sessions for a peer.
 type Transport struct {
-	identity *Identity
-
+	// identityMu protects the primary key and its identity, see SetPrivateKey.
+	identityMu sync.RWMutex
+	identity   *Identity
 	localPeer  peer.ID
 	privKey    ci.PrivKey
+
 	muxers     []protocol.ID
 	protocolID protocol.ID
+
+	// muxerProtos are the muxers, as ALPN values
+	muxerProtos []string
+	// nextProtos are the ALPN values we offer: the muxers, followed by the "libp2p" value.
+	// It is shared between connections, and must not be modified.
+	nextProtos []string
+	// serverConfig is the tls.Config shared by all inbound connections.
+	// It must not be modified after construction, all per-connection settings
+	// are applied in its GetConfigForClient callback.
+	serverConfig *tls.Config
+
+	strictVerification bool
+	identityOpts       []IdentityOption
+	maxHandshakeBytes  int
+
+	// additionalKeys are the keys configured using WithKeys,
+	// identities are the identities created for them, indexed by their peer ID.
+	additionalKeys []ci.PrivKey
+	identities     map[peer.ID]*Identity
+	keySelector    KeySelector
+
+	sessionResumption  bool
+	requireCommonMuxer bool
+	cipherSuites       []uint16
+	verifyConnection   func(context.Context, tls.ConnectionState) error
+	allowConnection    func(peer.ID) bool
+
+	onCertRotated func(p peer.ID, oldFingerprint, newFingerprint []byte)
+	// knownCerts are the fingerprints of the last certificate presented by peers
+	knownCerts *lru.Cache[peer.ID, []byte]
+	// sessionCache holds the session tickets for outbound connections
+	sessionCache tls.ClientSessionCache
+
+	handshakeStatsWindow int
+	handshakeStats       *handshakeStats
+
+	entropySource  EntropySource
+	entropyTimeout time.Duration
+
+	handshakeTimeout time.Duration
+	metricsTracer    MetricsTracer
+	// identityGenerationDuration is the time spent generating the identities in New
+	identityGenerationDuration time.Duration
 }
 
 var _ sec.SecureTransport = &Transport{}
 
 // New creates a TLS encrypted transport
-func New(id protocol.ID, key ci.PrivKey, muxers []tptu.StreamMuxer) (*Transport, error) {
+func New(id protocol.ID, key ci.PrivKey, muxers []tptu.StreamMuxer, opts ...Option) (*Transport, error) {
 	localPeer, err := peer.IDFromPrivateKey(key)
 	if err != nil {
 		return nil, err
 	}
 	muxerIDs := make([]protocol.ID, 0, len(muxers))
+	muxerProtos := make([]string, 0, len(muxers))
 	for _, m := range muxers {
 		muxerIDs = append(muxerIDs, m.ID)
+		muxerProtos = append(muxerProtos, string(m.ID))
 	}
 	t := &Transport{
-		protocolID: id,
-		localPeer:  localPeer,
-		privKey:    key,
-		muxers:     muxerIDs,
+		protocolID:           id,
+		localPeer:            localPeer,
+		privKey:              key,
+		muxers:               muxerIDs,
+		muxerProtos:          muxerProtos,
+		maxHandshakeBytes:    DefaultMaxHandshakeBytes,
+		handshakeStatsWindow: DefaultHandshakeStatsWindow,
+	}
+	t.serverConfig = &tls.Config{
+		MinVersion:         tls.VersionTLS13,
+		GetConfigForClient: t.getConfigForClient,
+	}
+	for _, opt := range opts {
+		if err := opt(t); err != nil {
+			return nil, err
+		}
 	}
 
-	identity, err := NewIdentity(key)
+	if t.entropySource != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), t.entropyTimeout)
+		err := WaitForEntropy(ctx, t.entropySource)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	start := time.Now()
+	identity, err := NewIdentity(key, t.identityOpts...)
 	if err != nil {
 		return nil, err
 	}
 	t.identity = identity
+	t.handshakeStats = newHandshakeStats(t.handshakeStatsWindow)
+	if len(t.additionalKeys) > 0 {
+		t.identities = make(map[peer.ID]*Identity, len(t.additionalKeys))
+		for _, k := range t.additionalKeys {
+			id, err := peer.IDFromPrivateKey(k)
+			if err != nil {
+				return nil, err
+			}
+			if id == localPeer {
+				continue
+			}
+			identity, err := NewIdentity(k, t.identityOpts...)
+			if err != nil {
+				return nil, err
+			}
+			t.identities[id] = identity
+		}
+	}
+	t.identityGenerationDuration = time.Since(start)
+	// Make sure that peers will see the peer IDs we expect, instead of failing
+	// the handshake in confusing ways.
+	if err := checkCertPeer(t.identity, localPeer); err != nil {
+		return nil, err
+	}
+	for id, identity := range t.identities {
+		if err := checkCertPeer(identity, id); err != nil {
+			return nil, err
+		}
+	}
+	if t.cipherSuites != nil {
+		t.serverConfig.CipherSuites = t.cipherSuites
+	}
+	if t.sessionResumption {
+		t.sessionCache = tls.NewLRUClientSessionCache(0)
+	}
+	if err := t.configureIdentity(t.identity); err != nil {
+		return nil, err
+	}
+	for _, identity := range t.identities {
+		if err := t.configureIdentity(identity); err != nil {
+			return nil, err
+		}
+	}
+	t.nextProtos = append(slices.Clip(t.muxerProtos), identity.config.NextProtos...)
 	return t, nil
 }
 
+// configureIdentity applies the settings of the transport to the tls.Config of an identity.
+func (t *Transport) configureIdentity(identity *Identity) error {
+	if t.cipherSuites != nil {
+		identity.config.CipherSuites = t.cipherSuites
+	}
+	if t.sessionResumption {
+		// Every identity uses its own ticket key, such that a session is never
+		// resumed with an identity other than the one it was established with.
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		identity.config.SessionTicketsDisabled = false
+		identity.config.SetSessionTicketKeys([][32]byte{key})
+	}
+	return nil
+}
+
+// SetPrivateKey replaces the primary key of the transport, e.g. to rotate the
+// host key. It generates a new identity for the key, which is presented in all
+// handshakes started afterwards. Handshakes in progress are not affected.
+// It is safe to call SetPrivateKey concurrently with SecureInbound and
+// SecureOutbound.
+func (t *Transport) SetPrivateKey(key ci.PrivKey) error {
+	if !slices.Contains(ci.KeyTypes, int(key.Type())) {
+		return fmt.Errorf("tls: unsupported key type %s", key.Type())
+	}
+	localPeer, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	identity, err := NewIdentity(key, t.identityOpts...)
+	if err != nil {
+		return err
+	}
+	if err := checkCertPeer(identity, localPeer); err != nil {
+		return err
+	}
+	if err := t.configureIdentity(identity); err != nil {
+		return err
+	}
+	t.identityMu.Lock()
+	t.identity = identity
+	t.localPeer = localPeer
+	t.privKey = key
+	t.identityMu.Unlock()
+	return nil
+}
+
+// primaryIdentity returns the identity of the primary key, and its peer ID.
+func (t *Transport) primaryIdentity() (peer.ID, *Identity) {
+	t.identityMu.RLock()
+	defer t.identityMu.RUnlock()
+	return t.localPeer, t.identity
+}
+
+// peerSessionCache stores the session tickets of a single remote peer.
+// The tls package keys sessions by server name or address, which doesn't
+// tell us which peer the ticket belongs to.
+type peerSessionCache struct {
+	cache tls.ClientSessionCache
+	key   string
+}
+
+func (c *peerSessionCache) Get(string) (*tls.ClientSessionState, bool) {
+	return c.cache.Get(c.key)
+}
+
+func (c *peerSessionCache) Put(_ string, cs *tls.ClientSessionState) {
+	c.cache.Put(c.key, cs)
+}
+
+// selectIdentity returns the identity to present to the remote peer, and its peer ID.
+func (t *Transport) selectIdentity(ctx context.Context, remote peer.ID) (peer.ID, *Identity, error) {
+	localPeer, primary := t.primaryIdentity()
+	id, ok := ctx.Value(identityOverrideKey{}).(peer.ID)
+	if !ok {
+		if t.keySelector == nil {
+			return localPeer, primary, nil
+		}
+		hint, _ := ctx.Value(keyHintKey{}).(string)
+		key := t.keySelector(remote, hint)
+		if key == nil {
+			return localPeer, primary, nil
+		}
+		var err error
+		id, err = peer.IDFromPrivateKey(key)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	if id == localPeer {
+		return localPeer, primary, nil
+	}
+	identity, ok := t.identities[id]
+	if !ok {
+		return "", nil, fmt.Errorf("tls: selected key for peer %s is not configured", id)
+	}
+	return id, identity, nil
+}
+
+type handshakeStateKey struct{}
+
+// handshakeState is the per-connection state of a handshake.
+// For inbound handshakes, it is passed to the GetConfigForClient callback via the handshake context.
+type handshakeState struct {
+	remote peer.ID
+	// localPeer is the peer ID of the identity presented to the remote peer
+	localPeer peer.ID
+	identity  *Identity
+	keyCh     chan ci.PubKey
+	conn      *handshakeConn
+	// remoteProtos are the ALPN values offered by the client, for inbound handshakes
+	remoteProtos []string
+	started      time.Time
+}
+
+// handshakeConn limits the number of bytes read from the connection,
+// until the handshake is done.
+type handshakeConn struct {
+	net.Conn
+	remaining int
+	done      atomic.Bool
+	// firstWrite is the time we sent our first handshake flight, and rtt the
+	// time it took until we read the first bytes of the peer's response.
+	firstWrite time.Time
+	rtt        time.Duration
+}
+
+func (c *handshakeConn) Write(b []byte) (int, error) {
+	if !c.done.Load() && c.firstWrite.IsZero() {
+		c.firstWrite = time.Now()
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *handshakeConn) Read(b []byte) (int, error) {
+	if c.done.Load() {
+		return c.Conn.Read(b)
+	}
+	if c.remaining <= 0 {
+		return 0, ErrHandshakeTooLarge
+	}
+	if len(b) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.Conn.Read(b)
+	c.remaining -= n
+	if n > 0 && c.rtt == 0 && !c.firstWrite.IsZero() {
+		c.rtt = time.Since(c.firstWrite)
+	}
+	return n, err
+}
+
 // SecureInbound runs the TLS handshake as a server.
 // If p is empty, connections from any peer are accepted.
 func (t *Transport) SecureInbound(ctx context.Context, insecure net.Conn, p peer.ID) (sec.SecureConn, error) {
-	config, keyCh := t.identity.ConfigForPeer(p)
-	muxers := make([]string, 0, len(t.muxers))
-	for _, muxer := range t.muxers {
-		muxers = append(muxers, string(muxer))
+	if isSecured(insecure) {
+		insecure.Close()
+		return nil, ErrAlreadySecured
 	}
-	// TLS' ALPN selection lets the server select the protocol, preferring the server's preferences.
-	// We want to prefer the client's preference though.
-	getConfigForClient := config.GetConfigForClient
-	config.GetConfigForClient = func(info *tls.ClientHelloInfo) (*tls.Config, error) {
-	alpnLoop:
-		for _, proto := range info.SupportedProtos {
-			for _, m := range muxers {
-				if m == proto {
-					// Match found. Select this muxer, as it's the client's preference.
-					// There's no need to add the "libp2p" entry here.
-					config.NextProtos = []string{proto}
-					break alpnLoop
-				}
-			}
-		}
-		if getConfigForClient != nil {
-			return getConfigForClient(info)
-		}
-		return config, nil
+	hs := &handshakeState{
+		remote:  p,
+		keyCh:   make(chan ci.PubKey, 1),
+		conn:    &handshakeConn{Conn: insecure, remaining: t.maxHandshakeBytes},
+		started: time.Now(),
 	}
-	config.NextProtos = append(muxers, config.NextProtos...)
-	cs, err := t.handshake(ctx, tls.Server(insecure, config), keyCh)
+	ctx = context.WithValue(ctx, handshakeStateKey{}, hs)
+	cs, err := t.handshake(ctx, tls.Server(hs.conn, t.serverConfig), hs)
+	t.recordHandshake(network.DirInbound, cs, err)
 	if err != nil {
 		addr, maErr := manet.FromNetAddr(insecure.RemoteAddr())
 		if maErr == nil {
@@ -100,6 +715,50 @@ func (t *Transport) SecureInbound(ctx context.Context, insecure net.Conn, p peer
 	return cs, err
 }
 
+// getConfigForClient is the GetConfigForClient callback of the (shared) server config.
+// It returns the tls.Config used for a single inbound connection.
+func (t *Transport) getConfigForClient(info *tls.ClientHelloInfo) (*tls.Config, error) {
+	hs, ok := info.Context().Value(handshakeStateKey{}).(*handshakeState)
+	if !ok {
+		return nil, errors.New("go-libp2p tls BUG: missing inbound handshake state")
+	}
+	localPeer, identity, err := t.selectIdentity(info.Context(), hs.remote)
+	if err != nil {
+		return nil, err
+	}
+	hs.localPeer = localPeer
+	hs.identity = identity
+	hs.remoteProtos = slices.Clone(info.SupportedProtos)
+	config := identity.configForPeer(hs.remote, hs.keyCh)
+	t.chainVerifyConnection(info.Context(), config)
+	// TLS' ALPN selection lets the server select the protocol, preferring the server's preferences.
+	// We want to prefer the client's preference though.
+	config.NextProtos = t.nextProtos
+	var matched bool
+alpnLoop:
+	for _, proto := range info.SupportedProtos {
+		for _, m := range t.muxerProtos {
+			if m == proto {
+				// Match found. Select this muxer, as it's the client's preference.
+				// There's no need to add the "libp2p" entry here.
+				config.NextProtos = []string{proto}
+				matched = true
+				break alpnLoop
+			}
+		}
+	}
+	if !matched && t.requireCommonMuxer {
+		remoteMuxers := slices.DeleteFunc(slices.Clone(info.SupportedProtos), func(proto string) bool { return proto == alpn })
+		if len(remoteMuxers) > 0 && len(t.muxerProtos) > 0 {
+			return nil, ErrNoCommonMuxer{Local: slices.Clone(t.muxerProtos), Remote: remoteMuxers}
+		}
+	}
+	if config.GetConfigForClient != nil {
+		return config.GetConfigForClient(info)
+	}
+	return config, nil
+}
+
 // SecureOutbound runs the TLS handshake as a client.
 // Note that SecureOutbound will not return an error if the server doesn't
 // accept the certificate. This is due to the fact that in TLS 1.3, the client
@@ -108,21 +767,235 @@ func (t *Transport) SecureInbound(ctx context.Context, insecure net.Conn, p peer
 // If the handshake fails, the server will close the connection. The client will
 // notice this after 1 RTT when calling Read.
 func (t *Transport) SecureOutbound(ctx context.Context, insecure net.Conn, p peer.ID) (sec.SecureConn, error) {
-	config, keyCh := t.identity.ConfigForPeer(p)
-	muxers := make([]string, 0, len(t.muxers))
-	for _, muxer := range t.muxers {
-		muxers = append(muxers, (string)(muxer))
+	if isSecured(insecure) {
+		insecure.Close()
+		return nil, ErrAlreadySecured
 	}
+	localPeer, identity, err := t.selectIdentity(ctx, p)
+	if err != nil {
+		insecure.Close()
+		return nil, err
+	}
+	hs := &handshakeState{
+		remote:    p,
+		localPeer: localPeer,
+		identity:  identity,
+		keyCh:     make(chan ci.PubKey, 1),
+		conn:      &handshakeConn{Conn: insecure, remaining: t.maxHandshakeBytes},
+		started:   time.Now(),
+	}
+	config := identity.configForPeer(p, hs.keyCh)
+	t.chainVerifyConnection(ctx, config)
 	// Prepend the preferred muxers list to TLS config.
-	config.NextProtos = append(muxers, config.NextProtos...)
-	cs, err := t.handshake(ctx, tls.Client(insecure, config), keyCh)
+	config.NextProtos = t.nextProtos
+	if t.sessionCache != nil && p != "" {
+		// A ticket is only valid for the identity we presented when obtaining it.
+		config.ClientSessionCache = &peerSessionCache{cache: t.sessionCache, key: string(localPeer) + "/" + string(p)}
+	}
+	cs, err := t.handshake(ctx, tls.Client(hs.conn, config), hs)
+	t.recordHandshake(network.DirOutbound, cs, err)
 	if err != nil {
 		insecure.Close()
 	}
 	return cs, err
 }
 
-func (t *Transport) handshake(ctx context.Context, tlsConn *tls.Conn, keyCh <-chan ci.PubKey) (_sconn sec.SecureConn, err error) {
+// checkCertPeer checks that the certificate of identity is bound to peer p.
+func checkCertPeer(identity *Identity, p peer.ID) error {
+	certPeer, err := identity.certPeer()
+	if err != nil {
+		return fmt.Errorf("tls: invalid certificate for %s: %w", p, err)
+	}
+	if certPeer != p {
+		return fmt.Errorf("tls: certificate for %s is bound to a different peer (%s)", p, certPeer)
+	}
+	return nil
+}
+
+// Validate checks the configuration of the transport, without running a handshake.
+// It checks that the certificates of all identities are currently valid and
+// bound to their respective key, and that they pass the verification applied
+// to peers' certificates. Running Validate at startup catches misconfigurations
+// that would otherwise only surface when the first connection is secured.
+func (t *Transport) Validate() error {
+	localPeer, primary := t.primaryIdentity()
+	if err := primary.validate(localPeer); err != nil {
+		return fmt.Errorf("tls: invalid identity for %s: %w", localPeer, err)
+	}
+	for id, identity := range t.identities {
+		if err := identity.validate(id); err != nil {
+			return fmt.Errorf("tls: invalid identity for %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// recordHandshake records the outcome of a handshake in the handshake stats,
+// and reports it to the metrics tracer.
+func (t *Transport) recordHandshake(dir network.Direction, conn sec.SecureConn, err error) {
+	keyType := UnknownKeyType
+	if err == nil {
+		keyType = conn.RemotePublicKey().Type()
+	}
+	t.handshakeStats.record(dir, keyType, err == nil)
+	if t.metricsTracer == nil {
+		return
+	}
+	if err != nil {
+		t.metricsTracer.IncHandshakeFailure(ClassifyHandshakeError(err))
+	} else {
+		t.metricsTracer.IncHandshakeSuccess()
+	}
+}
+
+// HandshakeStats returns the success rate of the most recent handshakes,
+// see WithHandshakeStatsWindow.
+// Note that outbound handshakes rejected by the server might be counted as
+// successful, see SecureOutbound.
+func (t *Transport) HandshakeStats() HandshakeStats {
+	return t.handshakeStats.stats()
+}
+
+// IdentityGenerationDuration returns the time New spent generating the
+// certificates for our keys. Signing the certificate is considerably slower
+// for RSA keys than for other key types.
+// Certificates generated later, e.g. by SetPrivateKey, are not included.
+func (t *Transport) IdentityGenerationDuration() time.Duration {
+	return t.identityGenerationDuration
+}
+
+// IdentityInfo describes one of the identities of the transport, see
+// ActiveIdentities. It doesn't contain any private key material.
+type IdentityInfo struct {
+	PeerID  peer.ID
+	KeyType pb.KeyType
+	// Primary is set for the identity of the primary key, see SetPrivateKey.
+	Primary bool
+	// Fingerprint is the SHA-256 hash of the certificate, see Identity.Fingerprint.
+	Fingerprint []byte
+	// NotBefore and NotAfter are the bounds of the certificate's validity period.
+	NotBefore, NotAfter time.Time
+}
+
+// ActiveIdentities returns information about the identities the transport
+// presents to peers: the identity of the primary key, followed by those of
+// the additional keys (see WithKeys), sorted by peer ID. It is safe to call
+// ActiveIdentities concurrently with SetPrivateKey, e.g. to monitor a key
+// rotation.
+func (t *Transport) ActiveIdentities() []IdentityInfo {
+	localPeer, primary := t.primaryIdentity()
+	infos := make([]IdentityInfo, 0, 1+len(t.identities))
+	infos = append(infos, identityInfo(localPeer, primary, true))
+	additional := make([]IdentityInfo, 0, len(t.identities))
+	for id, identity := range t.identities {
+		additional = append(additional, identityInfo(id, identity, false))
+	}
+	slices.SortFunc(additional, func(a, b IdentityInfo) int { return cmp.Compare(a.PeerID, b.PeerID) })
+	return append(infos, additional...)
+}
+
+func identityInfo(p peer.ID, identity *Identity, primary bool) IdentityInfo {
+	info := IdentityInfo{
+		PeerID:      p,
+		KeyType:     identity.keyType,
+		Primary:     primary,
+		Fingerprint: slices.Clone(identity.fingerprint),
+	}
+	// We generated the certificate ourselves, so parsing it doesn't fail.
+	if cert, err := identity.certificate(); err == nil {
+		info.NotBefore = cert.NotBefore
+		info.NotAfter = cert.NotAfter
+	}
+	return info
+}
+
+// HandshakeHandle is a handle to an outbound handshake started with StartSecureOutbound.
+type HandshakeHandle struct {
+	cancel context.CancelCauseFunc
+	done   chan struct{}
+	conn   sec.SecureConn
+	err    error
+}
+
+// Cancel aborts the handshake, if it is still in progress. The underlying
+// connection is closed, and the handshake fails with ErrHandshakeCanceled.
+// Cancel has no effect once the handshake has completed.
+func (h *HandshakeHandle) Cancel() {
+	h.cancel(ErrHandshakeCanceled)
+}
+
+// Done returns a channel that is closed when the handshake has completed.
+func (h *HandshakeHandle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Result waits for the handshake to complete, and returns its result.
+func (h *HandshakeHandle) Result() (sec.SecureConn, error) {
+	<-h.done
+	return h.conn, h.err
+}
+
+// StartSecureOutbound starts a handshake as a client, like SecureOutbound,
+// and returns a handle to it. The handle allows canceling this particular
+// handshake without canceling ctx, e.g. to selectively abort stalled handshakes.
+func (t *Transport) StartSecureOutbound(ctx context.Context, insecure net.Conn, p peer.ID) *HandshakeHandle {
+	ctx, cancel := context.WithCancelCause(ctx)
+	h := &HandshakeHandle{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(h.done)
+		defer cancel(nil)
+		h.conn, h.err = t.SecureOutbound(ctx, insecure, p)
+		if h.err != nil && errors.Is(context.Cause(ctx), ErrHandshakeCanceled) {
+			h.err = ErrHandshakeCanceled
+		}
+	}()
+	return h
+}
+
+// chainVerifyConnection makes config run the callback set by WithVerifyConnection
+// after its own verification. ctx is the context of the handshake.
+func (t *Transport) chainVerifyConnection(ctx context.Context, config *tls.Config) {
+	if t.verifyConnection == nil && t.cipherSuites == nil && t.allowConnection == nil {
+		return
+	}
+	verify := config.VerifyConnection
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		if verify != nil {
+			if err := verify(cs); err != nil {
+				return err
+			}
+		}
+		if t.cipherSuites != nil && !slices.Contains(t.cipherSuites, cs.CipherSuite) {
+			return fmt.Errorf("tls: negotiated cipher suite %s is not allowed", tls.CipherSuiteName(cs.CipherSuite))
+		}
+		if t.allowConnection != nil && len(cs.PeerCertificates) > 0 {
+			// The certificate chain was verified by the identity's callbacks.
+			p, err := peerIDFromCert(cs.PeerCertificates[0])
+			if err != nil {
+				return err
+			}
+			if !t.allowConnection(p) {
+				return fmt.Errorf("%w to %s", ErrDuplicateConnection, p)
+			}
+		}
+		if t.verifyConnection == nil {
+			return nil
+		}
+		return t.verifyConnection(ctx, cs)
+	}
+}
+
+// isSecured returns true if the connection already runs a security protocol.
+func isSecured(c net.Conn) bool {
+	switch c.(type) {
+	case *tls.Conn, sec.SecureConn:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *Transport) handshake(ctx context.Context, tlsConn *tls.Conn, hs *handshakeState) (_sconn sec.SecureConn, err error) {
 	defer func() {
 		if rerr := recover(); rerr != nil {
 			fmt.Fprintf(os.Stderr, "panic in TLS handshake: %s\n%s\n", rerr, debug.Stack())
@@ -131,31 +1004,71 @@ func (t *Transport) handshake(ctx context.Context, tlsConn *tls.Conn, keyCh <-ch
 		}
 	}()
 
+	if t.handshakeTimeout > 0 {
+		if err := hs.conn.SetDeadline(time.Now().Add(t.handshakeTimeout)); err != nil {
+			return nil, err
+		}
+	}
 	// handshaking...
 	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		if t.handshakeTimeout > 0 && errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, fmt.Errorf("%w after %s: %w", ErrHandshakeTimeout, t.handshakeTimeout, err)
+		}
 		return nil, err
 	}
+	hs.conn.done.Store(true)
+	if t.handshakeTimeout > 0 {
+		if err := hs.conn.SetDeadline(time.Time{}); err != nil {
+			return nil, err
+		}
+	}
 
 	// Should be ready by this point, don't block.
 	var remotePubKey ci.PubKey
 	select {
-	case remotePubKey = <-keyCh:
+	case remotePubKey = <-hs.keyCh:
 	default:
 	}
+	if t.strictVerification {
+		if err := verifyConnectionState(tlsConn.ConnectionState(), remotePubKey, hs.identity.now()); err != nil {
+			return nil, err
+		}
+	}
 	if remotePubKey == nil {
 		return nil, errors.New("go-libp2p tls BUG: expected remote pub key to be set")
 	}
 
-	return t.setupConn(tlsConn, remotePubKey)
+	return t.setupConn(tlsConn, hs, remotePubKey)
 }
 
-func (t *Transport) setupConn(tlsConn *tls.Conn, remotePubKey ci.PubKey) (sec.SecureConn, error) {
+// verifyConnectionState asserts that our verification callback ran and succeeded,
+// and that the key it extracted belongs to the certificate chain used in the handshake.
+// now is the time used to check the validity of the certificate chain.
+func verifyConnectionState(cs tls.ConnectionState, remotePubKey ci.PubKey, now time.Time) error {
+	if remotePubKey == nil {
+		return fmt.Errorf("%w: verification callback did not run", ErrPeerNotVerified)
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("%w: peer didn't present a certificate", ErrPeerNotVerified)
+	}
+	pubKey, err := pubKeyFromCertChain(cs.PeerCertificates, now)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrPeerNotVerified, err)
+	}
+	if !pubKey.Equals(remotePubKey) {
+		return fmt.Errorf("%w: verified key doesn't match the certificate chain", ErrPeerNotVerified)
+	}
+	return nil
+}
+
+func (t *Transport) setupConn(tlsConn *tls.Conn, hs *handshakeState, remotePubKey ci.PubKey) (sec.SecureConn, error) {
 	remotePeerID, err := peer.IDFromPublicKey(remotePubKey)
 	if err != nil {
 		return nil, err
 	}
 
-	nextProto := tlsConn.ConnectionState().NegotiatedProtocol
+	connState := tlsConn.ConnectionState()
+	nextProto := connState.NegotiatedProtocol
 	// The special ALPN extension value "libp2p" is used by libp2p versions
 	// that don't support early muxer negotiation. If we see this sepcial
 	// value selected, that means we are handshaking with a version that does
@@ -165,11 +1078,37 @@ func (t *Transport) setupConn(tlsConn *tls.Conn, remotePubKey ci.PubKey) (sec.Se
 		nextProto = ""
 	}
 
+	if t.onCertRotated != nil && len(connState.PeerCertificates) > 0 {
+		fingerprint := sha256.Sum256(connState.PeerCertificates[0].Raw)
+		if old, ok, _ := t.knownCerts.PeekOrAdd(remotePeerID, fingerprint[:]); ok && !bytes.Equal(old, fingerprint[:]) {
+			t.knownCerts.Add(remotePeerID, fingerprint[:])
+			t.onCertRotated(remotePeerID, old, fingerprint[:])
+		}
+	}
+
+	var certExtension []byte
+	if len(connState.PeerCertificates) > 0 {
+		certExtension = libp2pExtension(connState.PeerCertificates[0])
+	}
+
+	// Both sides derive the same nonce from the handshake's keying material.
+	nonce, err := connState.ExportKeyingMaterial(connectionNonceLabel, nil, connectionNonceLen)
+	if err != nil {
+		return nil, err
+	}
+
 	return &conn{
-		Conn:         tlsConn,
-		localPeer:    t.localPeer,
-		remotePeer:   remotePeerID,
-		remotePubKey: remotePubKey,
+		Conn:                tlsConn,
+		nonce:               nonce,
+		localPeer:           hs.localPeer,
+		identityFingerprint: hs.identity.fingerprint,
+		remoteProtos:        hs.remoteProtos,
+		remotePeer:          remotePeerID,
+		remotePubKey:        remotePubKey,
+		remoteCertExtension: certExtension,
+		protocolID:          t.protocolID,
+		handshakeDuration:   time.Since(hs.started),
+		estimatedRTT:        hs.conn.rtt,
 		connectionState: network.ConnectionState{
 			StreamMultiplexer:         protocol.ID(nextProto),
 			UsedEarlyMuxerNegotiation: nextProto != "",
@@ -1,26 +1,38 @@
 package libp2ptls
 
 import (
+	"bytes"
 	"context"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/asn1"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"math/big"
 	mrand "math/rand"
 	"net"
+	"reflect"
 	"runtime"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	ic "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/crypto/pb"
+	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/protocol"
 	"github.com/libp2p/go-libp2p/core/sec"
@@ -380,6 +392,11 @@ func TestPeerIDMismatch(t *testing.T) {
 		require.ErrorAs(t, err, &mismatchErr)
 		require.Equal(t, mismatchErr.Expected, thirdPartyID)
 		require.Equal(t, mismatchErr.Actual, serverID)
+		require.ErrorIs(t, err, ErrPeerIDMismatch)
+		require.Equal(t, mismatchErr.Error(), err.Error())
+		require.ErrorContains(t, err, thirdPartyID.String())
+		require.ErrorContains(t, err, serverID.String())
+		require.Equal(t, HandshakeErrorPeerIDMismatch, ClassifyHandshakeError(err))
 
 		var serverErr error
 		select {
@@ -389,6 +406,7 @@ func TestPeerIDMismatch(t *testing.T) {
 		}
 		require.Error(t, serverErr)
 		require.Contains(t, serverErr.Error(), "tls: bad certificate")
+		require.Equal(t, HandshakeErrorCertInvalid, ClassifyHandshakeError(serverErr))
 	})
 
 	t.Run("for incoming connections", func(t *testing.T) {
@@ -407,6 +425,7 @@ func TestPeerIDMismatch(t *testing.T) {
 		_, err = conn.Read([]byte{0})
 		require.Error(t, err)
 		require.Contains(t, err.Error(), "tls: bad certificate")
+		require.Equal(t, HandshakeErrorCertInvalid, ClassifyHandshakeError(err))
 
 		var serverErr error
 		select {
@@ -419,6 +438,8 @@ func TestPeerIDMismatch(t *testing.T) {
 		require.ErrorAs(t, serverErr, &mismatchErr)
 		require.Equal(t, mismatchErr.Expected, thirdPartyID)
 		require.Equal(t, mismatchErr.Actual, clientTransport.localPeer)
+		require.ErrorIs(t, serverErr, ErrPeerIDMismatch)
+		require.Equal(t, HandshakeErrorPeerIDMismatch, ClassifyHandshakeError(serverErr))
 	})
 }
 
@@ -586,7 +607,7 @@ func TestInvalidCerts(t *testing.T) {
 			name:  "certificate chain contains 2 certs",
 			apply: twoCerts,
 			checkErr: func(t *testing.T, err error) {
-				require.EqualError(t, err, "expected one certificates in the chain")
+				require.EqualError(t, err, "certificate chain too long: got 2 certificates, expected at most 1")
 			},
 		},
 		{
@@ -664,6 +685,9 @@ func TestInvalidCerts(t *testing.T) {
 					!isWindowsTCPCloseError(err) {
 					t.Errorf("unexpected error: %s", err.Error())
 				}
+				if !isWindowsTCPCloseError(err) {
+					require.Equal(t, HandshakeErrorCertInvalid, ClassifyHandshakeError(err))
+				}
 			case <-time.After(250 * time.Millisecond):
 				t.Fatal("expected the server handshake to return")
 			}
@@ -672,6 +696,7 @@ func TestInvalidCerts(t *testing.T) {
 			case err := <-serverErrChan:
 				require.Error(t, err)
 				tr.checkErr(t, err)
+				require.Equal(t, HandshakeErrorCertInvalid, ClassifyHandshakeError(err))
 			case <-time.After(250 * time.Millisecond):
 				t.Fatal("expected the server handshake to return")
 			}
@@ -695,6 +720,7 @@ func TestInvalidCerts(t *testing.T) {
 			_, err = clientTransport.SecureOutbound(context.Background(), clientInsecureConn, serverID)
 			require.Error(t, err)
 			tr.checkErr(t, err)
+			require.Equal(t, HandshakeErrorCertInvalid, ClassifyHandshakeError(err))
 
 			var serverErr error
 			select {
@@ -705,7 +731,2026 @@ func TestInvalidCerts(t *testing.T) {
 			require.Error(t, serverErr)
 			if !isWindowsTCPCloseError(serverErr) {
 				require.Contains(t, serverErr.Error(), "remote error: tls:")
+				require.Equal(t, HandshakeErrorCertInvalid, ClassifyHandshakeError(serverErr))
+			}
+		})
+	}
+}
+
+func TestStrictVerification(t *testing.T) {
+	clientID, clientKey := createPeer(t)
+	serverID, serverKey := createPeer(t)
+	_, staleKey := createPeer(t)
+	staleID, err := peer.IDFromPrivateKey(staleKey)
+	require.NoError(t, err)
+
+	serverTransport, err := New(ID, serverKey, nil)
+	require.NoError(t, err)
+
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strict=%t", strict), func(t *testing.T) {
+			var opts []Option
+			if strict {
+				opts = append(opts, WithStrictVerification())
+			}
+			clientTransport, err := New(ID, clientKey, nil, opts...)
+			require.NoError(t, err)
+
+			clientInsecureConn, serverInsecureConn := connect(t)
+			go func() {
+				if conn, err := serverTransport.SecureInbound(context.Background(), serverInsecureConn, ""); err == nil {
+					conn.Close()
+				}
+			}()
+
+			// Simulate a configuration regression: our verification callback doesn't
+			// run, and the key of a previous connection to the peer is used instead.
+			hs := &handshakeState{
+				localPeer: clientID,
+				identity:  clientTransport.identity,
+				keyCh:     make(chan ic.PubKey, 1),
+				conn:      &handshakeConn{Conn: clientInsecureConn, remaining: clientTransport.maxHandshakeBytes},
+			}
+			hs.keyCh <- staleKey.GetPublic()
+			config := hs.identity.configForPeer("", make(chan ic.PubKey, 1))
+			config.VerifyPeerCertificate = nil
+			config.VerifyConnection = nil
+
+			conn, err := clientTransport.handshake(context.Background(), tls.Client(hs.conn, config), hs)
+			if !strict {
+				// Without strict verification, the connection is attributed to the wrong peer.
+				require.NoError(t, err)
+				defer conn.Close()
+				require.Equal(t, staleID, conn.RemotePeer())
+				return
+			}
+			require.ErrorIs(t, err, ErrPeerNotVerified)
+			require.ErrorContains(t, err, "doesn't match the certificate chain")
+		})
+	}
+
+	t.Run("successful handshake", func(t *testing.T) {
+		serverTransport, err := New(ID, serverKey, nil, WithStrictVerification())
+		require.NoError(t, err)
+		strictClientTransport, err := New(ID, clientKey, nil, WithStrictVerification())
+		require.NoError(t, err)
+
+		clientInsecureConn, serverInsecureConn := connect(t)
+		errChan := make(chan error, 1)
+		go func() {
+			_, err := serverTransport.SecureInbound(context.Background(), serverInsecureConn, "")
+			errChan <- err
+		}()
+		conn, err := strictClientTransport.SecureOutbound(context.Background(), clientInsecureConn, serverID)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.NoError(t, <-errChan)
+	})
+}
+
+func BenchmarkSecureInbound(b *testing.B) {
+	clientKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+	require.NoError(b, err)
+	serverKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+	require.NoError(b, err)
+	serverID, err := peer.IDFromPrivateKey(serverKey)
+	require.NoError(b, err)
+	muxers := []tptu.StreamMuxer{{ID: "/yamux/1.0.0"}, {ID: "/mplex/6.7.0"}}
+	clientTransport, err := New(ID, clientKey, muxers)
+	require.NoError(b, err)
+	serverTransport, err := New(ID, serverKey, muxers)
+	require.NoError(b, err)
+
+	ln, err := net.ListenTCP("tcp", nil)
+	require.NoError(b, err)
+	defer ln.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		errChan := make(chan error, 1)
+		go func() {
+			conn, err := net.DialTCP("tcp", nil, ln.Addr().(*net.TCPAddr))
+			if err != nil {
+				errChan <- err
+				return
+			}
+			defer conn.Close()
+			sconn, err := clientTransport.SecureOutbound(context.Background(), conn, serverID)
+			if err == nil {
+				// wait for the server to close the connection
+				_, err = sconn.Read([]byte{0})
+				if err == io.EOF {
+					err = nil
+				}
+			}
+			errChan <- err
+		}()
+		serverInsecureConn, err := ln.Accept()
+		if err != nil {
+			b.Fatal(err)
+		}
+		conn, err := serverTransport.SecureInbound(context.Background(), serverInsecureConn, "")
+		if err != nil {
+			b.Fatal(err)
+		}
+		conn.Close()
+		if err := <-errChan; err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestConnectionNonce(t *testing.T) {
+	_, clientKey := createPeer(t)
+	serverID, serverKey := createPeer(t)
+	clientTransport, err := New(ID, clientKey, nil)
+	require.NoError(t, err)
+	serverTransport, err := New(ID, serverKey, nil)
+	require.NoError(t, err)
+
+	handshake := func(t *testing.T) (client, server *conn) {
+		clientInsecureConn, serverInsecureConn := connect(t)
+		serverConnChan := make(chan sec.SecureConn, 1)
+		go func() {
+			serverConn, err := serverTransport.SecureInbound(context.Background(), serverInsecureConn, "")
+			assert.NoError(t, err)
+			serverConnChan <- serverConn
+		}()
+		clientConn, err := clientTransport.SecureOutbound(context.Background(), clientInsecureConn, serverID)
+		require.NoError(t, err)
+		t.Cleanup(func() { clientConn.Close() })
+		serverConn := <-serverConnChan
+		require.NotNil(t, serverConn)
+		t.Cleanup(func() { serverConn.Close() })
+		return clientConn.(*conn), serverConn.(*conn)
+	}
+
+	client1, server1 := handshake(t)
+	require.Len(t, client1.ConnectionNonce(), connectionNonceLen)
+	require.Equal(t, client1.ConnectionNonce(), server1.ConnectionNonce())
+
+	client2, server2 := handshake(t)
+	require.Equal(t, client2.ConnectionNonce(), server2.ConnectionNonce())
+	require.NotEqual(t, client1.ConnectionNonce(), client2.ConnectionNonce())
+}
+
+func TestKeySelection(t *testing.T) {
+	clientID, clientKey := createPeer(t)
+	legacyKey, _, err := ic.GenerateRSAKeyPair(2048, rand.Reader)
+	require.NoError(t, err)
+	legacyID, err := peer.IDFromPrivateKey(legacyKey)
+	require.NoError(t, err)
+	serverID, serverKey := createPeer(t)
+
+	clientTransport, err := New(ID, clientKey, nil, WithKeys([]ic.PrivKey{legacyKey}, func(_ peer.ID, hint string) ic.PrivKey {
+		if hint == "legacy" {
+			return legacyKey
+		}
+		return nil
+	}))
+	require.NoError(t, err)
+	serverTransport, err := New(ID, serverKey, nil)
+	require.NoError(t, err)
+
+	handshake := func(t *testing.T, ctx context.Context) (client, server sec.SecureConn) {
+		clientInsecureConn, serverInsecureConn := connect(t)
+		serverConnChan := make(chan sec.SecureConn, 1)
+		go func() {
+			serverConn, err := serverTransport.SecureInbound(context.Background(), serverInsecureConn, "")
+			assert.NoError(t, err)
+			serverConnChan <- serverConn
+		}()
+		clientConn, err := clientTransport.SecureOutbound(ctx, clientInsecureConn, serverID)
+		require.NoError(t, err)
+		t.Cleanup(func() { clientConn.Close() })
+		serverConn := <-serverConnChan
+		require.NotNil(t, serverConn)
+		t.Cleanup(func() { serverConn.Close() })
+		return clientConn, serverConn
+	}
+
+	t.Run("default key", func(t *testing.T) {
+		clientConn, serverConn := handshake(t, context.Background())
+		require.Equal(t, clientID, clientConn.LocalPeer())
+		require.Equal(t, clientID, serverConn.RemotePeer())
+	})
+
+	t.Run("selected by hint", func(t *testing.T) {
+		clientConn, serverConn := handshake(t, ContextWithKeyHint(context.Background(), "legacy"))
+		require.Equal(t, legacyID, clientConn.LocalPeer())
+		require.Equal(t, legacyID, serverConn.RemotePeer())
+		require.True(t, serverConn.RemotePublicKey().Equals(legacyKey.GetPublic()))
+	})
+
+	t.Run("overridden per dial", func(t *testing.T) {
+		clientConn, serverConn := handshake(t, ContextWithIdentityOverride(context.Background(), legacyID))
+		require.Equal(t, legacyID, clientConn.LocalPeer())
+		require.Equal(t, legacyID, serverConn.RemotePeer())
+
+		// the override takes precedence over the key selector
+		ctx := ContextWithIdentityOverride(ContextWithKeyHint(context.Background(), "legacy"), clientID)
+		clientConn, serverConn = handshake(t, ctx)
+		require.Equal(t, clientID, clientConn.LocalPeer())
+		require.Equal(t, clientID, serverConn.RemotePeer())
+
+		unknownID, _ := createPeer(t)
+		clientInsecureConn, _ := connect(t)
+		_, err := clientTransport.SecureOutbound(ContextWithIdentityOverride(context.Background(), unknownID), clientInsecureConn, serverID)
+		require.ErrorContains(t, err, "is not configured")
+	})
+
+	t.Run("with certificate template", func(t *testing.T) {
+		tmpl, err := certTemplate()
+		require.NoError(t, err)
+		otherID, otherKey := createPeer(t)
+		keys := map[string]ic.PrivKey{"legacy": legacyKey, "other": otherKey}
+		tr, err := New(ID, clientKey, nil,
+			WithKeys([]ic.PrivKey{legacyKey, otherKey}, func(_ peer.ID, hint string) ic.PrivKey { return keys[hint] }),
+			WithIdentityOptions(WithCertTemplate(tmpl)),
+		)
+		require.NoError(t, err)
+		clientTransport = tr
+		for hint, id := range map[string]peer.ID{"": clientID, "legacy": legacyID, "other": otherID} {
+			clientConn, serverConn := handshake(t, ContextWithKeyHint(context.Background(), hint))
+			require.Equal(t, id, clientConn.LocalPeer())
+			require.Equal(t, id, serverConn.RemotePeer())
+		}
+		require.Empty(t, tmpl.ExtraExtensions)
+	})
+
+	t.Run("unknown key", func(t *testing.T) {
+		_, otherKey := createPeer(t)
+		tr, err := New(ID, clientKey, nil, WithKeys(nil, func(peer.ID, string) ic.PrivKey { return otherKey }))
+		require.NoError(t, err)
+		clientInsecureConn, _ := connect(t)
+		_, err = tr.SecureOutbound(context.Background(), clientInsecureConn, serverID)
+		require.ErrorContains(t, err, "is not configured")
+	})
+}
+
+func TestClassifyHandshakeError(t *testing.T) {
+	_, clientKey := createPeer(t)
+	serverID, serverKey := createPeer(t)
+	clientTransport, err := New(ID, clientKey, nil)
+	require.NoError(t, err)
+	serverTransport, err := New(ID, serverKey, nil)
+	require.NoError(t, err)
+
+	t.Run("timeout", func(t *testing.T) {
+		clientInsecureConn, _ := connect(t)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		// the server never responds
+		_, err := clientTransport.SecureOutbound(ctx, clientInsecureConn, serverID)
+		require.Error(t, err)
+		require.Equal(t, HandshakeErrorTimeout, ClassifyHandshakeError(err))
+	})
+
+	t.Run("transport", func(t *testing.T) {
+		clientInsecureConn, serverInsecureConn := connect(t)
+		serverInsecureConn.Close()
+		_, err := clientTransport.SecureOutbound(context.Background(), clientInsecureConn, serverID)
+		require.Error(t, err)
+		require.Equal(t, HandshakeErrorTransport, ClassifyHandshakeError(err))
+	})
+
+	t.Run("transport, inbound", func(t *testing.T) {
+		clientInsecureConn, serverInsecureConn := connect(t)
+		clientInsecureConn.Close()
+		_, err := serverTransport.SecureInbound(context.Background(), serverInsecureConn, "")
+		require.Error(t, err)
+		require.Equal(t, HandshakeErrorTransport, ClassifyHandshakeError(err))
+	})
+
+	t.Run("throttled", func(t *testing.T) {
+		err := fmt.Errorf("failed to open connection: %w", network.ErrResourceLimitExceeded)
+		require.Equal(t, HandshakeErrorThrottled, ClassifyHandshakeError(err))
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		clientInsecureConn, _ := connect(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		// the server never responds
+		_, err := clientTransport.SecureOutbound(ctx, clientInsecureConn, serverID)
+		require.Error(t, err)
+		require.Equal(t, HandshakeErrorCanceled, ClassifyHandshakeError(err))
+		require.Equal(t, HandshakeErrorCanceled, ClassifyHandshakeError(ErrHandshakeCanceled))
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		require.Equal(t, HandshakeErrorUnknown, ClassifyHandshakeError(nil))
+		require.Equal(t, HandshakeErrorUnknown, ClassifyHandshakeError(errors.New("foobar")))
+	})
+}
+
+func TestAlreadySecured(t *testing.T) {
+	clientID, clientKey := createPeer(t)
+	serverID, serverKey := createPeer(t)
+	clientTransport, err := New(ID, clientKey, nil)
+	require.NoError(t, err)
+	serverTransport, err := New(ID, serverKey, nil)
+	require.NoError(t, err)
+
+	clientInsecureConn, serverInsecureConn := connect(t)
+	serverConnChan := make(chan sec.SecureConn, 1)
+	go func() {
+		serverConn, err := serverTransport.SecureInbound(context.Background(), serverInsecureConn, "")
+		assert.NoError(t, err)
+		serverConnChan <- serverConn
+	}()
+	clientConn, err := clientTransport.SecureOutbound(context.Background(), clientInsecureConn, serverID)
+	require.NoError(t, err)
+	serverConn := <-serverConnChan
+	require.NotNil(t, serverConn)
+
+	_, err = clientTransport.SecureOutbound(context.Background(), clientConn, serverID)
+	require.ErrorIs(t, err, ErrAlreadySecured)
+	_, err = serverTransport.SecureInbound(context.Background(), serverConn, clientID)
+	require.ErrorIs(t, err, ErrAlreadySecured)
+
+	// a raw *tls.Conn is detected as well
+	_, err = clientTransport.SecureOutbound(context.Background(), tls.Client(clientInsecureConn, &tls.Config{}), serverID)
+	require.ErrorIs(t, err, ErrAlreadySecured)
+}
+
+func TestMaxHandshakeBytes(t *testing.T) {
+	_, serverKey := createPeer(t)
+	_, err := New(ID, serverKey, nil, WithMaxHandshakeBytes(0))
+	require.Error(t, err)
+	serverTransport, err := New(ID, serverKey, nil, WithMaxHandshakeBytes(1024))
+	require.NoError(t, err)
+
+	clientInsecureConn, serverInsecureConn := connect(t)
+	go func() {
+		// a TLS handshake record of the maximum size, followed by garbage
+		record := make([]byte, 5+1<<14)
+		copy(record, []byte{0x16, 0x03, 0x01, 0x40, 0x00})
+		clientInsecureConn.Write(record)
+	}()
+	_, err = serverTransport.SecureInbound(context.Background(), serverInsecureConn, "")
+	require.ErrorIs(t, err, ErrHandshakeTooLarge)
+}
+
+func TestLocalIdentityFingerprint(t *testing.T) {
+	_, serverKey := createPeer(t)
+	legacyKey, _, err := ic.GenerateRSAKeyPair(2048, rand.Reader)
+	require.NoError(t, err)
+	legacyID, err := peer.IDFromPrivateKey(legacyKey)
+	require.NoError(t, err)
+	legacyClientID, legacyClientKey := createPeer(t)
+	_, clientKey := createPeer(t)
+
+	// the server presents the legacy key to the legacy client
+	serverTransport, err := New(ID, serverKey, nil, WithKeys([]ic.PrivKey{legacyKey}, func(remote peer.ID, _ string) ic.PrivKey {
+		if remote == legacyClientID {
+			return legacyKey
+		}
+		return nil
+	}))
+	require.NoError(t, err)
+
+	handshake := func(t *testing.T, clientKey ic.PrivKey, serverID peer.ID) (client, server *conn) {
+		clientTransport, err := New(ID, clientKey, nil)
+		require.NoError(t, err)
+		clientID, err := peer.IDFromPrivateKey(clientKey)
+		require.NoError(t, err)
+		clientInsecureConn, serverInsecureConn := connect(t)
+		serverConnChan := make(chan sec.SecureConn, 1)
+		go func() {
+			// expect the client, so the selector knows the remote peer
+			serverConn, err := serverTransport.SecureInbound(context.Background(), serverInsecureConn, clientID)
+			assert.NoError(t, err)
+			serverConnChan <- serverConn
+		}()
+		clientConn, err := clientTransport.SecureOutbound(context.Background(), clientInsecureConn, serverID)
+		require.NoError(t, err)
+		t.Cleanup(func() { clientConn.Close() })
+		serverConn := <-serverConnChan
+		require.NotNil(t, serverConn)
+		t.Cleanup(func() { serverConn.Close() })
+		return clientConn.(*conn), serverConn.(*conn)
+	}
+
+	client1, server1 := handshake(t, clientKey, serverTransport.localPeer)
+	require.Equal(t, serverTransport.identity.Fingerprint(), server1.LocalIdentityFingerprint())
+	client2, server2 := handshake(t, legacyClientKey, legacyID)
+	require.Equal(t, serverTransport.identities[legacyID].Fingerprint(), server2.LocalIdentityFingerprint())
+	require.NotEqual(t, server1.LocalIdentityFingerprint(), server2.LocalIdentityFingerprint())
+
+	require.Len(t, client1.LocalIdentityFingerprint(), 32)
+	require.NotEqual(t, client1.LocalIdentityFingerprint(), client2.LocalIdentityFingerprint())
+}
+
+func TestSessionResumption(t *testing.T) {
+	clientID, clientKey := createPeer(t)
+	serverID, serverKey := createPeer(t)
+
+	clientTransport, err := New(ID, clientKey, nil, WithSessionResumption())
+	require.NoError(t, err)
+
+	handshake := func(t *testing.T, serverTransport *Transport) (client, server *conn) {
+		clientInsecureConn, serverInsecureConn := connect(t)
+		serverConnChan := make(chan sec.SecureConn, 1)
+		go func() {
+			serverConn, err := serverTransport.SecureInbound(context.Background(), serverInsecureConn, "")
+			assert.NoError(t, err)
+			serverConnChan <- serverConn
+		}()
+		clientConn, err := clientTransport.SecureOutbound(context.Background(), clientInsecureConn, serverID)
+		require.NoError(t, err)
+		t.Cleanup(func() { clientConn.Close() })
+		serverConn := <-serverConnChan
+		require.NotNil(t, serverConn)
+		t.Cleanup(func() { serverConn.Close() })
+
+		// The session ticket is sent after the handshake, and processed when reading.
+		_, err = serverConn.Write([]byte("foo"))
+		require.NoError(t, err)
+		b := make([]byte, 3)
+		_, err = io.ReadFull(clientConn, b)
+		require.NoError(t, err)
+
+		client, server = clientConn.(*conn), serverConn.(*conn)
+		require.Equal(t, serverID, client.RemotePeer())
+		require.Equal(t, clientID, server.RemotePeer())
+		require.True(t, client.RemotePublicKey().Equals(serverKey.GetPublic()))
+		require.True(t, server.RemotePublicKey().Equals(clientKey.GetPublic()))
+		return client, server
+	}
+
+	serverTransport, err := New(ID, serverKey, nil, WithSessionResumption())
+	require.NoError(t, err)
+	client, server := handshake(t, serverTransport)
+	require.False(t, client.ConnectionState().DidResume)
+	require.False(t, server.ConnectionState().DidResume)
+	require.False(t, client.DidResume())
+	require.False(t, server.DidResume())
+
+	t.Run("abbreviated handshake", func(t *testing.T) {
+		client, server := handshake(t, serverTransport)
+		require.True(t, client.ConnectionState().DidResume)
+		require.True(t, server.ConnectionState().DidResume)
+		require.True(t, client.DidResume())
+		require.True(t, server.DidResume())
+		require.Equal(t, client.ConnectionNonce(), server.ConnectionNonce())
+	})
+
+	t.Run("fallback to full handshake", func(t *testing.T) {
+		// A new transport doesn't know the session, e.g. after the server restarted.
+		serverTransport, err := New(ID, serverKey, nil, WithSessionResumption())
+		require.NoError(t, err)
+		client, server := handshake(t, serverTransport)
+		require.False(t, client.ConnectionState().DidResume)
+		require.False(t, server.ConnectionState().DidResume)
+		require.False(t, client.DidResume())
+		require.False(t, server.DidResume())
+	})
+}
+
+func TestRemoteSupportedProtos(t *testing.T) {
+	_, clientKey := createPeer(t)
+	serverID, serverKey := createPeer(t)
+
+	clientTransport, err := New(ID, clientKey, []tptu.StreamMuxer{{ID: "muxer1"}, {ID: "muxer2"}, {ID: "muxer3"}})
+	require.NoError(t, err)
+	serverTransport, err := New(ID, serverKey, []tptu.StreamMuxer{{ID: "muxer2"}})
+	require.NoError(t, err)
+
+	clientInsecureConn, serverInsecureConn := connect(t)
+	serverConnChan := make(chan sec.SecureConn, 1)
+	go func() {
+		serverConn, err := serverTransport.SecureInbound(context.Background(), serverInsecureConn, "")
+		assert.NoError(t, err)
+		serverConnChan <- serverConn
+	}()
+	clientConn, err := clientTransport.SecureOutbound(context.Background(), clientInsecureConn, serverID)
+	require.NoError(t, err)
+	defer clientConn.Close()
+	serverConn := <-serverConnChan
+	require.NotNil(t, serverConn)
+	defer serverConn.Close()
+
+	require.Equal(t, protocol.ID("muxer2"), serverConn.ConnState().StreamMultiplexer)
+	require.Equal(t, []string{"muxer1", "muxer2", "muxer3", "libp2p"}, serverConn.(*conn).RemoteSupportedProtos())
+	require.Nil(t, clientConn.(*conn).RemoteSupportedProtos())
+}
+
+func TestVerifyConnection(t *testing.T) {
+	_, clientKey := createPeer(t)
+	serverID, serverKey := createPeer(t)
+
+	errVersion := errors.New("unsupported TLS version")
+	requireVersion := func(version uint16) Option {
+		return WithVerifyConnection(func(_ context.Context, cs tls.ConnectionState) error {
+			// our libp2p verification already ran
+			require.NotEmpty(t, cs.PeerCertificates)
+			if cs.Version != version {
+				return errVersion
 			}
+			return nil
 		})
 	}
+
+	handshake := func(t *testing.T, opt Option) error {
+		clientTransport, err := New(ID, clientKey, nil, opt)
+		require.NoError(t, err)
+		serverTransport, err := New(ID, serverKey, nil)
+		require.NoError(t, err)
+
+		clientInsecureConn, serverInsecureConn := connect(t)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if serverConn, err := serverTransport.SecureInbound(context.Background(), serverInsecureConn, ""); err == nil {
+				serverConn.Close()
+			}
+		}()
+		defer func() { <-done }()
+		clientConn, err := clientTransport.SecureOutbound(context.Background(), clientInsecureConn, serverID)
+		if err != nil {
+			return err
+		}
+		return clientConn.Close()
+	}
+
+	t.Run("accepted", func(t *testing.T) {
+		require.NoError(t, handshake(t, requireVersion(tls.VersionTLS13)))
+	})
+	t.Run("rejected", func(t *testing.T) {
+		err := handshake(t, requireVersion(0xffff))
+		require.ErrorIs(t, err, errVersion)
+	})
+}
+
+func TestMaxCertLifetime(t *testing.T) {
+	_, clientKey := createPeer(t)
+	serverID, serverKey := createPeer(t)
+
+	clientTransport, err := New(ID, clientKey, nil, WithIdentityOptions(WithMaxCertLifetime(24*time.Hour)))
+	require.NoError(t, err)
+
+	handshake := func(t *testing.T, opts ...IdentityOption) error {
+		serverTransport, err := New(ID, serverKey, nil, WithIdentityOptions(opts...))
+		require.NoError(t, err)
+		clientInsecureConn, serverInsecureConn := connect(t)
+		go func() {
+			conn, err := serverTransport.SecureInbound(context.Background(), serverInsecureConn, "")
+			if err == nil {
+				conn.Close()
+			}
+		}()
+		conn, err := clientTransport.SecureOutbound(context.Background(), clientInsecureConn, serverID)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	t.Run("short-lived certificate", func(t *testing.T) {
+		tmpl, err := certTemplate()
+		require.NoError(t, err)
+		tmpl.NotAfter = tmpl.NotBefore.Add(12 * time.Hour)
+		require.NoError(t, handshake(t, WithCertTemplate(tmpl)))
+	})
+
+	t.Run("long-lived certificate", func(t *testing.T) {
+		err := handshake(t)
+		require.ErrorContains(t, err, "certificate lifetime")
+		require.Equal(t, HandshakeErrorCertInvalid, ClassifyHandshakeError(err))
+	})
+}
+
+func TestVerifyConnectionContext(t *testing.T) {
+	_, clientKey := createPeer(t)
+	serverID, serverKey := createPeer(t)
+
+	type traceIDKey struct{}
+	traceIDs := make(chan any, 2)
+	verify := WithVerifyConnection(func(ctx context.Context, _ tls.ConnectionState) error {
+		traceIDs <- ctx.Value(traceIDKey{})
+		return ctx.Err()
+	})
+	clientTransport, err := New(ID, clientKey, nil, verify)
+	require.NoError(t, err)
+	serverTransport, err := New(ID, serverKey, nil, verify)
+	require.NoError(t, err)
+
+	clientInsecureConn, serverInsecureConn := connect(t)
+	serverConnChan := make(chan sec.SecureConn, 1)
+	go func() {
+		ctx := context.WithValue(context.Background(), traceIDKey{}, "server")
+		serverConn, err := serverTransport.SecureInbound(ctx, serverInsecureConn, "")
+		assert.NoError(t, err)
+		serverConnChan <- serverConn
+	}()
+	ctx := context.WithValue(context.Background(), traceIDKey{}, "client")
+	clientConn, err := clientTransport.SecureOutbound(ctx, clientInsecureConn, serverID)
+	require.NoError(t, err)
+	defer clientConn.Close()
+	serverConn := <-serverConnChan
+	require.NotNil(t, serverConn)
+	defer serverConn.Close()
+
+	require.ElementsMatch(t, []any{"client", "server"}, []any{<-traceIDs, <-traceIDs})
+}
+
+func TestCertRotatedHook(t *testing.T) {
+	_, clientKey := createPeer(t)
+	serverID, serverKey := createPeer(t)
+
+	type rotation struct {
+		peer           peer.ID
+		oldFingerprint []byte
+		newFingerprint []byte
+	}
+	rotations := make(chan rotation, 10)
+	clientTransport, err := New(ID, clientKey, nil, WithCertRotatedHook(func(p peer.ID, oldFingerprint, newFingerprint []byte) {
+		rotations <- rotation{peer: p, oldFingerprint: oldFingerprint, newFingerprint: newFingerprint}
+	}))
+	require.NoError(t, err)
+
+	handshake := func(t *testing.T, serverTransport *Transport) {
+		clientInsecureConn, serverInsecureConn := connect(t)
+		go func() {
+			conn, err := serverTransport.SecureInbound(context.Background(), serverInsecureConn, "")
+			if err == nil {
+				conn.Close()
+			}
+		}()
+		conn, err := clientTransport.SecureOutbound(context.Background(), clientInsecureConn, serverID)
+		require.NoError(t, err)
+		conn.Close()
+	}
+
+	serverTransport, err := New(ID, serverKey, nil)
+	require.NoError(t, err)
+	handshake(t, serverTransport)
+	handshake(t, serverTransport)
+	require.Empty(t, rotations)
+
+	// a new transport generates a new certificate for the same key
+	rotatedTransport, err := New(ID, serverKey, nil)
+	require.NoError(t, err)
+	handshake(t, rotatedTransport)
+	require.Len(t, rotations, 1)
+	r := <-rotations
+	require.Equal(t, serverID, r.peer)
+	require.Equal(t, serverTransport.identity.Fingerprint(), r.oldFingerprint)
+	require.Equal(t, rotatedTransport.identity.Fingerprint(), r.newFingerprint)
+
+	handshake(t, rotatedTransport)
+	require.Empty(t, rotations)
+}
+
+func TestRequireCommonMuxer(t *testing.T) {
+	_, clientKey := createPeer(t)
+	serverID, serverKey := createPeer(t)
+
+	handshake := func(t *testing.T, clientMuxers, serverMuxers []tptu.StreamMuxer) error {
+		clientTransport, err := New(ID, clientKey, clientMuxers)
+		require.NoError(t, err)
+		serverTransport, err := New(ID, serverKey, serverMuxers, WithRequireCommonMuxer())
+		require.NoError(t, err)
+
+		clientInsecureConn, serverInsecureConn := connect(t)
+		go func() {
+			if conn, err := clientTransport.SecureOutbound(context.Background(), clientInsecureConn, serverID); err == nil {
+				conn.Close()
+			}
+		}()
+		conn, err := serverTransport.SecureInbound(context.Background(), serverInsecureConn, "")
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	t.Run("common muxer", func(t *testing.T) {
+		require.NoError(t, handshake(t, []tptu.StreamMuxer{{ID: "muxer1"}, {ID: "muxer2"}}, []tptu.StreamMuxer{{ID: "muxer2"}}))
+	})
+
+	t.Run("client without early muxer negotiation", func(t *testing.T) {
+		require.NoError(t, handshake(t, nil, []tptu.StreamMuxer{{ID: "muxer1"}}))
+	})
+
+	t.Run("disjoint muxers", func(t *testing.T) {
+		err := handshake(t, []tptu.StreamMuxer{{ID: "muxer1"}, {ID: "muxer2"}}, []tptu.StreamMuxer{{ID: "muxer3"}})
+		var muxerErr ErrNoCommonMuxer
+		require.ErrorAs(t, err, &muxerErr)
+		require.Equal(t, []string{"muxer3"}, muxerErr.Local)
+		require.Equal(t, []string{"muxer1", "muxer2"}, muxerErr.Remote)
+	})
+}
+
+func TestHandshakeStats(t *testing.T) {
+	_, clientKey := createPeer(t)
+	serverID, serverKey := createPeer(t)
+	clientTransport, err := New(ID, clientKey, nil)
+	require.NoError(t, err)
+	serverTransport, err := New(ID, serverKey, nil, WithHandshakeStatsWindow(4))
+	require.NoError(t, err)
+
+	handshake := func(t *testing.T, fail bool) {
+		clientInsecureConn, serverInsecureConn := connect(t)
+		if fail {
+			clientInsecureConn.Close()
+			_, err := serverTransport.SecureInbound(context.Background(), serverInsecureConn, "")
+			require.Error(t, err)
+			return
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			conn, err := clientTransport.SecureOutbound(context.Background(), clientInsecureConn, serverID)
+			assert.NoError(t, err)
+			if err == nil {
+				conn.Close()
+			}
+		}()
+		conn, err := serverTransport.SecureInbound(context.Background(), serverInsecureConn, "")
+		require.NoError(t, err)
+		conn.Close()
+		<-done
+	}
+
+	// the first failure falls out of the window
+	handshake(t, true)
+	for i := 0; i < 3; i++ {
+		handshake(t, false)
+	}
+	handshake(t, true)
+
+	stats := serverTransport.HandshakeStats()
+	require.Equal(t, HandshakeCounts{Succeeded: 3, Failed: 1}, stats.Total)
+	require.Equal(t, 0.75, stats.Total.SuccessRate())
+	require.Equal(t, map[network.Direction]HandshakeCounts{network.DirInbound: {Succeeded: 3, Failed: 1}}, stats.ByDirection)
+	require.Equal(t, map[pb.KeyType]HandshakeCounts{clientKey.Type(): {Succeeded: 3}, UnknownKeyType: {Failed: 1}}, stats.ByKeyType)
+
+	// the failed outbound handshake
+	clientInsecureConn, serverInsecureConn := connect(t)
+	serverInsecureConn.Close()
+	_, err = clientTransport.SecureOutbound(context.Background(), clientInsecureConn, serverID)
+	require.Error(t, err)
+	stats = clientTransport.HandshakeStats()
+	require.Equal(t, HandshakeCounts{Succeeded: 3, Failed: 1}, stats.ByDirection[network.DirOutbound])
+	require.Equal(t, map[pb.KeyType]HandshakeCounts{serverKey.Type(): {Succeeded: 3}, UnknownKeyType: {Failed: 1}}, stats.ByKeyType)
+	require.Zero(t, stats.ByDirection[network.DirInbound].SuccessRate())
+
+	_, err = New(ID, serverKey, nil, WithHandshakeStatsWindow(0))
+	require.Error(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	_, key := createPeer(t)
+	otherID, otherKey := createPeer(t)
+
+	t.Run("valid", func(t *testing.T) {
+		tr, err := New(ID, key, nil, WithKeys([]ic.PrivKey{otherKey}, func(peer.ID, string) ic.PrivKey { return nil }))
+		require.NoError(t, err)
+		require.NoError(t, tr.Validate())
+	})
+
+	t.Run("mismatched key and certificate", func(t *testing.T) {
+		tr, err := New(ID, key, nil)
+		require.NoError(t, err)
+		tr.identity, err = NewIdentity(otherKey)
+		require.NoError(t, err)
+		err = tr.Validate()
+		require.Error(t, err)
+		require.ErrorContains(t, err, "certificate is bound to a different key")
+		require.ErrorContains(t, err, otherID.String())
+	})
+
+	t.Run("expired certificate", func(t *testing.T) {
+		template, err := certTemplate()
+		require.NoError(t, err)
+		template.NotBefore = time.Now().Add(-2 * time.Hour)
+		template.NotAfter = time.Now().Add(-time.Hour)
+		tr, err := New(ID, key, nil, WithIdentityOptions(WithCertTemplate(template)))
+		require.NoError(t, err)
+		require.ErrorContains(t, tr.Validate(), "certificate expired")
+	})
+
+	t.Run("certificate lifetime exceeds the maximum", func(t *testing.T) {
+		tr, err := New(ID, key, nil, WithIdentityOptions(WithMaxCertLifetime(24*time.Hour)))
+		require.NoError(t, err)
+		require.ErrorContains(t, tr.Validate(), "exceeds the maximum")
+	})
+}
+
+func TestDeterministicCertificateHandshake(t *testing.T) {
+	clientID, clientKey := createPeer(t)
+	serverKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	serverID, err := peer.IDFromPrivateKey(serverKey)
+	require.NoError(t, err)
+
+	clientTransport, err := New(ID, clientKey, nil)
+	require.NoError(t, err)
+	serverTransport, err := New(ID, serverKey, nil, WithIdentityOptions(WithDeterministicCertificate()))
+	require.NoError(t, err)
+
+	clientInsecureConn, serverInsecureConn := connect(t)
+	serverConnChan := make(chan sec.SecureConn, 1)
+	go func() {
+		serverConn, err := serverTransport.SecureInbound(context.Background(), serverInsecureConn, "")
+		assert.NoError(t, err)
+		serverConnChan <- serverConn
+	}()
+	clientConn, err := clientTransport.SecureOutbound(context.Background(), clientInsecureConn, serverID)
+	require.NoError(t, err)
+	defer clientConn.Close()
+	serverConn := <-serverConnChan
+	require.NotNil(t, serverConn)
+	defer serverConn.Close()
+	require.Equal(t, serverID, clientConn.RemotePeer())
+	require.Equal(t, clientID, serverConn.RemotePeer())
+}
+
+func TestHandshakeHandleCancel(t *testing.T) {
+	_, clientKey := createPeer(t)
+	serverID, _ := createPeer(t)
+	clientTransport, err := New(ID, clientKey, nil)
+	require.NoError(t, err)
+
+	// the server never responds
+	clientInsecureConn, _ := connect(t)
+	h := clientTransport.StartSecureOutbound(context.Background(), clientInsecureConn, serverID)
+	select {
+	case <-h.Done():
+		t.Fatal("handshake with a silent peer completed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	start := time.Now()
+	h.Cancel()
+	select {
+	case <-h.Done():
+	case <-time.After(time.Second):
+		t.Fatal("handshake wasn't aborted")
+	}
+	require.Less(t, time.Since(start), time.Second)
+	_, err = h.Result()
+	require.ErrorIs(t, err, ErrHandshakeCanceled)
+	// the underlying connection was closed
+	_, err = clientInsecureConn.Write([]byte("foobar"))
+	require.ErrorIs(t, err, net.ErrClosed)
+}
+
+// recordingSigner is a Signer that records the data it signs.
+type recordingSigner struct {
+	key    ic.PrivKey
+	signed [][]byte
+}
+
+func (s *recordingSigner) Public() ic.PubKey { return s.key.GetPublic() }
+
+func (s *recordingSigner) Sign(data []byte) ([]byte, error) {
+	s.signed = append(s.signed, data)
+	return s.key.Sign(data)
+}
+
+func TestSigner(t *testing.T) {
+	clientID, clientKey := createPeer(t)
+	serverID, serverKey := createPeer(t)
+	signer := &recordingSigner{key: serverKey}
+	key := PrivKeyFromSigner(signer)
+	_, err := key.Raw()
+	require.Error(t, err)
+
+	serverTransport, err := New(ID, key, nil)
+	require.NoError(t, err)
+	require.Len(t, signer.signed, 1)
+	clientTransport, err := New(ID, clientKey, nil)
+	require.NoError(t, err)
+
+	clientInsecureConn, serverInsecureConn := connect(t)
+	type connErr struct {
+		conn sec.SecureConn
+		err  error
+	}
+	done := make(chan connErr, 1)
+	go func() {
+		conn, err := serverTransport.SecureInbound(context.Background(), serverInsecureConn, "")
+		done <- connErr{conn: conn, err: err}
+	}()
+	clientConn, err := clientTransport.SecureOutbound(context.Background(), clientInsecureConn, serverID)
+	require.NoError(t, err)
+	defer clientConn.Close()
+	res := <-done
+	require.NoError(t, res.err)
+	defer res.conn.Close()
+
+	require.Equal(t, serverID, res.conn.LocalPeer())
+	require.Equal(t, clientID, res.conn.RemotePeer())
+	require.Equal(t, serverID, clientConn.RemotePeer())
+	require.True(t, serverKey.GetPublic().Equals(clientConn.RemotePublicKey()))
+	// the key was only used to sign the certificate
+	require.Len(t, signer.signed, 1)
+}
+
+func TestMaxChainLength(t *testing.T) {
+	_, clientKey := createPeer(t)
+	_, serverKey := createPeer(t)
+
+	// chainOfLength returns a certificate chain of n certificates, each one signed by the next one.
+	chainOfLength := func(n int) tls.Certificate {
+		var certs [][]byte
+		var parent *x509.Certificate
+		var parentKey *ecdsa.PrivateKey
+		for i := 0; i < n; i++ {
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			require.NoError(t, err)
+			tmpl := &x509.Certificate{SerialNumber: big.NewInt(int64(i + 1))}
+			if parent == nil {
+				parent, parentKey = tmpl, key
+			}
+			certDER, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), parentKey)
+			require.NoError(t, err)
+			parent, err = x509.ParseCertificate(certDER)
+			require.NoError(t, err)
+			parentKey = key
+			certs = append([][]byte{certDER}, certs...)
+		}
+		return tls.Certificate{Certificate: certs, PrivateKey: parentKey}
+	}
+
+	handshake := func(t *testing.T, chain tls.Certificate, opts ...IdentityOption) error {
+		clientTransport, err := New(ID, clientKey, nil)
+		require.NoError(t, err)
+		clientTransport.identity.config.Certificates = []tls.Certificate{chain}
+		serverTransport, err := New(ID, serverKey, nil, WithIdentityOptions(opts...))
+		require.NoError(t, err)
+
+		clientInsecureConn, serverInsecureConn := connect(t)
+		go func() {
+			if conn, err := clientTransport.SecureOutbound(context.Background(), clientInsecureConn, ""); err == nil {
+				conn.Close()
+			}
+		}()
+		conn, err := serverTransport.SecureInbound(context.Background(), serverInsecureConn, "")
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	t.Run("default limit", func(t *testing.T) {
+		err := handshake(t, chainOfLength(DefaultMaxChainLength+1))
+		require.ErrorContains(t, err, "certificate chain too long")
+		require.Equal(t, HandshakeErrorCertInvalid, ClassifyHandshakeError(err))
+	})
+
+	t.Run("custom limit", func(t *testing.T) {
+		err := handshake(t, chainOfLength(3), WithMaxChainLength(2))
+		require.ErrorContains(t, err, "certificate chain too long: got 3 certificates, expected at most 2")
+	})
+
+	t.Run("within the limit", func(t *testing.T) {
+		// the chain is rejected by the libp2p verification, not by the limit
+		err := handshake(t, chainOfLength(2), WithMaxChainLength(2))
+		require.ErrorContains(t, err, "expected one certificates in the chain")
+	})
+
+	_, err := NewIdentity(clientKey, WithMaxChainLength(-1))
+	require.Error(t, err)
+}
+
+// mockEntropySource becomes ready after a number of calls to Ready.
+type mockEntropySource struct {
+	calls, readyAfter int
+}
+
+func (s *mockEntropySource) Ready() bool {
+	s.calls++
+	return s.calls > s.readyAfter
+}
+
+func TestEntropyCheck(t *testing.T) {
+	_, key := createPeer(t)
+
+	t.Run("waits until ready", func(t *testing.T) {
+		src := &mockEntropySource{readyAfter: 3}
+		start := time.Now()
+		_, err := New(ID, key, nil, WithEntropyCheck(src, 5*time.Second))
+		require.NoError(t, err)
+		require.Equal(t, 4, src.calls)
+		require.GreaterOrEqual(t, time.Since(start), 3*entropyPollInterval)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		src := &mockEntropySource{readyAfter: math.MaxInt}
+		_, err := New(ID, key, nil, WithEntropyCheck(src, 200*time.Millisecond))
+		require.ErrorIs(t, err, ErrEntropyNotReady)
+	})
+
+	t.Run("invalid options", func(t *testing.T) {
+		_, err := New(ID, key, nil, WithEntropyCheck(nil, time.Second))
+		require.Error(t, err)
+		_, err = New(ID, key, nil, WithEntropyCheck(&mockEntropySource{}, 0))
+		require.Error(t, err)
+	})
+}
+
+type mockMetricsTracer struct {
+	mx        sync.Mutex
+	successes int
+	failures  []HandshakeErrorClass
+}
+
+func (m *mockMetricsTracer) IncHandshakeSuccess() {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.successes++
+}
+
+func (m *mockMetricsTracer) getSuccesses() int {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	return m.successes
+}
+
+func (m *mockMetricsTracer) IncHandshakeFailure(reason HandshakeErrorClass) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.failures = append(m.failures, reason)
+}
+
+func (m *mockMetricsTracer) getFailures() []HandshakeErrorClass {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	return slices.Clone(m.failures)
+}
+
+// throttledConn is a net.Conn that fails all reads as if a resource limit was hit.
+type throttledConn struct {
+	net.Conn
+}
+
+func (c *throttledConn) Read([]byte) (int, error) {
+	return 0, fmt.Errorf("read failed: %w", network.ErrResourceLimitExceeded)
+}
+
+func TestMetricsTracerFailureReasons(t *testing.T) {
+	_, clientKey := createPeer(t)
+	serverID, serverKey := createPeer(t)
+
+	newTransports := func(t *testing.T) (client, server *Transport, tracer *mockMetricsTracer) {
+		tracer = &mockMetricsTracer{}
+		var err error
+		client, err = New(ID, clientKey, nil, WithMetricsTracer(tracer))
+		require.NoError(t, err)
+		server, err = New(ID, serverKey, nil)
+		require.NoError(t, err)
+		return client, server, tracer
+	}
+	// handshake runs a handshake and returns the client's error
+	handshake := func(t *testing.T, client, server *Transport, clientConn net.Conn, serverConn net.Conn, expected peer.ID) error {
+		go func() {
+			if conn, err := server.SecureInbound(context.Background(), serverConn, ""); err == nil {
+				conn.Close()
+			}
+		}()
+		conn, err := client.SecureOutbound(context.Background(), clientConn, expected)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	t.Run("verification", func(t *testing.T) {
+		client, server, tracer := newTransports(t)
+		server.identity.config.Certificates[0].PrivateKey = client.identity.config.Certificates[0].PrivateKey
+		clientConn, serverConn := connect(t)
+		require.Error(t, handshake(t, client, server, clientConn, serverConn, serverID))
+		require.Equal(t, []HandshakeErrorClass{HandshakeErrorCertInvalid}, tracer.getFailures())
+	})
+
+	t.Run("peer ID mismatch", func(t *testing.T) {
+		client, server, tracer := newTransports(t)
+		thirdPartyID, _ := createPeer(t)
+		clientConn, serverConn := connect(t)
+		require.Error(t, handshake(t, client, server, clientConn, serverConn, thirdPartyID))
+		require.Equal(t, []HandshakeErrorClass{HandshakeErrorPeerIDMismatch}, tracer.getFailures())
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		client, _, tracer := newTransports(t)
+		clientConn, _ := connect(t)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := client.SecureOutbound(ctx, clientConn, serverID)
+		require.Error(t, err)
+		require.Equal(t, []HandshakeErrorClass{HandshakeErrorTimeout}, tracer.getFailures())
+	})
+
+	t.Run("io", func(t *testing.T) {
+		client, _, tracer := newTransports(t)
+		clientConn, serverConn := connect(t)
+		serverConn.Close()
+		_, err := client.SecureOutbound(context.Background(), clientConn, serverID)
+		require.Error(t, err)
+		require.Equal(t, []HandshakeErrorClass{HandshakeErrorTransport}, tracer.getFailures())
+	})
+
+	t.Run("throttled", func(t *testing.T) {
+		client, _, tracer := newTransports(t)
+		clientConn, _ := connect(t)
+		_, err := client.SecureOutbound(context.Background(), &throttledConn{Conn: clientConn}, serverID)
+		require.Error(t, err)
+		require.Equal(t, []HandshakeErrorClass{HandshakeErrorThrottled}, tracer.getFailures())
+	})
+
+	t.Run("success", func(t *testing.T) {
+		client, server, tracer := newTransports(t)
+		clientConn, serverConn := connect(t)
+		require.NoError(t, handshake(t, client, server, clientConn, serverConn, serverID))
+		require.Empty(t, tracer.getFailures())
+		require.Equal(t, 1, tracer.getSuccesses())
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		client, _, tracer := newTransports(t)
+		clientConn, _ := connect(t)
+		h := client.StartSecureOutbound(context.Background(), clientConn, serverID)
+		h.Cancel()
+		_, err := h.Result()
+		require.ErrorIs(t, err, ErrHandshakeCanceled)
+		require.Equal(t, []HandshakeErrorClass{HandshakeErrorCanceled}, tracer.getFailures())
+		require.Zero(t, tracer.getSuccesses())
+	})
+}
+
+func TestCipherSuites(t *testing.T) {
+	clientID, clientKey := createPeer(t)
+	serverID, serverKey := createPeer(t)
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := New(ID, clientKey, nil, WithCipherSuites(nil))
+		require.EqualError(t, err, "tls: no cipher suites configured")
+		_, err = New(ID, clientKey, nil, WithCipherSuites([]uint16{tls.TLS_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}))
+		require.ErrorContains(t, err, "not a TLS 1.3 cipher suite")
+	})
+
+	// handshake returns the cipher suite negotiated by the client, or the error of the side that failed
+	handshake := func(t *testing.T, clientOpts, serverOpts []Option) (uint16, error) {
+		clientTransport, err := New(ID, clientKey, nil, clientOpts...)
+		require.NoError(t, err)
+		serverTransport, err := New(ID, serverKey, nil, serverOpts...)
+		require.NoError(t, err)
+
+		clientInsecureConn, serverInsecureConn := connect(t)
+		serverErr := make(chan error, 1)
+		go func() {
+			serverConn, err := serverTransport.SecureInbound(context.Background(), serverInsecureConn, clientID)
+			if err == nil {
+				serverConn.Close()
+			}
+			serverErr <- err
+		}()
+		clientConn, err := clientTransport.SecureOutbound(context.Background(), clientInsecureConn, serverID)
+		if err != nil {
+			<-serverErr
+			return 0, err
+		}
+		defer clientConn.Close()
+		if err := <-serverErr; err != nil {
+			return 0, err
+		}
+		return clientConn.(*conn).ConnectionState().CipherSuite, nil
+	}
+
+	negotiated, err := handshake(t, nil, nil)
+	require.NoError(t, err)
+	var other uint16
+	for _, s := range tls13CipherSuites {
+		if s != negotiated {
+			other = s
+			break
+		}
+	}
+
+	for _, side := range []string{"client", "server"} {
+		t.Run(side, func(t *testing.T) {
+			opts := func(suites ...uint16) (clientOpts, serverOpts []Option) {
+				if side == "client" {
+					return []Option{WithCipherSuites(suites)}, nil
+				}
+				return nil, []Option{WithCipherSuites(suites)}
+			}
+
+			clientOpts, serverOpts := opts(other, negotiated)
+			cs, err := handshake(t, clientOpts, serverOpts)
+			require.NoError(t, err)
+			require.Equal(t, negotiated, cs)
+
+			clientOpts, serverOpts = opts(other)
+			_, err = handshake(t, clientOpts, serverOpts)
+			require.ErrorContains(t, err, "is not allowed")
+		})
+	}
+
+	// crypto/tls doesn't consider the allowed suites when negotiating, and
+	// never prefers AES-256, so both sides allowing only AES-256 doesn't help.
+	t.Run("both sides", func(t *testing.T) {
+		require.NotEqual(t, tls.TLS_AES_256_GCM_SHA384, negotiated)
+		clientOpts := []Option{WithCipherSuites([]uint16{tls.TLS_AES_256_GCM_SHA384})}
+		serverOpts := []Option{WithCipherSuites([]uint16{tls.TLS_AES_256_GCM_SHA384})}
+		_, err := handshake(t, clientOpts, serverOpts)
+		require.ErrorContains(t, err, "is not allowed")
+	})
+}
+
+func TestCertVerifyCallback(t *testing.T) {
+	_, clientKey := createPeer(t)
+	serverID, serverKey := createPeer(t)
+
+	errNotPinned := errors.New("certificate not pinned")
+	var mx sync.Mutex
+	var pinned []byte
+	var seen [][]byte
+	cb := WithCertVerifyCallback(func(cert *x509.Certificate) error {
+		fp := sha256.Sum256(cert.Raw)
+		mx.Lock()
+		defer mx.Unlock()
+		seen = append(seen, fp[:])
+		if !bytes.Equal(fp[:], pinned) {
+			return errNotPinned
+		}
+		return nil
+	})
+	pin := func(fingerprint []byte) {
+		mx.Lock()
+		defer mx.Unlock()
+		pinned = fingerprint
+		seen = nil
+	}
+	getSeen := func() [][]byte {
+		mx.Lock()
+		defer mx.Unlock()
+		return seen
+	}
+
+	// handshake returns the errors of the client and the server
+	handshake := func(t *testing.T, clientTransport, serverTransport *Transport) (clientErr, serverErr error) {
+		clientInsecureConn, serverInsecureConn := connect(t)
+		serverErrChan := make(chan error, 1)
+		go func() {
+			serverConn, err := serverTransport.SecureInbound(context.Background(), serverInsecureConn, "")
+			if err == nil {
+				serverConn.Close()
+			}
+			serverErrChan <- err
+		}()
+		clientConn, clientErr := clientTransport.SecureOutbound(context.Background(), clientInsecureConn, serverID)
+		if clientErr == nil {
+			clientConn.Close()
+		}
+		return clientErr, <-serverErrChan
+	}
+
+	t.Run("outbound", func(t *testing.T) {
+		clientTransport, err := New(ID, clientKey, nil, cb)
+		require.NoError(t, err)
+		serverTransport, err := New(ID, serverKey, nil)
+		require.NoError(t, err)
+
+		pin(nil)
+		clientErr, _ := handshake(t, clientTransport, serverTransport)
+		require.ErrorIs(t, clientErr, errNotPinned)
+		require.Equal(t, HandshakeErrorCertInvalid, ClassifyHandshakeError(clientErr))
+		require.Equal(t, [][]byte{serverTransport.identity.Fingerprint()}, getSeen())
+
+		pin(serverTransport.identity.Fingerprint())
+		clientErr, serverErr := handshake(t, clientTransport, serverTransport)
+		require.NoError(t, clientErr)
+		require.NoError(t, serverErr)
+		require.Equal(t, [][]byte{serverTransport.identity.Fingerprint()}, getSeen())
+	})
+
+	t.Run("inbound", func(t *testing.T) {
+		clientTransport, err := New(ID, clientKey, nil)
+		require.NoError(t, err)
+		serverTransport, err := New(ID, serverKey, nil, cb)
+		require.NoError(t, err)
+
+		pin(nil)
+		_, serverErr := handshake(t, clientTransport, serverTransport)
+		require.ErrorIs(t, serverErr, errNotPinned)
+		require.Equal(t, [][]byte{clientTransport.identity.Fingerprint()}, getSeen())
+
+		pin(clientTransport.identity.Fingerprint())
+		clientErr, serverErr := handshake(t, clientTransport, serverTransport)
+		require.NoError(t, clientErr)
+		require.NoError(t, serverErr)
+		require.Equal(t, [][]byte{clientTransport.identity.Fingerprint()}, getSeen())
+	})
+
+	t.Run("resumed session", func(t *testing.T) {
+		clientTransport, err := New(ID, clientKey, nil, cb, WithSessionResumption())
+		require.NoError(t, err)
+		serverTransport, err := New(ID, serverKey, nil, WithSessionResumption())
+		require.NoError(t, err)
+
+		// handshake reads from the connection, so that the client processes the session ticket
+		handshake := func(t *testing.T) (didResume bool, clientErr error) {
+			clientInsecureConn, serverInsecureConn := connect(t)
+			go func() {
+				serverConn, err := serverTransport.SecureInbound(context.Background(), serverInsecureConn, "")
+				if err != nil {
+					return
+				}
+				defer serverConn.Close()
+				serverConn.Write([]byte("foo"))
+				serverConn.Read(make([]byte, 1))
+			}()
+			clientConn, err := clientTransport.SecureOutbound(context.Background(), clientInsecureConn, serverID)
+			if err != nil {
+				return false, err
+			}
+			defer clientConn.Close()
+			_, err = io.ReadFull(clientConn, make([]byte, 3))
+			require.NoError(t, err)
+			return clientConn.(*conn).ConnectionState().DidResume, nil
+		}
+
+		pin(serverTransport.identity.Fingerprint())
+		didResume, err := handshake(t)
+		require.NoError(t, err)
+		require.False(t, didResume)
+		didResume, err = handshake(t)
+		require.NoError(t, err)
+		require.True(t, didResume)
+		require.Len(t, getSeen(), 2)
+
+		// The callback also runs for resumed sessions.
+		pin(nil)
+		_, err = handshake(t)
+		require.ErrorIs(t, err, errNotPinned)
+		require.Equal(t, [][]byte{serverTransport.identity.Fingerprint()}, getSeen())
+	})
+}
+
+func TestSecuritySummary(t *testing.T) {
+	clientID, clientKey := createPeer(t)
+	serverID, serverKey := createPeer(t)
+
+	clientTransport, err := New(ID, clientKey, nil)
+	require.NoError(t, err)
+	serverTransport, err := New(ID, serverKey, nil)
+	require.NoError(t, err)
+
+	clientInsecureConn, serverInsecureConn := connect(t)
+	serverConnChan := make(chan sec.SecureConn, 1)
+	go func() {
+		serverConn, err := serverTransport.SecureInbound(context.Background(), serverInsecureConn, "")
+		assert.NoError(t, err)
+		serverConnChan <- serverConn
+	}()
+	start := time.Now()
+	clientConn, err := clientTransport.SecureOutbound(context.Background(), clientInsecureConn, serverID)
+	require.NoError(t, err)
+	defer clientConn.Close()
+	serverConn := <-serverConnChan
+	require.NotNil(t, serverConn)
+	defer serverConn.Close()
+	took := time.Since(start)
+
+	clientSummary := clientConn.(*conn).SecuritySummary()
+	require.Equal(t, ID, clientSummary.Protocol)
+	require.Equal(t, serverID, clientSummary.PeerID)
+	require.Equal(t, serverKey.Type().String(), clientSummary.KeyType)
+	require.Positive(t, clientSummary.HandshakeDuration)
+	require.LessOrEqual(t, clientSummary.HandshakeDuration, took)
+
+	serverSummary := serverConn.(*conn).SecuritySummary()
+	require.Equal(t, ID, serverSummary.Protocol)
+	require.Equal(t, clientID, serverSummary.PeerID)
+	require.Equal(t, clientKey.Type().String(), serverSummary.KeyType)
+	require.Positive(t, serverSummary.HandshakeDuration)
+}
+
+type unsupportedKey struct {
+	ic.PrivKey
+}
+
+func (unsupportedKey) Type() pb.KeyType { return 42 }
+
+func TestSetPrivateKey(t *testing.T) {
+	_, clientKey := createPeer(t)
+	oldID, oldKey := createPeer(t)
+	newID, newKey := createPeer(t)
+
+	clientTransport, err := New(ID, clientKey, nil)
+	require.NoError(t, err)
+	serverTransport, err := New(ID, oldKey, nil)
+	require.NoError(t, err)
+
+	handshake := func(t *testing.T, expected peer.ID) (localPeer peer.ID, err error) {
+		clientInsecureConn, serverInsecureConn := connect(t)
+		serverConnChan := make(chan sec.SecureConn, 1)
+		go func() {
+			serverConn, _ := serverTransport.SecureInbound(context.Background(), serverInsecureConn, "")
+			serverConnChan <- serverConn
+		}()
+		clientConn, err := clientTransport.SecureOutbound(context.Background(), clientInsecureConn, expected)
+		serverConn := <-serverConnChan
+		if err != nil {
+			return "", err
+		}
+		clientConn.Close()
+		if serverConn == nil {
+			return "", errors.New("inbound handshake failed")
+		}
+		defer serverConn.Close()
+		return serverConn.LocalPeer(), nil
+	}
+
+	localPeer, err := handshake(t, oldID)
+	require.NoError(t, err)
+	require.Equal(t, oldID, localPeer)
+
+	require.NoError(t, serverTransport.SetPrivateKey(newKey))
+	_, err = handshake(t, oldID)
+	require.ErrorAs(t, err, new(sec.ErrPeerIDMismatch))
+	localPeer, err = handshake(t, newID)
+	require.NoError(t, err)
+	require.Equal(t, newID, localPeer)
+	require.NoError(t, serverTransport.Validate())
+
+	t.Run("unsupported key type", func(t *testing.T) {
+		err := serverTransport.SetPrivateKey(unsupportedKey{PrivKey: oldKey})
+		require.ErrorContains(t, err, "unsupported key type")
+		// the transport still uses the previous key
+		localPeer, err := handshake(t, newID)
+		require.NoError(t, err)
+		require.Equal(t, newID, localPeer)
+	})
+
+	t.Run("concurrent rotation", func(t *testing.T) {
+		keys := map[peer.ID]ic.PrivKey{oldID: oldKey, newID: newKey}
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				assert.NoError(t, serverTransport.SetPrivateKey(keys[[]peer.ID{oldID, newID}[i%2]]))
+			}
+		}()
+		for i := 0; i < 10; i++ {
+			// accept any peer, and check that the server presented one of its keys
+			localPeer, err := handshake(t, "")
+			require.NoError(t, err)
+			require.Contains(t, keys, localPeer)
+		}
+		wg.Wait()
+	})
+
+	t.Run("with certificate template", func(t *testing.T) {
+		tmpl, err := certTemplate()
+		require.NoError(t, err)
+		tr, err := New(ID, oldKey, nil, WithIdentityOptions(WithCertTemplate(tmpl)))
+		require.NoError(t, err)
+		serverTransport = tr
+		require.NoError(t, serverTransport.SetPrivateKey(newKey))
+		require.NoError(t, serverTransport.SetPrivateKey(oldKey))
+		localPeer, err := handshake(t, oldID)
+		require.NoError(t, err)
+		require.Equal(t, oldID, localPeer)
+		// the template passed by the caller isn't modified
+		require.Empty(t, tmpl.ExtraExtensions)
+	})
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	_, clientKey := createPeer(t)
+	serverID, serverKey := createPeer(t)
+
+	_, err := New(ID, clientKey, nil, WithHandshakeTimeout(-time.Second))
+	require.Error(t, err)
+
+	t.Run("timeout", func(t *testing.T) {
+		clientTransport, err := New(ID, clientKey, nil, WithHandshakeTimeout(100*time.Millisecond))
+		require.NoError(t, err)
+		// the server never responds
+		clientInsecureConn, _ := connect(t)
+		start := time.Now()
+		_, err = clientTransport.SecureOutbound(context.Background(), clientInsecureConn, serverID)
+		require.ErrorIs(t, err, ErrHandshakeTimeout)
+		require.Equal(t, HandshakeErrorTimeout, ClassifyHandshakeError(err))
+		require.Less(t, time.Since(start), 5*time.Second)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		clientTransport, err := New(ID, clientKey, nil, WithHandshakeTimeout(time.Hour))
+		require.NoError(t, err)
+		clientInsecureConn, _ := connect(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(100*time.Millisecond, cancel)
+		_, err = clientTransport.SecureOutbound(ctx, clientInsecureConn, serverID)
+		require.ErrorIs(t, err, context.Canceled)
+		require.NotErrorIs(t, err, ErrHandshakeTimeout)
+	})
+
+	t.Run("deadline cleared after the handshake", func(t *testing.T) {
+		clientTransport, err := New(ID, clientKey, nil, WithHandshakeTimeout(100*time.Millisecond))
+		require.NoError(t, err)
+		serverTransport, err := New(ID, serverKey, nil, WithHandshakeTimeout(100*time.Millisecond))
+		require.NoError(t, err)
+
+		clientInsecureConn, serverInsecureConn := connect(t)
+		serverConnChan := make(chan sec.SecureConn, 1)
+		go func() {
+			serverConn, err := serverTransport.SecureInbound(context.Background(), serverInsecureConn, "")
+			assert.NoError(t, err)
+			serverConnChan <- serverConn
+		}()
+		clientConn, err := clientTransport.SecureOutbound(context.Background(), clientInsecureConn, serverID)
+		require.NoError(t, err)
+		defer clientConn.Close()
+		serverConn := <-serverConnChan
+		require.NotNil(t, serverConn)
+		defer serverConn.Close()
+
+		time.Sleep(200 * time.Millisecond)
+		go func() {
+			_, err := clientConn.Write([]byte("foobar"))
+			assert.NoError(t, err)
+		}()
+		b := make([]byte, 6)
+		_, err = io.ReadFull(serverConn, b)
+		require.NoError(t, err)
+		require.Equal(t, "foobar", string(b))
+	})
+}
+
+type countingReader struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+func TestWithRand(t *testing.T) {
+	_, clientKey := createPeer(t)
+	serverID, serverKey := createPeer(t)
+
+	_, err := New(ID, clientKey, nil, WithRand(nil))
+	require.Error(t, err)
+
+	r := &countingReader{r: rand.Reader}
+	clientTransport, err := New(ID, clientKey, nil, WithRand(r))
+	require.NoError(t, err)
+	require.NotZero(t, r.n.Load())
+	require.NoError(t, clientTransport.Validate())
+
+	// the certificate is accepted by peers
+	serverTransport, err := New(ID, serverKey, nil)
+	require.NoError(t, err)
+	clientInsecureConn, serverInsecureConn := connect(t)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serverConn, err := serverTransport.SecureInbound(context.Background(), serverInsecureConn, "")
+		assert.NoError(t, err)
+		if err == nil {
+			serverConn.Close()
+		}
+	}()
+	clientConn, err := clientTransport.SecureOutbound(context.Background(), clientInsecureConn, serverID)
+	require.NoError(t, err)
+	clientConn.Close()
+	<-done
+
+	t.Run("read errors", func(t *testing.T) {
+		_, err := New(ID, clientKey, nil, WithRand(iotest.ErrReader(errors.New("no entropy"))))
+		require.ErrorContains(t, err, "no entropy")
+	})
+}
+
+func TestTimeSource(t *testing.T) {
+	_, clientKey := createPeer(t)
+	serverID, serverKey := createPeer(t)
+
+	_, err := New(ID, clientKey, nil, WithTimeSource(nil))
+	require.Error(t, err)
+
+	// The system clock is off by 10 years, compared to the trusted time.
+	trustedTime := time.Now().Add(10 * 365 * 24 * time.Hour)
+	timeSource := WithTimeSource(func() time.Time { return trustedTime })
+	// the server's certificate is valid at the trusted time, but not according to the system clock
+	tmpl, err := certTemplate()
+	require.NoError(t, err)
+	tmpl.NotBefore = trustedTime.Add(-time.Hour)
+	tmpl.NotAfter = trustedTime.Add(time.Hour)
+	serverTransport, err := New(ID, serverKey, nil, timeSource, WithIdentityOptions(WithCertTemplate(tmpl)))
+	require.NoError(t, err)
+	require.NoError(t, serverTransport.Validate())
+
+	handshake := func(t *testing.T, clientTransport *Transport) error {
+		clientInsecureConn, serverInsecureConn := connect(t)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if serverConn, err := serverTransport.SecureInbound(context.Background(), serverInsecureConn, ""); err == nil {
+				serverConn.Close()
+			}
+		}()
+		defer func() { <-done }()
+		clientConn, err := clientTransport.SecureOutbound(context.Background(), clientInsecureConn, serverID)
+		if err != nil {
+			return err
+		}
+		return clientConn.Close()
+	}
+
+	t.Run("system clock", func(t *testing.T) {
+		clientTransport, err := New(ID, clientKey, nil)
+		require.NoError(t, err)
+		err = handshake(t, clientTransport)
+		require.ErrorContains(t, err, "certificate has expired or is not yet valid")
+	})
+
+	t.Run("trusted time", func(t *testing.T) {
+		clientTransport, err := New(ID, clientKey, nil, timeSource)
+		require.NoError(t, err)
+		require.NoError(t, clientTransport.Validate())
+		require.NoError(t, handshake(t, clientTransport))
+	})
+}
+
+func TestNextProtos(t *testing.T) {
+	_, clientKey := createPeer(t)
+	serverID, serverKey := createPeer(t)
+
+	for _, protos := range [][]string{{""}, {"libp2p"}, {strings.Repeat("a", 256)}} {
+		_, err := New(ID, clientKey, nil, WithNextProtos(protos))
+		require.Error(t, err)
+	}
+
+	handshake := func(t *testing.T, clientOpts, serverOpts []Option) (client, server *conn) {
+		clientTransport, err := New(ID, clientKey, []tptu.StreamMuxer{{ID: "/muxer/1.0.0"}}, clientOpts...)
+		require.NoError(t, err)
+		serverTransport, err := New(ID, serverKey, []tptu.StreamMuxer{{ID: "/muxer/1.0.0"}}, serverOpts...)
+		require.NoError(t, err)
+
+		clientInsecureConn, serverInsecureConn := connect(t)
+		serverConnChan := make(chan sec.SecureConn, 1)
+		go func() {
+			serverConn, err := serverTransport.SecureInbound(context.Background(), serverInsecureConn, "")
+			assert.NoError(t, err)
+			serverConnChan <- serverConn
+		}()
+		clientConn, err := clientTransport.SecureOutbound(context.Background(), clientInsecureConn, serverID)
+		require.NoError(t, err)
+		t.Cleanup(func() { clientConn.Close() })
+		serverConn := <-serverConnChan
+		require.NotNil(t, serverConn)
+		t.Cleanup(func() { serverConn.Close() })
+		return clientConn.(*conn), serverConn.(*conn)
+	}
+
+	t.Run("default", func(t *testing.T) {
+		client, server := handshake(t, nil, nil)
+		require.Equal(t, "/muxer/1.0.0", client.NegotiatedNextProto())
+		require.Equal(t, "/muxer/1.0.0", server.NegotiatedNextProto())
+	})
+
+	t.Run("overridden", func(t *testing.T) {
+		client, server := handshake(t, []Option{WithNextProtos([]string{"/muxer/2.0.0", "/muxer/3.0.0"})}, []Option{WithNextProtos([]string{"/muxer/3.0.0"})})
+		require.Equal(t, "/muxer/3.0.0", client.NegotiatedNextProto())
+		require.Equal(t, "/muxer/3.0.0", server.NegotiatedNextProto())
+		require.Equal(t, protocol.ID("/muxer/3.0.0"), client.ConnState().StreamMultiplexer)
+		require.Equal(t, []string{"/muxer/2.0.0", "/muxer/3.0.0", "libp2p"}, server.RemoteSupportedProtos())
+	})
+
+	t.Run("no common value", func(t *testing.T) {
+		client, server := handshake(t, []Option{WithNextProtos([]string{"/muxer/2.0.0"})}, nil)
+		require.Empty(t, client.NegotiatedNextProto())
+		require.Empty(t, server.NegotiatedNextProto())
+	})
+}
+
+func TestRemoteCertExtension(t *testing.T) {
+	_, clientKey := createPeer(t)
+	serverID, serverKey := createPeer(t)
+
+	clientTransport, err := New(ID, clientKey, nil)
+	require.NoError(t, err)
+	serverTransport, err := New(ID, serverKey, nil)
+	require.NoError(t, err)
+
+	clientInsecureConn, serverInsecureConn := connect(t)
+	serverConnChan := make(chan sec.SecureConn, 1)
+	go func() {
+		serverConn, err := serverTransport.SecureInbound(context.Background(), serverInsecureConn, "")
+		assert.NoError(t, err)
+		serverConnChan <- serverConn
+	}()
+	clientConn, err := clientTransport.SecureOutbound(context.Background(), clientInsecureConn, serverID)
+	require.NoError(t, err)
+	defer clientConn.Close()
+	serverConn := <-serverConnChan
+	require.NotNil(t, serverConn)
+	defer serverConn.Close()
+
+	checkExtension := func(t *testing.T, c sec.SecureConn, key ic.PrivKey) {
+		ext := c.(*conn).RemoteCertExtension()
+		require.NotEmpty(t, ext)
+		var sk signedKey
+		rest, err := asn1.Unmarshal(ext, &sk)
+		require.NoError(t, err)
+		require.Empty(t, rest)
+		pubKeyBytes, err := ic.MarshalPublicKey(key.GetPublic())
+		require.NoError(t, err)
+		require.Equal(t, pubKeyBytes, sk.PubKey)
+
+		// the signature covers the key of the certificate used in the handshake
+		cert := c.(*conn).ConnectionState().PeerCertificates[0]
+		certKeyPub, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+		require.NoError(t, err)
+		valid, err := key.GetPublic().Verify(append([]byte(certificatePrefix), certKeyPub...), sk.Signature)
+		require.NoError(t, err)
+		require.True(t, valid)
+	}
+	t.Run("client", func(t *testing.T) { checkExtension(t, clientConn, serverKey) })
+	t.Run("server", func(t *testing.T) { checkExtension(t, serverConn, clientKey) })
+
+	t.Run("non-libp2p certificate", func(t *testing.T) {
+		tmpl, err := certTemplate()
+		require.NoError(t, err)
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, priv.Public(), priv)
+		require.NoError(t, err)
+		cert, err := x509.ParseCertificate(der)
+		require.NoError(t, err)
+		require.Nil(t, libp2pExtension(cert))
+	})
+}
+
+func TestConnectionReuseCheck(t *testing.T) {
+	clientID, clientKey := createPeer(t)
+	serverID, serverKey := createPeer(t)
+
+	var mx sync.Mutex
+	connected := make(map[peer.ID]bool)
+	allow := func(p peer.ID) bool {
+		mx.Lock()
+		defer mx.Unlock()
+		return !connected[p]
+	}
+	clientTransport, err := New(ID, clientKey, nil)
+	require.NoError(t, err)
+	serverTransport, err := New(ID, serverKey, nil, WithConnectionReuseCheck(allow))
+	require.NoError(t, err)
+
+	handshake := func() (clientErr, serverErr error) {
+		t.Helper()
+		clientInsecureConn, serverInsecureConn := connect(t)
+		serverErrChan := make(chan error, 1)
+		go func() {
+			conn, err := serverTransport.SecureInbound(context.Background(), serverInsecureConn, "")
+			if err == nil {
+				mx.Lock()
+				connected[conn.RemotePeer()] = true
+				mx.Unlock()
+			}
+			serverErrChan <- err
+		}()
+		clientConn, clientErr := clientTransport.SecureOutbound(context.Background(), clientInsecureConn, serverID)
+		serverErr = <-serverErrChan
+		if clientErr == nil && serverErr != nil {
+			// In TLS 1.3, the client completes the handshake before the server
+			// verifies the client's certificate. The rejection arrives as an alert.
+			_, clientErr = clientConn.Read([]byte{0})
+		}
+		return clientErr, serverErr
+	}
+
+	clientErr, serverErr := handshake()
+	require.NoError(t, clientErr)
+	require.NoError(t, serverErr)
+	require.True(t, connected[clientID])
+
+	// the second handshake is rejected, since we already have a connection
+	clientErr, serverErr = handshake()
+	require.Error(t, clientErr)
+	require.ErrorIs(t, serverErr, ErrDuplicateConnection)
+}
+
+func TestWeakKeySet(t *testing.T) {
+	_, clientKey := createPeer(t)
+	_, serverKey := createPeer(t)
+	_, weakKey := createPeer(t)
+
+	set, err := NewWeakKeySet(weakKey.GetPublic())
+	require.NoError(t, err)
+	require.True(t, set.Contains(weakKey.GetPublic()))
+	require.False(t, set.Contains(serverKey.GetPublic()))
+
+	t.Run("own key", func(t *testing.T) {
+		_, err := New(ID, weakKey, nil, WithWeakKeySet(set))
+		require.ErrorIs(t, err, ErrWeakKey)
+	})
+
+	handshake := func(t *testing.T, serverKey ic.PrivKey) (clientErr, serverErr error) {
+		t.Helper()
+		serverID, err := peer.IDFromPrivateKey(serverKey)
+		require.NoError(t, err)
+		clientTransport, err := New(ID, clientKey, nil, WithWeakKeySet(set))
+		require.NoError(t, err)
+		serverTransport, err := New(ID, serverKey, nil)
+		require.NoError(t, err)
+
+		clientInsecureConn, serverInsecureConn := connect(t)
+		serverErrChan := make(chan error, 1)
+		go func() {
+			conn, err := serverTransport.SecureInbound(context.Background(), serverInsecureConn, "")
+			if err == nil {
+				conn.Close()
+			}
+			serverErrChan <- err
+		}()
+		conn, clientErr := clientTransport.SecureOutbound(context.Background(), clientInsecureConn, serverID)
+		if clientErr == nil {
+			conn.Close()
+		}
+		return clientErr, <-serverErrChan
+	}
+
+	t.Run("weak peer key", func(t *testing.T) {
+		clientErr, serverErr := handshake(t, weakKey)
+		require.ErrorIs(t, clientErr, ErrWeakKey)
+		require.Equal(t, HandshakeErrorCertInvalid, ClassifyHandshakeError(clientErr))
+		require.Error(t, serverErr)
+	})
+
+	t.Run("clean peer key", func(t *testing.T) {
+		clientErr, serverErr := handshake(t, serverKey)
+		require.NoError(t, clientErr)
+		require.NoError(t, serverErr)
+	})
+}
+
+func TestIdentityGenerationDuration(t *testing.T) {
+	// Sum up multiple runs, so that the test isn't affected by scheduling hiccups.
+	measure := func(genKey func() (ic.PrivKey, error)) time.Duration {
+		var total time.Duration
+		for i := 0; i < 5; i++ {
+			key, err := genKey()
+			require.NoError(t, err)
+			tr, err := New(ID, key, nil)
+			require.NoError(t, err)
+			require.NotZero(t, tr.IdentityGenerationDuration())
+			total += tr.IdentityGenerationDuration()
+		}
+		return total
+	}
+	ed25519Duration := measure(func() (ic.PrivKey, error) {
+		priv, _, err := ic.GenerateEd25519Key(rand.Reader)
+		return priv, err
+	})
+	rsaDuration := measure(func() (ic.PrivKey, error) {
+		priv, _, err := ic.GenerateRSAKeyPair(2048, rand.Reader)
+		return priv, err
+	})
+	t.Logf("ed25519: %s, RSA: %s", ed25519Duration, rsaDuration)
+	require.Greater(t, rsaDuration, ed25519Duration)
+}
+
+func TestRemoteIDIsInline(t *testing.T) {
+	ed25519Key, _, err := ic.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	rsaKey, _, err := ic.GenerateRSAKeyPair(2048, rand.Reader)
+	require.NoError(t, err)
+
+	clientTransport, err := New(ID, ed25519Key, nil)
+	require.NoError(t, err)
+	serverTransport, err := New(ID, rsaKey, nil)
+	require.NoError(t, err)
+	serverID, err := peer.IDFromPrivateKey(rsaKey)
+	require.NoError(t, err)
+
+	clientInsecureConn, serverInsecureConn := connect(t)
+	serverConnChan := make(chan sec.SecureConn, 1)
+	go func() {
+		serverConn, err := serverTransport.SecureInbound(context.Background(), serverInsecureConn, "")
+		assert.NoError(t, err)
+		serverConnChan <- serverConn
+	}()
+	clientConn, err := clientTransport.SecureOutbound(context.Background(), clientInsecureConn, serverID)
+	require.NoError(t, err)
+	defer clientConn.Close()
+	serverConn := <-serverConnChan
+	require.NotNil(t, serverConn)
+	defer serverConn.Close()
+
+	// the client talks to the RSA peer, the server to the Ed25519 peer
+	require.False(t, clientConn.(*conn).RemoteIDIsInline())
+	require.True(t, serverConn.(*conn).RemoteIDIsInline())
+}
+
+func TestEstimatedRTT(t *testing.T) {
+	const delay = 50 * time.Millisecond
+
+	clientKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	serverKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	clientTransport, err := New(ID, clientKey, nil)
+	require.NoError(t, err)
+	serverTransport, err := New(ID, serverKey, nil)
+	require.NoError(t, err)
+	serverID, err := peer.IDFromPrivateKey(serverKey)
+	require.NoError(t, err)
+
+	// Delaying every read simulates a network with an RTT of (at least) delay.
+	clientInsecureConn, serverInsecureConn := connect(t)
+	serverConnChan := make(chan sec.SecureConn, 1)
+	go func() {
+		serverConn, err := serverTransport.SecureInbound(context.Background(), &delayedConn{Conn: serverInsecureConn, delay: delay}, "")
+		assert.NoError(t, err)
+		serverConnChan <- serverConn
+	}()
+	clientConn, err := clientTransport.SecureOutbound(context.Background(), &delayedConn{Conn: clientInsecureConn, delay: delay}, serverID)
+	require.NoError(t, err)
+	defer clientConn.Close()
+	serverConn := <-serverConnChan
+	require.NotNil(t, serverConn)
+	defer serverConn.Close()
+
+	for _, c := range []sec.SecureConn{clientConn, serverConn} {
+		rtt := c.(*conn).EstimatedRTT()
+		t.Logf("estimated RTT: %s", rtt)
+		require.GreaterOrEqual(t, rtt, delay)
+		require.Less(t, rtt, 10*delay)
+	}
+}
+
+func TestNewChecksCertPeer(t *testing.T) {
+	_, key := createPeer(t)
+	otherID, otherKey := createPeer(t)
+	extensionKey = otherKey
+	t.Cleanup(func() { extensionKey = nil })
+
+	_, err := New(ID, key, nil)
+	require.Error(t, err)
+	require.ErrorContains(t, err, otherID.String())
+
+	extensionKey = nil
+	_, err = New(ID, key, nil)
+	require.NoError(t, err)
+}
+
+func TestActiveIdentities(t *testing.T) {
+	primaryID, primaryKey := createPeer(t)
+	otherID, otherKey := createPeer(t)
+	tr, err := New(ID, primaryKey, nil, WithKeys([]ic.PrivKey{otherKey}, func(peer.ID, string) ic.PrivKey { return nil }))
+	require.NoError(t, err)
+
+	infos := tr.ActiveIdentities()
+	require.Len(t, infos, 2)
+	for i, expected := range []struct {
+		id       peer.ID
+		key      ic.PrivKey
+		identity *Identity
+		primary  bool
+	}{
+		{id: primaryID, key: primaryKey, identity: tr.identity, primary: true},
+		{id: otherID, key: otherKey, identity: tr.identities[otherID]},
+	} {
+		info := infos[i]
+		require.Equal(t, expected.id, info.PeerID)
+		require.Equal(t, expected.key.Type(), info.KeyType)
+		require.Equal(t, expected.primary, info.Primary)
+		require.Equal(t, expected.identity.Fingerprint(), info.Fingerprint)
+		require.True(t, info.NotBefore.Before(time.Now()))
+		require.True(t, info.NotAfter.After(time.Now()))
+
+		// no private key material
+		raw, err := expected.key.Raw()
+		require.NoError(t, err)
+		require.NotContains(t, fmt.Sprintf("%#v", info), fmt.Sprintf("%#v", raw))
+	}
+	infoType := reflect.TypeOf(IdentityInfo{})
+	for i := 0; i < infoType.NumField(); i++ {
+		fieldType := infoType.Field(i).Type
+		require.False(t, fieldType.Implements(reflect.TypeOf((*ic.PrivKey)(nil)).Elem()), infoType.Field(i).Name)
+		require.False(t, fieldType.Implements(reflect.TypeOf((*crypto.Signer)(nil)).Elem()), infoType.Field(i).Name)
+	}
+
+	// the info reflects key rotations
+	newID, newKey := createPeer(t)
+	require.NoError(t, tr.SetPrivateKey(newKey))
+	infos = tr.ActiveIdentities()
+	require.Len(t, infos, 2)
+	require.Equal(t, newID, infos[0].PeerID)
+	require.True(t, infos[0].Primary)
 }